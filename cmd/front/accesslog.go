@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var accessLogPath string
+var accessLogFormat string
+
+const (
+	accessLogCommon = "common"
+	accessLogJSON   = "json"
+)
+
+// accessLog is where requests are logged, nil when -access-log is unset.
+var accessLog *log.Logger
+
+// openAccessLog sets up -access-log: "-" is stdout, "stderr" is the
+// application log's stream, anything else a file appended to.
+func openAccessLog() error {
+	switch accessLogFormat {
+	case accessLogCommon, accessLogJSON:
+	default:
+		return fmt.Errorf("invalid -access-log-format %q, want %s or %s", accessLogFormat, accessLogCommon, accessLogJSON)
+	}
+	switch accessLogPath {
+	case "":
+		return nil
+	case "-":
+		accessLog = log.New(os.Stdout, "", 0)
+	case "stderr":
+		accessLog = log.New(os.Stderr, "", 0)
+	default:
+		f, err := os.OpenFile(accessLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("could not open -access-log: %v", err)
+		}
+		accessLog = log.New(f, "", 0)
+	}
+	return nil
+}
+
+// accessEntry is one request in the JSON access log.
+type accessEntry struct {
+	Time         time.Time `json:"time"`
+	RequestID    string    `json:"request_id"`
+	ClientIP     string    `json:"client_ip"`
+	ForwardedFor string    `json:"forwarded_for,omitempty"`
+	Method       string    `json:"method"`
+	Path         string    `json:"path"`
+	Proto        string    `json:"proto"`
+	Status       int       `json:"status"`
+	Bytes        int64     `json:"bytes"`
+	LatencyMS    float64   `json:"latency_ms"`
+	UserAgent    string    `json:"user_agent,omitempty"`
+}
+
+// accessLogHandler makes sure every request has an X-Request-Id, keeping a
+// well-formed one sent by the client or a proxy, and echoes it in the
+// response. Requests are logged to -access-log once they are answered.
+func accessLogHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get("X-Request-Id")
+		if !validRequestID(id) {
+			id = generateID(16)
+			r.Header.Set("X-Request-Id", id)
+		}
+		w.Header().Set("X-Request-Id", id)
+		if accessLog == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		lw := &loggingResponseWriter{ResponseWriter: w}
+		defer func() {
+			logAccess(r, id, lw.status, lw.bytes, start)
+		}()
+		next.ServeHTTP(lw, r)
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func logAccess(r *http.Request, id string, status int, bytes int64, start time.Time) {
+	if status == 0 {
+		// The handler wrote nothing: net/http answers 200 with no body.
+		status = http.StatusOK
+	}
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if accessLogFormat == accessLogJSON {
+		line, _ := json.Marshal(accessEntry{
+			Time:         start.UTC(),
+			RequestID:    id,
+			ClientIP:     ip,
+			ForwardedFor: r.Header.Get("X-Forwarded-For"),
+			Method:       r.Method,
+			Path:         r.URL.RequestURI(),
+			Proto:        r.Proto,
+			Status:       status,
+			Bytes:        bytes,
+			LatencyMS:    float64(time.Since(start).Microseconds()) / 1000,
+			UserAgent:    r.UserAgent(),
+		})
+		accessLog.Print(string(line))
+		return
+	}
+	// Common Log Format, followed by the latency in milliseconds and the
+	// request ID.
+	size := "-"
+	if bytes > 0 {
+		size = fmt.Sprint(bytes)
+	}
+	accessLog.Printf("%s - - [%s] %q %d %s %.3f %s",
+		ip, start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+r.URL.RequestURI()+" "+r.Proto,
+		status, size, float64(time.Since(start).Microseconds())/1000, id)
+}
+
+// loggingResponseWriter records the status and size of a response.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *loggingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom passes io.Copy through to the connection so that files are still
+// served with sendfile.
+func (w *loggingResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(w.ResponseWriter, r)
+	}
+	w.bytes += n
+	return n, err
+}
+
+func (w *loggingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection.
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
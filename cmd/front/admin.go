@@ -0,0 +1,29 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var adminKey string
+
+// requireAdmin checks the admin key of the request, responding with an
+// error itself when it does not match. The admin API is disabled unless
+// -admin-key is set.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if adminKey == "" {
+		jsonError(w, http.StatusForbidden, fmt.Errorf("admin api is disabled, set -admin-key to enable it"))
+		return false
+	}
+	key := r.Header.Get("X-Admin-Key")
+	if auth := r.Header.Get("Authorization"); key == "" && strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) != 1 {
+		jsonError(w, http.StatusUnauthorized, fmt.Errorf("invalid admin key"))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// API versions. Unprefixed routes are served as v1 so that clients written
+// before versioning keep working unchanged.
+const (
+	apiV1 = 1
+	apiV2 = 2
+)
+
+type apiVersionKey struct{}
+
+// handleVersioned registers h for pattern unprefixed and under /v1 and /v2.
+// Handlers see the path without the version prefix and ask apiVersion for
+// the shapes to use.
+func handleVersioned(pattern string, h http.HandlerFunc) {
+	http.HandleFunc(pattern, h)
+	for _, v := range []int{apiV1, apiV2} {
+		prefix := "/v" + strconv.Itoa(v)
+		http.Handle(prefix+pattern, withAPIVersion(v, http.StripPrefix(prefix, h)))
+	}
+}
+
+func withAPIVersion(v int, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v >= apiV2 && wantsEnvelope(r) {
+			w = &envelopeResponseWriter{ResponseWriter: w}
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, v)))
+	})
+}
+
+// apiVersion returns the API version r was routed under.
+func apiVersion(r *http.Request) int {
+	if v, ok := r.Context().Value(apiVersionKey{}).(int); ok {
+		return v
+	}
+	return apiV1
+}
+
+// recognizeResponseV2 is the /v2 answer to recognize and upload requests:
+// the results grouped by input with their detections inline, instead of a
+// flat list of output URLs.
+type recognizeResponseV2 struct {
+	JobID string `json:"job_id"`
+	// Status is "done", or "partial" when some inputs failed to stage and
+	// the job went on without them.
+	Status string          `json:"status"`
+	Images []imageResultV2 `json:"images"`
+	// OtherOutputs are outputs not tied to an input, such as files added
+	// by post hooks.
+	OtherOutputs  []string      `json:"other_outputs,omitempty"`
+	Discrepancies []errorDetail `json:"discrepancies,omitempty"`
+	// Errors lists the inputs that failed to stage.
+	Errors    []errorDetail `json:"errors,omitempty"`
+	DryRun    bool          `json:"dry_run,omitempty"`
+	ExpiresAt *time.Time    `json:"expires_at,omitempty"`
+}
+
+// imageResultV2 is the outcome of one input.
+type imageResultV2 struct {
+	Index int    `json:"index"`
+	Input string `json:"input"`
+	// Status is "done" or "failed".
+	Status     string       `json:"status"`
+	Outputs    []string     `json:"outputs"`
+	Detections []detection  `json:"detections"`
+	Error      *errorDetail `json:"error,omitempty"`
+	// Staged is where a dry run left the input.
+	Staged   string         `json:"staged,omitempty"`
+	Metadata *imageMetadata `json:"metadata,omitempty"`
+	// Inline holds the annotated images of the input for requests with
+	// include_images=inline, base64 encoded.
+	Inline []inlineOutput `json:"inline,omitempty"`
+}
+
+const jobPartial = "partial"
+
+func recognizeResponseOf(t *tenant, j *job) recognizeResponseV2 {
+	resp := recognizeResponseV2{
+		JobID:         j.ID,
+		Status:        jobDone,
+		Images:        make([]imageResultV2, j.imageCount()),
+		Discrepancies: j.Discrepancies,
+		Errors:        j.Skipped,
+		DryRun:        j.DryRun,
+		ExpiresAt:     j.ExpiresAt,
+	}
+	if len(j.Skipped) > 0 {
+		resp.Status = jobPartial
+	}
+	for i := range resp.Images {
+		resp.Images[i] = imageResultV2{Index: i, Input: j.inputName(i), Status: jobDone, Outputs: []string{}, Detections: []detection{}}
+		if i < len(j.InputMetadata) {
+			resp.Images[i].Metadata = j.InputMetadata[i]
+		}
+	}
+	for _, e := range j.Skipped {
+		if e.Index >= 0 && e.Index < len(resp.Images) {
+			e := e
+			resp.Images[e.Index].Status = jobFailed
+			resp.Images[e.Index].Error = &e
+		}
+	}
+	for _, input := range j.indexedInputs() {
+		if input.index < len(resp.Images) && j.DryRun {
+			resp.Images[input.index].Staged = input.path
+		}
+	}
+	for _, f := range j.Files {
+		if f.Index < 0 || f.Index >= len(resp.Images) {
+			resp.OtherOutputs = append(resp.OtherOutputs, f.URL)
+			continue
+		}
+		img := &resp.Images[f.Index]
+		img.Outputs = append(img.Outputs, f.URL)
+		if filepath.Ext(f.Source) == ".json" {
+			if ds, err := readDetections(j.outputFilePath(t, f)); err == nil {
+				img.Detections = ds
+			}
+		}
+	}
+	return resp
+}
+
+// partialStaging lets a /v2 job go on without the inputs that failed to
+// stage, recording them in j.Skipped, as long as at least one input was
+// staged and staging ran to the end. It reports whether the job may go on.
+func partialStaging(ctx context.Context, r *http.Request, j *job, err error) bool {
+	return apiVersion(r) >= apiV2 && goOnWithout(ctx, j, err)
+}
+
+// goOnWithout is partialStaging for jobs of any API version.
+func goOnWithout(ctx context.Context, j *job, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var e *apiError
+	if !errors.As(err, &e) || len(e.details) == 0 || len(e.details) >= j.imageCount() {
+		return false
+	}
+	for _, d := range e.details {
+		// Staging stops at the first mismatch, so later inputs were
+		// never tried.
+		if d.Code == codeChecksumMismatch {
+			return false
+		}
+	}
+	j.Skipped = e.details
+	log.Printf("Job %s goes on without %d of %d inputs: %v", j.ID, len(e.details), j.imageCount(), err)
+	return true
+}
+
+// withoutSkipped drops the missing output reports of inputs j went on
+// without.
+func withoutSkipped(j *job, found []errorDetail) []errorDetail {
+	if len(j.Skipped) == 0 {
+		return found
+	}
+	skipped := make(map[int]bool)
+	for _, d := range j.Skipped {
+		skipped[d.Index] = true
+	}
+	kept := found[:0]
+	for _, d := range found {
+		if d.Code != codeMissingOutput || !skipped[d.Index] {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
+
+// writeRecognizedV2 is writeRecognized for /v2.
+func writeRecognizedV2(w http.ResponseWriter, r *http.Request, t *tenant, j *job) {
+	resp := recognizeResponseOf(t, j)
+	if j.IncludeImages == includeInline && !j.DryRun {
+		embedImages(t, j, &resp)
+	}
+	log.Printf("Sending v2 recognize response of job %s: %s, %d images", j.ID, resp.Status, len(resp.Images))
+	envelopeJob(w, j)
+	if acceptsMultipart(r) && !j.DryRun {
+		writeMultipart(w, t, j, resp)
+		return
+	}
+	jsonResponse(w, http.StatusOK, resp)
+}
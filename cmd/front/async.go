@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// syncMaxImages and syncMaxBytes cap the recognize and upload requests
+// answered synchronously; larger ones are answered 202 Accepted and go on
+// in the background. Zero means no cap.
+var syncMaxImages int
+var syncMaxBytes int64
+
+// asyncPollInterval is the Retry-After suggested to clients polling an
+// asynchronous job.
+const asyncPollInterval = 2 * time.Second
+
+// asyncResponse answers a request turned into an asynchronous job. URL is
+// where its response can be fetched once the job finished.
+type asyncResponse struct {
+	JobID  string `json:"job_id"`
+	Status string `json:"status"`
+	URL    string `json:"url"`
+}
+
+// overSyncImages reports whether a request for n images is answered
+// asynchronously.
+func overSyncImages(n int) bool {
+	return syncMaxImages > 0 && n > syncMaxImages
+}
+
+// overSyncBytes reports whether a request for size bytes of images is
+// answered asynchronously.
+func overSyncBytes(size int64) bool {
+	return syncMaxBytes > 0 && size > syncMaxBytes
+}
+
+// stagedBytes is the size of the inputs staged for j.
+func stagedBytes(t *tenant, j *job) int64 {
+	files, err := ioutil.ReadDir(j.inputPath(t))
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, f := range files {
+		size += f.Size()
+	}
+	return size
+}
+
+// responseURL is where the response of job id is served, under the API
+// version of r.
+func responseURL(r *http.Request, id string) string {
+	url := "/jobs/" + id + "/response"
+	if apiVersion(r) >= apiV2 {
+		url = "/v2" + url
+		if b, err := strconv.ParseBool(r.URL.Query().Get("envelope")); err == nil {
+			url += "?envelope=" + strconv.FormatBool(b)
+		}
+	}
+	return url
+}
+
+// respondAsync answers 202 Accepted for j and runs it in the background with
+// run, which finishes the job with finishJobStatus and returns the status the
+// synchronous request would have failed with. Like resumed jobs, it can be cancelled and
+// -request-timeout applies from when it is accepted.
+func respondAsync(w http.ResponseWriter, r *http.Request, t *tenant, j *job, run func(ctx context.Context) (int, error)) {
+	j.Async = true
+	if err := saveJob(t, j); err != nil {
+		log.Printf("Could not persist job %s: %v", j.ID, err)
+	}
+	log.Printf("Running job %s of %d images asynchronously", j.ID, j.imageCount())
+	url := responseURL(r, j.ID)
+	w.Header().Set("Location", url)
+	w.Header().Set("Retry-After", fmt.Sprint(int(asyncPollInterval.Seconds())))
+	jsonResponse(w, http.StatusAccepted, asyncResponse{JobID: j.ID, Status: jobRunning, URL: url})
+
+	go func() {
+		// The job outlives the request but keeps its values, such as
+		// injected faults.
+		base := context.WithoutCancel(r.Context())
+		ctx, cancelTimeout := context.WithCancel(base)
+		if requestTimeout > 0 {
+			ctx, cancelTimeout = context.WithTimeout(base, requestTimeout)
+		}
+		ctx, done := trackJob(ctx, cancelTimeout, t, j.ID)
+		defer done()
+		if _, err := run(ctx); err != nil {
+			log.Printf("Asynchronous job %s failed: %v", j.ID, err)
+		}
+	}()
+}
+
+// getResponse serves GET /jobs/{id}/response: what the request of the job
+// would have been answered with synchronously once it finished, and 202
+// Accepted until then.
+func getResponse(w http.ResponseWriter, r *http.Request, t *tenant, id string) {
+	j, err := loadJob(t, id)
+	if os.IsNotExist(err) {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("job %s not found", id))
+		return
+	}
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("X-Job-Id", j.ID)
+	setOutputToken(w, t, j)
+	switch {
+	case j.DeletedAt != nil:
+		jsonError(w, http.StatusGone, fmt.Errorf("the outputs of job %s were deleted", j.ID))
+	case j.Status == jobRunning:
+		w.Header().Set("Retry-After", fmt.Sprint(int(asyncPollInterval.Seconds())))
+		jsonResponse(w, http.StatusAccepted, asyncResponse{JobID: j.ID, Status: j.Status, URL: responseURL(r, j.ID)})
+	case j.Status == jobDone && j.Set != "":
+		writeSetRun(w, t, j)
+	case j.Status == jobDone:
+		writeRecognized(w, r, t, j)
+	default:
+		status := j.ErrorStatus
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+		jsonError(w, status, withCode(j.ErrorCode, errors.New(j.Error), j.ErrorDetails...))
+	}
+}
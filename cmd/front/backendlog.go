@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backendDebugFlag, backendDebugPersist and backendDebugRedactHeaders are
+// the initial backend debug settings, which admins change at runtime.
+var backendDebugFlag bool
+var backendDebugPersist bool
+var backendDebugRedactHeaders string
+var backendDebugMaxBody int
+
+// backendLogsDir holds the persisted exchanges of a tenant's jobs, one
+// JSON line per darkflow call, under its input dir.
+const backendLogsDir = "backend-logs"
+
+const redacted = "REDACTED"
+
+// backendDebugConfig is what debug mode logs darkflow calls with.
+type backendDebugConfig struct {
+	Enabled bool `json:"enabled"`
+	// Persist also appends the calls of a job to its backend log.
+	Persist bool `json:"persist"`
+	// RedactHeaders are the headers whose values are never logged.
+	RedactHeaders []string `json:"redact_headers"`
+	// RedactURLs replaces the credentials and query strings of the URLs
+	// in logged requests and payloads.
+	RedactURLs bool `json:"redact_urls"`
+}
+
+var backendDebug struct {
+	mu     sync.Mutex
+	config backendDebugConfig
+}
+
+func setupBackendDebug() {
+	backendDebug.config = backendDebugConfig{
+		Enabled:       backendDebugFlag,
+		Persist:       backendDebugPersist,
+		RedactHeaders: splitList(backendDebugRedactHeaders),
+		RedactURLs:    true,
+	}
+}
+
+func currentBackendDebug() backendDebugConfig {
+	backendDebug.mu.Lock()
+	defer backendDebug.mu.Unlock()
+	return backendDebug.config
+}
+
+// splitList splits a comma separated flag, dropping empty entries.
+func splitList(s string) []string {
+	list := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// backendExchange is one darkflow call as debug mode logs it. Bodies are
+// cut at -backend-debug-max-body.
+type backendExchange struct {
+	Time            time.Time   `json:"time"`
+	JobID           string      `json:"job_id,omitempty"`
+	Method          string      `json:"method"`
+	URL             string      `json:"url"`
+	RequestHeaders  http.Header `json:"request_headers"`
+	RequestBody     string      `json:"request_body,omitempty"`
+	Status          int         `json:"status,omitempty"`
+	ResponseHeaders http.Header `json:"response_headers,omitempty"`
+	ResponseBody    string      `json:"response_body,omitempty"`
+	DurationMs      float64     `json:"duration_ms"`
+	Error           string      `json:"error,omitempty"`
+}
+
+type backendLogKey struct{}
+
+// backendLogTarget is the job whose darkflow calls a context makes.
+type backendLogTarget struct {
+	tenant *tenant
+	jobID  string
+}
+
+// withBackendLog marks the darkflow calls made with ctx as those of job id
+// of tenant t.
+func withBackendLog(ctx context.Context, t *tenant, id string) context.Context {
+	return context.WithValue(ctx, backendLogKey{}, backendLogTarget{t, id})
+}
+
+func backendLogPath(t *tenant, id string) string {
+	return filepath.Join(t.inputDir(), backendLogsDir, id+".jsonl")
+}
+
+// debugTransport logs the darkflow calls it sends while debug mode is on.
+// Request bodies that can only be read once, as streamed uploads, are not
+// logged.
+type debugTransport struct {
+	base http.RoundTripper
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cfg := currentBackendDebug()
+	if !cfg.Enabled {
+		return t.base.RoundTrip(req)
+	}
+	e := backendExchange{Time: time.Now().UTC(), Method: req.Method, URL: req.URL.String(), RequestHeaders: req.Header.Clone()}
+	target, _ := req.Context().Value(backendLogKey{}).(backendLogTarget)
+	e.JobID = target.jobID
+	switch {
+	case req.Body == nil || req.Body == http.NoBody:
+	case req.GetBody != nil:
+		if body, err := req.GetBody(); err == nil {
+			e.RequestBody = readLogged(body)
+			body.Close()
+		}
+	default:
+		e.RequestBody = "(streamed body not logged)"
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	e.DurationMs = float64(time.Since(e.Time)) / float64(time.Millisecond)
+	if err != nil {
+		e.Error = err.Error()
+	} else {
+		e.Status = resp.StatusCode
+		e.ResponseHeaders = resp.Header.Clone()
+		// The caller still reads the whole body, starting with what
+		// was logged.
+		head, _ := io.ReadAll(io.LimitReader(resp.Body, int64(backendDebugMaxBody)+1))
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+		e.ResponseBody = truncateLogged(head)
+	}
+	cfg.redact(&e)
+	data, _ := json.Marshal(e)
+	log.Printf("Darkflow call: %s", data)
+	if cfg.Persist && target.tenant != nil {
+		if err := appendBackendLog(target.tenant, target.jobID, data); err != nil {
+			log.Printf("Could not persist darkflow call of job %s: %v", target.jobID, err)
+		}
+	}
+	return resp, err
+}
+
+func readLogged(r io.Reader) string {
+	head, _ := io.ReadAll(io.LimitReader(r, int64(backendDebugMaxBody)+1))
+	return truncateLogged(head)
+}
+
+func truncateLogged(b []byte) string {
+	if len(b) > backendDebugMaxBody {
+		return string(b[:backendDebugMaxBody]) + fmt.Sprintf("... (cut at %d bytes)", backendDebugMaxBody)
+	}
+	return string(b)
+}
+
+var loggedURLRe = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"'<>\\]+`)
+
+// redact blanks the configured headers of e and, with RedactURLs, the
+// credentials and queries of the URLs in it.
+func (cfg backendDebugConfig) redact(e *backendExchange) {
+	for _, h := range []http.Header{e.RequestHeaders, e.ResponseHeaders} {
+		for _, name := range cfg.RedactHeaders {
+			if _, ok := h[http.CanonicalHeaderKey(name)]; ok {
+				h.Set(name, redacted)
+			}
+		}
+	}
+	if !cfg.RedactURLs {
+		return
+	}
+	e.URL = redactURLs(e.URL)
+	e.RequestBody = redactURLs(e.RequestBody)
+	e.ResponseBody = redactURLs(e.ResponseBody)
+}
+
+func redactURLs(s string) string {
+	return loggedURLRe.ReplaceAllStringFunc(s, func(raw string) string {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return raw
+		}
+		if u.User != nil {
+			u.User = url.User(redacted)
+		}
+		if u.RawQuery != "" {
+			u.RawQuery = redacted
+		}
+		return u.String()
+	})
+}
+
+var backendLogMu sync.Mutex
+
+func appendBackendLog(t *tenant, id string, line []byte) error {
+	backendLogMu.Lock()
+	defer backendLogMu.Unlock()
+	file := backendLogPath(t, id)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readBackendLog returns the persisted darkflow calls of job id.
+func readBackendLog(t *tenant, id string) ([]backendExchange, error) {
+	f, err := os.Open(backendLogPath(t, id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	list := []backendExchange{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		var e backendExchange
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("could not parse backend log: %v", err)
+		}
+		list = append(list, e)
+	}
+	return list, scanner.Err()
+}
+
+// backendDebugRequest changes the debug settings; fields left out keep
+// their value.
+type backendDebugRequest struct {
+	Enabled       *bool    `json:"enabled"`
+	Persist       *bool    `json:"persist"`
+	RedactHeaders []string `json:"redact_headers"`
+	RedactURLs    *bool    `json:"redact_urls"`
+}
+
+// adminBackendDebug serves /admin/backend-debug, where GET reports and PUT
+// changes the debug settings, and GET /admin/backend-debug/jobs/{id}, the
+// persisted darkflow calls of a job of the tenant named by the tenant query
+// parameter.
+func adminBackendDebug(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		setupResponse(w)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if id := strings.TrimPrefix(r.URL.Path, "/admin/backend-debug/jobs/"); id != r.URL.Path && r.Method == http.MethodGet {
+		adminBackendLog(w, r, id)
+		return
+	}
+	if r.URL.Path != "/admin/backend-debug" {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req backendDebugRequest
+		status, err := decodeJSONBody(w, r, &req)
+		if err != nil {
+			jsonError(w, status, err)
+			return
+		}
+		backendDebug.mu.Lock()
+		cfg := &backendDebug.config
+		if req.Enabled != nil {
+			cfg.Enabled = *req.Enabled
+		}
+		if req.Persist != nil {
+			cfg.Persist = *req.Persist
+		}
+		if req.RedactHeaders != nil {
+			cfg.RedactHeaders = req.RedactHeaders
+		}
+		if req.RedactURLs != nil {
+			cfg.RedactURLs = *req.RedactURLs
+		}
+		log.Printf("Backend debug settings changed: %+v", *cfg)
+		backendDebug.mu.Unlock()
+	default:
+		jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+		return
+	}
+	jsonResponse(w, http.StatusOK, currentBackendDebug())
+}
+
+func adminBackendLog(w http.ResponseWriter, r *http.Request, id string) {
+	name := r.URL.Query().Get("tenant")
+	var t *tenant
+	for _, c := range allTenants() {
+		if c.Name == name {
+			t = c
+		}
+	}
+	if t == nil || !jobIDRe.MatchString(id) {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("no backend log of job %s", id))
+		return
+	}
+	list, err := readBackendLog(t, id)
+	if os.IsNotExist(err) {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("no backend log of job %s", id))
+		return
+	}
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, list)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// dedupeOutputs stores output files by content: every job directory holds
+// hard links to blobs under -output, so identical outputs of repeated jobs
+// take the disk space of one.
+var dedupeOutputs bool
+
+// blobsDir holds the blobs, named after their SHA-256 checksum. It is a dot
+// directory, which /output does not serve.
+const blobsDir = ".blobs"
+
+// blobs serializes linking outputs to blobs with removing unreferenced
+// ones, so that a blob is never removed just as a job links to it.
+var blobs struct {
+	mu sync.Mutex
+	// saved is the number of bytes that linking to an existing blob saved.
+	saved int64
+}
+
+func setupBlobs() error {
+	if !dedupeOutputs {
+		return nil
+	}
+	if !linkCountSupported {
+		return fmt.Errorf("-dedupe-outputs is not supported on this platform")
+	}
+	if err := os.MkdirAll(filepath.Join(outputDir, blobsDir), 0755); err != nil {
+		return fmt.Errorf("could not create blob dir: %v", err)
+	}
+	return nil
+}
+
+func blobPath(sum string) string {
+	return filepath.Join(outputDir, blobsDir, sum[:2], sum)
+}
+
+// linkBlobs replaces the checksummed outputs of j by hard links to their
+// blobs, adding the blobs that do not exist yet. Outputs that cannot be
+// linked, e.g. because -output spans file systems, are left as they are.
+func linkBlobs(t *tenant, j *job) {
+	if !dedupeOutputs {
+		return
+	}
+	blobs.mu.Lock()
+	defer blobs.mu.Unlock()
+	for _, f := range j.Files {
+		if f.SHA256 == "" {
+			continue
+		}
+		if err := linkBlob(j.outputFilePath(t, f), f.SHA256); err != nil {
+			log.Printf("Could not deduplicate output %s of job %s: %v", f.URL, j.ID, err)
+		}
+	}
+}
+
+func linkBlob(file, sum string) error {
+	blob := blobPath(sum)
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	existing, err := os.Stat(blob)
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+			return err
+		}
+		return os.Link(file, blob)
+	}
+	if err != nil {
+		return err
+	}
+	if os.SameFile(info, existing) {
+		return nil
+	}
+	// The link replaces the file in one rename, so readers always find
+	// one or the other.
+	tmp := file + ".blob"
+	if err := os.Link(blob, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	blobs.saved += info.Size()
+	return nil
+}
+
+// releaseBlobs removes the blobs of the outputs of j, which were just
+// deleted, that no other job links to any more.
+func releaseBlobs(j *job) {
+	if !dedupeOutputs {
+		return
+	}
+	blobs.mu.Lock()
+	defer blobs.mu.Unlock()
+	for _, f := range j.Files {
+		if f.SHA256 != "" {
+			removeUnreferencedBlob(blobPath(f.SHA256))
+		}
+	}
+}
+
+// sweepBlobs removes every blob no output links to, such as those of jobs
+// whose outputs were removed by hand.
+func sweepBlobs() {
+	if !dedupeOutputs {
+		return
+	}
+	blobs.mu.Lock()
+	defer blobs.mu.Unlock()
+	dirs, err := ioutil.ReadDir(filepath.Join(outputDir, blobsDir))
+	if err != nil {
+		return
+	}
+	for _, d := range dirs {
+		dir := filepath.Join(outputDir, blobsDir, d.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			removeUnreferencedBlob(filepath.Join(dir, f.Name()))
+		}
+	}
+}
+
+// removeUnreferencedBlob removes blob if its own name is its last link.
+func removeUnreferencedBlob(blob string) {
+	info, err := os.Stat(blob)
+	if err != nil {
+		return
+	}
+	if n, ok := linkCount(info); !ok || n > 1 {
+		return
+	}
+	if err := os.Remove(blob); err != nil {
+		log.Printf("Could not remove blob %s: %v", filepath.Base(blob), err)
+	}
+}
+
+// writeBlobMetrics appends the bytes deduplication saved to the Prometheus
+// text b.
+func writeBlobMetrics(b io.Writer) {
+	if !dedupeOutputs {
+		return
+	}
+	blobs.mu.Lock()
+	defer blobs.mu.Unlock()
+	fmt.Fprintf(b, "# TYPE darkflow_front_dedupe_saved_bytes_total counter\n")
+	fmt.Fprintf(b, "darkflow_front_dedupe_saved_bytes_total %d\n", blobs.saved)
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+const linkCountSupported = false
+
+func linkCount(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// errJobCancelled is the cancellation cause of jobs stopped through the
+// cancel endpoint.
+var errJobCancelled = errors.New("job was cancelled")
+
+// activeJobs tracks the jobs this process is working on so they can be
+// cancelled.
+var activeJobs = &jobRegistry{jobs: make(map[string]*activeJob)}
+
+// jobRegistry holds the active jobs by activeJobKey, since job IDs are only
+// unique within a tenant.
+type jobRegistry struct {
+	mu   sync.Mutex
+	jobs map[string]*activeJob
+}
+
+// activeJobKey is the registry key of job id of tenant t.
+func activeJobKey(t *tenant, id string) string {
+	return t.Name + "/" + id
+}
+
+type activeJob struct {
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+}
+
+// jobContext is requestContext for the work on job id of tenant t,
+// registered so that the job can be cancelled. A disconnect of the client is
+// handled as -on-disconnect says. The returned function must be called once
+// the job finished.
+func jobContext(r *http.Request, t *tenant, id string) (context.Context, func()) {
+	ctx, cancelTimeout := detachedContext(r)
+	ctx, done := trackJob(ctx, cancelTimeout, t, id)
+	stop := make(chan struct{})
+	go watchDisconnect(r, t, id, stop)
+	return ctx, func() {
+		close(stop)
+		done()
+	}
+}
+
+// trackJob registers the work on job id of tenant t under ctx, which
+// cancelTimeout releases; see jobContext.
+func trackJob(ctx context.Context, cancelTimeout context.CancelFunc, t *tenant, id string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	a := &activeJob{cancel: cancel, done: make(chan struct{})}
+	key := activeJobKey(t, id)
+
+	activeJobs.mu.Lock()
+	activeJobs.jobs[key] = a
+	activeJobs.mu.Unlock()
+
+	return ctx, func() {
+		activeJobs.mu.Lock()
+		delete(activeJobs.jobs, key)
+		activeJobs.mu.Unlock()
+		cancel(nil)
+		cancelTimeout()
+		close(a.done)
+	}
+}
+
+// cancel stops job id of tenant t and waits up to timeout for it to wind
+// down. It reports false if the job is not running in this process.
+func (reg *jobRegistry) cancel(t *tenant, id string, timeout time.Duration) bool {
+	reg.mu.Lock()
+	a, ok := reg.jobs[activeJobKey(t, id)]
+	reg.mu.Unlock()
+	if !ok {
+		return false
+	}
+	a.cancel(errJobCancelled)
+	select {
+	case <-a.done:
+	case <-time.After(timeout):
+	}
+	return true
+}
+
+// count is the number of jobs running in this process.
+func (reg *jobRegistry) count() int {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return len(reg.jobs)
+}
+
+// abort stops job id of tenant t with cause without waiting for it,
+// reporting false if the job is not running in this process.
+func (reg *jobRegistry) abort(t *tenant, id string, cause error) bool {
+	reg.mu.Lock()
+	a, ok := reg.jobs[activeJobKey(t, id)]
+	reg.mu.Unlock()
+	if ok {
+		a.cancel(cause)
+	}
+	return ok
+}
+
+// cancelJob handles POST and DELETE /jobs/{id}/cancel. Downloads and the
+// darkflow call of the job are aborted; closing the darkflow connection is
+// the stop signal for darkflow builds that watch for it. Partial inputs and
+// outputs are removed.
+func cancelJob(w http.ResponseWriter, t *tenant, id string) {
+	j, err := loadJob(t, id)
+	if os.IsNotExist(err) {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("job %s not found", id))
+		return
+	}
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if j.Status != jobRunning {
+		jsonError(w, http.StatusConflict, fmt.Errorf("job %s is not running", id))
+		return
+	}
+	if !activeJobs.cancel(t, id, 10*time.Second) {
+		jsonError(w, http.StatusConflict, fmt.Errorf("job %s is not running in this process", id))
+		return
+	}
+	log.Printf("Cancelled job %s of tenant %q", id, t.Name)
+
+	if j, err = loadJob(t, id); err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, j)
+}
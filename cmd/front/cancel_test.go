@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestJobRegistryTenants(t *testing.T) {
+	acme, other := &tenant{Name: "acme"}, &tenant{Name: "other"}
+	ctxAcme, doneAcme := trackJob(context.Background(), func() {}, acme, "j1")
+	ctxOther, doneOther := trackJob(context.Background(), func() {}, other, "j1")
+	defer doneOther()
+	if n := activeJobs.count(); n != 2 {
+		t.Fatalf("count() = %d, want 2", n)
+	}
+
+	if activeJobs.abort(&tenant{Name: "third"}, "j1", errJobCancelled) {
+		t.Error("abort() of a job of another tenant succeeded")
+	}
+	if !activeJobs.cancel(acme, "j1", time.Millisecond) {
+		t.Fatal("cancel() of a running job reported it is not running")
+	}
+	if context.Cause(ctxAcme) != errJobCancelled {
+		t.Errorf("cancelled job context cause = %v", context.Cause(ctxAcme))
+	}
+	if ctxOther.Err() != nil {
+		t.Errorf("cancel() stopped the job %q of another tenant", "j1")
+	}
+
+	doneAcme()
+	if activeJobs.abort(acme, "j1", errJobCancelled) {
+		t.Error("abort() of a finished job succeeded")
+	}
+	if !activeJobs.abort(other, "j1", errJobCancelled) || ctxOther.Err() == nil {
+		t.Error("abort() did not stop the running job")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// parseChecksum normalizes a client supplied SHA-256 checksum, given as hex
+// with an optional "sha256:" prefix.
+func parseChecksum(s string) (string, error) {
+	sum := strings.ToLower(strings.TrimPrefix(s, "sha256:"))
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid sha256 checksum %q", s)
+	}
+	return sum, nil
+}
+
+// validateChecksums normalizes the expected checksums of a request in place.
+// Every checksum must belong to one of urls.
+func validateChecksums(urls []string, sums map[string]string) error {
+	known := make(map[string]bool, len(urls))
+	for _, u := range urls {
+		known[u] = true
+	}
+	for u, s := range sums {
+		if !known[u] {
+			return fmt.Errorf("checksum given for %q which is not in image_urls", u)
+		}
+		sum, err := parseChecksum(s)
+		if err != nil {
+			return fmt.Errorf("%s: %v", u, err)
+		}
+		sums[u] = sum
+	}
+	return nil
+}
+
+// checksumError reports a downloaded image whose content is not what the
+// client expected.
+func checksumError(want, got string) error {
+	return withCode(codeChecksumMismatch, fmt.Errorf("checksum mismatch: expected sha256 %s, got %s", want, got))
+}
+
+// copyChecksummed copies src to dst and returns the SHA-256 checksum of what
+// was copied.
+func copyChecksummed(dst io.Writer, src io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(dst, h), src); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func fileChecksum(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return copyChecksummed(io.Discard, f)
+}
+
+// checksumOutputs records the checksum of every output file of j.
+func checksumOutputs(t *tenant, j *job) error {
+	for i, f := range j.Files {
+		sum, err := fileChecksum(j.outputFilePath(t, f))
+		if err != nil {
+			return fmt.Errorf("could not checksum output %s: %v", f.URL, err)
+		}
+		j.Files[i].SHA256 = sum
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var s3Endpoint string
+
+// cloudClient fetches from object storage. Unlike insecureClient it always
+// verifies certificates since it carries credentials.
+var cloudClient = &http.Client{Timeout: 5 * time.Minute}
+
+// splitBucketURL splits s3://bucket/key or gs://bucket/key.
+func splitBucketURL(raw string) (bucket, key string, err error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", err
+	}
+	key = strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return "", "", fmt.Errorf("invalid object url %q, want %s://bucket/key", raw, u.Scheme)
+	}
+	return u.Host, key, nil
+}
+
+// openS3 fetches an object using the AWS_* credentials from the environment.
+// With -s3-endpoint set, path-style requests go to that endpoint instead of
+// AWS, e.g. for MinIO.
+func openS3(ctx context.Context, raw string) (io.ReadCloser, int64, error) {
+	bucket, key, err := splitBucketURL(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	creds, err := awsCredentialsFromEnv()
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not fetch %s: %v", raw, err)
+	}
+
+	region := awsRegion()
+	req, err := http.NewRequest(http.MethodGet, s3ObjectURL(bucket, key, region), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	signAWSv4(req, nil, "s3", region, creds)
+	return openObject(req.WithContext(ctx), raw)
+}
+
+// s3ObjectURL is the URL of an object on AWS or, with -s3-endpoint, of the
+// path-style endpoint.
+func s3ObjectURL(bucket, key, region string) string {
+	if s3Endpoint != "" {
+		return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(s3Endpoint, "/"), bucket, awsEscape(key, false))
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, region, awsEscape(key, false))
+}
+
+// openGCS fetches an object with an OAuth token of the service account in
+// $GOOGLE_APPLICATION_CREDENTIALS or, without it, of the instance the
+// frontend runs on.
+func openGCS(ctx context.Context, raw string) (io.ReadCloser, int64, error) {
+	bucket, key, err := splitBucketURL(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	token, err := gcsTokens.get()
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not fetch %s: %v", raw, err)
+	}
+
+	u := fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s?alt=media", bucket, url.PathEscape(key))
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return openObject(req.WithContext(ctx), raw)
+}
+
+func openObject(req *http.Request, raw string) (io.ReadCloser, int64, error) {
+	resp, err := cloudClient.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not fetch %s: %v", raw, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("could not fetch %s: %s", raw, resp.Status)
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_only"
+
+var gcsTokens = &tokenCache{}
+
+// tokenCache holds a Google access token until shortly before it expires.
+type tokenCache struct {
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (c *tokenCache) get() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Add(time.Minute).Before(c.expires) {
+		return c.token, nil
+	}
+
+	var tok googleToken
+	var err error
+	if file := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); file != "" {
+		tok, err = serviceAccountToken(file)
+	} else {
+		tok, err = metadataToken()
+	}
+	if err != nil {
+		return "", err
+	}
+	c.token = tok.AccessToken
+	c.expires = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	return c.token, nil
+}
+
+type googleToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+type serviceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// serviceAccountToken exchanges a self-signed JWT of the service account key
+// in file for an access token.
+func serviceAccountToken(file string) (googleToken, error) {
+	var tok googleToken
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return tok, fmt.Errorf("could not read google credentials: %v", err)
+	}
+	var sa serviceAccount
+	if err := json.Unmarshal(data, &sa); err != nil {
+		return tok, fmt.Errorf("could not parse google credentials: %v", err)
+	}
+	if sa.TokenURI == "" {
+		sa.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return tok, fmt.Errorf("no private key in google credentials")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return tok, fmt.Errorf("could not parse google private key: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return tok, fmt.Errorf("google private key is not an RSA key")
+	}
+
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   sa.ClientEmail,
+		"scope": gcsScope,
+		"aud":   sa.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return tok, err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return tok, fmt.Errorf("could not sign google token request: %v", err)
+	}
+
+	resp, err := cloudClient.PostForm(sa.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)},
+	})
+	if err != nil {
+		return tok, fmt.Errorf("could not get google token: %v", err)
+	}
+	err = decodeToken(resp, &tok)
+	return tok, err
+}
+
+func metadataToken() (googleToken, error) {
+	var tok googleToken
+	req, err := http.NewRequest(http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return tok, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := cloudClient.Do(req)
+	if err != nil {
+		return tok, fmt.Errorf("could not get google token from metadata server: %v", err)
+	}
+	err = decodeToken(resp, &tok)
+	return tok, err
+}
+
+func decodeToken(resp *http.Response, tok *googleToken) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not get google token: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(tok); err != nil {
+		return fmt.Errorf("could not decode google token: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var compareBackendsFlag string
+
+// compareBackends are the darkflow backends a compare request may pick by
+// name, configured as -compare-backends name=url,...
+var compareBackends map[string]string
+
+func parseCompareBackends(spec string) (map[string]string, error) {
+	m := make(map[string]string)
+	if spec == "" {
+		return m, nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid compare backend %q, want name=url", pair)
+		}
+		m[kv[0]] = kv[1]
+	}
+	return m, nil
+}
+
+// compareSide selects how one side of a comparison is processed. An empty
+// backend uses the regular darkflow backends.
+type compareSide struct {
+	Backend   string  `json:"backend,omitempty"`
+	Model     string  `json:"model,omitempty"`
+	Threshold float64 `json:"threshold,omitempty"`
+}
+
+type compareRequest struct {
+	ImageURLs []string    `json:"image_urls"`
+	A         compareSide `json:"a"`
+	B         compareSide `json:"b"`
+	// IoU is the minimum overlap for two boxes of the same label to be
+	// considered the same detection; 0.5 when unset.
+	IoU float64 `json:"iou"`
+	// MinDelta is the smallest confidence change reported as changed.
+	MinDelta float64 `json:"min_delta"`
+}
+
+type compareSideResult struct {
+	compareSide
+	Outputs       []string        `json:"outputs"`
+	Discrepancies []errorDetail   `json:"discrepancies,omitempty"`
+	Environment   *jobEnvironment `json:"environment,omitempty"`
+}
+
+type detectionChange struct {
+	Label string    `json:"label"`
+	A     detection `json:"a"`
+	B     detection `json:"b"`
+	Delta float64   `json:"delta"`
+}
+
+// imageDiff describes how the detections of side B differ from side A for
+// one input image.
+type imageDiff struct {
+	Index     int               `json:"index"`
+	Input     string            `json:"input"`
+	Added     []detection       `json:"added"`
+	Removed   []detection       `json:"removed"`
+	Changed   []detectionChange `json:"changed"`
+	Unchanged int               `json:"unchanged"`
+}
+
+type compareResponse struct {
+	JobID  string            `json:"job_id"`
+	A      compareSideResult `json:"a"`
+	B      compareSideResult `json:"b"`
+	Images []imageDiff       `json:"images"`
+}
+
+// compare runs the same inputs through two backend/model combinations and
+// responds with a per-image diff of their detections. Each side writes to
+// its own subdirectory, a/ or b/, of the job's output.
+func compare(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		setupResponse(w)
+		return
+	}
+	received := time.Now()
+	t, ok := admit(w, r)
+	if !ok {
+		return
+	}
+	var req compareRequest
+	status, err := decodeJSONBody(w, r, &req)
+	if err != nil {
+		jsonError(w, status, err)
+		return
+	}
+	if len(req.ImageURLs) == 0 {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: image_urls must not be empty"))
+		return
+	}
+	if err := checkURLs(req.ImageURLs); err != nil {
+		jsonError(w, http.StatusForbidden, err)
+		return
+	}
+	for _, side := range []compareSide{req.A, req.B} {
+		if _, ok := compareBackends[side.Backend]; side.Backend != "" && !ok {
+			jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: unknown backend %q", side.Backend))
+			return
+		}
+	}
+	if req.IoU <= 0 {
+		req.IoU = 0.5
+	}
+
+	if err := checkMaintenance(); err != nil {
+		jsonError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err := darkflowQueue.check(); err != nil {
+		jsonError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	// Both sides process every image, so both count against the quota.
+	if err := t.reserveImages(2 * len(req.ImageURLs)); err != nil {
+		jsonError(w, http.StatusTooManyRequests, err)
+		return
+	}
+
+	log.Printf("Got compare request %+v from tenant %q", req, t.Name)
+	j := newJob()
+	j.ImageURLs = req.ImageURLs
+	j.Compare = true
+	j.addTiming(stageValidation, time.Since(received))
+	if err := createJob(t, j); err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("X-Job-Id", j.ID)
+	setOutputToken(w, t, j)
+
+	ctx, cancel := jobContext(r, t, j.ID)
+	defer cancel()
+	if err := stageImages(ctx, t, j); err != nil {
+		finishJob(t, j, err)
+		jsonError(w, stagingStatus(err), err)
+		return
+	}
+
+	resp := compareResponse{
+		JobID: j.ID,
+		A:     compareSideResult{compareSide: req.A},
+		B:     compareSideResult{compareSide: req.B},
+	}
+	for _, side := range []struct {
+		name string
+		res  *compareSideResult
+	}{{"a", &resp.A}, {"b", &resp.B}} {
+		status, err := runCompareSide(ctx, t, j, side.name, side.res)
+		if err != nil {
+			code, details := errorCode(err, status)
+			err = withCode(code, fmt.Errorf("side %s: %v", side.name, err), details...)
+			finishJob(t, j, err)
+			jsonError(w, status, err)
+			return
+		}
+		j.Outputs = append(j.Outputs, side.res.Outputs...)
+	}
+
+	start := time.Now()
+	resp.Images, err = diffOutputs(t, j, req.IoU, req.MinDelta)
+	j.addTiming(stagePostProcessing, time.Since(start))
+	if err != nil {
+		finishJob(t, j, err)
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	finishJob(t, j, nil)
+	jsonResponse(w, http.StatusOK, resp)
+}
+
+func runCompareSide(ctx context.Context, t *tenant, j *job, name string, res *compareSideResult) (int, error) {
+	output := filepath.Join(j.outputPath(t), name)
+	res.Environment = newEnvironment(res.Model)
+	req := darkflowRequest{
+		InputDir:  j.inputPath(t),
+		OutputDir: output,
+		Model:     res.Model,
+		Threshold: res.Threshold,
+		images:    len(j.ImageURLs),
+		env:       res.Environment,
+	}
+	var status int
+	var err error
+	ctx = withBackendLog(ctx, t, j.ID)
+	start := time.Now()
+	if res.Backend != "" {
+		status, err = callBackend(ctx, compareBackends[res.Backend], req)
+	} else {
+		status, err = callDarkflow(ctx, req)
+	}
+	j.addTiming(stageBackend, time.Since(start))
+	if err != nil {
+		return status, err
+	}
+	start = time.Now()
+	defer func() { j.addTiming(stagePostProcessing, time.Since(start)) }()
+
+	res.Discrepancies, err = verifyOutputs(output, len(j.ImageURLs), j.inputName)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := discrepancyError(res.Discrepancies); err != nil {
+		return http.StatusBadGateway, err
+	}
+
+	files, err := ioutil.ReadDir(output)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("could not read output dir: %v", err)
+	}
+	res.Outputs = make([]string, len(files))
+	for i, f := range files {
+		res.Outputs[i] = t.outputURL(j.ID, name+"/"+f.Name())
+	}
+	return 0, nil
+}
+
+// diffOutputs compares the annotations of sides a and b for every input.
+func diffOutputs(t *tenant, j *job, iou, minDelta float64) ([]imageDiff, error) {
+	diffs := make([]imageDiff, len(j.ImageURLs))
+	for i, input := range j.ImageURLs {
+		name := fmt.Sprintf("%d.json", i)
+		a, err := readDetections(filepath.Join(j.outputPath(t), "a", name))
+		if err != nil {
+			return nil, err
+		}
+		b, err := readDetections(filepath.Join(j.outputPath(t), "b", name))
+		if err != nil {
+			return nil, err
+		}
+		diffs[i] = diffDetections(a, b, iou, minDelta)
+		diffs[i].Index = i
+		diffs[i].Input = input
+	}
+	return diffs, nil
+}
+
+// diffDetections pairs up boxes of the same label in a and b, greedily by
+// highest overlap, and reports the unpaired ones as removed or added.
+func diffDetections(a, b []detection, iou, minDelta float64) imageDiff {
+	type pair struct {
+		i, j int
+		iou  float64
+	}
+	var pairs []pair
+	for i := range a {
+		for j := range b {
+			if a[i].Label != b[j].Label {
+				continue
+			}
+			if v := boxIoU(a[i], b[j]); v >= iou {
+				pairs = append(pairs, pair{i, j, v})
+			}
+		}
+	}
+	sort.Slice(pairs, func(x, y int) bool { return pairs[x].iou > pairs[y].iou })
+
+	d := imageDiff{Added: []detection{}, Removed: []detection{}, Changed: []detectionChange{}}
+	usedA := make([]bool, len(a))
+	usedB := make([]bool, len(b))
+	for _, p := range pairs {
+		if usedA[p.i] || usedB[p.j] {
+			continue
+		}
+		usedA[p.i], usedB[p.j] = true, true
+		delta := b[p.j].Confidence - a[p.i].Confidence
+		if math.Abs(delta) > minDelta {
+			d.Changed = append(d.Changed, detectionChange{Label: a[p.i].Label, A: a[p.i], B: b[p.j], Delta: delta})
+		} else {
+			d.Unchanged++
+		}
+	}
+	for i, used := range usedA {
+		if !used {
+			d.Removed = append(d.Removed, a[i])
+		}
+	}
+	for j, used := range usedB {
+		if !used {
+			d.Added = append(d.Added, b[j])
+		}
+	}
+	return d
+}
+
+// boxIoU is the intersection over union of the boxes of two detections.
+func boxIoU(a, b detection) float64 {
+	ix := math.Min(float64(a.BottomRight.X), float64(b.BottomRight.X)) - math.Max(float64(a.TopLeft.X), float64(b.TopLeft.X))
+	iy := math.Min(float64(a.BottomRight.Y), float64(b.BottomRight.Y)) - math.Max(float64(a.TopLeft.Y), float64(b.TopLeft.Y))
+	if ix <= 0 || iy <= 0 {
+		return 0
+	}
+	inter := ix * iy
+	union := a.area() + b.area() - inter
+	if union <= 0 {
+		return 0
+	}
+	return inter / union
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var cropDetections bool
+
+var unsafeLabelRe = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// annotationPath returns where the annotation of input index is stored after
+// renaming, or "" if darkflow produced none.
+func annotationPath(t *tenant, j *job, index int) string {
+	prefix := t.outputURL(j.ID, "") + "/"
+	for _, f := range j.Files {
+		if f.Index == index && filepath.Ext(f.Source) == ".json" {
+			return filepath.Join(j.outputPath(t), filepath.FromSlash(strings.TrimPrefix(f.URL, prefix)))
+		}
+	}
+	return ""
+}
+
+// cropOutputs cuts every detected box out of the original input images and
+// stores it as crops/<label>/<index>_<n>.jpg in the job's output dir.
+// Redacted detections are not cut out.
+func cropOutputs(t *tenant, j *job) error {
+	for _, input := range j.indexedInputs() {
+		i := input.index
+		ann := annotationPath(t, j, i)
+		if ann == "" {
+			continue
+		}
+		ds, err := readDetections(ann)
+		if err != nil {
+			return err
+		}
+		if len(ds) == 0 {
+			continue
+		}
+
+		// j.Inputs names the final location; while the job runs the
+		// inputs are still staged.
+		img, err := decodeImageFile(filepath.Join(j.inputPath(t), filepath.Base(input.path)))
+		if err != nil {
+			return err
+		}
+		for n, d := range ds {
+			if redactedBy(j.Render).redacts(d.Label) {
+				continue
+			}
+			rect := image.Rect(d.TopLeft.X, d.TopLeft.Y, d.BottomRight.X, d.BottomRight.Y).Intersect(img.Bounds())
+			if rect.Empty() {
+				continue
+			}
+			label := unsafeLabelRe.ReplaceAllString(d.Label, "_")
+			rel := fmt.Sprintf("crops/%s/%d_%d.jpg", label, i, n)
+			if err := writeCrop(img, rect, filepath.Join(j.outputPath(t), filepath.FromSlash(rel))); err != nil {
+				return err
+			}
+			url := t.outputURL(j.ID, rel)
+			j.Files = append(j.Files, outputFile{Source: "crop", Index: i, Input: j.inputName(i), URL: url})
+			j.Outputs = append(j.Outputs, url)
+		}
+	}
+	return nil
+}
+
+func decodeImageFile(file string) (image.Image, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode %s: %v", file, err)
+	}
+	return img, nil
+}
+
+func writeCrop(img image.Image, rect image.Rectangle, to string) error {
+	crop := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(crop, crop.Bounds(), img, rect.Min, draw.Src)
+
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return fmt.Errorf("could not create crops dir: %v", err)
+	}
+	file, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return jpeg.Encode(file, crop, &jpeg.Options{Quality: 95})
+}
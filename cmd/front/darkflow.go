@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var darkflowCert string
+var darkflowKey string
+var darkflowCA string
+var darkflowToken string
+var darkflowAPIKey string
+var darkflowAPIKeyHeader string
+var waitForDarkflow time.Duration
+
+// darkflowUpload sends the input images to darkflow in a multipart request
+// and reads the results back from a multipart response, for darkflow builds
+// that do not share the input and output volumes with the frontend.
+var darkflowUpload bool
+
+// darkflowInputPrefix and darkflowOutputPrefix are where darkflow mounts the
+// input and output dirs, when not at the same paths as the frontend.
+var darkflowInputPrefix string
+var darkflowOutputPrefix string
+
+type darkflowRequest struct {
+	InputDir  string  `json:"input_dir"`
+	OutputDir string  `json:"output_dir"`
+	Model     string  `json:"model,omitempty"`
+	Threshold float64 `json:"threshold,omitempty"`
+	// images is the number of inputs, which the adaptive timeout depends
+	// on.
+	images int
+	// memory replaces the directories for -in-memory jobs, which are only
+	// ever uploaded.
+	memory *memoryBatch
+	// env, if set, records the backend the request is sent to and the
+	// model darkflow ran.
+	env *jobEnvironment
+}
+
+// setDarkflowAuth adds the configured credentials to a darkflow request.
+func setDarkflowAuth(req *http.Request) {
+	if darkflowToken != "" {
+		req.Header.Set("Authorization", "Bearer "+darkflowToken)
+	}
+	if darkflowAPIKey != "" {
+		req.Header.Set(darkflowAPIKeyHeader, darkflowAPIKey)
+	}
+}
+
+// darkflowTLS is the TLS configuration of connections to darkflow, shared by
+// darkflowClient and the streaming connections of -darkflow-stream-path.
+var darkflowTLS *tls.Config
+
+// newDarkflowClient builds the HTTP client used to talk to darkflow. When
+// -darkflow-cert/-darkflow-key are set the client presents them for mutual
+// TLS, and -darkflow-ca replaces the system roots for verifying darkflow.
+func newDarkflowClient() (*http.Client, error) {
+	if (darkflowCert == "") != (darkflowKey == "") {
+		return nil, fmt.Errorf("both -darkflow-cert and -darkflow-key must be set for mTLS")
+	}
+
+	cfg := &tls.Config{}
+	if darkflowCert != "" {
+		cert, err := tls.LoadX509KeyPair(darkflowCert, darkflowKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not load darkflow client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if darkflowCA != "" {
+		pem, err := ioutil.ReadFile(darkflowCA)
+		if err != nil {
+			return nil, fmt.Errorf("could not read darkflow CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", darkflowCA)
+		}
+		cfg.RootCAs = pool
+	}
+
+	darkflowTLS = cfg
+	// Debug logging sees the requests as they are sent, signed.
+	tr := &debugTransport{base: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: cfg,
+	}}
+	if darkflowSigningSecret != "" {
+		return &http.Client{Transport: &signingTransport{base: tr, secret: []byte(darkflowSigningSecret)}}, nil
+	}
+	return &http.Client{Transport: tr}, nil
+}
+
+// probeBackend checks that the darkflow at backend accepts requests. Any HTTP
+// response counts, since darkflow may not implement GET at all.
+func probeBackend(backend string) error {
+	req, err := http.NewRequest(http.MethodGet, backend, nil)
+	if err != nil {
+		return err
+	}
+	setDarkflowAuth(req)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := darkflowClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// awaitDarkflow blocks until at least one darkflow backend responds, polling
+// for up to timeout. It lets the frontend hold off accepting traffic while
+// darkflow is still loading its models.
+func awaitDarkflow(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		var lastErr error
+		for _, backend := range backends.list() {
+			if lastErr = probeBackend(backend); lastErr == nil {
+				log.Printf("Darkflow at %s is up", backend)
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("darkflow did not come up within %s: %v", timeout, lastErr)
+		}
+		log.Printf("Waiting for darkflow: %v", lastErr)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// callDarkflow posts req to the next darkflow backend and waits for it to
+// finish processing. On failure it returns the HTTP status the caller should
+// respond with.
+func callDarkflow(ctx context.Context, req darkflowRequest) (int, error) {
+	release, err := darkflowQueue.acquire(ctx)
+	if err != nil {
+		return abortStatus(err, http.StatusServiceUnavailable), err
+	}
+	defer release()
+	if status, err := injectedDarkflowError(ctx); err != nil {
+		return status, err
+	}
+	backend, done, err := backends.pick()
+	if err != nil {
+		return http.StatusServiceUnavailable, withCode(codeBackendUnavailable, err)
+	}
+	defer done()
+	if err := supervision.wait(ctx, backend); err != nil {
+		return abortStatus(err, http.StatusServiceUnavailable), err
+	}
+	status, err := callBackend(ctx, backend, req)
+	supervision.record(backend, status, err)
+	return status, err
+}
+
+// callBackend posts req to the darkflow at backend, giving it up to
+// -darkflow-timeout or the adaptive timeout for its batch size.
+func callBackend(ctx context.Context, backend string, req darkflowRequest) (int, error) {
+	req.env.recordBackend(backend)
+	limit := backendTimeout(req.images)
+	step, cancel := stepContext(ctx, limit)
+	defer cancel()
+	start := time.Now()
+	var status int
+	var err error
+	switch {
+	case darkflowStreamPath != "":
+		status, err = streamToBackend(step, backend, req)
+	case darkflowUpload:
+		status, err = uploadToBackend(step, backend, req)
+	default:
+		status, err = postToBackend(step, backend, req)
+	}
+	if err != nil && step.Err() != nil {
+		err = timeoutError(ctx, step, codeBackendTimeout, limit, err)
+		return abortStatus(err, http.StatusGatewayTimeout), err
+	}
+	if err == nil {
+		latencies.observe(req.images, time.Since(start))
+	}
+	return status, err
+}
+
+// postToBackend posts req as JSON, in the format of the protocol version
+// negotiated with backend; darkflow reads and writes the shared
+// directories itself.
+func postToBackend(ctx context.Context, backend string, req darkflowRequest) (int, error) {
+	req.InputDir = darkflowPath(req.InputDir, inputDir, darkflowInputPrefix)
+	req.OutputDir = darkflowPath(req.OutputDir, outputDir, darkflowOutputPrefix)
+	body, err := encodeDarkflowRequest(req, requestTemplateFor(backend))
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("could not encode darkflow request: %v", err)
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, backend, bytes.NewReader(body))
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("could not create darkflow request: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	setDarkflowAuth(httpReq)
+
+	resp, err := darkflowClient.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return http.StatusInternalServerError, withCode(codeBackendUnavailable, fmt.Errorf("could not call darkflow: %v", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnprocessableEntity {
+			// The backend may have been upgraded to a protocol that no
+			// longer understands the request.
+			versions.forget(backend)
+		}
+		return resp.StatusCode, withCode(codeBackendError, fmt.Errorf("darkflow returned error: %s", resp.Status))
+	}
+	req.env.recordResponse(resp.Header)
+	return 0, nil
+}
+
+// darkflowPath maps p, a path under the frontend's dir, to the same path
+// under prefix, where darkflow mounts dir. Paths outside dir are sent as
+// they are.
+func darkflowPath(p, dir, prefix string) string {
+	if prefix == "" {
+		return p
+	}
+	rel, err := filepath.Rel(dir, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return p
+	}
+	return path.Join(prefix, filepath.ToSlash(rel))
+}
+
+// uploadToBackend posts the images in req.InputDir to the darkflow at backend
+// as multipart/form-data, one "images" part per file alongside the model and
+// threshold fields. Darkflow answers with a multipart body holding one part
+// per output file, which is written to req.OutputDir. Requests of
+// -in-memory jobs take their images from, and leave the outputs in,
+// req.memory instead.
+func uploadToBackend(ctx context.Context, backend string, req darkflowRequest) (int, error) {
+	var files []os.FileInfo
+	if req.memory == nil {
+		var err error
+		files, err = ioutil.ReadDir(req.InputDir)
+		if err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("could not read input dir: %v", err)
+		}
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeUploadForm(mw, req, files))
+	}()
+
+	httpReq, err := http.NewRequest(http.MethodPost, backend, pr)
+	if err != nil {
+		pr.Close()
+		return http.StatusInternalServerError, fmt.Errorf("could not create darkflow request: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", mw.FormDataContentType())
+	setDarkflowAuth(httpReq)
+
+	resp, err := darkflowClient.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return http.StatusInternalServerError, withCode(codeBackendUnavailable, fmt.Errorf("could not call darkflow: %v", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, withCode(codeBackendError, fmt.Errorf("darkflow returned error: %s", resp.Status))
+	}
+	req.env.recordResponse(resp.Header)
+	if req.memory != nil {
+		err = readUploadResults(resp, func(name string, part io.Reader) error {
+			data, err := ioutil.ReadAll(part)
+			if err != nil {
+				return fmt.Errorf("could not read darkflow output %s: %v", name, err)
+			}
+			req.memory.outputs = append(req.memory.outputs, memoryFile{name: name, data: data})
+			return nil
+		})
+	} else {
+		err = saveUploadResults(resp, req.OutputDir)
+	}
+	if err != nil {
+		return http.StatusBadGateway, withCode(codeBackendError, err)
+	}
+	return 0, nil
+}
+
+func writeUploadForm(mw *multipart.Writer, req darkflowRequest, files []os.FileInfo) error {
+	if req.Model != "" {
+		if err := mw.WriteField("model", req.Model); err != nil {
+			return err
+		}
+	}
+	if req.Threshold != 0 {
+		if err := mw.WriteField("threshold", strconv.FormatFloat(req.Threshold, 'f', -1, 64)); err != nil {
+			return err
+		}
+	}
+	if req.memory != nil {
+		if err := writeMemoryForm(mw, req.memory); err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		part, err := mw.CreateFormFile("images", f.Name())
+		if err != nil {
+			return err
+		}
+		in, err := os.Open(filepath.Join(req.InputDir, f.Name()))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(part, in)
+		in.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// saveUploadResults writes every file part of a multipart darkflow response
+// into dir.
+func saveUploadResults(resp *http.Response, dir string) error {
+	if err := os.MkdirAll(dir, os.FileMode(0755)); err != nil {
+		return fmt.Errorf("could not create output dir: %v", err)
+	}
+	return readUploadResults(resp, func(name string, part io.Reader) error {
+		out, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return fmt.Errorf("could not save darkflow output: %v", err)
+		}
+		_, err = io.Copy(out, part)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("could not save darkflow output %s: %v", name, err)
+		}
+		return nil
+	})
+}
+
+// readUploadResults passes every file part of a multipart darkflow response
+// to save, along with its base name.
+func readUploadResults(resp *http.Response, save func(name string, part io.Reader) error) error {
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return fmt.Errorf("darkflow returned %q, want a multipart response", resp.Header.Get("Content-Type"))
+	}
+
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read darkflow response: %v", err)
+		}
+		name := filepath.Base(part.FileName())
+		if part.FileName() == "" || name == "." || name == ".." || name == "/" {
+			part.Close()
+			continue
+		}
+		err = save(name, part)
+		part.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// darkflowStreamPath is -darkflow-stream-path, the WebSocket endpoint of
+// darkflow that images are streamed to over persistent connections instead
+// of a request per batch; darkflowStreamConns is how many connections are
+// kept open to each backend.
+var darkflowStreamPath string
+var darkflowStreamConns int
+
+// darkflowStreamImage announces an image on a darkflow stream. The image
+// itself follows as the next binary message.
+type darkflowStreamImage struct {
+	ID        string  `json:"id"`
+	Name      string  `json:"name"`
+	Model     string  `json:"model,omitempty"`
+	Threshold float64 `json:"threshold,omitempty"`
+}
+
+// darkflowStreamResult is darkflow's answer to the image with the same ID:
+// its detections, or the error it failed with. Model and ModelVersion name
+// the model that ran, when darkflow tells.
+type darkflowStreamResult struct {
+	ID           string      `json:"id"`
+	Detections   []detection `json:"detections"`
+	Error        string      `json:"error,omitempty"`
+	Model        string      `json:"model,omitempty"`
+	ModelVersion string      `json:"model_version,omitempty"`
+
+	// broken is set instead when the connection failed before darkflow
+	// answered.
+	broken error
+}
+
+func validateDarkflowStream() error {
+	if darkflowStreamPath == "" {
+		return nil
+	}
+	if !strings.HasPrefix(darkflowStreamPath, "/") {
+		return fmt.Errorf("invalid -darkflow-stream-path %q, want a path starting with /", darkflowStreamPath)
+	}
+	if darkflowStreamConns <= 0 {
+		return fmt.Errorf("invalid -darkflow-stream-conns %d, want a positive number", darkflowStreamConns)
+	}
+	if darkflowSigningSecret != "" {
+		return fmt.Errorf("-darkflow-stream-path cannot be used with -darkflow-signing-secret, stream messages are not signed")
+	}
+	return nil
+}
+
+// darkflowStream is one persistent connection to a backend, over which the
+// images of any number of requests are in flight at once.
+type darkflowStream struct {
+	backend string
+	ws      *wsConn
+
+	mu      sync.Mutex
+	pending map[string]chan darkflowStreamResult
+	err     error
+}
+
+// darkflowStreamPool holds the open streams by backend.
+type darkflowStreamPool struct {
+	mu    sync.Mutex
+	conns map[string][]*darkflowStream
+	next  int
+}
+
+var darkflowStreams = &darkflowStreamPool{conns: make(map[string][]*darkflowStream)}
+
+// get returns a stream to backend, opening another while fewer than
+// -darkflow-stream-conns are open and taking turns between them after.
+func (p *darkflowStreamPool) get(ctx context.Context, backend string) (*darkflowStream, error) {
+	p.mu.Lock()
+	var open []*darkflowStream
+	for _, s := range p.conns[backend] {
+		if s.broken() == nil {
+			open = append(open, s)
+		}
+	}
+	p.conns[backend] = open
+	if len(open) >= darkflowStreamConns {
+		p.next++
+		s := open[p.next%len(open)]
+		p.mu.Unlock()
+		return s, nil
+	}
+	p.mu.Unlock()
+
+	s, err := openDarkflowStream(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.conns[backend] = append(p.conns[backend], s)
+	p.mu.Unlock()
+	return s, nil
+}
+
+func openDarkflowStream(ctx context.Context, backend string) (*darkflowStream, error) {
+	u, err := url.Parse(backend)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = darkflowStreamPath
+	ws, err := dialWebSocket(ctx, u.String(), darkflowTLS)
+	if err != nil {
+		return nil, err
+	}
+	s := &darkflowStream{backend: backend, ws: ws, pending: make(map[string]chan darkflowStreamResult)}
+	go s.read()
+	log.Printf("Opened stream to darkflow at %s", u.Redacted())
+	return s, nil
+}
+
+func (s *darkflowStream) broken() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// read hands darkflow's results to the images waiting for them until the
+// connection fails.
+func (s *darkflowStream) read() {
+	for {
+		op, msg, err := s.ws.readMessage()
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		if op != wsText {
+			continue
+		}
+		var res darkflowStreamResult
+		if err := json.Unmarshal(msg, &res); err != nil {
+			s.fail(fmt.Errorf("could not parse darkflow stream result: %v", err))
+			return
+		}
+		s.mu.Lock()
+		ch := s.pending[res.ID]
+		delete(s.pending, res.ID)
+		s.mu.Unlock()
+		if ch != nil {
+			ch <- res
+		}
+	}
+}
+
+// fail closes the stream, failing the images still waiting on it.
+func (s *darkflowStream) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	// Closing the socket also unblocks a send stuck writing to it.
+	s.ws.conn.Close()
+	for id, ch := range s.pending {
+		ch <- darkflowStreamResult{ID: id, broken: err}
+	}
+	s.pending = nil
+	log.Printf("Stream to darkflow at %s failed: %v", s.backend, err)
+}
+
+// send streams the image data and returns where its result arrives.
+func (s *darkflowStream) send(img darkflowStreamImage, data []byte) (chan darkflowStreamResult, error) {
+	header, err := json.Marshal(img)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan darkflowStreamResult, 1)
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	s.pending[img.ID] = ch
+	s.mu.Unlock()
+	// Both messages go out under one lock so that the images of
+	// concurrent requests do not interleave.
+	s.ws.wmu.Lock()
+	err = s.ws.writeFrameLocked(wsText, header)
+	if err == nil {
+		err = s.ws.writeFrameLocked(wsBinary, data)
+	}
+	s.ws.wmu.Unlock()
+	if err != nil {
+		s.fail(err)
+		return nil, err
+	}
+	return ch, nil
+}
+
+// forget stops waiting for the result of image id.
+func (s *darkflowStream) forget(id string) {
+	s.mu.Lock()
+	delete(s.pending, id)
+	s.mu.Unlock()
+}
+
+// streamedImage is an image of a request being streamed.
+type streamedImage struct {
+	id     string
+	name   string
+	data   []byte
+	result chan darkflowStreamResult
+}
+
+// streamToBackend streams the images of req to the darkflow at backend over
+// one of its persistent connections and writes the detections darkflow
+// sends back as the annotation files, drawing the annotated images itself,
+// to req.OutputDir or, for -in-memory jobs, req.memory.
+func streamToBackend(ctx context.Context, backend string, req darkflowRequest) (int, error) {
+	var inputs []*streamedImage
+	if req.memory != nil {
+		for _, f := range req.memory.inputs {
+			inputs = append(inputs, &streamedImage{name: f.name, data: f.data})
+		}
+	} else {
+		files, err := ioutil.ReadDir(req.InputDir)
+		if err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("could not read input dir: %v", err)
+		}
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(req.InputDir, f.Name()))
+			if err != nil {
+				return http.StatusInternalServerError, fmt.Errorf("could not read input: %v", err)
+			}
+			inputs = append(inputs, &streamedImage{name: f.Name(), data: data})
+		}
+	}
+
+	if req.memory == nil {
+		if err := os.MkdirAll(req.OutputDir, os.FileMode(0755)); err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("could not create output dir: %v", err)
+		}
+	}
+	s, err := darkflowStreams.get(ctx, backend)
+	if err != nil {
+		return http.StatusInternalServerError, withCode(codeBackendUnavailable, fmt.Errorf("could not open darkflow stream: %v", err))
+	}
+	defer func() {
+		for _, in := range inputs {
+			if in.result != nil {
+				s.forget(in.id)
+			}
+		}
+	}()
+	for _, in := range inputs {
+		in.id = generateID(16)
+		in.result, err = s.send(darkflowStreamImage{ID: in.id, Name: in.name, Model: req.Model, Threshold: req.Threshold}, in.data)
+		if err != nil {
+			return http.StatusInternalServerError, withCode(codeBackendUnavailable, fmt.Errorf("could not stream %s to darkflow: %v", in.name, err))
+		}
+	}
+	for _, in := range inputs {
+		var res darkflowStreamResult
+		select {
+		case res = <-in.result:
+			in.result = nil
+		case <-ctx.Done():
+			return http.StatusInternalServerError, ctx.Err()
+		}
+		if res.broken != nil {
+			return http.StatusInternalServerError, withCode(codeBackendUnavailable, fmt.Errorf("darkflow stream failed: %v", res.broken))
+		}
+		if res.Error != "" {
+			return http.StatusBadGateway, withCode(codeBackendError, fmt.Errorf("darkflow failed on %s: %s", in.name, res.Error))
+		}
+		if res.Model != "" {
+			req.env.recordModel(res.Model, res.ModelVersion)
+		}
+		if err := writeStreamedOutputs(req, in, res.Detections); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	return 0, nil
+}
+
+// writeStreamedOutputs writes the annotation and annotated image of in, as
+// darkflow would have named them.
+func writeStreamedOutputs(req darkflowRequest, in *streamedImage, ds []detection) error {
+	if ds == nil {
+		ds = []detection{}
+	}
+	annotation, err := json.Marshal(ds)
+	if err != nil {
+		return fmt.Errorf("could not encode annotation of %s: %v", in.name, err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(in.data))
+	if err != nil {
+		return fmt.Errorf("could not decode %s: %v", in.name, err)
+	}
+	var rendered bytes.Buffer
+	if err := encodeRendered(&rendered, drawDetections(img, ds, &renderOptions{}), in.name); err != nil {
+		return fmt.Errorf("could not encode annotated %s: %v", in.name, err)
+	}
+	base := strings.TrimSuffix(in.name, filepath.Ext(in.name))
+	outputs := []memoryFile{{name: base + ".json", data: annotation}, {name: in.name, data: rendered.Bytes()}}
+	if req.memory != nil {
+		req.memory.outputs = append(req.memory.outputs, outputs...)
+		return nil
+	}
+	for _, f := range outputs {
+		if err := ioutil.WriteFile(filepath.Join(req.OutputDir, f.name), f.data, 0644); err != nil {
+			return fmt.Errorf("could not write darkflow output %s: %v", f.name, err)
+		}
+	}
+	return nil
+}
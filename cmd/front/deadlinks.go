@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var fetchFailureThreshold int
+var fetchFailureCooldown time.Duration
+
+// fetchFailuresFile keeps the sources in cooldown across restarts, in the
+// input dir.
+const fetchFailuresFile = ".fetch-failures.json"
+
+// missingSourceError is a fetch failure saying the image does not exist,
+// such as an HTTP 404.
+type missingSourceError struct {
+	msg string
+}
+
+func (e *missingSourceError) Error() string { return e.msg }
+
+// fetchFailures counts the consecutive failures of image URLs that are
+// missing and of hosts that time out or refuse connections. A source that
+// fails -fetch-failure-threshold times in a row is not fetched again for
+// -fetch-failure-cooldown.
+var fetchFailures = &failureTracker{counts: make(map[string]int), blocked: make(map[string]sourceCooldown)}
+
+type failureTracker struct {
+	mu      sync.Mutex
+	counts  map[string]int
+	blocked map[string]sourceCooldown
+}
+
+// sourceCooldown is a URL or host in cooldown.
+type sourceCooldown struct {
+	// Source is an image URL, or host:<host> for a whole host.
+	Source    string    `json:"source"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"last_error"`
+	Until     time.Time `json:"until"`
+}
+
+// sourceKeys are the keys a URL is tracked under: itself and its host.
+func sourceKeys(from string) (string, string) {
+	u, err := url.Parse(from)
+	if err != nil || u.Host == "" {
+		return from, ""
+	}
+	return from, "host:" + strings.ToLower(u.Host)
+}
+
+// check fails with codeSourceCooldown if from or its host is in cooldown.
+func (f *failureTracker) check(from string) error {
+	if fetchFailureThreshold <= 0 {
+		return nil
+	}
+	urlKey, hostKey := sourceKeys(from)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, key := range []string{urlKey, hostKey} {
+		c, ok := f.blocked[key]
+		if !ok {
+			continue
+		}
+		if time.Now().After(c.Until) {
+			delete(f.blocked, key)
+			continue
+		}
+		return withCode(codeSourceCooldown, fmt.Errorf("could not fetch image: %s failed %d times in a row, last with %q; not retrying before %s",
+			strings.TrimPrefix(key, "host:"), c.Failures, c.LastError, c.Until.Format(time.RFC3339)))
+	}
+	return nil
+}
+
+// record counts the outcome of fetching from. Failures that say nothing of
+// the source, like the request running out of time, are not counted.
+func (f *failureTracker) record(from string, err error) {
+	if fetchFailureThreshold <= 0 {
+		return
+	}
+	urlKey, hostKey := sourceKeys(from)
+	key := ""
+	switch {
+	case err == nil:
+		f.mu.Lock()
+		delete(f.counts, urlKey)
+		delete(f.counts, hostKey)
+		f.mu.Unlock()
+		return
+	case isMissingSource(err):
+		key = urlKey
+	case hostKey != "" && isHostFailure(err):
+		key = hostKey
+	default:
+		return
+	}
+
+	f.mu.Lock()
+	f.counts[key]++
+	n := f.counts[key]
+	if n < fetchFailureThreshold {
+		f.mu.Unlock()
+		return
+	}
+	delete(f.counts, key)
+	c := sourceCooldown{Source: key, Failures: n, LastError: err.Error(), Until: time.Now().Add(fetchFailureCooldown).UTC()}
+	f.blocked[key] = c
+	snapshot := f.snapshot()
+	f.mu.Unlock()
+	log.Printf("Not fetching %s for %s after %d failures in a row: %v", strings.TrimPrefix(key, "host:"), fetchFailureCooldown, n, err)
+	saveFetchFailures(snapshot)
+}
+
+func isMissingSource(err error) bool {
+	var missing *missingSourceError
+	return errors.As(err, &missing)
+}
+
+// isHostFailure reports whether err says the host of an image is down: the
+// download timed out or no connection could be made.
+func isHostFailure(err error) bool {
+	if codeOr(err, "") == codeDownloadTimeout {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.Temporary()
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// snapshot lists the sources in cooldown, soonest to end first. f.mu must
+// be held.
+func (f *failureTracker) snapshot() []sourceCooldown {
+	now := time.Now()
+	list := []sourceCooldown{}
+	for key, c := range f.blocked {
+		if now.After(c.Until) {
+			delete(f.blocked, key)
+			continue
+		}
+		list = append(list, c)
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Until.Before(list[b].Until) })
+	return list
+}
+
+func (f *failureTracker) clear() {
+	f.mu.Lock()
+	f.counts = make(map[string]int)
+	f.blocked = make(map[string]sourceCooldown)
+	f.mu.Unlock()
+	saveFetchFailures(nil)
+}
+
+// loadFetchFailures restores the sources still in cooldown.
+func loadFetchFailures() {
+	if fetchFailureThreshold <= 0 {
+		return
+	}
+	data, err := ioutil.ReadFile(filepath.Join(inputDir, fetchFailuresFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Could not read fetch failures: %v", err)
+		}
+		return
+	}
+	var list []sourceCooldown
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Printf("Could not parse fetch failures: %v", err)
+		return
+	}
+	now := time.Now()
+	fetchFailures.mu.Lock()
+	for _, c := range list {
+		if now.Before(c.Until) {
+			fetchFailures.blocked[c.Source] = c
+		}
+	}
+	n := len(fetchFailures.blocked)
+	fetchFailures.mu.Unlock()
+	if n > 0 {
+		log.Printf("Restored %d sources in fetch failure cooldown", n)
+	}
+}
+
+func saveFetchFailures(list []sourceCooldown) {
+	if list == nil {
+		list = []sourceCooldown{}
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		log.Printf("Could not encode fetch failures: %v", err)
+		return
+	}
+	file := filepath.Join(inputDir, fetchFailuresFile)
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Printf("Could not save fetch failures: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		log.Printf("Could not save fetch failures: %v", err)
+	}
+}
+
+type fetchFailuresResponse struct {
+	Threshold       int              `json:"threshold"`
+	CooldownSeconds float64          `json:"cooldown_seconds"`
+	Sources         []sourceCooldown `json:"sources"`
+}
+
+// adminFetchFailures serves GET /admin/fetch-failures, listing the sources in
+// cooldown, and DELETE, which lets them all be fetched again.
+func adminFetchFailures(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		setupResponse(w)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		fetchFailures.clear()
+		log.Printf("Cleared fetch failure cooldowns")
+	default:
+		jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+		return
+	}
+	fetchFailures.mu.Lock()
+	list := fetchFailures.snapshot()
+	fetchFailures.mu.Unlock()
+	jsonResponse(w, http.StatusOK, fetchFailuresResponse{
+		Threshold:       fetchFailureThreshold,
+		CooldownSeconds: fetchFailureCooldown.Seconds(),
+		Sources:         list,
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"time"
+)
+
+var debugDumpDir string
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+}
+
+// hideDebug answers 404 for the /debug/ endpoints net/http/pprof and expvar
+// register on the default mux, which are only served behind the admin key
+// under /admin/debug/.
+func hideDebug(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/debug/") {
+			jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminDebug serves /admin/debug/pprof/ and /admin/debug/vars, the pprof
+// profiles and expvar variables of the frontend.
+func adminDebug(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		setupResponse(w)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/admin")
+	if path != "/debug/vars" && !strings.HasPrefix(path, "/debug/pprof/") {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+		return
+	}
+	http.StripPrefix("/admin", http.DefaultServeMux).ServeHTTP(w, r)
+}
+
+type debugDumpResponse struct {
+	Goroutines int      `json:"goroutines"`
+	Files      []string `json:"files"`
+}
+
+// adminDebugDump serves POST /admin/debug/dump, writing a full goroutine
+// dump and a heap profile taken after a garbage collection to
+// -debug-dump-dir, for the cases a profile cannot be fetched live.
+func adminDebugDump(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		setupResponse(w)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+		return
+	}
+	if err := os.MkdirAll(debugDumpDir, 0755); err != nil {
+		jsonError(w, http.StatusInternalServerError, fmt.Errorf("could not create dump dir: %v", err))
+		return
+	}
+	stamp := time.Now().UTC().Format("20060102T150405")
+	resp := debugDumpResponse{Goroutines: runtime.NumGoroutine()}
+	runtime.GC()
+	for _, p := range []struct {
+		name  string
+		debug int
+		ext   string
+	}{{"goroutine", 2, "txt"}, {"heap", 0, "pb.gz"}} {
+		file := filepath.Join(debugDumpDir, fmt.Sprintf("%s-%s.%s", p.name, stamp, p.ext))
+		if err := writeProfile(p.name, p.debug, file); err != nil {
+			jsonError(w, http.StatusInternalServerError, err)
+			return
+		}
+		resp.Files = append(resp.Files, file)
+	}
+	log.Printf("Wrote debug dumps %s", strings.Join(resp.Files, ", "))
+	jsonResponse(w, http.StatusOK, resp)
+}
+
+func writeProfile(name string, debug int, file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return fmt.Errorf("could not create %s dump: %v", name, err)
+	}
+	err = pprof.Lookup(name).WriteTo(f, debug)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write %s dump: %v", name, err)
+	}
+	return nil
+}
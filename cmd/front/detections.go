@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// detection is a single bounding box as written by darkflow's --json output.
+type detection struct {
+	Label       string  `json:"label"`
+	Confidence  float64 `json:"confidence"`
+	TopLeft     point   `json:"topleft"`
+	BottomRight point   `json:"bottomright"`
+}
+
+type point struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// area is the area of the detection's bounding box.
+func (d detection) area() float64 {
+	w := d.BottomRight.X - d.TopLeft.X
+	h := d.BottomRight.Y - d.TopLeft.Y
+	if w <= 0 || h <= 0 {
+		return 0
+	}
+	return float64(w) * float64(h)
+}
+
+// readDetections parses a darkflow annotation file.
+func readDetections(file string) ([]detection, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var ds []detection
+	if err := json.Unmarshal(data, &ds); err != nil {
+		return nil, fmt.Errorf("could not parse annotation %s: %v", file, err)
+	}
+	return ds, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Values of -on-disconnect.
+const (
+	disconnectAbort = "abort"
+	disconnectAsync = "async"
+)
+
+// statusClientClosedRequest is logged for requests whose job was aborted
+// because the client went away; nobody is left to read it.
+const statusClientClosedRequest = 499
+
+var onDisconnect string
+
+// errClientDisconnected is the cancellation cause of jobs aborted because
+// their client disconnected.
+var errClientDisconnected = errors.New("client disconnected")
+
+func validateOnDisconnect() error {
+	switch onDisconnect {
+	case disconnectAbort, disconnectAsync:
+		return nil
+	}
+	return fmt.Errorf("invalid -on-disconnect %q, want %s or %s", onDisconnect, disconnectAbort, disconnectAsync)
+}
+
+// watchDisconnect acts on the client of r disconnecting before stop is
+// closed: the work on job id of tenant t is aborted, or with -on-disconnect async left
+// to finish so that its response can be fetched from /jobs/{id}/response.
+func watchDisconnect(r *http.Request, t *tenant, id string, stop <-chan struct{}) {
+	select {
+	case <-stop:
+		return
+	case <-r.Context().Done():
+	}
+	select {
+	case <-stop:
+		// The handler returned, which ends the request context too.
+		return
+	default:
+	}
+	if onDisconnect == disconnectAsync {
+		log.Printf("Client of job %s disconnected, finishing the job for %s", id, responseURL(r, id))
+		return
+	}
+	if activeJobs.abort(t, id, errClientDisconnected) {
+		log.Printf("Client of job %s disconnected, aborting the job", id)
+	}
+}
+
+// detachedContext is requestContext cut loose from the cancellation of r,
+// whose disconnects watchDisconnect handles instead. It keeps the values of
+// r, such as its API version.
+func detachedContext(r *http.Request) (context.Context, context.CancelFunc) {
+	base := context.WithoutCancel(r.Context())
+	if requestTimeout > 0 {
+		return context.WithTimeout(base, requestTimeout)
+	}
+	return context.WithCancel(base)
+}
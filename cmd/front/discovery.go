@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var darkflowDiscovery string
+var darkflowDiscoveryInterval time.Duration
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// backends is the set of darkflow URLs requests are spread over. It holds
+// just -darkflow-url unless -darkflow-discovery is set.
+var backends = &backendSet{}
+
+type backendSet struct {
+	mu   sync.Mutex
+	urls []string
+	next int
+	// inflight counts the calls in progress per backend and load holds the
+	// utilization backends last reported, for -dispatch least-loaded.
+	inflight map[string]int
+	load     map[string]float64
+}
+
+func (b *backendSet) set(urls []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.urls = urls
+}
+
+func (b *backendSet) list() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.urls...)
+}
+
+// pick returns the backend to send the next call to, in round-robin order or
+// the least loaded one depending on -dispatch. The returned function must be
+// called once the call finished.
+func (b *backendSet) pick() (string, func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.urls) == 0 {
+		return "", nil, fmt.Errorf("no darkflow backends available")
+	}
+	n := b.next % len(b.urls)
+	if dispatchMode == dispatchLeastLoaded {
+		n = b.leastLoaded()
+	}
+	u := b.urls[n]
+	b.next = n + 1
+	if b.inflight == nil {
+		b.inflight = make(map[string]int)
+	}
+	b.inflight[u]++
+	return u, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.inflight[u]--; b.inflight[u] <= 0 {
+			delete(b.inflight, u)
+		}
+	}, nil
+}
+
+// startDiscovery resolves the darkflow backends once and, when discovery is
+// enabled, keeps re-resolving them every -darkflow-discovery-interval. A
+// failed refresh keeps the previously known backends.
+//
+// Discovery is configured as srv:<name> to use the targets of a DNS SRV
+// record, or k8s:<namespace>/<service>[:<port name>] to use the ready
+// addresses of a Kubernetes Endpoints object. Scheme and path of each backend
+// URL are taken from -darkflow-url.
+func startDiscovery() error {
+	if darkflowDiscovery == "" {
+		backends.set([]string{darkflowURL})
+		return nil
+	}
+
+	urls, err := discoverBackends()
+	if err != nil {
+		return err
+	}
+	backends.set(urls)
+	log.Printf("Discovered darkflow backends: %v", urls)
+
+	go func() {
+		for range time.Tick(darkflowDiscoveryInterval) {
+			urls, err := discoverBackends()
+			if err != nil {
+				log.Printf("Could not refresh darkflow backends: %v", err)
+				continue
+			}
+			if old := backends.list(); !sameStrings(old, urls) {
+				log.Printf("Darkflow backends changed: %v -> %v", old, urls)
+			}
+			backends.set(urls)
+		}
+	}()
+	return nil
+}
+
+func discoverBackends() ([]string, error) {
+	var hostPorts []string
+	var err error
+	switch {
+	case strings.HasPrefix(darkflowDiscovery, "srv:"):
+		hostPorts, err = lookupSRV(strings.TrimPrefix(darkflowDiscovery, "srv:"))
+	case strings.HasPrefix(darkflowDiscovery, "k8s:"):
+		hostPorts, err = lookupEndpoints(strings.TrimPrefix(darkflowDiscovery, "k8s:"))
+	default:
+		return nil, fmt.Errorf("unknown darkflow discovery %q, want srv:<name> or k8s:<namespace>/<service>", darkflowDiscovery)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(hostPorts) == 0 {
+		return nil, fmt.Errorf("discovery %s returned no backends", darkflowDiscovery)
+	}
+	sort.Strings(hostPorts)
+
+	base, err := url.Parse(darkflowURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -darkflow-url: %v", err)
+	}
+	urls := make([]string, len(hostPorts))
+	for i, hp := range hostPorts {
+		u := *base
+		u.Host = hp
+		urls[i] = u.String()
+	}
+	return urls, nil
+}
+
+func lookupSRV(name string) ([]string, error) {
+	_, addrs, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, fmt.Errorf("could not look up SRV %s: %v", name, err)
+	}
+	hostPorts := make([]string, len(addrs))
+	for i, a := range addrs {
+		hostPorts[i] = net.JoinHostPort(strings.TrimSuffix(a.Target, "."), strconv.Itoa(int(a.Port)))
+	}
+	return hostPorts, nil
+}
+
+type k8sEndpoints struct {
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+// lookupEndpoints queries the API server of the cluster the frontend runs in
+// using its service account.
+func lookupEndpoints(spec string) ([]string, error) {
+	portName := ""
+	if i := strings.LastIndex(spec, ":"); i >= 0 {
+		spec, portName = spec[:i], spec[i+1:]
+	}
+	parts := strings.Split(spec, "/")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid kubernetes service %q, want <namespace>/<service>", spec)
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" {
+		return nil, fmt.Errorf("not running inside kubernetes")
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("could not read service account token: %v", err)
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("could not read service account CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	hc := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+
+	u := fmt.Sprintf("https://%s/api/v1/namespaces/%s/endpoints/%s", net.JoinHostPort(host, port), parts[0], parts[1])
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not get endpoints %s: %v", spec, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not get endpoints %s: %s", spec, resp.Status)
+	}
+
+	var ep k8sEndpoints
+	if err := json.NewDecoder(resp.Body).Decode(&ep); err != nil {
+		return nil, fmt.Errorf("could not decode endpoints %s: %v", spec, err)
+	}
+
+	var hostPorts []string
+	for _, s := range ep.Subsets {
+		p := 0
+		for _, sp := range s.Ports {
+			if portName == "" || sp.Name == portName {
+				p = sp.Port
+				break
+			}
+		}
+		if p == 0 {
+			continue
+		}
+		for _, a := range s.Addresses {
+			hostPorts = append(hostPorts, net.JoinHostPort(a.IP, strconv.Itoa(p)))
+		}
+	}
+	return hostPorts, nil
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
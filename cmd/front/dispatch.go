@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var dispatchMode string
+var darkflowLoadPath string
+var loadPollInterval time.Duration
+
+const (
+	dispatchRoundRobin  = "round-robin"
+	dispatchLeastLoaded = "least-loaded"
+)
+
+// backendLoad is what a darkflow load endpoint reports. Load is the GPU
+// utilization between 0 and 1.
+type backendLoad struct {
+	Load float64 `json:"load"`
+}
+
+func validateDispatch() error {
+	switch dispatchMode {
+	case dispatchRoundRobin, dispatchLeastLoaded:
+		return nil
+	}
+	return fmt.Errorf("invalid -dispatch %q, want %s or %s", dispatchMode, dispatchRoundRobin, dispatchLeastLoaded)
+}
+
+// leastLoaded returns the index of the backend with the lowest score: its
+// calls in flight plus its reported GPU utilization, so utilization breaks
+// ties and a saturated GPU weighs as much as one more job. Equal scores go
+// round-robin starting at b.next. The caller holds b.mu.
+func (b *backendSet) leastLoaded() int {
+	best, bestScore := -1, 0.0
+	for i := range b.urls {
+		n := (b.next + i) % len(b.urls)
+		u := b.urls[n]
+		score := float64(b.inflight[u]) + b.load[u]
+		if best < 0 || score < bestScore {
+			best, bestScore = n, score
+		}
+	}
+	return best
+}
+
+// setLoad records the utilization last reported by backend; ok false forgets
+// it.
+func (b *backendSet) setLoad(backend string, load float64, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.load == nil {
+		b.load = make(map[string]float64)
+	}
+	if ok {
+		b.load[backend] = load
+	} else {
+		delete(b.load, backend)
+	}
+}
+
+// startLoadPolling polls -darkflow-load-path of every backend each
+// -load-poll-interval for least-loaded dispatch.
+func startLoadPolling() {
+	if dispatchMode != dispatchLeastLoaded || darkflowLoadPath == "" || loadPollInterval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			for _, backend := range backends.list() {
+				load, err := fetchLoad(backend)
+				if err != nil {
+					log.Printf("Could not read load of darkflow at %s: %v", backend, err)
+				}
+				backends.setLoad(backend, load, err == nil)
+			}
+			time.Sleep(loadPollInterval)
+		}
+	}()
+}
+
+func fetchLoad(backend string) (float64, error) {
+	u, err := url.Parse(backend)
+	if err != nil {
+		return 0, err
+	}
+	u.Path = darkflowLoadPath
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	setDarkflowAuth(req)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := darkflowClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("got %s", resp.Status)
+	}
+	var l backendLoad
+	if err := json.NewDecoder(resp.Body).Decode(&l); err != nil {
+		return 0, fmt.Errorf("could not parse load: %v", err)
+	}
+	return l.Load, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var downloadBandwidth int64
+
+// downloads tracks every image download in flight and enforces the
+// aggregate -download-bandwidth cap across all of them.
+var downloads = &downloadManager{active: make(map[*download]bool)}
+
+type downloadManager struct {
+	mu      sync.Mutex
+	active  map[*download]bool
+	limiter *bandwidthLimiter
+}
+
+// download is the progress of a single image download.
+type download struct {
+	bytes int64 // accessed atomically
+
+	Job     string
+	URL     string
+	Total   int64
+	Started time.Time
+}
+
+type downloadStatus struct {
+	Job         string    `json:"job"`
+	URL         string    `json:"url"`
+	Bytes       int64     `json:"bytes"`
+	Total       int64     `json:"total"`
+	StartedAt   time.Time `json:"started_at"`
+	BytesPerSec int64     `json:"bytes_per_second"`
+}
+
+func (m *downloadManager) start(job, url string, total int64) *download {
+	d := &download{Job: job, URL: url, Total: total, Started: time.Now()}
+	m.mu.Lock()
+	m.active[d] = true
+	m.mu.Unlock()
+	return d
+}
+
+func (m *downloadManager) finish(d *download) {
+	m.mu.Lock()
+	delete(m.active, d)
+	m.mu.Unlock()
+}
+
+// reader wraps r so that reads are accounted to d and throttled by the
+// bandwidth cap.
+func (m *downloadManager) reader(d *download, r io.Reader) io.Reader {
+	return &progressReader{r: r, d: d, limiter: m.limiter}
+}
+
+func (m *downloadManager) snapshot() []downloadStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	list := make([]downloadStatus, 0, len(m.active))
+	for d := range m.active {
+		n := atomic.LoadInt64(&d.bytes)
+		s := downloadStatus{
+			Job:       d.Job,
+			URL:       d.URL,
+			Bytes:     n,
+			Total:     d.Total,
+			StartedAt: d.Started.UTC(),
+		}
+		if elapsed := now.Sub(d.Started).Seconds(); elapsed > 0 {
+			s.BytesPerSec = int64(float64(n) / elapsed)
+		}
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+	return list
+}
+
+type progressReader struct {
+	r       io.Reader
+	d       *download
+	limiter *bandwidthLimiter
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	if p.limiter != nil && len(b) > p.limiter.chunk {
+		b = b[:p.limiter.chunk]
+	}
+	n, err := p.r.Read(b)
+	atomic.AddInt64(&p.d.bytes, int64(n))
+	if p.limiter != nil {
+		p.limiter.wait(n)
+	}
+	return n, err
+}
+
+// bandwidthLimiter is a token bucket of bytes shared by all downloads.
+type bandwidthLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+	chunk  int
+}
+
+func newBandwidthLimiter(bytesPerSec int64) *bandwidthLimiter {
+	chunk := 32 << 10
+	if bytesPerSec < int64(chunk) {
+		chunk = int(bytesPerSec)
+	}
+	return &bandwidthLimiter{
+		rate:   float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+		chunk:  chunk,
+	}
+}
+
+// wait charges n bytes to the bucket and sleeps until the bucket is no
+// longer in debt.
+func (l *bandwidthLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	debt := l.tokens
+	l.mu.Unlock()
+
+	if debt < 0 {
+		time.Sleep(time.Duration(-debt / l.rate * float64(time.Second)))
+	}
+}
+
+type downloadsResponse struct {
+	Active       int              `json:"active"`
+	BandwidthCap int64            `json:"bandwidth_cap_bytes_per_second"`
+	Downloads    []downloadStatus `json:"downloads"`
+}
+
+// adminDownloads reports the downloads currently in flight.
+func adminDownloads(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		setupResponse(w)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	list := downloads.snapshot()
+	jsonResponse(w, http.StatusOK, downloadsResponse{
+		Active:       len(list),
+		BandwidthCap: downloadBandwidth,
+		Downloads:    list,
+	})
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fetchProxy is -fetch-proxy, the proxy images are fetched through: an
+// http://, https:// or socks5:// URL, env to follow HTTP_PROXY, HTTPS_PROXY
+// and NO_PROXY, or empty to connect directly. fetchNoProxy lists the hosts,
+// domains and networks fetched from directly anyway. fetchDNS is the DNS
+// server, host:port, the fetcher resolves names with instead of the
+// system's.
+var fetchProxy string
+var fetchNoProxy string
+var fetchDNS string
+
+// fetchProxyEnv is the -fetch-proxy value deferring to the environment.
+const fetchProxyEnv = "env"
+
+// fetchDialer connects to image hosts, through the -fetch-dns resolver and
+// subject to the URL policy; fetchers that do not go through insecureClient
+// dial with it too.
+var fetchDialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: policyDialControl}
+
+// fetchProxies holds the addresses of the proxies the fetcher used, which are
+// dialed without the URL policy. The policy applies to the hosts fetched
+// from through them instead.
+var fetchProxies sync.Map
+
+// noProxyRule is an entry of -fetch-no-proxy: a host, a domain with its
+// subdomains when it starts with a dot, a network, or * for all.
+type noProxyRule struct {
+	host   string
+	domain string
+	net    *net.IPNet
+	all    bool
+}
+
+func parseNoProxy(list string) ([]noProxyRule, error) {
+	var rules []noProxyRule
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			continue
+		case entry == "*":
+			rules = append(rules, noProxyRule{all: true})
+		case strings.Contains(entry, "/"):
+			_, n, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid -fetch-no-proxy network %q: %v", entry, err)
+			}
+			rules = append(rules, noProxyRule{net: n})
+		case strings.HasPrefix(entry, "."):
+			rules = append(rules, noProxyRule{domain: entry})
+		default:
+			rules = append(rules, noProxyRule{host: entry})
+		}
+	}
+	return rules, nil
+}
+
+func (r noProxyRule) matches(host string) bool {
+	switch {
+	case r.all:
+		return true
+	case r.net != nil:
+		ip := net.ParseIP(host)
+		return ip != nil && r.net.Contains(ip)
+	case r.domain != "":
+		return strings.HasSuffix(host, r.domain) || host == r.domain[1:]
+	}
+	return host == r.host
+}
+
+// newFetchClient builds insecureClient, which fetches images over HTTP(S)
+// without verifying certificates, through the -fetch-proxy proxy and the
+// -fetch-dns resolver.
+func newFetchClient() (*http.Client, error) {
+	if fetchDNS != "" {
+		server := fetchDNS
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return nil, fmt.Errorf("invalid -fetch-dns %q, want host[:port]", fetchDNS)
+		}
+		var d net.Dialer
+		fetchDialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	bypass, err := parseNoProxy(fetchNoProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := &http.Transport{
+		DialContext:     dialFetch,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	switch fetchProxy {
+	case "":
+	case fetchProxyEnv:
+		tr.Proxy = fetchProxyFunc(http.ProxyFromEnvironment, bypass)
+	default:
+		u, err := url.Parse(fetchProxy)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid -fetch-proxy %q, want a proxy URL or %s", fetchProxy, fetchProxyEnv)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("invalid -fetch-proxy %q, want an http, https or socks5 URL", fetchProxy)
+		}
+		tr.Proxy = fetchProxyFunc(http.ProxyURL(u), bypass)
+	}
+	return &http.Client{Transport: tr, CheckRedirect: policyCheckRedirect}, nil
+}
+
+// fetchProxyFunc picks the proxy of a request with proxy, unless bypass
+// exempts its host. Since the proxy resolves the names it connects to, the
+// URL policy is checked here against the addresses the fetcher resolves the
+// host to; when the policy restricts networks, hosts it cannot resolve are
+// not fetched.
+func fetchProxyFunc(proxy func(*http.Request) (*url.URL, error), bypass []noProxyRule) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		host := strings.ToLower(req.URL.Hostname())
+		for _, r := range bypass {
+			if r.matches(host) {
+				return nil, nil
+			}
+		}
+		u, err := proxy(req)
+		if u == nil || err != nil {
+			return u, err
+		}
+		if err := checkHostAddrs(req.Context(), host); err != nil {
+			return nil, err
+		}
+		fetchProxies.Store(canonicalProxyAddr(u), true)
+		return u, nil
+	}
+}
+
+// checkHostAddrs applies the network rules of the URL policy to host, whose
+// addresses policyDialControl does not see when it is fetched through a proxy
+// or by -stream-grab-command.
+func checkHostAddrs(ctx context.Context, host string) error {
+	p := policy.get()
+	if !p.DenyPrivate && len(p.denyNets) == 0 {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return p.checkIP(ip)
+	}
+	resolver := fetchDialer.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return withCode(codeURLBlocked, fmt.Errorf("could not resolve %s to apply the url policy: %v", host, err))
+	}
+	for _, a := range addrs {
+		if err := p.checkIP(a.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// canonicalProxyAddr is the host:port the transport dials for proxy u.
+func canonicalProxyAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+// dialFetch connects insecureClient to image hosts with fetchDialer, and to
+// its proxies past the URL policy, which a proxy on a private network
+// would fail.
+func dialFetch(ctx context.Context, network, addr string) (net.Conn, error) {
+	if _, ok := fetchProxies.Load(strings.ToLower(addr)); ok {
+		d := *fetchDialer
+		d.Control = nil
+		return d.DialContext(ctx, network, addr)
+	}
+	return fetchDialer.DialContext(ctx, network, addr)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// v2Envelope is -v2-envelope: /v2 JSON responses are wrapped in a
+// responseEnvelope unless the request asks otherwise with ?envelope=false.
+var v2Envelope bool
+
+// responseEnvelope is the shape of enveloped /v2 responses. Data is what
+// the response would be without the envelope, null for errors. Warnings are
+// the non-fatal issues met serving the request, such as detections dropped
+// by thresholds; Errors the error of a failed request, with index -1,
+// followed by its details, or the inputs a partial job went on without.
+type responseEnvelope struct {
+	Data     interface{}   `json:"data"`
+	Warnings []errorDetail `json:"warnings"`
+	Errors   []errorDetail `json:"errors"`
+}
+
+// wantsEnvelope reports whether the response to the /v2 request r is
+// enveloped: as its envelope parameter says, or -v2-envelope.
+func wantsEnvelope(r *http.Request) bool {
+	if b, err := strconv.ParseBool(r.URL.Query().Get("envelope")); err == nil {
+		return b
+	}
+	return v2Envelope
+}
+
+// envelopeResponseWriter collects the warnings and errors of an enveloped
+// response until jsonResponse or jsonError writes it.
+type envelopeResponseWriter struct {
+	http.ResponseWriter
+	warnings []errorDetail
+	errors   []errorDetail
+}
+
+// ReadFrom passes io.Copy through so that files are still served with
+// sendfile.
+func (w *envelopeResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(w.ResponseWriter, r)
+}
+
+func (w *envelopeResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *envelopeResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// envelopeOf returns the envelope of the response w writes, nil when it is
+// not enveloped.
+func envelopeOf(w http.ResponseWriter) *envelopeResponseWriter {
+	for {
+		switch v := w.(type) {
+		case *envelopeResponseWriter:
+			return v
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// wrap puts data in the envelope.
+func (w *envelopeResponseWriter) wrap(data interface{}) responseEnvelope {
+	env := responseEnvelope{Data: data, Warnings: w.warnings, Errors: w.errors}
+	if env.Warnings == nil {
+		env.Warnings = []errorDetail{}
+	}
+	if env.Errors == nil {
+		env.Errors = []errorDetail{}
+	}
+	return env
+}
+
+// envelopeJob adds the warnings of j, and the inputs it went on without as
+// errors, to the envelope of w if the response is enveloped.
+func envelopeJob(w http.ResponseWriter, j *job) {
+	e := envelopeOf(w)
+	if e == nil {
+		return
+	}
+	e.warnings = append(e.warnings, j.Warnings...)
+	e.warnings = append(e.warnings, j.Discrepancies...)
+	e.errors = append(e.errors, j.Skipped...)
+}
+
+// metadataWarnings warns of the JPEG inputs of j that carry no Exif data,
+// as far as -input-metadata read them.
+func metadataWarnings(j *job) []errorDetail {
+	var warnings []errorDetail
+	for i, m := range j.InputMetadata {
+		if m != nil && m.Format == "jpeg" && !m.hasExif() {
+			warnings = append(warnings, errorDetail{Index: i, Input: j.inputName(i), Code: codeExifMissing, Message: "image has no Exif data"})
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// frontendVersion is the version of this build, set with
+// -ldflags "-X main.frontendVersion=v1.2.3"; builds without it report the
+// module version or VCS revision they were built from.
+var frontendVersion string
+
+// nodeName is -node-name, the name of this process in job environments.
+var nodeName string
+
+// configHash identifies the flags the process was started with.
+var configHash string
+
+// Headers darkflow may answer a recognize call with to name the model it
+// ran, which can be its default, and the version of that model.
+const (
+	darkflowModelHeader        = "X-Darkflow-Model"
+	darkflowModelVersionHeader = "X-Darkflow-Model-Version"
+)
+
+// secretFlagWords mark the flags kept out of configHash, whose values are
+// credentials.
+var secretFlagWords = []string{"secret", "token", "key", "password"}
+
+// jobEnvironment is what a job ran on, so that its results can be
+// reproduced and regressions traced to a rollout.
+type jobEnvironment struct {
+	Frontend   string `json:"frontend"`
+	ConfigHash string `json:"config_hash"`
+	Node       string `json:"node"`
+	// Backend is the darkflow the job was sent to and BackendVersion the
+	// version it reported, if -darkflow-version-path is set.
+	Backend        string `json:"backend,omitempty"`
+	BackendVersion string `json:"backend_version,omitempty"`
+	// Model is the model darkflow ran, the one requested unless darkflow
+	// named it, and ModelVersion its version where darkflow tells.
+	Model        string `json:"model,omitempty"`
+	ModelVersion string `json:"model_version,omitempty"`
+}
+
+func setupEnvironment() error {
+	if frontendVersion == "" {
+		frontendVersion = buildVersion()
+	}
+	if nodeName == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("could not get hostname for -node-name: %v", err)
+		}
+		nodeName = host
+	}
+	configHash = hashFlags()
+	return nil
+}
+
+// buildVersion is the module version of the build or, for builds from a
+// checkout, its VCS revision.
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	var revision, modified string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value
+		}
+	}
+	if revision == "" {
+		return "devel"
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified == "true" {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+// hashFlags hashes the values of every flag but the secret ones.
+func hashFlags() string {
+	var lines []string
+	flag.VisitAll(func(f *flag.Flag) {
+		for _, w := range secretFlagWords {
+			if strings.Contains(f.Name, w) {
+				return
+			}
+		}
+		lines = append(lines, f.Name+"="+f.Value.String())
+	})
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// newEnvironment is the environment of a job about to run in this process.
+func newEnvironment(model string) *jobEnvironment {
+	return &jobEnvironment{Frontend: frontendVersion, ConfigHash: configHash, Node: nodeName, Model: model}
+}
+
+// recordBackend notes backend as the darkflow the job is sent to.
+func (e *jobEnvironment) recordBackend(backend string) {
+	if e == nil {
+		return
+	}
+	e.Backend = backend
+	if u, err := url.Parse(backend); err == nil {
+		e.Backend = u.Redacted()
+	}
+	if darkflowVersionPath != "" {
+		e.BackendVersion = versions.get(backend)
+	}
+}
+
+// recordResponse notes the model darkflow says it ran in its response.
+func (e *jobEnvironment) recordResponse(h http.Header) {
+	if e == nil {
+		return
+	}
+	e.recordModel(h.Get(darkflowModelHeader), h.Get(darkflowModelVersionHeader))
+}
+
+// recordModel notes model, if darkflow named one, and its version.
+func (e *jobEnvironment) recordModel(model, version string) {
+	if e == nil {
+		return
+	}
+	if model != "" {
+		e.Model = model
+	}
+	e.ModelVersion = version
+}
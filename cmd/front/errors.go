@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// Error codes sent in the "code" field of error responses. Clients branch on
+// these; messages are for humans and may change.
+const (
+	codeInvalidRequest     = "INVALID_REQUEST"
+	codeBodyTooLarge       = "BODY_TOO_LARGE"
+	codeUnauthorized       = "UNAUTHORIZED"
+	codeForbidden          = "FORBIDDEN"
+	codeNotFound           = "NOT_FOUND"
+	codeGone               = "GONE"
+	codeConflict           = "CONFLICT"
+	codeRateLimited        = "RATE_LIMITED"
+	codeQueueFull          = "QUEUE_FULL"
+	codeMaintenance        = "MAINTENANCE"
+	codeQuotaExceeded      = "QUOTA_EXCEEDED"
+	codeURLBlocked         = "URL_BLOCKED"
+	codeDownloadFailed     = "DOWNLOAD_FAILED"
+	codeSourceCooldown     = "SOURCE_COOLDOWN"
+	codeInvalidImage       = "INVALID_IMAGE"
+	codeUnsupportedFormat  = "UNSUPPORTED_FORMAT"
+	codeChecksumMismatch   = "CHECKSUM_MISMATCH"
+	codeBackendUnavailable = "BACKEND_UNAVAILABLE"
+	codeBackendError       = "BACKEND_ERROR"
+	codeDownloadTimeout    = "DOWNLOAD_TIMEOUT"
+	codeBackendTimeout     = "BACKEND_TIMEOUT"
+	codeRequestTimeout     = "REQUEST_TIMEOUT"
+	codeCancelled          = "CANCELLED"
+	codeClientDisconnected = "CLIENT_DISCONNECTED"
+	codeInterrupted        = "INTERRUPTED"
+	codeInternal           = "INTERNAL"
+)
+
+// Warning codes of the non-fatal issues of a job, in its record and the
+// warnings of enveloped /v2 responses.
+const (
+	codeExifMissing       = "EXIF_MISSING"
+	codeDetectionsDropped = "DETECTIONS_DROPPED"
+)
+
+// errorDetail describes the failure of a single item, such as one image of a
+// batch.
+type errorDetail struct {
+	Index   int    `json:"index"`
+	Input   string `json:"input,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiError is an error with a machine-readable code and optional per-item
+// details.
+type apiError struct {
+	code    string
+	err     error
+	details []errorDetail
+}
+
+func (e *apiError) Error() string {
+	return e.err.Error()
+}
+
+func (e *apiError) Unwrap() error {
+	return e.err
+}
+
+// withCode attaches code to err. A nil err stays nil.
+func withCode(code string, err error, details ...errorDetail) error {
+	if err == nil {
+		return nil
+	}
+	return &apiError{code: code, err: err, details: details}
+}
+
+// errorBody is the JSON body of every error response. Reason repeats the
+// message for clients written against the original free-text responses.
+type errorBody struct {
+	Code    string        `json:"code"`
+	Message string        `json:"message"`
+	Details []errorDetail `json:"details,omitempty"`
+	// Queue describes the darkflow queue when it was too full to take the
+	// request.
+	Queue *queueStatus `json:"queue,omitempty"`
+	// Maintenance describes the maintenance window that turned the
+	// request away.
+	Maintenance *maintenanceStatus `json:"maintenance,omitempty"`
+	Reason      string             `json:"reason"`
+}
+
+func newErrorBody(status int, err error) errorBody {
+	code, details := errorCode(err, status)
+	body := errorBody{Code: code, Message: err.Error(), Details: details, Reason: err.Error()}
+	var qe *queueFullError
+	if errors.As(err, &qe) {
+		body.Queue = &qe.status
+	}
+	var me *maintenanceError
+	if errors.As(err, &me) {
+		body.Maintenance = &me.status
+	}
+	return body
+}
+
+// setRetryAfter advertises when a request turned away for lack of capacity,
+// or during maintenance, may be retried.
+func setRetryAfter(w http.ResponseWriter, err error) {
+	var qe *queueFullError
+	if errors.As(err, &qe) {
+		w.Header().Set("Retry-After", strconv.Itoa(qe.retryAfter()))
+	}
+	var me *maintenanceError
+	if errors.As(err, &me) {
+		w.Header().Set("Retry-After", strconv.Itoa(me.retryAfter()))
+	}
+}
+
+// codeOr returns the code attached to err, or fallback when it has none.
+func codeOr(err error, fallback string) string {
+	var e *apiError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return fallback
+}
+
+// errorCode returns the code and details attached to err, falling back to a
+// code derived from the response status.
+func errorCode(err error, status int) (string, []errorDetail) {
+	var e *apiError
+	if errors.As(err, &e) {
+		return e.code, e.details
+	}
+	switch status {
+	case http.StatusBadRequest:
+		return codeInvalidRequest, nil
+	case http.StatusRequestEntityTooLarge:
+		return codeBodyTooLarge, nil
+	case http.StatusUnauthorized:
+		return codeUnauthorized, nil
+	case http.StatusForbidden:
+		return codeForbidden, nil
+	case http.StatusNotFound:
+		return codeNotFound, nil
+	case http.StatusGone:
+		return codeGone, nil
+	case http.StatusConflict:
+		return codeConflict, nil
+	case http.StatusTooManyRequests:
+		return codeRateLimited, nil
+	case http.StatusGatewayTimeout:
+		return codeRequestTimeout, nil
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return codeBackendUnavailable, nil
+	}
+	return codeInternal, nil
+}
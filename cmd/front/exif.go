@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var fixOrientation bool
+
+const exifOrientationTag = 0x0112
+
+// exifSegment returns the TIFF payload of a JPEG's APP1 Exif segment, or nil
+// if data is not a JPEG or has no Exif segment.
+func exifSegment(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return nil
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// Start of scan or end of image: no more metadata.
+			return nil
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if size < 2 || i+2+size > len(data) {
+			return nil
+		}
+		seg := data[i+4 : i+2+size]
+		if marker == 0xE1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return seg[6:]
+		}
+		i += 2 + size
+	}
+	return nil
+}
+
+// tiffReader reads IFD entries of a TIFF structure such as an Exif payload.
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func newTIFFReader(data []byte) (*tiffReader, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("tiff header too short")
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid tiff byte order")
+	}
+	if order.Uint16(data[2:]) != 42 {
+		return nil, fmt.Errorf("invalid tiff magic")
+	}
+	return &tiffReader{data: data, order: order}, nil
+}
+
+// firstIFD returns the offset of IFD0.
+func (t *tiffReader) firstIFD() int {
+	return int(t.order.Uint32(t.data[4:]))
+}
+
+// tiffEntry is a raw IFD entry; value holds the 4 byte value/offset field.
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// entries returns the entries of the IFD at offset.
+func (t *tiffReader) entries(offset int) ([]tiffEntry, error) {
+	if offset < 8 || offset+2 > len(t.data) {
+		return nil, fmt.Errorf("ifd offset out of range")
+	}
+	n := int(t.order.Uint16(t.data[offset:]))
+	if offset+2+12*n > len(t.data) {
+		return nil, fmt.Errorf("ifd truncated")
+	}
+	list := make([]tiffEntry, n)
+	for i := range list {
+		e := t.data[offset+2+12*i:]
+		list[i] = tiffEntry{
+			tag:   t.order.Uint16(e),
+			typ:   t.order.Uint16(e[2:]),
+			count: t.order.Uint32(e[4:]),
+			value: e[8:12],
+		}
+	}
+	return list, nil
+}
+
+// uint returns the first SHORT or LONG value of e.
+func (t *tiffReader) uint(e tiffEntry) uint32 {
+	if e.typ == 3 {
+		return uint32(t.order.Uint16(e.value))
+	}
+	return t.order.Uint32(e.value)
+}
+
+// tiffTypeSizes are the sizes in bytes of the TIFF field types, by type.
+var tiffTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+// bytes returns the raw values of e, which are stored in the entry itself
+// when they fit in 4 bytes and at an offset otherwise, or nil if they lie
+// outside the data.
+func (t *tiffReader) bytes(e tiffEntry) []byte {
+	size := tiffTypeSizes[e.typ] * int(e.count)
+	if size <= 4 {
+		return e.value[:size]
+	}
+	offset := int(t.order.Uint32(e.value))
+	if offset < 0 || offset+size > len(t.data) {
+		return nil
+	}
+	return t.data[offset : offset+size]
+}
+
+// ascii returns the ASCII value of e without its terminating NULs.
+func (t *tiffReader) ascii(e tiffEntry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(t.bytes(e)), "\x00"))
+}
+
+// rationals returns the RATIONAL values of e.
+func (t *tiffReader) rationals(e tiffEntry) []float64 {
+	b := t.bytes(e)
+	if e.typ != 5 || b == nil {
+		return nil
+	}
+	list := make([]float64, e.count)
+	for i := range list {
+		num, den := t.order.Uint32(b[8*i:]), t.order.Uint32(b[8*i+4:])
+		if den == 0 {
+			return nil
+		}
+		list[i] = float64(num) / float64(den)
+	}
+	return list
+}
+
+// jpegOrientation returns the Exif orientation (1-8) of a JPEG, or 1 when
+// it has none.
+func jpegOrientation(data []byte) int {
+	tr, err := newTIFFReader(exifSegment(data))
+	if err != nil {
+		return 1
+	}
+	entries, err := tr.entries(tr.firstIFD())
+	if err != nil {
+		return 1
+	}
+	for _, e := range entries {
+		if e.tag == exifOrientationTag {
+			if o := int(tr.uint(e)); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+	}
+	return 1
+}
+
+// fixJPEGOrientation rewrites the JPEG at file upright according to its Exif
+// orientation. Other formats and upright JPEGs are left untouched.
+func fixJPEGOrientation(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	upright, err := uprightJPEG(data, file)
+	if err != nil || upright == nil {
+		return err
+	}
+	return ioutil.WriteFile(file, upright, os.FileMode(0644))
+}
+
+// uprightJPEG re-encodes the image data, named name in errors, upright
+// according to its Exif orientation. It returns nil for other formats and
+// upright JPEGs.
+func uprightJPEG(data []byte, name string) ([]byte, error) {
+	o := jpegOrientation(data)
+	if o == 1 {
+		return nil, nil
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, withCode(codeInvalidImage, fmt.Errorf("could not decode %s: %v", name, err))
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, orient(img, o), &jpeg.Options{Quality: 95}); err != nil {
+		return nil, fmt.Errorf("could not encode %s: %v", name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// orient applies the transformation that makes an image with Exif
+// orientation o upright.
+func orient(src image.Image, o int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for sy := 0; sy < h; sy++ {
+		for sx := 0; sx < w; sx++ {
+			var dx, dy int
+			switch o {
+			case 2:
+				dx, dy = w-1-sx, sy
+			case 3:
+				dx, dy = w-1-sx, h-1-sy
+			case 4:
+				dx, dy = sx, h-1-sy
+			case 5:
+				dx, dy = sy, sx
+			case 6:
+				dx, dy = h-1-sy, sx
+			case 7:
+				dx, dy = h-1-sy, w-1-sx
+			case 8:
+				dx, dy = sy, w-1-sx
+			default:
+				dx, dy = sx, sy
+			}
+			dst.Set(dx, dy, src.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testOrder is a byte order building TIFF data can append with.
+type testOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// testEntry is an IFD entry of buildTIFF. Its data is stored inline or
+// after the IFDs; with ifd set, it is a LONG pointing at that IFD instead.
+type testEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+	ifd   int
+}
+
+// buildTIFF lays out ifds one after the other from offset 8, IFD0 first,
+// followed by the entry data too long to be inline.
+func buildTIFF(order testOrder, ifds ...[]testEntry) []byte {
+	offsets := make([]int, len(ifds))
+	end := 8
+	for i, ifd := range ifds {
+		offsets[i] = end
+		end += 2 + 12*len(ifd) + 4
+	}
+	var b []byte
+	if order == binary.LittleEndian {
+		b = append(b, "II"...)
+	} else {
+		b = append(b, "MM"...)
+	}
+	b = order.AppendUint16(b, 42)
+	b = order.AppendUint32(b, 8)
+	var extra []byte
+	for _, ifd := range ifds {
+		b = order.AppendUint16(b, uint16(len(ifd)))
+		for _, e := range ifd {
+			b = order.AppendUint16(b, e.tag)
+			typ, count, data := e.typ, e.count, e.data
+			if e.ifd > 0 {
+				typ, count, data = 4, 1, order.AppendUint32(nil, uint32(offsets[e.ifd]))
+			}
+			b = order.AppendUint16(b, typ)
+			b = order.AppendUint32(b, count)
+			if len(data) <= 4 {
+				b = append(b, append(data, make([]byte, 4-len(data))...)...)
+				continue
+			}
+			b = order.AppendUint32(b, uint32(end+len(extra)))
+			extra = append(extra, data...)
+		}
+		b = order.AppendUint32(b, 0)
+	}
+	return append(b, extra...)
+}
+
+// jpegWithExif wraps a TIFF payload into the APP1 segment of a JPEG header.
+func jpegWithExif(tiff []byte) []byte {
+	seg := append([]byte("Exif\x00\x00"), tiff...)
+	b := []byte{0xFF, 0xD8, 0xFF, 0xE1}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(seg)+2))
+	b = append(b, seg...)
+	return append(b, 0xFF, 0xDA, 0, 2, 0xFF, 0xD9)
+}
+
+func orientationTIFF(order testOrder, o uint16) []byte {
+	return buildTIFF(order, []testEntry{{tag: exifOrientationTag, typ: 3, count: 1, data: order.AppendUint16(nil, o)}})
+}
+
+func TestExifSegment(t *testing.T) {
+	tiff := orientationTIFF(binary.BigEndian, 6)
+	app0 := []byte{0xFF, 0xD8, 0xFF, 0xE0, 0, 4, 'J', 'F'}
+	tt := []struct {
+		name string
+		data []byte
+		want []byte
+	}{
+		{name: "empty"},
+		{name: "not a jpeg", data: []byte("\x89PNG\r\n\x1a\n")},
+		{name: "soi only", data: []byte{0xFF, 0xD8}},
+		{name: "exif", data: jpegWithExif(tiff), want: tiff},
+		{name: "after app0", data: append(app0, jpegWithExif(tiff)[2:]...), want: tiff},
+		{name: "segment past the end", data: jpegWithExif(tiff)[:20]},
+		{name: "segment size below 2", data: []byte{0xFF, 0xD8, 0xFF, 0xE1, 0, 1, 0, 0}},
+		{name: "no marker", data: []byte{0xFF, 0xD8, 0x00, 0xE1, 0, 8, 'E', 'x', 'i', 'f', 0, 0}},
+		{name: "scan before exif", data: append([]byte{0xFF, 0xD8, 0xFF, 0xDA, 0, 2}, jpegWithExif(tiff)[2:]...)},
+		{name: "app1 without exif header", data: []byte{0xFF, 0xD8, 0xFF, 0xE1, 0, 6, 'h', 't', 't', 'p'}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := exifSegment(tc.data); !bytes.Equal(got, tc.want) {
+				t.Errorf("exifSegment() = %x, want %x", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewTIFFReader(t *testing.T) {
+	tt := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{name: "empty", wantErr: true},
+		{name: "short header", data: []byte("II*\x00\x08\x00"), wantErr: true},
+		{name: "bad byte order", data: []byte("IM*\x00\x08\x00\x00\x00"), wantErr: true},
+		{name: "bad magic", data: []byte("II+\x00\x08\x00\x00\x00"), wantErr: true},
+		{name: "magic of the other order", data: []byte("MM*\x00\x00\x00\x00\x08"), wantErr: true},
+		{name: "little endian", data: []byte("II*\x00\x08\x00\x00\x00")},
+		{name: "big endian", data: []byte("MM\x00*\x00\x00\x00\x08")},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newTIFFReader(tc.data)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("newTIFFReader() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestTIFFEntries(t *testing.T) {
+	valid := orientationTIFF(binary.LittleEndian, 3)
+	tt := []struct {
+		name    string
+		data    []byte
+		offset  int
+		want    int
+		wantErr bool
+	}{
+		{name: "valid", data: valid, offset: 8, want: 1},
+		{name: "offset inside the header", data: valid, offset: 4, wantErr: true},
+		{name: "negative offset", data: valid, offset: -2, wantErr: true},
+		{name: "offset past the end", data: valid, offset: len(valid), wantErr: true},
+		{name: "offset on the last byte", data: valid, offset: len(valid) - 1, wantErr: true},
+		{name: "truncated entries", data: valid[:8+2+6], offset: 8, wantErr: true},
+		{name: "count past the end", data: append([]byte("II*\x00\x08\x00\x00\x00"), 0xFF, 0xFF), offset: 8, wantErr: true},
+		{name: "no entries", data: append([]byte("II*\x00\x08\x00\x00\x00"), 0, 0), offset: 8},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			tr, err := newTIFFReader(tc.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := tr.entries(tc.offset)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("entries() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if len(entries) != tc.want {
+				t.Errorf("entries() = %d entries, want %d", len(entries), tc.want)
+			}
+		})
+	}
+}
+
+func TestTIFFValues(t *testing.T) {
+	var order testOrder = binary.BigEndian
+	rational := func(num, den uint32) []byte { return order.AppendUint32(order.AppendUint32(nil, num), den) }
+	data := buildTIFF(order, []testEntry{
+		{tag: 1, typ: 2, count: 4, data: []byte("ab\x00\x00")},
+		{tag: 2, typ: 2, count: 8, data: []byte(" Canon\x00\x00")},
+		{tag: 3, typ: 5, count: 2, data: append(rational(1, 2), rational(3, 4)...)},
+		{tag: 4, typ: 5, count: 1, data: rational(1, 0)},
+	})
+	tr, err := newTIFFReader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := tr.entries(tr.firstIFD())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tr.ascii(entries[0]); got != "ab" {
+		t.Errorf("inline ascii = %q, want %q", got, "ab")
+	}
+	if got := tr.ascii(entries[1]); got != "Canon" {
+		t.Errorf("ascii = %q, want %q", got, "Canon")
+	}
+	if got := tr.ascii(entries[2]); got != "" {
+		t.Errorf("ascii of rationals = %q, want empty", got)
+	}
+	if got := tr.rationals(entries[2]); len(got) != 2 || got[0] != 0.5 || got[1] != 0.75 {
+		t.Errorf("rationals = %v, want [0.5 0.75]", got)
+	}
+	if got := tr.rationals(entries[3]); got != nil {
+		t.Errorf("rationals with a zero denominator = %v, want nil", got)
+	}
+	if got := tr.rationals(entries[0]); got != nil {
+		t.Errorf("rationals of ascii = %v, want nil", got)
+	}
+
+	malformed := []struct {
+		name  string
+		entry tiffEntry
+	}{
+		{name: "offset past the end", entry: tiffEntry{typ: 5, count: 1, value: order.AppendUint32(nil, uint32(len(data)))}},
+		{name: "size past the end", entry: tiffEntry{typ: 5, count: 2, value: order.AppendUint32(nil, uint32(len(data)-8))}},
+		{name: "huge count", entry: tiffEntry{typ: 5, count: 0xFFFFFFFF, value: order.AppendUint32(nil, 8)}},
+		{name: "huge offset", entry: tiffEntry{typ: 2, count: 16, value: order.AppendUint32(nil, 0xFFFFFFF0)}},
+	}
+	for _, tc := range malformed {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tr.bytes(tc.entry); got != nil {
+				t.Errorf("bytes() = %x, want nil", got)
+			}
+			if got := tr.rationals(tc.entry); got != nil {
+				t.Errorf("rationals() = %v, want nil", got)
+			}
+			if got := tr.ascii(tc.entry); got != "" {
+				t.Errorf("ascii() = %q, want empty", got)
+			}
+		})
+	}
+	if got := tr.bytes(tiffEntry{typ: 0xFF, count: 100, value: make([]byte, 4)}); len(got) != 0 {
+		t.Errorf("bytes() of an unknown type = %x, want none", got)
+	}
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	tt := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{name: "not a jpeg", data: []byte("GIF89a"), want: 1},
+		{name: "no exif", data: []byte{0xFF, 0xD8, 0xFF, 0xD9}, want: 1},
+		{name: "big endian", data: jpegWithExif(orientationTIFF(binary.BigEndian, 6)), want: 6},
+		{name: "little endian", data: jpegWithExif(orientationTIFF(binary.LittleEndian, 8)), want: 8},
+		{name: "out of range", data: jpegWithExif(orientationTIFF(binary.BigEndian, 9)), want: 1},
+		{name: "zero", data: jpegWithExif(orientationTIFF(binary.BigEndian, 0)), want: 1},
+		{name: "ifd0 past the end", data: jpegWithExif([]byte("MM\x00*\x00\x00\xFF\xFF")), want: 1},
+		{name: "truncated ifd", data: jpegWithExif(orientationTIFF(binary.BigEndian, 6)[:14]), want: 1},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := jpegOrientation(tc.data); got != tc.want {
+				t.Errorf("jpegOrientation() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var exportDestinations stringList
+var exportTimeout time.Duration
+
+// exportAttempts is how many times an export to one destination is tried
+// before it is given up.
+const exportAttempts = 3
+
+// exportFile is one file of an exported job. Rel is its path under the
+// job's prefix at the destination; the content is in the file at Local or,
+// for the job record, in Data.
+type exportFile struct {
+	Rel   string
+	Local string
+	Data  []byte
+}
+
+func (f exportFile) read() ([]byte, error) {
+	if f.Local == "" {
+		return f.Data, nil
+	}
+	return ioutil.ReadFile(f.Local)
+}
+
+// exporter copies the files of finished jobs to one destination.
+type exporter interface {
+	name() string
+	export(ctx context.Context, prefix string, files []exportFile) error
+}
+
+// exporters are the destinations of -export.
+var exporters []exporter
+
+// setupExporters builds the destinations of -export: s3://bucket/prefix,
+// sftp://[user@]host[:port]/path or an http(s):// URL files are PUT under.
+func setupExporters() error {
+	for _, raw := range exportDestinations {
+		e, err := newExporter("-export", raw)
+		if err != nil {
+			return err
+		}
+		exporters = append(exporters, e)
+	}
+	return nil
+}
+
+// newExporter builds the destination raw of the flag name.
+func newExporter(name, raw string) (exporter, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %v", name, raw, err)
+	}
+	switch u.Scheme {
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid %s %q, want s3://bucket/prefix", name, raw)
+		}
+		if _, err := awsCredentialsFromEnv(); err != nil {
+			return nil, fmt.Errorf("%s %s: %v", name, raw, err)
+		}
+		return s3Exporter{bucket: u.Host, prefix: strings.Trim(u.Path, "/")}, nil
+	case "sftp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid %s %q, want sftp://[user@]host[:port]/path", name, raw)
+		}
+		if _, err := exec.LookPath("sftp"); err != nil {
+			return nil, fmt.Errorf("%s %s needs the sftp command: %v", name, raw, err)
+		}
+		return sftpExporter{url: u}, nil
+	case "http", "https":
+		return httpExporter{base: strings.TrimSuffix(raw, "/")}, nil
+	default:
+		return nil, fmt.Errorf("invalid %s %q: unsupported scheme %q", name, raw, u.Scheme)
+	}
+}
+
+// exportJob copies the outputs and the record of finished job j to every
+// -export destination in the background, under <tenant>/<job id>/, or
+// <job id>/ without tenants. Failures are logged and notified.
+func exportJob(t *tenant, j *job) {
+	if len(exporters) == 0 || j.Status != jobDone || j.DryRun {
+		return
+	}
+	record, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		log.Printf("Could not encode job %s to export: %v", j.ID, err)
+		return
+	}
+	files := []exportFile{{Rel: "job.json", Data: record}}
+	files, err = appendDirFiles(files, j.finalOutputPath(t), "")
+	if err != nil {
+		log.Printf("Could not list outputs of job %s to export: %v", j.ID, err)
+		return
+	}
+	prefix := exportPrefix(t, j)
+	for _, e := range exporters {
+		go func(e exporter) {
+			if err := exportWithRetries(e, prefix, files); err != nil {
+				log.Printf("Could not export job %s to %s: %v", j.ID, e.name(), err)
+				notify(eventExportFailed, "Export of job "+j.ID+" failed", "Job %s of tenant %q could not be exported to %s: %v", j.ID, t.Name, e.name(), err)
+				return
+			}
+			log.Printf("Exported %d files of job %s to %s", len(files), j.ID, e.name())
+		}(e)
+	}
+}
+
+// appendDirFiles appends the files under root to files, at their path
+// under root prefixed with under. A missing root has no files.
+func appendDirFiles(files []exportFile, root, under string) ([]exportFile, error) {
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, exportFile{Rel: path.Join(under, filepath.ToSlash(rel)), Local: p})
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return files, nil
+}
+
+// exportPrefix is where the files of j go at a destination:
+// <tenant>/<job id>, or <job id> without tenants.
+func exportPrefix(t *tenant, j *job) string {
+	if t.Name != "" {
+		return t.Name + "/" + j.ID
+	}
+	return j.ID
+}
+
+// exportWithRetries exports files to e under prefix, trying up to
+// exportAttempts times with -export-timeout each.
+func exportWithRetries(e exporter, prefix string, files []exportFile) error {
+	var err error
+	for attempt := 1; attempt <= exportAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		err = e.export(ctx, prefix, files)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt < exportAttempts {
+			time.Sleep(time.Duration(attempt) * 10 * time.Second)
+		}
+	}
+	return err
+}
+
+func contentTypeOf(name string) string {
+	if ct := mime.TypeByExtension(path.Ext(name)); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
+// s3Exporter puts the files as objects under a prefix of a bucket, with the
+// AWS_* environment credentials.
+type s3Exporter struct {
+	bucket string
+	prefix string
+}
+
+func (e s3Exporter) name() string { return "s3://" + path.Join(e.bucket, e.prefix) }
+
+func (e s3Exporter) export(ctx context.Context, prefix string, files []exportFile) error {
+	creds, err := awsCredentialsFromEnv()
+	if err != nil {
+		return err
+	}
+	region := awsRegion()
+	for _, f := range files {
+		data, err := f.read()
+		if err != nil {
+			return err
+		}
+		key := path.Join(e.prefix, prefix, f.Rel)
+		req, err := http.NewRequest(http.MethodPut, s3ObjectURL(e.bucket, key, region), bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", contentTypeOf(f.Rel))
+		signAWSv4(req, data, "s3", region, creds)
+		if err := doExport(ctx, req); err != nil {
+			return fmt.Errorf("could not put %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// httpExporter PUTs every file at <base>/<prefix>/<file>. Credentials in the
+// URL are sent as basic auth.
+type httpExporter struct {
+	base string
+}
+
+func (e httpExporter) name() string {
+	if u, err := url.Parse(e.base); err == nil {
+		return u.Redacted()
+	}
+	return e.base
+}
+
+func (e httpExporter) export(ctx context.Context, prefix string, files []exportFile) error {
+	for _, f := range files {
+		data, err := f.read()
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest(http.MethodPut, e.base+"/"+awsEscape(path.Join(prefix, f.Rel), false), bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", contentTypeOf(f.Rel))
+		if err := doExport(ctx, req); err != nil {
+			return fmt.Errorf("could not put %s: %v", f.Rel, err)
+		}
+	}
+	return nil
+}
+
+func doExport(ctx context.Context, req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("got %s", resp.Status)
+	}
+	return nil
+}
+
+// sftpExporter uploads with the sftp command in batch mode, so it
+// authenticates with the keys and known hosts of the user the frontend runs
+// as.
+type sftpExporter struct {
+	url *url.URL
+}
+
+func (e sftpExporter) name() string { return e.url.Redacted() }
+
+func (e sftpExporter) export(ctx context.Context, prefix string, files []exportFile) error {
+	tmp, err := ioutil.TempDir("", "export")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	var batch bytes.Buffer
+	dirs := map[string]bool{}
+	root := path.Join(e.url.Path, prefix)
+	for _, f := range files {
+		// Every parent is created; "-" has sftp go on when it exists.
+		for dir := path.Dir(path.Join(root, f.Rel)); !dirs[dir] && dir != "/" && dir != "."; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+		local := f.Local
+		if local == "" {
+			local = filepath.Join(tmp, path.Base(f.Rel))
+			if err := ioutil.WriteFile(local, f.Data, 0644); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(&batch, "put %s %s\n", sftpQuote(local), sftpQuote(path.Join(root, f.Rel)))
+	}
+	var mkdirs bytes.Buffer
+	for _, dir := range sortedDirs(dirs) {
+		fmt.Fprintf(&mkdirs, "-mkdir %s\n", sftpQuote(dir))
+	}
+
+	dest := e.url.Host
+	args := []string{"-b", "-", "-o", "BatchMode=yes"}
+	if port := e.url.Port(); port != "" {
+		args = append(args, "-P", port)
+		dest = e.url.Hostname()
+	}
+	if e.url.User != nil {
+		dest = e.url.User.Username() + "@" + dest
+	}
+	cmd := exec.CommandContext(ctx, "sftp", append(args, dest)...)
+	cmd.Stdin = io.MultiReader(&mkdirs, &batch)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// sortedDirs lists dirs parents first.
+func sortedDirs(dirs map[string]bool) []string {
+	list := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		list = append(list, dir)
+	}
+	sort.Slice(list, func(a, b int) bool {
+		return len(list[a]) < len(list[b]) || len(list[a]) == len(list[b]) && list[a] < list[b]
+	})
+	return list
+}
+
+func sftpQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
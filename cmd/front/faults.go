@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// faultInjection enables the X-Inject-Faults request header, which makes
+// the request fail in controlled ways so that the error handling of API
+// clients can be tested deterministically. It must not be set in
+// production: anyone may send the header.
+var faultInjection bool
+
+// faults are the failures a request asked for with X-Inject-Faults, e.g.
+// "download-delay=2s; darkflow-status=500; drop-outputs=0,2".
+type faults struct {
+	// downloadDelay stalls every image download, within -download-timeout.
+	downloadDelay time.Duration
+	// darkflowStatus answers the darkflow call with the status instead of
+	// sending it.
+	darkflowStatus int
+	// dropOutputs are the indexes of the inputs whose outputs are removed
+	// once darkflow returned, as if it had left them out.
+	dropOutputs []int
+}
+
+type faultsKey struct{}
+
+func parseFaults(value string) (*faults, error) {
+	f := &faults{}
+	for _, directive := range strings.Split(value, ";") {
+		directive = strings.TrimSpace(directive)
+		if directive == "" {
+			continue
+		}
+		name, arg, _ := strings.Cut(directive, "=")
+		switch strings.TrimSpace(name) {
+		case "download-delay":
+			d, err := time.ParseDuration(strings.TrimSpace(arg))
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid download-delay %q", arg)
+			}
+			f.downloadDelay = d
+		case "darkflow-status":
+			status, err := strconv.Atoi(strings.TrimSpace(arg))
+			if err != nil || status < 400 || status > 599 {
+				return nil, fmt.Errorf("invalid darkflow-status %q, want 400 to 599", arg)
+			}
+			f.darkflowStatus = status
+		case "drop-outputs":
+			for _, s := range strings.Split(arg, ",") {
+				index, err := strconv.Atoi(strings.TrimSpace(s))
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("invalid drop-outputs index %q", s)
+				}
+				f.dropOutputs = append(f.dropOutputs, index)
+			}
+		default:
+			return nil, fmt.Errorf("unknown fault %q", name)
+		}
+	}
+	return f, nil
+}
+
+// injectFaults attaches the faults of X-Inject-Faults to the request
+// context, where the jobs started by the request find them. The header is
+// ignored unless -fault-injection is set.
+func injectFaults(h http.Handler) http.Handler {
+	if !faultInjection {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get("X-Inject-Faults")
+		if value == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		f, err := parseFaults(value)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid X-Inject-Faults: %v", err))
+			return
+		}
+		log.Printf("Injecting faults into %s %s: %s", r.Method, r.URL.Path, value)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), faultsKey{}, f)))
+	})
+}
+
+// faultsOf returns the faults injected into the request ctx derives from.
+func faultsOf(ctx context.Context) *faults {
+	if f, ok := ctx.Value(faultsKey{}).(*faults); ok {
+		return f
+	}
+	return &faults{}
+}
+
+// delayDownload waits out the injected download delay, if any.
+func delayDownload(ctx context.Context) error {
+	d := faultsOf(ctx).downloadDelay
+	if d == 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// injectedDarkflowError fails the darkflow call the way a darkflow
+// answering with the injected status would.
+func injectedDarkflowError(ctx context.Context) (int, error) {
+	status := faultsOf(ctx).darkflowStatus
+	if status == 0 {
+		return 0, nil
+	}
+	return status, withCode(codeBackendError, fmt.Errorf("darkflow returned error: %d %s (injected)", status, http.StatusText(status)))
+}
+
+// dropInjectedOutputs removes the outputs darkflow produced for the inputs
+// of the injected drop-outputs from dir.
+func dropInjectedOutputs(ctx context.Context, dir string) error {
+	drop := faultsOf(ctx).dropOutputs
+	if len(drop) == 0 {
+		return nil
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("could not read output dir: %v", err)
+	}
+	for _, f := range files {
+		index, err := strconv.Atoi(strings.TrimSuffix(f.Name(), filepath.Ext(f.Name())))
+		if err != nil {
+			continue
+		}
+		for _, d := range drop {
+			if d == index {
+				if err := os.RemoveAll(filepath.Join(dir, f.Name())); err != nil {
+					return fmt.Errorf("could not drop output: %v", err)
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var localImageDir string
+
+// fetcher opens the images of one kind of source. open returns the content
+// and its size, or -1 if unknown.
+type fetcher interface {
+	open(ctx context.Context, from string) (io.ReadCloser, int64, error)
+}
+
+// fetcherFunc adapts a function to the fetcher interface.
+type fetcherFunc func(ctx context.Context, from string) (io.ReadCloser, int64, error)
+
+func (f fetcherFunc) open(ctx context.Context, from string) (io.ReadCloser, int64, error) {
+	return f(ctx, from)
+}
+
+// fetchers maps URL schemes to the fetcher handling them. Image URLs without
+// a scheme are local paths.
+var fetchers = map[string]fetcher{
+	"http":  httpFetcher{},
+	"https": httpFetcher{},
+	"s3":    fetcherFunc(openS3),
+	"gs":    fetcherFunc(openGCS),
+	"data":  dataFetcher{},
+	"file":  localFetcher{},
+	"":      localFetcher{},
+	"ftp":   ftpFetcher{},
+}
+
+// openImage opens the image at from with the fetcher for its scheme.
+func openImage(ctx context.Context, from string) (io.ReadCloser, int64, error) {
+	scheme := ""
+	if i := strings.Index(from, ":"); i > 0 && !strings.ContainsAny(from[:i], "/\\") {
+		scheme = strings.ToLower(from[:i])
+	}
+	f, ok := fetchers[scheme]
+	if !ok {
+		return nil, 0, fmt.Errorf("could not fetch image: unsupported scheme %q", scheme)
+	}
+	return f.open(ctx, from)
+}
+
+// httpFetcher downloads over HTTP(S) with insecureClient.
+type httpFetcher struct{}
+
+func (httpFetcher) open(ctx context.Context, from string) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequest(http.MethodGet, from, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not wget image: %v", err)
+	}
+	release, err := hostLimits.acquire(ctx, from)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not wget image: %v", err)
+	}
+	response, err := insecureClient.Do(req.WithContext(ctx))
+	if err != nil {
+		release()
+		return nil, 0, withCode(codeOr(err, codeDownloadFailed), fmt.Errorf("could not wget image: %w", err))
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		release()
+		err := fmt.Errorf("could not wget image: %s", response.Status)
+		if response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone {
+			return nil, 0, &missingSourceError{msg: err.Error()}
+		}
+		return nil, 0, err
+	}
+	return &releasingBody{ReadCloser: response.Body, release: release}, response.ContentLength, nil
+}
+
+// dataFetcher decodes data: URIs, data:[<media type>][;base64],<data>.
+type dataFetcher struct{}
+
+func (dataFetcher) open(ctx context.Context, from string) (io.ReadCloser, int64, error) {
+	i := strings.Index(from, ",")
+	if i < 0 {
+		return nil, 0, fmt.Errorf("invalid data uri: missing ','")
+	}
+	meta, payload := from[len("data:"):i], from[i+1:]
+	var content []byte
+	if strings.HasSuffix(strings.ToLower(meta), ";base64") {
+		var err error
+		if strings.Contains(payload, "%") {
+			// + / and = may be percent-encoded in URLs.
+			if payload, err = url.PathUnescape(payload); err != nil {
+				return nil, 0, fmt.Errorf("invalid data uri: %v", err)
+			}
+		}
+		content, err = base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			// Some encoders leave the padding off.
+			content, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(payload, "="))
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid data uri: %v", err)
+		}
+	} else {
+		s, err := url.PathUnescape(payload)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid data uri: %v", err)
+		}
+		content = []byte(s)
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), int64(len(content)), nil
+}
+
+// localFetcher reads images from the frontend's filesystem, given as file://
+// URLs or absolute paths. Only files under -local-image-dir can be read;
+// without it local fetching is disabled.
+type localFetcher struct{}
+
+func (localFetcher) open(ctx context.Context, from string) (io.ReadCloser, int64, error) {
+	if localImageDir == "" {
+		return nil, 0, fmt.Errorf("could not fetch %s: local images are disabled, see -local-image-dir", from)
+	}
+	path := from
+	if strings.HasPrefix(from, "file:") {
+		u, err := url.Parse(from)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid file url %q: %v", from, err)
+		}
+		if u.Host != "" && u.Host != "localhost" {
+			return nil, 0, fmt.Errorf("invalid file url %q: remote host %q", from, u.Host)
+		}
+		path = u.Path
+	}
+	path, err := localImagePath(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not open image: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("could not open image: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, 0, fmt.Errorf("could not open image: %s is not a regular file", from)
+	}
+	return f, info.Size(), nil
+}
+
+// localImagePath resolves path, following symlinks, and checks that it stays
+// inside -local-image-dir.
+func localImagePath(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("local image path %q is not absolute", path)
+	}
+	root, err := filepath.EvalSymlinks(localImageDir)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve -local-image-dir: %v", err)
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Clean(path))
+	if err != nil {
+		return "", fmt.Errorf("could not open image: %v", err)
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", withCode(codeURLBlocked, fmt.Errorf("%s is outside -local-image-dir", path))
+	}
+	return resolved, nil
+}
+
+// ftpFetcher downloads from FTP servers in passive mode, logging in as
+// anonymous unless the URL carries credentials. Data connections always go
+// to the control connection's host, whatever address the server announces.
+type ftpFetcher struct{}
+
+func (ftpFetcher) open(ctx context.Context, from string) (io.ReadCloser, int64, error) {
+	u, err := url.Parse(from)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid ftp url %q: %v", from, err)
+	}
+	if u.Path == "" || strings.HasSuffix(u.Path, "/") {
+		return nil, 0, fmt.Errorf("invalid ftp url %q: no file", from)
+	}
+	if err := checkFTPArgs(u); err != nil {
+		return nil, 0, withCode(codeInvalidRequest, fmt.Errorf("invalid ftp url %q: %v", from, err))
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "21")
+	}
+	release, err := hostLimits.acquire(ctx, from)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not connect to ftp server: %v", err)
+	}
+	conn, err := fetchDialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		release()
+		return nil, 0, withCode(codeOr(err, codeDownloadFailed), fmt.Errorf("could not connect to ftp server: %w", err))
+	}
+	c := &ftpConn{ctrl: textproto.NewConn(conn), conn: conn}
+	// Closing the connections unblocks any read once ctx is done.
+	c.stop = context.AfterFunc(ctx, c.closeAll)
+	body, size, err := c.retrieve(ctx, fetchDialer, u)
+	if err != nil {
+		c.stop()
+		c.closeAll()
+		release()
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		return nil, 0, fmt.Errorf("could not fetch %s: %v", from, err)
+	}
+	return &releasingBody{ReadCloser: body, release: release}, size, nil
+}
+
+// checkFTPArgs rejects the parts of u that go into FTP commands when they
+// hold line breaks, which url.Parse decodes from %0d%0a and which would end
+// the command and start another.
+func checkFTPArgs(u *url.URL) error {
+	args := []string{u.Path}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		args = append(args, u.User.Username(), pass)
+	}
+	for _, a := range args {
+		if strings.ContainsAny(a, "\r\n\x00") {
+			return fmt.Errorf("control characters in the path or credentials")
+		}
+	}
+	return nil
+}
+
+type ftpConn struct {
+	ctrl *textproto.Conn
+	conn net.Conn
+	stop func() bool
+
+	mu   sync.Mutex
+	data net.Conn
+}
+
+func (c *ftpConn) closeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.data != nil {
+		c.data.Close()
+	}
+	c.conn.Close()
+}
+
+// cmd sends a command and reads the reply, which must have one of the codes
+// in expect.
+func (c *ftpConn) cmd(expect []int, format string, args ...interface{}) (int, string, error) {
+	if format != "" {
+		if err := c.ctrl.PrintfLine(format, args...); err != nil {
+			return 0, "", err
+		}
+	}
+	code, msg, err := c.ctrl.ReadResponse(0)
+	if err != nil {
+		return code, msg, err
+	}
+	for _, want := range expect {
+		if code == want {
+			return code, msg, nil
+		}
+	}
+	return code, msg, fmt.Errorf("ftp server replied %d %s", code, msg)
+}
+
+func (c *ftpConn) retrieve(ctx context.Context, dialer *net.Dialer, u *url.URL) (io.ReadCloser, int64, error) {
+	if _, _, err := c.cmd([]int{220}, ""); err != nil {
+		return nil, 0, err
+	}
+	user, pass := "anonymous", "anonymous@"
+	if u.User != nil {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+	}
+	code, _, err := c.cmd([]int{230, 331}, "USER %s", user)
+	if err != nil {
+		return nil, 0, err
+	}
+	if code == 331 {
+		if _, _, err := c.cmd([]int{230, 202}, "PASS %s", pass); err != nil {
+			return nil, 0, err
+		}
+	}
+	if _, _, err := c.cmd([]int{200}, "TYPE I"); err != nil {
+		return nil, 0, err
+	}
+	size := int64(-1)
+	if _, msg, err := c.cmd([]int{213}, "SIZE %s", u.Path); err == nil {
+		if n, err := strconv.ParseInt(strings.TrimSpace(msg), 10, 64); err == nil {
+			size = n
+		}
+	}
+	port, err := c.passivePort()
+	if err != nil {
+		return nil, 0, err
+	}
+	host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	data, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not open data connection: %v", err)
+	}
+	c.mu.Lock()
+	c.data = data
+	c.mu.Unlock()
+	if _, _, err := c.cmd([]int{125, 150}, "RETR %s", u.Path); err != nil {
+		return nil, 0, err
+	}
+	return &ftpBody{c: c, r: bufio.NewReader(data)}, size, nil
+}
+
+// passivePort asks for a data port with EPSV, falling back to PASV.
+func (c *ftpConn) passivePort() (int, error) {
+	if _, msg, err := c.cmd([]int{229}, "EPSV"); err == nil {
+		if port, err := parseEPSV(msg); err == nil {
+			return port, nil
+		}
+	}
+	_, msg, err := c.cmd([]int{227}, "PASV")
+	if err != nil {
+		return 0, err
+	}
+	return parsePASV(msg)
+}
+
+// parseEPSV returns the port of an EPSV reply, "Entering Extended Passive
+// Mode (|||port|)", where | may be any delimiter.
+func parseEPSV(msg string) (int, error) {
+	start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+	if start < 0 || end < start+5 {
+		return 0, fmt.Errorf("could not parse EPSV reply %q", msg)
+	}
+	args := msg[start+1 : end]
+	d := args[0]
+	if args[1] != d || args[2] != d || args[len(args)-1] != d {
+		return 0, fmt.Errorf("could not parse EPSV reply %q", msg)
+	}
+	port, err := strconv.Atoi(args[3 : len(args)-1])
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("could not parse EPSV reply %q", msg)
+	}
+	return port, nil
+}
+
+// parsePASV returns the port of a PASV reply, "Entering Passive Mode
+// (h1,h2,h3,h4,p1,p2)". The address is ignored: data connections go to the
+// host of the control connection.
+func parsePASV(msg string) (int, error) {
+	start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+	if start < 0 || end < start {
+		return 0, fmt.Errorf("could not parse PASV reply %q", msg)
+	}
+	parts := strings.Split(msg[start+1:end], ",")
+	if len(parts) != 6 {
+		return 0, fmt.Errorf("could not parse PASV reply %q", msg)
+	}
+	hi, err1 := strconv.Atoi(strings.TrimSpace(parts[4]))
+	lo, err2 := strconv.Atoi(strings.TrimSpace(parts[5]))
+	if err1 != nil || err2 != nil || hi < 0 || hi > 255 || lo < 0 || lo > 255 || hi|lo == 0 {
+		return 0, fmt.Errorf("could not parse PASV reply %q", msg)
+	}
+	return hi<<8 | lo, nil
+}
+
+// ftpBody reads a file being retrieved. Closing it completes the transfer
+// and logs out.
+type ftpBody struct {
+	c *ftpConn
+	r io.Reader
+}
+
+func (b *ftpBody) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+func (b *ftpBody) Close() error {
+	b.c.stop()
+	b.c.mu.Lock()
+	b.c.data.Close()
+	b.c.mu.Unlock()
+	b.c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := b.c.cmd([]int{226, 250}, "")
+	b.c.ctrl.PrintfLine("QUIT")
+	b.c.conn.Close()
+	return err
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+)
+
+// defaultFilters are the server default output filters, from -min-box-area,
+// -max-detections and -nms-iou, which requests may override.
+var defaultFilters outputFilters
+
+// outputFilters clean up darkflow's detections before they are returned.
+// Zero values disable a filter.
+type outputFilters struct {
+	// MinBoxArea drops the detections whose box is smaller, in pixels.
+	MinBoxArea float64 `json:"min_box_area,omitempty"`
+	// MaxDetections keeps only the most confident detections of each image.
+	MaxDetections int `json:"max_detections,omitempty"`
+	// NMSIoU drops the detections overlapping a more confident one of their
+	// class by more than this intersection over union.
+	NMSIoU float64 `json:"nms_iou,omitempty"`
+}
+
+func setupFilters() error {
+	if err := validateFilters(&defaultFilters); err != nil {
+		return fmt.Errorf("invalid output filters: %v", err)
+	}
+	if mergeFilters(nil) != nil && inMemory {
+		return fmt.Errorf("-min-box-area, -max-detections and -nms-iou are not available with -in-memory, the annotated images could not be redrawn")
+	}
+	return nil
+}
+
+func validateFilters(f *outputFilters) error {
+	if f == nil {
+		return nil
+	}
+	if f.MinBoxArea < 0 || math.IsNaN(f.MinBoxArea) || math.IsInf(f.MinBoxArea, 0) {
+		return fmt.Errorf("min_box_area must be a non-negative number, got %v", f.MinBoxArea)
+	}
+	if f.MaxDetections < 0 {
+		return fmt.Errorf("max_detections must not be negative, got %d", f.MaxDetections)
+	}
+	if !(f.NMSIoU >= 0 && f.NMSIoU <= 1) {
+		return fmt.Errorf("nms_iou must be between 0 and 1, got %v", f.NMSIoU)
+	}
+	return nil
+}
+
+// mergeFilters returns the server defaults overridden by the filters the
+// request sets, or nil when no filter applies.
+func mergeFilters(request *outputFilters) *outputFilters {
+	merged := defaultFilters
+	if request != nil {
+		if request.MinBoxArea != 0 {
+			merged.MinBoxArea = request.MinBoxArea
+		}
+		if request.MaxDetections != 0 {
+			merged.MaxDetections = request.MaxDetections
+		}
+		if request.NMSIoU != 0 {
+			merged.NMSIoU = request.NMSIoU
+		}
+	}
+	if merged == (outputFilters{}) {
+		return nil
+	}
+	return &merged
+}
+
+// apply returns the detections of one image that pass f: those big enough,
+// then those NMS keeps, then the most confident of them.
+func (f *outputFilters) apply(ds []detection) []detection {
+	kept := make([]detection, 0, len(ds))
+	for _, d := range ds {
+		if d.area() >= f.MinBoxArea {
+			kept = append(kept, d)
+		}
+	}
+	sort.SliceStable(kept, func(a, b int) bool { return kept[a].Confidence > kept[b].Confidence })
+	if f.NMSIoU > 0 {
+		nms := kept[:0:0]
+		for _, d := range kept {
+			suppressed := false
+			for _, k := range nms {
+				if k.Label == d.Label && iou(k, d) > f.NMSIoU {
+					suppressed = true
+					break
+				}
+			}
+			if !suppressed {
+				nms = append(nms, d)
+			}
+		}
+		kept = nms
+	}
+	if f.MaxDetections > 0 && len(kept) > f.MaxDetections {
+		kept = kept[:f.MaxDetections]
+	}
+	return kept
+}
+
+// iou is the intersection over union of the boxes of a and b.
+func iou(a, b detection) float64 {
+	overlap := detection{
+		TopLeft:     point{max(a.TopLeft.X, b.TopLeft.X), max(a.TopLeft.Y, b.TopLeft.Y)},
+		BottomRight: point{min(a.BottomRight.X, b.BottomRight.X), min(a.BottomRight.Y, b.BottomRight.Y)},
+	}
+	inter := overlap.area()
+	union := a.area() + b.area() - inter
+	if union <= 0 {
+		return 0
+	}
+	return inter / union
+}
+
+// applyFilters runs the output filters of j over darkflow's annotations.
+func applyFilters(t *tenant, j *job) error {
+	if j.Filters == nil {
+		return nil
+	}
+	dropped, err := filterAnnotations(t, j, "by the output filters", j.Filters.apply)
+	if dropped > 0 {
+		log.Printf("Output filters dropped %d detections of job %s", dropped, j.ID)
+	}
+	return err
+}
+
+// filterAnnotations replaces darkflow's annotation of every image of j by
+// the detections keep returns for it and reports how many were dropped,
+// warning of them, dropped for reason, in j.Warnings. Annotated images that
+// lost detections are redrawn, with the default render options unless the
+// job has its own, since darkflow drew the dropped boxes.
+func filterAnnotations(t *tenant, j *job, reason string, keep func([]detection) []detection) (int, error) {
+	dir := j.outputPath(t)
+	var redraw []int
+	dropped := 0
+	for i := 0; i < j.imageCount(); i++ {
+		file := filepath.Join(dir, fmt.Sprintf("%d.json", i))
+		ds, err := readDetections(file)
+		if err != nil {
+			continue
+		}
+		kept := keep(ds)
+		if len(kept) == len(ds) {
+			continue
+		}
+		dropped += len(ds) - len(kept)
+		j.Warnings = append(j.Warnings, errorDetail{
+			Index:   i,
+			Input:   j.inputName(i),
+			Code:    codeDetectionsDropped,
+			Message: fmt.Sprintf("%d of %d detections dropped %s", len(ds)-len(kept), len(ds), reason),
+		})
+		data, err := json.Marshal(kept)
+		if err != nil {
+			return dropped, fmt.Errorf("could not encode filtered annotation: %v", err)
+		}
+		if err := ioutil.WriteFile(file, data, 0644); err != nil {
+			return dropped, fmt.Errorf("could not write filtered annotation: %v", err)
+		}
+		redraw = append(redraw, i)
+	}
+	if j.Render != nil {
+		// renderOutputs redraws every image.
+		return dropped, nil
+	}
+	for _, i := range redraw {
+		if err := renderOutput(t, j, i, &renderOptions{}); err != nil {
+			return dropped, err
+		}
+	}
+	return dropped, nil
+}
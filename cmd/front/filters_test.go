@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func box(label string, confidence float64, x1, y1, x2, y2 int) detection {
+	return detection{Label: label, Confidence: confidence, TopLeft: point{x1, y1}, BottomRight: point{x2, y2}}
+}
+
+func TestIoU(t *testing.T) {
+	tt := []struct {
+		name string
+		a, b detection
+		want float64
+	}{
+		{name: "identical", a: box("", 0, 0, 0, 10, 10), b: box("", 0, 0, 0, 10, 10), want: 1},
+		{name: "half", a: box("", 0, 0, 0, 10, 10), b: box("", 0, 5, 0, 15, 10), want: 50.0 / 150},
+		{name: "contained", a: box("", 0, 0, 0, 10, 10), b: box("", 0, 0, 0, 5, 5), want: 0.25},
+		{name: "disjoint", a: box("", 0, 0, 0, 10, 10), b: box("", 0, 20, 20, 30, 30)},
+		{name: "touching", a: box("", 0, 0, 0, 10, 10), b: box("", 0, 10, 0, 20, 10)},
+		{name: "diagonal", a: box("", 0, 0, 0, 10, 10), b: box("", 0, 10, 10, 20, 20)},
+		{name: "both empty", a: box("", 0, 5, 5, 5, 5), b: box("", 0, 5, 5, 5, 5)},
+		{name: "inverted", a: box("", 0, 10, 10, 0, 0), b: box("", 0, 0, 0, 10, 10)},
+		{name: "both inverted", a: box("", 0, 10, 10, 0, 0), b: box("", 0, 10, 10, 0, 0)},
+		{name: "negative coordinates", a: box("", 0, -10, -10, 0, 0), b: box("", 0, -5, -10, 5, 0), want: 50.0 / 150},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			got, swapped := iou(tc.a, tc.b), iou(tc.b, tc.a)
+			if math.Abs(got-tc.want) > 1e-9 || got != swapped {
+				t.Errorf("iou() = %v (swapped %v), want %v", got, swapped, tc.want)
+			}
+			if math.IsNaN(got) || got < 0 || got > 1 {
+				t.Errorf("iou() = %v, out of [0, 1]", got)
+			}
+		})
+	}
+}
+
+func TestFiltersApply(t *testing.T) {
+	car := box("car", 0.9, 0, 0, 10, 10)
+	carOverlap := box("car", 0.8, 1, 0, 11, 10)
+	carApart := box("car", 0.7, 50, 50, 60, 60)
+	personOverlap := box("person", 0.6, 1, 0, 11, 10)
+	tiny := box("car", 0.95, 0, 0, 2, 2)
+	inverted := box("car", 0.99, 10, 10, 0, 0)
+	tt := []struct {
+		name    string
+		filters outputFilters
+		in      []detection
+		want    []detection
+	}{
+		{name: "none", in: []detection{carApart, car}, want: []detection{car, carApart}},
+		{name: "empty", filters: outputFilters{NMSIoU: 0.5, MaxDetections: 1, MinBoxArea: 1}, want: []detection{}},
+		{name: "min box area", filters: outputFilters{MinBoxArea: 10}, in: []detection{tiny, car, inverted}, want: []detection{car}},
+		{name: "nms", filters: outputFilters{NMSIoU: 0.5}, in: []detection{carOverlap, carApart, car}, want: []detection{car, carApart}},
+		{name: "nms keeps other classes", filters: outputFilters{NMSIoU: 0.5}, in: []detection{car, personOverlap}, want: []detection{car, personOverlap}},
+		{name: "nms at the threshold", filters: outputFilters{NMSIoU: 1}, in: []detection{car, car}, want: []detection{car, car}},
+		{name: "nms keeps empty boxes", filters: outputFilters{NMSIoU: 0.1}, in: []detection{inverted, inverted}, want: []detection{inverted, inverted}},
+		{name: "max detections", filters: outputFilters{MaxDetections: 2}, in: []detection{carApart, tiny, car}, want: []detection{tiny, car}},
+		{name: "max detections after nms", filters: outputFilters{NMSIoU: 0.5, MaxDetections: 2}, in: []detection{car, carOverlap, carApart}, want: []detection{car, carApart}},
+		{name: "stable ties", in: []detection{carOverlap, box("car", 0.8, 5, 5, 6, 6)}, want: []detection{carOverlap, box("car", 0.8, 5, 5, 6, 6)}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			in := append([]detection(nil), tc.in...)
+			got := tc.filters.apply(in)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("apply() = %v, want %v", got, tc.want)
+			}
+			if !reflect.DeepEqual(in, tc.in) {
+				t.Errorf("apply() modified its input: %v", in)
+			}
+		})
+	}
+}
+
+func TestValidateFilters(t *testing.T) {
+	tt := []struct {
+		name    string
+		filters *outputFilters
+		wantErr bool
+	}{
+		{name: "nil"},
+		{name: "zero", filters: &outputFilters{}},
+		{name: "valid", filters: &outputFilters{MinBoxArea: 100, MaxDetections: 10, NMSIoU: 0.5}},
+		{name: "nms of 1", filters: &outputFilters{NMSIoU: 1}},
+		{name: "negative area", filters: &outputFilters{MinBoxArea: -1}, wantErr: true},
+		{name: "nan area", filters: &outputFilters{MinBoxArea: math.NaN()}, wantErr: true},
+		{name: "infinite area", filters: &outputFilters{MinBoxArea: math.Inf(1)}, wantErr: true},
+		{name: "negative max detections", filters: &outputFilters{MaxDetections: -1}, wantErr: true},
+		{name: "negative nms", filters: &outputFilters{NMSIoU: -0.1}, wantErr: true},
+		{name: "nms over 1", filters: &outputFilters{NMSIoU: 1.1}, wantErr: true},
+		{name: "nan nms", filters: &outputFilters{NMSIoU: math.NaN()}, wantErr: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := validateFilters(tc.filters); (err != nil) != tc.wantErr {
+				t.Errorf("validateFilters() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
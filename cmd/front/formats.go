@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var allowedFormatsFlag string
+
+// allowedFormats is the set parsed from -allowed-formats; nil lets any image
+// through.
+var allowedFormats map[string]bool
+
+// imageFormats maps the content types inputs are sniffed as to the format
+// names -allowed-formats takes.
+var imageFormats = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+	"image/bmp":  "bmp",
+	"image/tiff": "tiff",
+}
+
+// validateFormats parses -allowed-formats, a comma separated list of format
+// names. "jpg" and "tif" are accepted as aliases.
+func validateFormats() error {
+	if strings.TrimSpace(allowedFormatsFlag) == "" {
+		return nil
+	}
+	known := make(map[string]bool)
+	for _, f := range imageFormats {
+		known[f] = true
+	}
+	allowedFormats = make(map[string]bool)
+	for _, f := range strings.Split(allowedFormatsFlag, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		switch f {
+		case "":
+			continue
+		case "jpg":
+			f = "jpeg"
+		case "tif":
+			f = "tiff"
+		}
+		if !known[f] {
+			return fmt.Errorf("invalid -allowed-formats: unknown format %q, want one of %s", f, strings.Join(formatNames(known), ", "))
+		}
+		allowedFormats[f] = true
+	}
+	return nil
+}
+
+// checkFormat rejects an input whose leading bytes, head, are not of one of
+// -allowed-formats, so that darkflow is never handed an image its model
+// cannot read.
+func checkFormat(head []byte) error {
+	if allowedFormats == nil {
+		return nil
+	}
+	format := sniffFormat(head)
+	if format == "" {
+		return withCode(codeUnsupportedFormat, fmt.Errorf("unrecognized image format, want one of %s", strings.Join(formatNames(allowedFormats), ", ")))
+	}
+	if !allowedFormats[format] {
+		return withCode(codeUnsupportedFormat, fmt.Errorf("image format %s is not allowed, want one of %s", format, strings.Join(formatNames(allowedFormats), ", ")))
+	}
+	return nil
+}
+
+// sniffFormat returns the format name of the image starting with head, or
+// "" when it is not one the frontend recognizes. http.DetectContentType
+// knows no TIFF, so its byte order marks are checked here.
+func sniffFormat(head []byte) string {
+	if bytes.HasPrefix(head, []byte("II*\x00")) || bytes.HasPrefix(head, []byte("MM\x00*")) {
+		return "tiff"
+	}
+	return imageFormats[http.DetectContentType(head)]
+}
+
+func formatNames(set map[string]bool) []string {
+	names := make([]string, 0, len(set))
+	for f := range set {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+)
+
+// heatmapAll is the heatmap class aggregating the detections of every class.
+const heatmapAll = "*"
+
+// heatmapName is the file the heatmap of a job is stored as in its outputs.
+const heatmapName = "heatmap.png"
+
+// heatmapMaxSize bounds the longer side of heatmaps, which are drawn at the
+// size of the first input otherwise.
+const heatmapMaxSize = 1024
+
+func validateHeatmap(class string) error {
+	if len(class) > 100 {
+		return fmt.Errorf("invalid heatmap class, longer than 100 characters")
+	}
+	return nil
+}
+
+// writeHeatmap aggregates the detections of class j.Heatmap across all
+// inputs of j into heatmapName among its outputs: the boxes, weighted by
+// confidence, are scaled to the first input, on which their density is
+// overlaid from blue to red. Inputs of other sizes are scaled to it, which
+// suits fixed cameras.
+func writeHeatmap(t *tenant, j *job) error {
+	if j.Heatmap == "" {
+		return nil
+	}
+	var background image.Image
+	var heat []float64
+	var width, height int
+	for _, input := range j.indexedInputs() {
+		ann := annotationPath(t, j, input.index)
+		if ann == "" {
+			continue
+		}
+		ds, err := readDetections(ann)
+		if err != nil {
+			return err
+		}
+		// j.Inputs names the final location; while the job runs the
+		// inputs are still staged.
+		img, err := decodeImageFile(filepath.Join(j.inputPath(t), filepath.Base(input.path)))
+		if err != nil {
+			return err
+		}
+		b := img.Bounds()
+		if background == nil {
+			background = img
+			width, height = b.Dx(), b.Dy()
+			if longer := max(width, height); longer > heatmapMaxSize {
+				width = width * heatmapMaxSize / longer
+				height = height * heatmapMaxSize / longer
+			}
+			heat = make([]float64, (width+1)*(height+1))
+		}
+		for _, d := range ds {
+			if j.Heatmap != heatmapAll && d.Label != j.Heatmap {
+				continue
+			}
+			x0 := clampInt((d.TopLeft.X-b.Min.X)*width/b.Dx(), 0, width)
+			y0 := clampInt((d.TopLeft.Y-b.Min.Y)*height/b.Dy(), 0, height)
+			x1 := clampInt((d.BottomRight.X-b.Min.X)*width/b.Dx(), 0, width)
+			y1 := clampInt((d.BottomRight.Y-b.Min.Y)*height/b.Dy(), 0, height)
+			if x1 <= x0 || y1 <= y0 {
+				continue
+			}
+			// Corners of a 2D difference array, summed up below.
+			heat[y0*(width+1)+x0] += d.Confidence
+			heat[y0*(width+1)+x1] -= d.Confidence
+			heat[y1*(width+1)+x0] -= d.Confidence
+			heat[y1*(width+1)+x1] += d.Confidence
+		}
+	}
+	if background == nil {
+		return nil
+	}
+
+	peak := 0.0
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*(width+1) + x
+			if x > 0 {
+				heat[i] += heat[i-1]
+			}
+			if y > 0 {
+				heat[i] += heat[i-width-1]
+			}
+			if x > 0 && y > 0 {
+				heat[i] -= heat[i-width-2]
+			}
+			peak = max(peak, heat[i])
+		}
+	}
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	b := background.Bounds()
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			// The input is dimmed to grey so that the heat stands out.
+			r, g, bl, _ := background.At(b.Min.X+x*b.Dx()/width, b.Min.Y+y*b.Dy()/height).RGBA()
+			grey := float64((r*299+g*587+bl*114)/1000>>8) * 0.6
+			c := color.RGBA{uint8(grey), uint8(grey), uint8(grey), 255}
+			if v := heat[y*(width+1)+x]; v > 0 && peak > 0 {
+				c = blend(c, heatColor(v/peak), 0.35+0.4*v/peak)
+			}
+			out.Set(x, y, c)
+		}
+	}
+	file := filepath.Join(j.outputPath(t), heatmapName)
+	if err := writeRendered(out, file); err != nil {
+		os.Remove(file)
+		return err
+	}
+	url := t.outputURL(j.ID, heatmapName)
+	j.Files = append(j.Files, outputFile{Source: "heatmap", Index: -1, URL: url})
+	j.Outputs = append(j.Outputs, url)
+	return nil
+}
+
+// heatColor maps v, from 0 to 1, from blue through cyan, green and yellow to
+// red.
+func heatColor(v float64) color.RGBA {
+	stops := []color.RGBA{{0, 0, 255, 255}, {0, 255, 255, 255}, {0, 255, 0, 255}, {255, 255, 0, 255}, {255, 0, 0, 255}}
+	pos := v * float64(len(stops)-1)
+	i := min(int(pos), len(stops)-2)
+	return blend(stops[i], stops[i+1], pos-float64(i))
+}
+
+// blend mixes c into base by share, from 0 to 1.
+func blend(base, c color.RGBA, share float64) color.RGBA {
+	mix := func(a, b uint8) uint8 { return uint8(float64(a)*(1-share) + float64(b)*share) }
+	return color.RGBA{mix(base.R, c.R), mix(base.G, c.G), mix(base.B, c.B), 255}
+}
+
+func clampInt(v, lo, hi int) int {
+	return max(lo, min(v, hi))
+}
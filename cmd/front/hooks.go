@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// stringList is a flag that may be given multiple times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+var postHooks stringList
+var postHookTimeout time.Duration
+
+// hookRequest is written to a hook's stdin. The directories are the job's
+// staging directories, which are moved into place once the job finishes.
+type hookRequest struct {
+	Job       *job   `json:"job"`
+	Tenant    string `json:"tenant,omitempty"`
+	InputDir  string `json:"input_dir"`
+	OutputDir string `json:"output_dir"`
+}
+
+// hookResponse is read from a hook's stdout. Files lists files the hook
+// created, relative to the job's output dir; Data is stored with the job.
+type hookResponse struct {
+	Files []string        `json:"files"`
+	Data  json.RawMessage `json:"data"`
+	Error string          `json:"error"`
+}
+
+// runPostHooks runs every -post-hook command, in order, after darkflow has
+// finished a job. A hook is a program that reads a hookRequest as JSON on
+// stdin and writes a hookResponse as JSON to stdout; a non-zero exit status
+// or a non-empty error fails the job.
+func runPostHooks(t *tenant, j *job) error {
+	for _, hook := range postHooks {
+		if err := runPostHook(t, j, hook); err != nil {
+			return fmt.Errorf("post hook %q failed: %v", hook, err)
+		}
+	}
+	return nil
+}
+
+func runPostHook(t *tenant, j *job, hook string) error {
+	args := strings.Fields(hook)
+	if len(args) == 0 {
+		return nil
+	}
+	input, err := json.Marshal(hookRequest{
+		Job:       j,
+		Tenant:    t.Name,
+		InputDir:  j.inputPath(t),
+		OutputDir: j.outputPath(t),
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), postHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("timed out after %s", postHookTimeout)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+
+	var resp hookResponse
+	if stdout.Len() > 0 {
+		if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+			return fmt.Errorf("invalid response: %v", err)
+		}
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+
+	name := filepath.Base(args[0])
+	for _, f := range resp.Files {
+		rel := filepath.ToSlash(filepath.Clean(f))
+		if filepath.IsAbs(f) || rel == ".." || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("file %q is outside the output dir", f)
+		}
+		if _, err := os.Stat(filepath.Join(j.outputPath(t), rel)); err != nil {
+			return fmt.Errorf("reported file %q: %v", f, err)
+		}
+		url := t.outputURL(j.ID, rel)
+		j.Files = append(j.Files, outputFile{Source: "hook:" + name, Index: -1, URL: url})
+		j.Outputs = append(j.Outputs, url)
+	}
+	if len(resp.Data) > 0 {
+		if j.Hooks == nil {
+			j.Hooks = make(map[string]json.RawMessage)
+		}
+		j.Hooks[name] = resp.Data
+	}
+	return nil
+}
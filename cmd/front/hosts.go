@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var maxHostConnections int
+var hostStagger time.Duration
+
+// hostLimits caps the downloads in flight from each source host across all
+// jobs at -max-host-connections, and spaces their starts -host-stagger
+// apart, so that large crawls of one image host are not taken for an
+// attack.
+var hostLimits = &hostLimiters{hosts: make(map[string]*hostLimiter)}
+
+type hostLimiters struct {
+	mu    sync.Mutex
+	hosts map[string]*hostLimiter
+}
+
+type hostLimiter struct {
+	slots chan struct{}
+	// next is when the next download from the host may start.
+	next  time.Time
+	users int
+}
+
+// acquire waits for a download slot of the host of from, returning the
+// function that frees it.
+func (h *hostLimiters) acquire(ctx context.Context, from string) (func(), error) {
+	if maxHostConnections <= 0 && hostStagger <= 0 {
+		return func() {}, nil
+	}
+	u, err := url.Parse(from)
+	if err != nil || u.Host == "" {
+		return func() {}, nil
+	}
+	host := strings.ToLower(u.Host)
+
+	h.mu.Lock()
+	l := h.hosts[host]
+	if l == nil {
+		h.prune()
+		l = &hostLimiter{}
+		if maxHostConnections > 0 {
+			l.slots = make(chan struct{}, maxHostConnections)
+		}
+		h.hosts[host] = l
+	}
+	l.users++
+	h.mu.Unlock()
+	done := func() {
+		h.mu.Lock()
+		l.users--
+		h.mu.Unlock()
+	}
+
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			done()
+			return nil, fmt.Errorf("waiting for a connection to %s: %v", host, ctx.Err())
+		}
+	}
+	release := func() {
+		if l.slots != nil {
+			<-l.slots
+		}
+		done()
+	}
+
+	h.mu.Lock()
+	now := time.Now()
+	start := l.next
+	if start.Before(now) {
+		start = now
+	}
+	l.next = start.Add(hostStagger)
+	h.mu.Unlock()
+	if wait := time.Until(start); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			release()
+			return nil, fmt.Errorf("waiting for a connection to %s: %v", host, ctx.Err())
+		}
+	}
+	return release, nil
+}
+
+// prune forgets the hosts nothing is downloaded from and whose stagger has
+// passed. h.mu must be held.
+func (h *hostLimiters) prune() {
+	now := time.Now()
+	for host, l := range h.hosts {
+		if l.users == 0 && l.next.Before(now) {
+			delete(h.hosts, host)
+		}
+	}
+}
+
+// releasingBody frees the host slot of a download once its body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// includeInline embeds the annotated images of a /v2 response in it as
+// base64, sparing clients one request per image.
+const includeInline = "inline"
+
+// inlineMaxSize is the largest annotated image include_images=inline
+// embeds; larger ones are only linked.
+var inlineMaxSize int64
+
+// inlineOutput is an output file embedded in a response.
+type inlineOutput struct {
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
+}
+
+// validateIncludeImages checks the include_images option of a request
+// routed as r, which only /v2 responses have room for.
+func validateIncludeImages(r *http.Request, v string) error {
+	switch {
+	case v == "":
+		return nil
+	case v != includeInline:
+		return fmt.Errorf("invalid include_images %q, want %s", v, includeInline)
+	case apiVersion(r) < apiV2:
+		return fmt.Errorf("include_images is only available under /v2")
+	}
+	return nil
+}
+
+// embedImages adds the annotated images of j up to -inline-max-size to the
+// results of their inputs in resp.
+func embedImages(t *tenant, j *job, resp *recognizeResponseV2) {
+	for _, f := range j.Files {
+		if f.Index < 0 || f.Index >= len(resp.Images) || !strings.HasPrefix(contentTypeOf(f.URL), "image/") {
+			continue
+		}
+		file := j.outputFilePath(t, f)
+		if info, err := os.Stat(file); err != nil || info.Size() > inlineMaxSize {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Printf("Could not embed output %s of job %s: %v", f.URL, j.ID, err)
+			continue
+		}
+		img := &resp.Images[f.Index]
+		img.Inline = append(img.Inline, inlineOutput{URL: f.URL, ContentType: contentTypeOf(f.URL), Data: data})
+	}
+}
+
+// acceptsMultipart reports whether the client asked, through its Accept
+// header, for the output files inline in a multipart/mixed response.
+func acceptsMultipart(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil || mediaType != "multipart/mixed" {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// writeMultipart responds with the outputs of the finished job j in one
+// multipart/mixed body: first head as JSON, then every
+// output file, annotated images and detections alike, in that order. Each
+// file part names its URL in Content-Location and its input in
+// X-Input-Index. Files are streamed from disk one at a time; a file that
+// cannot be read once the response has started ends the body without its
+// closing boundary, so clients can tell it is incomplete.
+func writeMultipart(w http.ResponseWriter, t *tenant, j *job, head interface{}) {
+	mw, err := startMultipart(w, head)
+	if err != nil {
+		log.Printf("Could not send multipart response of job %s: %v", j.ID, err)
+		return
+	}
+	for _, f := range j.Files {
+		if err := writeOutputPart(mw, t, j, f); err != nil {
+			log.Printf("Could not send multipart response of job %s: %v", j.ID, err)
+			return
+		}
+	}
+	mw.Close()
+}
+
+// startMultipart starts a multipart/mixed response with head, the list of
+// output files or the /v2 response, as its first part.
+func startMultipart(w http.ResponseWriter, head interface{}) (*multipart.Writer, error) {
+	list, err := json.Marshal(head)
+	if err != nil {
+		return nil, err
+	}
+	mw := multipart.NewWriter(w)
+	setupResponse(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.WriteHeader(http.StatusOK)
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json"}})
+	if err != nil {
+		return nil, err
+	}
+	_, err = part.Write(append(list, '\n'))
+	return mw, err
+}
+
+func writeOutputPart(mw *multipart.Writer, t *tenant, j *job, f outputFile) error {
+	file, err := os.Open(j.outputFilePath(t, f))
+	if err != nil {
+		return fmt.Errorf("could not open output %s: %v", f.URL, err)
+	}
+	defer file.Close()
+	return writeFilePart(mw, path.Base(f.URL), f.URL, f.Index, file)
+}
+
+// writeFilePart adds the file name with content r to mw. location is its
+// URL, if it has one, and index that of its input, or -1.
+func writeFilePart(mw *multipart.Writer, name, location string, index int, r io.Reader) error {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h := textproto.MIMEHeader{
+		"Content-Type":        {contentType},
+		"Content-Disposition": {mime.FormatMediaType("inline", map[string]string{"filename": name})},
+	}
+	if location != "" {
+		h.Set("Content-Location", location)
+	}
+	if index >= 0 {
+		h.Set("X-Input-Index", strconv.Itoa(index))
+	}
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, r)
+	return err
+}
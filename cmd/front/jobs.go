@@ -0,0 +1,779 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+var jobIDRe = regexp.MustCompile(`^[0-9a-f]+$`)
+
+// job is a single recognition run. Its record is stored as <id>.json next to
+// the tenant's input directories so it survives restarts.
+type job struct {
+	ID         string                     `json:"id"`
+	Status     string                     `json:"status"`
+	ImageURLs  []string                   `json:"image_urls,omitempty"`
+	Uploads    []string                   `json:"uploads,omitempty"`
+	Model      string                     `json:"model,omitempty"`
+	Threshold  float64                    `json:"threshold,omitempty"`
+	Metadata   map[string]string          `json:"metadata,omitempty"`
+	Tags       []string                   `json:"tags,omitempty"`
+	InputID    string                     `json:"input_id,omitempty"`
+	Crops      bool                       `json:"crops,omitempty"`
+	DryRun     bool                       `json:"dry_run,omitempty"`
+	Inputs     []string                   `json:"inputs,omitempty"`
+	CreatedAt  time.Time                  `json:"created_at"`
+	FinishedAt *time.Time                 `json:"finished_at,omitempty"`
+	Outputs    []string                   `json:"outputs,omitempty"`
+	Files      []outputFile               `json:"files,omitempty"`
+	Hooks      map[string]json.RawMessage `json:"hooks,omitempty"`
+	Error      string                     `json:"error,omitempty"`
+	ErrorCode  string                     `json:"error_code,omitempty"`
+	// ErrorDetails lists the failed items when the job failed on some of
+	// its images.
+	ErrorDetails []errorDetail `json:"error_details,omitempty"`
+	// Discrepancies lists problems found when verifying darkflow's results,
+	// such as inputs without output or annotations that do not parse.
+	Discrepancies []errorDetail `json:"discrepancies,omitempty"`
+	// Warnings lists non-fatal issues of the inputs, such as JPEGs without
+	// Exif data or detections dropped by the class thresholds and filters.
+	Warnings []errorDetail `json:"warnings,omitempty"`
+	// Retain is the client's retention hint; ExpiresAt is when the janitor
+	// deletes the job's data and DeletedAt when it did.
+	Retain    string     `json:"retain,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Checksums are the SHA-256 checksums the client expected of its image
+	// URLs; InputChecksums are those of the images as staged, before any
+	// preprocessing, in the order of the inputs.
+	Checksums      map[string]string `json:"checksums,omitempty"`
+	InputChecksums []string          `json:"input_checksums,omitempty"`
+	// InputMetadata are the dimensions and Exif data of the images as
+	// staged, in the order of the inputs, null for those that failed.
+	InputMetadata []*imageMetadata `json:"input_metadata,omitempty"`
+	Timings       *jobTimings      `json:"timings,omitempty"`
+	// Compare marks the jobs of /compare, whose outputs are split by side.
+	Compare bool `json:"compare,omitempty"`
+	// ResumedAt is when the job was resumed after a restart of the
+	// frontend interrupted it.
+	ResumedAt *time.Time `json:"resumed_at,omitempty"`
+	// Render are the client's preferences for the annotated images.
+	Render *renderOptions `json:"render,omitempty"`
+	// ClassThresholds are the minimum confidences of classes, the server
+	// defaults merged with the request's; other classes need Threshold.
+	ClassThresholds map[string]float64 `json:"class_thresholds,omitempty"`
+	// Filters are the output filters, the server defaults merged with the
+	// request's.
+	Filters *outputFilters `json:"filters,omitempty"`
+	// Skipped lists the inputs that failed to stage and that a /v2 job went
+	// on without.
+	Skipped []errorDetail `json:"skipped,omitempty"`
+	// Async marks the jobs answered 202 Accepted for being over the
+	// synchronous caps; ErrorStatus is the HTTP status their request
+	// would have failed with.
+	Async       bool `json:"async,omitempty"`
+	ErrorStatus int  `json:"error_status,omitempty"`
+	// Report is the format of the job's report, pdf or html, empty for
+	// the server default.
+	Report string `json:"report,omitempty"`
+	// Heatmap is the class, or * for all, of the job's heatmap.
+	Heatmap string `json:"heatmap,omitempty"`
+	// Set is the image set the job ran for.
+	Set string `json:"set,omitempty"`
+	// Manifest is the manifest the job ran a chunk of.
+	Manifest string `json:"manifest,omitempty"`
+	// IncludeImages is the include_images option of the request, which
+	// its response follows.
+	IncludeImages string `json:"include_images,omitempty"`
+	// Environment is what the job last ran on: the frontend, its
+	// configuration, and the darkflow backend and model.
+	Environment *jobEnvironment `json:"environment,omitempty"`
+	// Summary totals the detections of a finished job by class, as its
+	// results pages report them.
+	Summary *resultSummary `json:"summary,omitempty"`
+	// QASampled marks the jobs copied to -qa-destination for review.
+	QASampled bool `json:"qa_sampled,omitempty"`
+	// FailedStage is the pipeline stage a failed job failed in. Retries
+	// counts the times it was retried, last at RetriedAt.
+	FailedStage string     `json:"failed_stage,omitempty"`
+	Retries     int        `json:"retries,omitempty"`
+	RetriedAt   *time.Time `json:"retried_at,omitempty"`
+
+	// lock is held while the job runs with -job-locks.
+	lock *jobLock
+	// stage is the stage processJob got to.
+	stage string
+	// CallbackURL is where the job record is POSTed when the job finishes.
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+func newJob() *job {
+	return &job{
+		ID:        generateID(8),
+		Status:    jobRunning,
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+const (
+	maxTags        = 32
+	maxMetadata    = 32
+	maxMetadataLen = 1024
+)
+
+// validateLabels checks the client supplied metadata and tags of a job.
+func validateLabels(metadata map[string]string, tags []string) error {
+	if len(metadata) > maxMetadata {
+		return fmt.Errorf("at most %d metadata entries are allowed", maxMetadata)
+	}
+	for k, v := range metadata {
+		if k == "" || len(k) > maxMetadataLen || len(v) > maxMetadataLen {
+			return fmt.Errorf("metadata keys must be non-empty and keys and values at most %d bytes", maxMetadataLen)
+		}
+	}
+	if len(tags) > maxTags {
+		return fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	for _, tag := range tags {
+		if tag == "" || len(tag) > maxMetadataLen {
+			return fmt.Errorf("tags must be non-empty and at most %d bytes", maxMetadataLen)
+		}
+	}
+	return nil
+}
+
+// matches reports whether j carries all tags and metadata values of filter.
+func (j *job) matches(tags []string, metadata map[string]string) bool {
+	for _, want := range tags {
+		found := false
+		for _, tag := range j.Tags {
+			if tag == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for k, v := range metadata {
+		if got, ok := j.Metadata[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// imageCount is the number of input images of the job.
+func (j *job) imageCount() int {
+	return len(j.ImageURLs) + len(j.Uploads)
+}
+
+// inputName returns the image URL or uploaded file name of input index.
+func (j *job) inputName(index int) string {
+	if index < len(j.ImageURLs) {
+		return j.ImageURLs[index]
+	}
+	if index-len(j.ImageURLs) < len(j.Uploads) {
+		return j.Uploads[index-len(j.ImageURLs)]
+	}
+	return ""
+}
+
+// indexedInput is an input file of a job, as listed in j.Inputs, and the
+// index of the image it was staged from.
+type indexedInput struct {
+	index int
+	path  string
+}
+
+// indexedInputs returns the inputs of j in the order of their indexes, which
+// their files are named after. The position of a file in j.Inputs is not
+// its index: the files are listed as sorted by name, 10.jpg before 2.jpg, and
+// inputs that failed to stage are missing.
+func (j *job) indexedInputs() []indexedInput {
+	var inputs []indexedInput
+	for _, p := range j.Inputs {
+		name := filepath.Base(p)
+		i, err := strconv.Atoi(strings.TrimSuffix(name, filepath.Ext(name)))
+		if err != nil || i < 0 {
+			continue
+		}
+		inputs = append(inputs, indexedInput{index: i, path: p})
+	}
+	sort.Slice(inputs, func(a, b int) bool { return inputs[a].index < inputs[b].index })
+	return inputs
+}
+
+// inputID is the ID of the job whose downloaded inputs this job processes.
+// It differs from ID for re-runs.
+func (j *job) inputID() string {
+	if j.InputID != "" {
+		return j.InputID
+	}
+	return j.ID
+}
+
+// stagingDir holds the directories of running jobs. They are promoted to
+// their final location by finishJob, so a job that crashes or is cancelled
+// never leaves a half-populated directory next to finished ones.
+const stagingDir = ".staging"
+
+// inputPath is where the job's inputs are while it is running and, for
+// re-runs and finished jobs, where they were promoted to.
+func (j *job) inputPath(t *tenant) string {
+	if j.InputID == "" && j.Status == jobRunning {
+		return filepath.Join(t.inputDir(), stagingDir, j.ID)
+	}
+	return j.finalInputPath(t)
+}
+
+func (j *job) finalInputPath(t *tenant) string {
+	return filepath.Join(t.inputDir(), j.inputID())
+}
+
+// outputPath is where the job's outputs are while it is running and, once
+// it finished, where they were promoted to.
+func (j *job) outputPath(t *tenant) string {
+	if j.Status == jobRunning {
+		return filepath.Join(t.outputDir(), stagingDir, j.ID)
+	}
+	return j.finalOutputPath(t)
+}
+
+func (j *job) finalOutputPath(t *tenant) string {
+	return filepath.Join(t.outputDir(), j.ID)
+}
+
+// promoteJob moves the staged directories of a job that is finishing with
+// status into place. Outputs of failed jobs are discarded, and so are inputs
+// when the job failed before they were all staged or was cancelled;
+// otherwise inputs are kept for re-runs.
+func promoteJob(t *tenant, j *job, status string) {
+	failed := status != jobDone
+	moves := [][2]string{}
+	if j.InputID == "" {
+		if failed && j.Inputs == nil || status == jobCancelled {
+			os.RemoveAll(j.inputPath(t))
+			j.Inputs = nil
+		} else {
+			moves = append(moves, [2]string{j.inputPath(t), j.finalInputPath(t)})
+		}
+	}
+	if failed {
+		os.RemoveAll(j.outputPath(t))
+	} else {
+		moves = append(moves, [2]string{j.outputPath(t), j.finalOutputPath(t)})
+	}
+	for _, m := range moves {
+		if err := os.Rename(m[0], m[1]); err != nil && !os.IsNotExist(err) {
+			log.Printf("Could not promote %s of job %s: %v", m[0], j.ID, err)
+		}
+	}
+}
+
+func jobRecordPath(t *tenant, id string) string {
+	return filepath.Join(t.inputDir(), id+".json")
+}
+
+func saveJob(t *tenant, j *job) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return fmt.Errorf("could not encode job: %v", err)
+	}
+	if err := os.MkdirAll(t.inputDir(), 0755); err != nil {
+		return fmt.Errorf("could not create input dir: %v", err)
+	}
+	if err := ioutil.WriteFile(jobRecordPath(t, j.ID), data, 0644); err != nil {
+		return fmt.Errorf("could not save job: %v", err)
+	}
+	return nil
+}
+
+// loadJob reads a job record of tenant t. Jobs of other tenants are never
+// found since lookups are confined to t's input directory.
+func loadJob(t *tenant, id string) (*job, error) {
+	if !jobIDRe.MatchString(id) {
+		return nil, os.ErrNotExist
+	}
+	data, err := ioutil.ReadFile(jobRecordPath(t, id))
+	if err != nil {
+		return nil, err
+	}
+	var j job
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, fmt.Errorf("could not parse job %s: %v", id, err)
+	}
+	return &j, nil
+}
+
+// listJobs returns all job records of tenant t, newest first.
+func listJobs(t *tenant) ([]*job, error) {
+	names, err := filepath.Glob(filepath.Join(t.inputDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*job, 0, len(names))
+	for _, name := range names {
+		j, err := loadJob(t, strings.TrimSuffix(filepath.Base(name), ".json"))
+		if err != nil {
+			log.Printf("Skipping job record %s: %v", name, err)
+			continue
+		}
+		list = append(list, j)
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].CreatedAt.After(list[b].CreatedAt) })
+	return list, nil
+}
+
+// finishJob records the outcome of j and persists it.
+func finishJob(t *tenant, j *job, err error) {
+	status := jobDone
+	if err != nil {
+		status = jobFailed
+		if code := codeOr(err, ""); code == codeCancelled || code == codeClientDisconnected {
+			status = jobCancelled
+		}
+	}
+	if j.Status == jobRunning {
+		promoteJob(t, j, status)
+	}
+	now := time.Now().UTC()
+	j.FinishedAt = &now
+	j.Status = status
+	if err != nil {
+		j.Error = err.Error()
+		j.ErrorCode, j.ErrorDetails = errorCode(err, 0)
+	}
+	if status == jobFailed {
+		// Jobs fail in staging until processJob takes over.
+		j.FailedStage = j.stage
+		if j.FailedStage == "" {
+			j.FailedStage = stageDownload
+		}
+	}
+	if d := retentionOf(j); d > 0 {
+		expires := now.Add(d)
+		j.ExpiresAt = &expires
+	}
+	j.QASampled = sampledForQA(j)
+	if err := saveJob(t, j); err != nil {
+		log.Printf("Could not persist job %s: %v", j.ID, err)
+	}
+	j.unlock()
+	metrics.observe(j)
+	usage.observe(j)
+	exportJob(t, j)
+	copyForQA(t, j)
+	replicateJob(j)
+	deliverCallback(t, j)
+	if status == jobFailed {
+		notify(eventJobFailed, "Job "+j.ID+" failed", "Job %s of tenant %q failed with %s: %s", j.ID, t.Name, j.ErrorCode, j.Error)
+	}
+}
+
+// finishJobStatus is finishJob for a request that fails with the HTTP status
+// when err is not nil. Asynchronous jobs record it for GET /jobs/{id}/response
+// before they are persisted and handed on.
+func finishJobStatus(t *tenant, j *job, status int, err error) {
+	if err != nil && j.Async {
+		j.ErrorStatus = status
+	}
+	finishJob(t, j, err)
+}
+
+// processJob runs darkflow over the job's inputs and collects the produced
+// output URLs. Dry-run jobs stop after listing the staged inputs. On failure
+// it returns the HTTP status to respond with.
+func processJob(ctx context.Context, t *tenant, j *job) (int, error) {
+	input := j.inputPath(t)
+	staged, err := ioutil.ReadDir(input)
+	if err != nil {
+		err = fmt.Errorf("could not read input dir: %v", err)
+		finishJobStatus(t, j, http.StatusInternalServerError, err)
+		return http.StatusInternalServerError, err
+	}
+	// Inputs are listed where they will be once the job finished.
+	j.Inputs = make([]string, len(staged))
+	for i, f := range staged {
+		j.Inputs[i] = filepath.Join(j.finalInputPath(t), f.Name())
+	}
+	j.Warnings = metadataWarnings(j)
+	j.Environment = newEnvironment(j.Model)
+	if j.DryRun || dryRun {
+		j.DryRun = true
+		finishJob(t, j, nil)
+		return 0, nil
+	}
+
+	j.stage = stageBackend
+	start := time.Now()
+	status, err := callDarkflow(withBackendLog(ctx, t, j.ID), darkflowRequest{
+		InputDir:  input,
+		OutputDir: j.outputPath(t),
+		Model:     j.Model,
+		Threshold: j.darkflowThreshold(),
+		images:    len(staged),
+		env:       j.Environment,
+	})
+	j.addTiming(stageBackend, time.Since(start))
+	if err != nil {
+		finishJobStatus(t, j, status, err)
+		return status, err
+	}
+	if err := dropInjectedOutputs(ctx, j.outputPath(t)); err != nil {
+		finishJobStatus(t, j, http.StatusInternalServerError, err)
+		return http.StatusInternalServerError, err
+	}
+
+	j.stage = stagePostProcessing
+	start = time.Now()
+	status, err = postProcess(t, j)
+	j.addTiming(stagePostProcessing, time.Since(start))
+	finishJobStatus(t, j, status, err)
+	return status, err
+}
+
+// postProcess verifies and collects darkflow's outputs for j and runs the
+// configured crops, hooks and checksums over them. On failure it returns the
+// HTTP status to respond with.
+func postProcess(t *tenant, j *job) (int, error) {
+	var err error
+	j.Discrepancies, err = verifyOutputs(j.outputPath(t), j.imageCount(), j.inputName)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	j.Discrepancies = withoutSkipped(j, j.Discrepancies)
+	if len(j.Discrepancies) > 0 {
+		log.Printf("Darkflow results of job %s have %d discrepancies, first: %s", j.ID, len(j.Discrepancies), j.Discrepancies[0].Message)
+	}
+	if err := discrepancyError(j.Discrepancies); err != nil {
+		return http.StatusBadGateway, err
+	}
+	if err := applyClassThresholds(t, j); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := applyFilters(t, j); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := renderOutputs(t, j); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	j.Files, err = renameOutputs(t, j)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	j.Outputs = make([]string, len(j.Files))
+	for i, f := range j.Files {
+		j.Outputs[i] = f.URL
+	}
+	if j.Crops || cropDetections {
+		j.Crops = true
+		if err := cropOutputs(t, j); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	if err := writeHeatmap(t, j); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := writeReport(t, j); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := runPostHooks(t, j); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := checksumOutputs(t, j); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	summary := summarizeResults(t, j)
+	j.Summary = &summary
+	linkBlobs(t, j)
+	return 0, nil
+}
+
+type rerunRequest struct {
+	Model     string            `json:"model"`
+	Threshold float64           `json:"threshold"`
+	DryRun    bool              `json:"dry_run"`
+	Crops     bool              `json:"crops"`
+	Metadata  map[string]string `json:"metadata"`
+	Tags      []string          `json:"tags"`
+	Retain    string            `json:"retain"`
+	// Render replaces the rendering options of the source job.
+	Render *renderOptions `json:"render"`
+	// ClassThresholds override those of the source job class by class.
+	ClassThresholds map[string]float64 `json:"class_thresholds"`
+	// Filters override those of the source job filter by filter.
+	Filters *outputFilters `json:"filters"`
+	// Report replaces the report format of the source job.
+	Report string `json:"report"`
+	// Heatmap replaces the heatmap class of the source job.
+	Heatmap string `json:"heatmap"`
+	// CallbackURL replaces the callback of the source job.
+	CallbackURL string `json:"callback_url"`
+}
+
+// jobs serves the /jobs/{id}/... endpoints.
+func jobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		setupResponse(w)
+		return
+	}
+	t, ok := admit(w, r)
+	if !ok {
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	parts := strings.Split(rest, "/")
+	switch {
+	case rest == "" && r.Method == http.MethodGet:
+		getJobs(w, r, t)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		getJob(w, t, parts[0])
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		removeJob(w, t, parts[0])
+	case len(parts) == 2 && parts[1] == "cancel" && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		cancelJob(w, t, parts[0])
+	case len(parts) == 2 && parts[1] == "results" && r.Method == http.MethodGet:
+		getResults(w, r, t, parts[0])
+	case len(parts) == 2 && parts[1] == "stats" && r.Method == http.MethodGet:
+		getStats(w, t, parts[0])
+	case len(parts) == 2 && parts[1] == "rerun" && r.Method == http.MethodPost:
+		rerun(w, r, t, parts[0])
+	case len(parts) == 2 && parts[1] == "retry" && r.Method == http.MethodPost:
+		retryJob(w, r, t, parts[0])
+	case len(parts) == 2 && parts[1] == "response" && r.Method == http.MethodGet:
+		getResponse(w, r, t, parts[0])
+	default:
+		jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// getJobs lists the tenant's jobs. Repeated tag parameters and
+// meta.<key>=<value> parameters narrow the list to jobs carrying all of them.
+func getJobs(w http.ResponseWriter, r *http.Request, t *tenant) {
+	query := r.URL.Query()
+	tags := query["tag"]
+	metadata := make(map[string]string)
+	for k, vs := range query {
+		if strings.HasPrefix(k, "meta.") && len(vs) > 0 {
+			metadata[strings.TrimPrefix(k, "meta.")] = vs[0]
+		}
+	}
+
+	all, err := listJobs(t)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, fmt.Errorf("could not list jobs: %v", err))
+		return
+	}
+	list := make([]*job, 0, len(all))
+	for _, j := range all {
+		if j.matches(tags, metadata) {
+			list = append(list, j)
+		}
+	}
+	jsonResponse(w, http.StatusOK, list)
+}
+
+// getJob responds with the record of job id.
+func getJob(w http.ResponseWriter, t *tenant, id string) {
+	j, err := loadJob(t, id)
+	if os.IsNotExist(err) {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("job %s not found", id))
+		return
+	}
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if j.DeletedAt == nil {
+		setOutputToken(w, t, j)
+	}
+	envelopeJob(w, j)
+	jsonResponse(w, http.StatusOK, j)
+}
+
+// rerun reprocesses the inputs downloaded by an earlier job as a new job,
+// optionally overriding its model and threshold. The original image URLs are
+// not fetched again.
+func rerun(w http.ResponseWriter, r *http.Request, t *tenant, id string) {
+	received := time.Now()
+	src, err := loadJob(t, id)
+	if os.IsNotExist(err) {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("job %s not found", id))
+		return
+	}
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var req rerunRequest
+	var status int
+	if r.ContentLength != 0 {
+		status, err = decodeJSONBody(w, r, &req)
+		if err != nil {
+			jsonError(w, status, err)
+			return
+		}
+	}
+
+	if err := validateRetention(req.Retain); err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, err := os.Stat(src.inputPath(t)); err != nil {
+		jsonError(w, http.StatusGone, fmt.Errorf("inputs of job %s are no longer available", id))
+		return
+	}
+	if err := checkMaintenance(); err != nil {
+		jsonError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err := darkflowQueue.check(); err != nil {
+		jsonError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	j := newJob()
+	j.ImageURLs = src.ImageURLs
+	j.Uploads = src.Uploads
+	j.InputID = src.inputID()
+	j.Model = src.Model
+	j.Threshold = src.Threshold
+	if req.Model != "" {
+		j.Model = req.Model
+	}
+	if req.Threshold != 0 {
+		j.Threshold = req.Threshold
+	}
+	if len(src.ClassThresholds) > 0 || len(req.ClassThresholds) > 0 {
+		j.ClassThresholds = make(map[string]float64)
+		for class, v := range src.ClassThresholds {
+			j.ClassThresholds[class] = v
+		}
+		for class, v := range req.ClassThresholds {
+			j.ClassThresholds[class] = v
+		}
+	}
+	if src.Filters != nil || req.Filters != nil {
+		j.Filters = &outputFilters{}
+		if src.Filters != nil {
+			*j.Filters = *src.Filters
+		}
+		if req.Filters != nil {
+			if req.Filters.MinBoxArea != 0 {
+				j.Filters.MinBoxArea = req.Filters.MinBoxArea
+			}
+			if req.Filters.MaxDetections != 0 {
+				j.Filters.MaxDetections = req.Filters.MaxDetections
+			}
+			if req.Filters.NMSIoU != 0 {
+				j.Filters.NMSIoU = req.Filters.NMSIoU
+			}
+		}
+	}
+	j.DryRun = req.DryRun
+	j.Crops = req.Crops || src.Crops
+	j.Metadata = src.Metadata
+	j.Tags = src.Tags
+	if req.Metadata != nil {
+		j.Metadata = req.Metadata
+	}
+	if req.Tags != nil {
+		j.Tags = req.Tags
+	}
+	j.Retain = src.Retain
+	j.InputChecksums = src.InputChecksums
+	j.InputMetadata = src.InputMetadata
+	j.Skipped = src.Skipped
+	j.Render = src.Render
+	if req.Render != nil {
+		j.Render = req.Render
+	}
+	if req.Retain != "" {
+		j.Retain = req.Retain
+	}
+	j.CallbackURL = src.CallbackURL
+	if req.CallbackURL != "" {
+		j.CallbackURL = req.CallbackURL
+	}
+	if err := validateCallback(t, j.CallbackURL); err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	j.Report = src.Report
+	if req.Report != "" {
+		j.Report = req.Report
+	}
+	j.Heatmap = src.Heatmap
+	if req.Heatmap != "" {
+		j.Heatmap = req.Heatmap
+	}
+	if err := validateLabels(j.Metadata, j.Tags); err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateRender(j.Render); err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateClassThresholds(j.ClassThresholds); err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateFilters(j.Filters); err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateHeatmap(j.Heatmap); err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateReport(j.Report); err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	// The quota is charged only once the re-run is known to be valid.
+	if err := t.reserveImages(src.imageCount()); err != nil {
+		jsonError(w, http.StatusTooManyRequests, err)
+		return
+	}
+	j.addTiming(stageValidation, time.Since(received))
+	if err := createJob(t, j); err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Printf("Re-running job %s as %s", id, j.ID)
+	setOutputToken(w, t, j)
+	ctx, cancel := jobContext(r, t, j.ID)
+	defer cancel()
+	status, err = processJob(ctx, t, j)
+	if err != nil {
+		jsonError(w, status, err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, j)
+}
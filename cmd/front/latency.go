@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var adaptiveTimeoutFactor float64
+var adaptiveTimeoutMin time.Duration
+var adaptiveTimeoutMax time.Duration
+var adaptiveTimeoutSamples int
+
+// latencyWindow is how many of the most recent darkflow calls of each batch
+// size the adaptive timeout is derived from.
+const latencyWindow = 256
+
+// latencies tracks how long darkflow takes per batch size, to derive
+// -adaptive-timeout-factor deadlines from.
+var latencies = &latencyTracker{buckets: make(map[int]*latencyBucket)}
+
+type latencyTracker struct {
+	mu      sync.Mutex
+	buckets map[int]*latencyBucket
+}
+
+// latencyBucket is a ring of the durations of recent successful calls with
+// a batch size in [2^n, 2^(n+1)).
+type latencyBucket struct {
+	samples []time.Duration
+	next    int
+}
+
+// latencyBucketOf returns n for batches of size images in [2^n, 2^(n+1)).
+func latencyBucketOf(images int) int {
+	if images < 1 {
+		images = 1
+	}
+	return bits.Len(uint(images)) - 1
+}
+
+// observe records a successful darkflow call over images images.
+func (l *latencyTracker) observe(images int, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := latencyBucketOf(images)
+	b := l.buckets[n]
+	if b == nil {
+		b = &latencyBucket{}
+		l.buckets[n] = b
+	}
+	if len(b.samples) < latencyWindow {
+		b.samples = append(b.samples, d)
+		return
+	}
+	b.samples[b.next] = d
+	b.next = (b.next + 1) % latencyWindow
+}
+
+// percentiles returns the p50 and p99 of bucket n and its number of
+// samples.
+func (l *latencyTracker) percentiles(n int) (p50, p99 time.Duration, samples int) {
+	l.mu.Lock()
+	b := l.buckets[n]
+	var sorted []time.Duration
+	if b != nil {
+		sorted = append(sorted, b.samples...)
+	}
+	l.mu.Unlock()
+	if len(sorted) == 0 {
+		return 0, 0, 0
+	}
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a] < sorted[b] })
+	return nearestRank(sorted, 0.5), nearestRank(sorted, 0.99), len(sorted)
+}
+
+func nearestRank(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// backendTimeout is the deadline of a darkflow call over images images:
+// the p99 of recent calls of that batch size times -adaptive-timeout-factor,
+// kept within -adaptive-timeout-min and -adaptive-timeout-max. Until enough
+// calls of the size were seen, and without a factor, it is -darkflow-timeout.
+func backendTimeout(images int) time.Duration {
+	if adaptiveTimeoutFactor <= 0 {
+		return darkflowTimeout
+	}
+	_, p99, samples := latencies.percentiles(latencyBucketOf(images))
+	if samples < adaptiveTimeoutSamples {
+		return darkflowTimeout
+	}
+	return adaptiveTimeout(p99)
+}
+
+func adaptiveTimeout(p99 time.Duration) time.Duration {
+	d := time.Duration(float64(p99) * adaptiveTimeoutFactor)
+	if d < adaptiveTimeoutMin {
+		d = adaptiveTimeoutMin
+	}
+	if adaptiveTimeoutMax > 0 && d > adaptiveTimeoutMax {
+		d = adaptiveTimeoutMax
+	}
+	return d
+}
+
+// seedLatencies fills the tracker from the backend timings of finished jobs
+// so that adaptive timeouts apply right after a restart. Those timings
+// include the wait for a free darkflow slot, which errs on the side of
+// longer deadlines until fresh calls replace them.
+func seedLatencies() {
+	if adaptiveTimeoutFactor <= 0 {
+		return
+	}
+	seeded := 0
+	for _, t := range allTenants() {
+		list, err := listJobs(t)
+		if err != nil {
+			log.Printf("Could not list jobs of tenant %q to seed timeouts: %v", t.Name, err)
+			continue
+		}
+		// Oldest first, so that the window keeps the most recent.
+		for i := len(list) - 1; i >= 0; i-- {
+			j := list[i]
+			if j.Status != jobDone || j.DryRun || j.Compare || j.ResumedAt != nil || j.Timings == nil || j.Timings.Backend <= 0 {
+				continue
+			}
+			latencies.observe(len(j.Inputs), time.Duration(j.Timings.Backend*float64(time.Second)))
+			seeded++
+		}
+	}
+	if seeded > 0 {
+		log.Printf("Seeded adaptive darkflow timeouts from %d finished jobs", seeded)
+	}
+}
+
+// timeoutSuggestion is the latency of one batch size range and the
+// deadline derived from it.
+type timeoutSuggestion struct {
+	// Images is the range of batch sizes, e.g. "4-7".
+	Images     string  `json:"images"`
+	Samples    int     `json:"samples"`
+	P50Seconds float64 `json:"p50_seconds"`
+	P99Seconds float64 `json:"p99_seconds"`
+	// SuggestedSeconds is p99 times the factor, within the bounds.
+	SuggestedSeconds float64 `json:"suggested_seconds"`
+	// TimeoutSeconds is the deadline calls of this size get now, 0 for
+	// none.
+	TimeoutSeconds float64 `json:"timeout_seconds"`
+}
+
+type timeoutsResponse struct {
+	Factor         float64             `json:"factor"`
+	MinSamples     int                 `json:"min_samples"`
+	DefaultSeconds float64             `json:"default_seconds"`
+	Buckets        []timeoutSuggestion `json:"buckets"`
+}
+
+// adminTimeouts serves GET /admin/timeouts, the observed darkflow latency
+// per batch size with the timeouts it suggests. Without
+// -adaptive-timeout-factor the suggestions use a factor of 3, to help pick
+// one or a fixed -darkflow-timeout.
+func adminTimeouts(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		setupResponse(w)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+		return
+	}
+	factor := adaptiveTimeoutFactor
+	if factor <= 0 {
+		factor = 3
+	}
+	latencies.mu.Lock()
+	var ns []int
+	for n := range latencies.buckets {
+		ns = append(ns, n)
+	}
+	latencies.mu.Unlock()
+	sort.Ints(ns)
+
+	resp := timeoutsResponse{
+		Factor:         adaptiveTimeoutFactor,
+		MinSamples:     adaptiveTimeoutSamples,
+		DefaultSeconds: darkflowTimeout.Seconds(),
+		Buckets:        []timeoutSuggestion{},
+	}
+	for _, n := range ns {
+		p50, p99, samples := latencies.percentiles(n)
+		suggested := time.Duration(float64(p99) * factor)
+		if adaptiveTimeoutFactor > 0 {
+			suggested = adaptiveTimeout(p99)
+		}
+		images := strconv.Itoa(1 << n)
+		if n > 0 {
+			images += "-" + strconv.Itoa(1<<(n+1)-1)
+		}
+		resp.Buckets = append(resp.Buckets, timeoutSuggestion{
+			Images:           images,
+			Samples:          samples,
+			P50Seconds:       p50.Seconds(),
+			P99Seconds:       p99.Seconds(),
+			SuggestedSeconds: suggested.Seconds(),
+			TimeoutSeconds:   backendTimeout(1 << n).Seconds(),
+		})
+	}
+	jsonResponse(w, http.StatusOK, resp)
+}
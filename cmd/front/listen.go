@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var listenAddrs stringList
+var adminListenAddrs stringList
+
+// isAdminPath reports whether path belongs to the endpoints moved to
+// -admin-listen when it is set.
+func isAdminPath(path string) bool {
+	return strings.HasPrefix(path, "/admin/")
+}
+
+// splitHandlers returns the handlers of the public and admin listeners. Without
+// -admin-listen everything is public.
+func splitHandlers(h http.Handler) (public, admin http.Handler) {
+	if len(adminListenAddrs) == 0 {
+		return h, nil
+	}
+	public = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isAdminPath(r.URL.Path) {
+			jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+	admin = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isAdminPath(r.URL.Path) {
+			jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+	return public, admin
+}
+
+// listen opens addr, or takes it over from the predecessor of the process,
+// which is host:port with an optional tcp4: or tcp6:
+// prefix to restrict it to one address family. [::]:port and :port accept
+// both IPv4 and IPv6 where the system allows dual-stack sockets.
+func listen(addr string) (net.Listener, error) {
+	network := "tcp"
+	for _, n := range []string{"tcp4", "tcp6"} {
+		if strings.HasPrefix(addr, n+":") {
+			network, addr = n, strings.TrimPrefix(addr, n+":")
+		}
+	}
+	if l, ok := inheritedListener(addr); ok {
+		return l, nil
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on %s: %v", addr, err)
+	}
+	return l, nil
+}
+
+// serve starts a server with handler h on every one of addrs. Errors of the
+// running servers are sent to errs.
+func serve(addrs []string, h http.Handler, errs chan<- error) error {
+	for _, addr := range addrs {
+		l, err := listen(addr)
+		if err != nil {
+			return err
+		}
+		srv := &http.Server{Handler: h}
+		if enableH2C {
+			// Internal clients may speak HTTP/2 with prior knowledge over
+			// plain TCP; HTTP/1.1 clients are unaffected.
+			srv.Protocols = new(http.Protocols)
+			srv.Protocols.SetHTTP1(true)
+			srv.Protocols.SetUnencryptedHTTP2(true)
+		}
+		servers.mu.Lock()
+		servers.list = append(servers.list, srv)
+		servers.addrs = append(servers.addrs, addr)
+		servers.listeners = append(servers.listeners, l)
+		servers.mu.Unlock()
+		log.Printf("Listening on %s", l.Addr())
+		go func() {
+			// Serve ends when the process drains and closes l.
+			if err := srv.Serve(l); !draining.Load() {
+				errs <- err
+			}
+		}()
+	}
+	return nil
+}
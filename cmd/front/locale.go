@@ -0,0 +1,153 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// localeFiles are the message catalogs, locales/<language>.json, each
+// mapping error codes to their message in the language.
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// catalogs map languages to their messages. English has none: it is the
+// language errors are written in, with the specifics the catalogs leave
+// out.
+var catalogs = loadCatalogs()
+
+func loadCatalogs() map[string]map[string]string {
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	catalogs := make(map[string]map[string]string)
+	for _, f := range files {
+		data, err := localeFiles.ReadFile(path.Join("locales", f.Name()))
+		if err != nil {
+			panic(err)
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			panic("invalid message catalog " + f.Name() + ": " + err.Error())
+		}
+		catalogs[strings.TrimSuffix(f.Name(), ".json")] = messages
+	}
+	return catalogs
+}
+
+// preferredLanguage picks the language of a catalog the Accept-Language
+// header ranks highest, or "" for English, the default.
+func preferredLanguage(header string) string {
+	type choice struct {
+		lang string
+		q    float64
+	}
+	var choices []choice
+	for _, entry := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(entry), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		lang, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if lang != "" && q > 0 {
+			choices = append(choices, choice{lang, q})
+		}
+	}
+	sort.SliceStable(choices, func(a, b int) bool { return choices[a].q > choices[b].q })
+	for _, c := range choices {
+		if c.lang == "en" {
+			return ""
+		}
+		if _, ok := catalogs[c.lang]; ok {
+			return c.lang
+		}
+	}
+	return ""
+}
+
+// localizeHandler has the error responses of requests follow their
+// Accept-Language header.
+func localizeHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lang := preferredLanguage(r.Header.Get("Accept-Language"))
+		if lang == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&localeResponseWriter{ResponseWriter: w, lang: lang}, r)
+	})
+}
+
+// localeResponseWriter carries the language of a request to jsonError.
+type localeResponseWriter struct {
+	http.ResponseWriter
+	lang string
+}
+
+// ReadFrom passes io.Copy through so that files are still served with
+// sendfile.
+func (w *localeResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(w.ResponseWriter, r)
+}
+
+func (w *localeResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection.
+func (w *localeResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// languageOf returns the language the response w is written in, looking
+// through the writers wrapping it.
+func languageOf(w http.ResponseWriter) string {
+	for {
+		switch v := w.(type) {
+		case *localeResponseWriter:
+			return v.lang
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return ""
+		}
+	}
+}
+
+// localize translates the messages of body, and of its details, into lang
+// where its catalog has them.
+func localize(body *errorBody, lang string) {
+	messages := catalogs[lang]
+	if m, ok := messages[body.Code]; ok {
+		body.Message = m
+		body.Reason = m
+	}
+	localizeDetails(body.Details, lang)
+}
+
+// localizeDetails translates the messages of details into lang where its
+// catalog has them.
+func localizeDetails(details []errorDetail, lang string) {
+	messages := catalogs[lang]
+	for i, d := range details {
+		if m, ok := messages[d.Code]; ok {
+			details[i].Message = m
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// jobLocks makes every running job hold a lock on its ID in the input
+// volume, for replicas sharing the volumes.
+var jobLocks bool
+
+const lockDirName = ".locks"
+
+var errJobLocked = errors.New("job is locked by another process")
+
+// jobLock is an exclusive lock on a job ID. Locks are flock(2) locks on a
+// file per ID, so they are dropped when their process dies and never need
+// to be broken by hand.
+type jobLock struct {
+	file *os.File
+	path string
+}
+
+func validateJobLocks() error {
+	if !jobLocks {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Join(inputDir, lockDirName), 0755); err != nil {
+		return fmt.Errorf("could not create job lock dir: %v", err)
+	}
+	l, err := lockJob("startup-check")
+	if err != nil {
+		return fmt.Errorf("-job-locks: %v", err)
+	}
+	l.release()
+	return nil
+}
+
+// lockJob takes the lock of job id without waiting, failing with
+// errJobLocked when it is held, by another process or another job of this
+// one.
+func lockJob(id string) (*jobLock, error) {
+	path := filepath.Join(inputDir, lockDirName, id+".lock")
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("could not open job lock: %v", err)
+		}
+		if err := tryLockFile(f); err != nil {
+			f.Close()
+			if err == errJobLocked {
+				return nil, err
+			}
+			return nil, fmt.Errorf("could not lock job %s: %v", id, err)
+		}
+		// A holder removes the file before unlocking it, so the lock may
+		// have been won on a file no longer in place, which guards
+		// nothing.
+		held, err := f.Stat()
+		current, cerr := os.Stat(path)
+		if err == nil && cerr == nil && os.SameFile(held, current) {
+			host, _ := os.Hostname()
+			f.Truncate(0)
+			fmt.Fprintf(f, "%s %d\n", host, os.Getpid())
+			return &jobLock{file: f, path: path}, nil
+		}
+		f.Close()
+	}
+}
+
+func (l *jobLock) release() {
+	os.Remove(l.path)
+	l.file.Close()
+}
+
+// unlock releases the lock of j, if it holds one.
+func (j *job) unlock() {
+	if j.lock != nil {
+		j.lock.release()
+		j.lock = nil
+	}
+}
+
+// createJob persists the new job j. With -job-locks it first takes the lock
+// of the job's ID, drawing another ID while the one drawn is locked or
+// already has a record, so that replicas never run two jobs under one ID.
+func createJob(t *tenant, j *job) error {
+	if jobLocks {
+		for attempt := 0; j.lock == nil; attempt++ {
+			if attempt == 10 {
+				return fmt.Errorf("could not find a free job id")
+			}
+			l, err := lockJob(j.ID)
+			if err == errJobLocked {
+				j.ID = generateID(8)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if _, err := os.Stat(jobRecordPath(t, j.ID)); err == nil {
+				l.release()
+				j.ID = generateID(8)
+				continue
+			}
+			j.lock = l
+		}
+	}
+	if err := saveJob(t, j); err != nil {
+		j.unlock()
+		return err
+	}
+	return nil
+}
+
+// jobBusy reports whether job id is being worked on, by this process or
+// another replica. When it is not, the returned lock keeps it that way
+// until released.
+func jobBusy(id string) (bool, *jobLock) {
+	l, err := lockJob(id)
+	if err == errJobLocked {
+		return true, nil
+	}
+	if err != nil {
+		// Better to leave a job alone than to clobber it.
+		log.Printf("Could not check the lock of job %s: %v", id, err)
+		return true, nil
+	}
+	return false, l
+}
+
+// removeStaleLocks deletes the lock files of jobs a dead process held.
+func removeStaleLocks() {
+	entries, err := ioutil.ReadDir(filepath.Join(inputDir, lockDirName))
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if locked, l := jobBusy(strings.TrimSuffix(e.Name(), ".lock")); !locked {
+			l.release()
+		}
+	}
+}
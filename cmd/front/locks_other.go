@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func tryLockFile(f *os.File) error {
+	return errors.New("job locks are not supported on this platform")
+}
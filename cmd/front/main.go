@@ -0,0 +1,840 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var inputDir string
+var outputDir string
+var darkflowURL string
+var maxBodySize int64
+var dryRun bool
+var enableH2C bool
+var insecureClient *http.Client
+var darkflowClient *http.Client
+
+func readFlags() {
+	flag.StringVar(&inputDir, "input", "/input", "directory to store downloaded input images")
+	flag.StringVar(&outputDir, "output", "/output", "directory to store processed input images")
+	flag.StringVar(&darkflowURL, "darkflow-url", "http://darkflow:8000", "URL where darkflow is waiting")
+	flag.Int64Var(&maxBodySize, "max-body-size", 1<<20, "maximum size of a JSON request body in bytes")
+	flag.StringVar(&darkflowCert, "darkflow-cert", "", "client certificate file to present to darkflow (mTLS)")
+	flag.StringVar(&darkflowKey, "darkflow-key", "", "private key file for -darkflow-cert")
+	flag.StringVar(&darkflowCA, "darkflow-ca", "", "CA bundle used to verify darkflow's certificate instead of the system roots")
+	flag.StringVar(&darkflowToken, "darkflow-token", os.Getenv("DARKFLOW_TOKEN"), "bearer token sent to darkflow (defaults to $DARKFLOW_TOKEN)")
+	flag.StringVar(&darkflowAPIKey, "darkflow-api-key", os.Getenv("DARKFLOW_API_KEY"), "API key sent to darkflow (defaults to $DARKFLOW_API_KEY)")
+	flag.StringVar(&darkflowAPIKeyHeader, "darkflow-api-key-header", "X-API-Key", "header carrying -darkflow-api-key")
+	flag.StringVar(&darkflowSigningSecret, "darkflow-signing-secret", os.Getenv("DARKFLOW_SIGNING_SECRET"), "shared secret darkflow requests are signed, and its responses must be signed, with (defaults to $DARKFLOW_SIGNING_SECRET); empty disables signing")
+	flag.Int64Var(&maxUploadSize, "max-upload-size", 32<<20, "maximum size of a multipart upload in bytes")
+	flag.StringVar(&darkflowDiscovery, "darkflow-discovery", "", "discover darkflow replicas via srv:<name> or k8s:<namespace>/<service>[:<port name>] instead of using -darkflow-url's host")
+	flag.DurationVar(&darkflowDiscoveryInterval, "darkflow-discovery-interval", 30*time.Second, "how often to re-resolve -darkflow-discovery")
+	flag.StringVar(&dispatchMode, "dispatch", dispatchRoundRobin, "how calls are spread over darkflow backends: round-robin or least-loaded")
+	flag.StringVar(&darkflowLoadPath, "darkflow-load-path", "", "path of the darkflow endpoint reporting {\"load\": <GPU utilization 0-1>}, polled for -dispatch least-loaded")
+	flag.DurationVar(&loadPollInterval, "load-poll-interval", 5*time.Second, "how often -darkflow-load-path is polled")
+	flag.BoolVar(&dryRun, "dry-run", false, "stage inputs of every job without calling darkflow")
+	flag.StringVar(&outputNameTemplate, "output-name-template", defaultOutputNameTemplate, "template for output file names, e.g. {jobid}/{index}_{label_count}{ext}; also supports {tenant}, {date} and {name}")
+	flag.StringVar(&localImageDir, "local-image-dir", "", "directory whose files may be given as file:// URLs or absolute paths in image_urls; local images are disabled when empty")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "", "S3-compatible endpoint for s3:// image URLs instead of AWS, e.g. http://minio:9000")
+	flag.Int64Var(&outputRateLimit, "output-rate-limit", 0, "cap on the rate files under /output are sent to one client connection in bytes per second, 0 for unlimited")
+	flag.IntVar(&fetchFailureThreshold, "fetch-failure-threshold", 3, "consecutive 404s of an image URL, or timeouts and refused connections of a host, after which it is not fetched for -fetch-failure-cooldown; 0 disables the cooldown")
+	flag.DurationVar(&fetchFailureCooldown, "fetch-failure-cooldown", time.Hour, "how long a failing image URL or host is not fetched")
+	flag.DurationVar(&probeCacheTTL, "probe-cache-ttl", 5*time.Minute, "how long the HEAD result of an image URL is reused by URL checks; 0 disables the cache")
+	flag.IntVar(&probeCacheSize, "probe-cache-size", 4096, "most image URLs whose HEAD result is cached; the least recently used are dropped first")
+	flag.IntVar(&maxHostConnections, "max-host-connections", 4, "most image downloads in flight from one source host across all jobs, 0 for unlimited")
+	flag.DurationVar(&hostStagger, "host-stagger", 50*time.Millisecond, "least time between the starts of two downloads from one source host")
+	flag.Int64Var(&downloadBandwidth, "download-bandwidth", 0, "aggregate cap on image download bandwidth in bytes per second, 0 for unlimited")
+	flag.StringVar(&adminKey, "admin-key", os.Getenv("ADMIN_KEY"), "key granting access to /admin endpoints (defaults to $ADMIN_KEY); the admin api is disabled when empty")
+	flag.StringVar(&allowedFormatsFlag, "allowed-formats", "", "comma separated image formats accepted as inputs, e.g. jpeg,png,webp; any image is accepted when empty")
+	flag.BoolVar(&fixOrientation, "fix-orientation", true, "rotate JPEG inputs upright according to their EXIF orientation before recognition")
+	flag.Float64Var(&defaultFilters.MinBoxArea, "min-box-area", 0, "drop the detections whose box is smaller, in pixels; 0 keeps all, requests may override")
+	flag.IntVar(&defaultFilters.MaxDetections, "max-detections", 0, "keep only the most confident detections of each image; 0 keeps all, requests may override")
+	flag.Float64Var(&defaultFilters.NMSIoU, "nms-iou", 0, "drop the detections overlapping a more confident one of their class by more than this IoU; 0 disables, requests may override")
+	flag.StringVar(&classThresholdsFlag, "class-thresholds", "", "comma separated <class>=<confidence> minimum confidences of the detections of classes, which requests may override")
+	flag.StringVar(&replicaFlag, "replica", "", "s3://bucket/prefix the outputs of finished jobs are replicated to; /output falls back to it when a file cannot be read from -output")
+	flag.DurationVar(&storageCheckInterval, "storage-check-interval", 30*time.Second, "how often -output and -replica are probed for /readyz; 0 disables the probes")
+	flag.StringVar(&defaultMaintenanceMessage, "maintenance-message", "the service is under maintenance", "message of maintenance windows started without one")
+	flag.DurationVar(&defaultMaintenanceDuration, "maintenance-duration", time.Hour, "length of maintenance windows started without a duration")
+	flag.DurationVar(&maxMaintenanceDuration, "max-maintenance-duration", 24*time.Hour, "longest maintenance window an admin may start; 0 means no cap")
+	flag.DurationVar(&outputTokenTTL, "output-token-ttl", time.Hour, "how long the output token issued with each job response grants read access to that job's outputs only; 0 disables the tokens")
+	flag.StringVar(&outputTokenSecret, "output-token-secret", os.Getenv("OUTPUT_TOKEN_SECRET"), "key output tokens are signed with (defaults to $OUTPUT_TOKEN_SECRET); a random key valid until restart is used when empty")
+	flag.BoolVar(&requireOutputToken, "require-output-token", false, "serve /output only to requests with an output token, so api keys do not grant access to all of a tenant's outputs")
+	flag.BoolVar(&faultInjection, "fault-injection", false, "test mode: honor X-Inject-Faults request headers that slow downloads, fail darkflow calls or drop outputs; never set in production")
+	flag.BoolVar(&dedupeOutputs, "dedupe-outputs", false, "store output files by content under -output and hard link them into job directories, so identical outputs of repeated jobs are kept once")
+	flag.Int64Var(&inlineMaxSize, "inline-max-size", 256<<10, "largest annotated image in bytes that include_images=inline embeds in /v2 responses; larger ones are only linked")
+	flag.BoolVar(&backendDebugFlag, "backend-debug", false, "log the full requests to and responses from darkflow; admins toggle it at runtime with PUT /admin/backend-debug")
+	flag.BoolVar(&backendDebugPersist, "backend-debug-persist", false, "with -backend-debug, also keep the darkflow calls of every job for GET /admin/backend-debug/jobs/{id}")
+	flag.StringVar(&backendDebugRedactHeaders, "backend-debug-redact-headers", "Authorization,X-API-Key,X-Darkflow-Signature,Set-Cookie,Cookie", "comma separated headers whose values -backend-debug never logs")
+	flag.IntVar(&backendDebugMaxBody, "backend-debug-max-body", 64<<10, "bytes of each request and response body -backend-debug logs")
+	flag.StringVar(&defaultReport, "report", "", "format of the report added to the outputs of every job, pdf or html; requests may ask for one when empty")
+	flag.StringVar(&onDisconnect, "on-disconnect", disconnectAbort, "what happens to the job of a client that disconnects: abort stops its downloads and darkflow call, async finishes it for GET /jobs/{id}/response")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 5*time.Minute, "how long a process stopping on SIGTERM, or handing over to a new one on SIGHUP, waits for its requests and jobs")
+	flag.DurationVar(&upgradeTimeout, "upgrade-timeout", time.Minute, "how long to wait for the process started on SIGHUP to serve before giving up the upgrade")
+	flag.IntVar(&manifestChunkSize, "manifest-chunk-size", 500, "number of manifest rows per job unless the request asks otherwise")
+	flag.IntVar(&manifestMaxRows, "manifest-max-rows", 100000, "maximum number of rows of a manifest")
+	flag.BoolVar(&v2Envelope, "v2-envelope", false, "wrap /v2 JSON responses in {data, warnings, errors}; requests override it with ?envelope=true or false")
+	flag.StringVar(&nodeName, "node-name", "", "name of this node recorded in the environment of every job; defaults to the hostname")
+	flag.IntVar(&syncMaxImages, "sync-max-images", 0, "recognize and upload requests for more images are answered 202 Accepted and run in the background; 0 means no cap")
+	flag.Int64Var(&syncMaxBytes, "sync-max-bytes", 0, "recognize and upload requests whose images total more bytes are answered 202 Accepted and run in the background; 0 means no cap")
+	flag.BoolVar(&inputMetadata, "input-metadata", true, "return the dimensions and EXIF data of each input image with its results")
+	flag.StringVar(&compareBackendsFlag, "compare-backends", "", "comma-separated name=url darkflow backends that /compare requests can select by name")
+	flag.Var(&exportDestinations, "export", "where to copy the outputs and record of every finished job: s3://bucket/prefix, sftp://[user@]host[:port]/path or an http(s) URL to PUT files under; may be repeated")
+	flag.DurationVar(&exportTimeout, "export-timeout", 10*time.Minute, "time limit of one attempt to export a job to one destination")
+	flag.Float64Var(&qaSamplePercent, "qa-sample-percent", 0, "percentage of finished jobs whose inputs, outputs and record are copied to -qa-destination for review; 0 disables sampling")
+	flag.StringVar(&qaDestination, "qa-destination", "", "where sampled jobs are copied with their labels: a directory or any -export destination")
+	flag.Var(&qaLabelFlags, "qa-label", "key=value label recorded with every job sampled for QA; may be repeated")
+	flag.Var(&postHooks, "post-hook", "command run after darkflow for every job, with the job as JSON on stdin; may be repeated")
+	flag.DurationVar(&postHookTimeout, "post-hook-timeout", time.Minute, "maximum run time of a single -post-hook")
+	flag.BoolVar(&cropDetections, "crops", false, "store crops of every detected box under crops/<label>/ of each job's output")
+	flag.Var(&listenAddrs, "listen", "address to serve the API on, e.g. :8080, [::1]:8080 or tcp4:0.0.0.0:8080; may be repeated (default :8080)")
+	flag.StringVar(&debugDumpDir, "debug-dump-dir", os.TempDir(), "directory POST /admin/debug/dump writes goroutine dumps and heap profiles to")
+	flag.Var(&adminListenAddrs, "admin-listen", "address to serve the /admin endpoints on instead of the -listen addresses, e.g. 127.0.0.1:9090; may be repeated")
+	flag.BoolVar(&enableH2C, "h2c", true, "accept cleartext HTTP/2 (h2c) connections with prior knowledge alongside HTTP/1.1")
+	flag.StringVar(&darkflowRequestTemplate, "darkflow-request-template", "", "file with a text/template rendering the JSON body posted to darkflow from .InputDir, .OutputDir, .Model, .Threshold and .Options")
+	flag.StringVar(&darkflowVersionPath, "darkflow-version-path", "/version", "path of the darkflow endpoint reporting {\"version\": ...}, asked to pick the request format of each backend; empty disables negotiation")
+	flag.StringVar(&darkflowProtocols, "darkflow-protocols", "", "comma separated <major version>=<template file> request templates for darkflow versions whose request format differs")
+	flag.StringVar(&darkflowModelsPath, "darkflow-models-path", "/models", "path of the darkflow endpoint listing its models and their classes for GET /models, with <path>/<name>/load loading one; empty disables /models")
+	flag.DurationVar(&modelLoadTimeout, "model-load-timeout", 5*time.Minute, "how long darkflow may take to load a model for POST /models/{name}/load")
+	flag.DurationVar(&versionTTL, "darkflow-version-ttl", time.Minute, "how long a backend's reported version is trusted before asking again")
+	flag.BoolVar(&inMemory, "in-memory", false, "keep /recognize images and results in memory instead of the input and output dirs, answering as multipart/mixed; needs -darkflow-upload or -darkflow-stream-path")
+	flag.Int64Var(&inMemoryMaxSize, "in-memory-max-size", 8<<20, "largest image in bytes -in-memory downloads")
+	flag.StringVar(&darkflowInputPrefix, "darkflow-input-prefix", "", "path darkflow mounts -input at, sent in place of -input when the two containers mount it differently")
+	flag.StringVar(&darkflowOutputPrefix, "darkflow-output-prefix", "", "path darkflow mounts -output at, sent in place of -output when the two containers mount it differently")
+	flag.BoolVar(&darkflowUpload, "darkflow-upload", false, "send images to darkflow as multipart uploads and read results from its response instead of sharing the input and output dirs")
+	flag.StringVar(&darkflowStreamPath, "darkflow-stream-path", "", "WebSocket path of darkflow to stream images to over persistent connections, receiving their detections, instead of a request per batch; empty disables streaming")
+	flag.IntVar(&darkflowStreamConns, "darkflow-stream-conns", 2, "persistent connections kept open to each darkflow backend with -darkflow-stream-path")
+	flag.StringVar(&defaultRetention, "retention", retainForever, "how long to keep the data of jobs that set no retain hint, e.g. 24h, 7d or forever")
+	flag.DurationVar(&maxRetention, "max-retention", 0, "upper bound on any job's retention, including forever; 0 means no bound")
+	flag.DurationVar(&janitorInterval, "janitor-interval", 10*time.Minute, "how often expired jobs are deleted; 0 disables the janitor")
+	flag.StringVar(&recoverMode, "recover-jobs", recoverFail, "what to do at startup with jobs a previous process left running: fail, resume or off; use off when replicas share the job store without -job-locks")
+	flag.BoolVar(&jobLocks, "job-locks", false, "lock job IDs with flock files under the input dir so replicas sharing the volumes never reuse an ID, clean up or recover each other's running jobs")
+	flag.StringVar(&accessLogPath, "access-log", "", "where to log requests: a file, - for stdout or stderr; empty disables the access log")
+	flag.StringVar(&accessLogFormat, "access-log-format", accessLogCommon, "access log format: common or json")
+	flag.DurationVar(&replayWindow, "replay-window", 0, "answer a recognize request identical to one completed this recently with the earlier job's results; 0 disables replays")
+	flag.DurationVar(&defaultStreamInterval, "stream-interval", 5*time.Second, "default interval between sampled frames of a camera stream")
+	flag.DurationVar(&minStreamInterval, "min-stream-interval", time.Second, "smallest sampling interval a stream may request")
+	flag.IntVar(&maxStreams, "max-streams", 16, "maximum number of camera streams registered at once")
+	flag.StringVar(&streamGrabCommand, "stream-grab-command", "", "command printing one JPEG frame of an rtsp:// or rtsps:// stream to stdout, with {url} replaced by the stream URL")
+	flag.IntVar(&maxConcurrentJobs, "max-concurrent-jobs", 0, "maximum number of darkflow calls in flight; further jobs queue up. 0 means no limit")
+	flag.IntVar(&maxQueuedJobs, "max-queue", 100, "maximum number of jobs waiting for darkflow before requests are rejected with 503")
+	flag.DurationVar(&downloadTimeout, "download-timeout", 0, "maximum time to download a single image; 0 means no limit")
+	flag.DurationVar(&darkflowTimeout, "darkflow-timeout", 0, "maximum time darkflow may take to process a job; 0 means no limit")
+	flag.Float64Var(&adaptiveTimeoutFactor, "adaptive-timeout-factor", 0, "time darkflow calls out after this multiple of the p99 latency of recent calls with as many images, instead of -darkflow-timeout; 0 disables adaptive timeouts")
+	flag.IntVar(&adaptiveTimeoutSamples, "adaptive-timeout-samples", 20, "calls of a batch size needed before its adaptive timeout replaces -darkflow-timeout")
+	flag.DurationVar(&adaptiveTimeoutMin, "adaptive-timeout-min", 5*time.Second, "lower bound of adaptive darkflow timeouts")
+	flag.DurationVar(&adaptiveTimeoutMax, "adaptive-timeout-max", 0, "upper bound of adaptive darkflow timeouts; 0 means none")
+	flag.DurationVar(&requestTimeout, "request-timeout", 0, "maximum time for a whole request including downloads, queueing and darkflow; 0 means no limit")
+	flag.BoolVar(&strictOutputs, "strict-outputs", false, "fail jobs whose darkflow results do not pass verification instead of reporting the discrepancies")
+	flag.DurationVar(&waitForDarkflow, "wait-for-darkflow", 0, "wait up to this long for darkflow to respond before accepting traffic, e.g. 90s")
+	flag.StringVar(&urlPolicyFile, "url-policy", "", "JSON file restricting the hosts and networks images are fetched from; reloaded when it changes")
+	flag.DurationVar(&urlPolicyInterval, "url-policy-interval", 10*time.Second, "how often -url-policy is checked for changes")
+	flag.StringVar(&fetchProxy, "fetch-proxy", "", "proxy to fetch images through: an http://, https:// or socks5:// URL, or env for HTTP_PROXY, HTTPS_PROXY and NO_PROXY; empty connects directly. Darkflow is not reached through it")
+	flag.StringVar(&fetchNoProxy, "fetch-no-proxy", "", "comma-separated hosts, .domains and networks that images are fetched from directly despite -fetch-proxy")
+	flag.StringVar(&fetchDNS, "fetch-dns", "", "DNS server, host[:port], to resolve the hosts of images with instead of the system resolver")
+	flag.IntVar(&restartAfter, "restart-after", 0, "restart a darkflow backend after this many consecutive failures; 0 disables restarts")
+	flag.StringVar(&restartCommand, "restart-command", "", "command restarting a wedged darkflow, with {backend} replaced by its URL")
+	flag.StringVar(&restartContainer, "restart-container", "", "docker container to restart through the Docker API when -restart-command is not set, or comma-separated <backend URL>=<container> pairs when there are several backends")
+	flag.StringVar(&dockerHost, "docker-host", defaultDockerHost(), "Docker API address for -restart-container, unix:// or tcp:// (defaults to $DOCKER_HOST)")
+	flag.DurationVar(&restartWait, "restart-wait", 2*time.Minute, "how long to wait for a restarted darkflow to respond before resuming dispatch")
+	flag.StringVar(&notifySlack, "notify-slack", "", "Slack incoming webhook URL to send notifications to")
+	flag.StringVar(&notifyEmail, "notify-email", "", "SMTP server to mail notifications through, as smtp://[user:password@]host:port?from=<address>&to=<address>[,...]")
+	flag.StringVar(&notifySNS, "notify-sns", "", "ARN of an AWS SNS topic to publish notifications to, using the AWS_* environment credentials")
+	flag.StringVar(&snsEndpoint, "sns-endpoint", "", "custom SNS endpoint for -notify-sns")
+	flag.StringVar(&notifyEvents, "notify-events", "job_failed,backend_down,backend_recovered,backend_restarted,export_failed", "comma-separated events to notify of")
+	flag.IntVar(&outageAfter, "outage-after", 3, "consecutive failures after which a darkflow backend is reported down")
+	flag.StringVar(&webhookSecret, "webhook-secret", os.Getenv("WEBHOOK_SECRET"), "key the callbacks of jobs with a callback_url are signed with, unless their tenant has a webhook_secret (defaults to $WEBHOOK_SECRET)")
+	flag.DurationVar(&webhookTimeout, "webhook-timeout", 30*time.Second, "time limit of one attempt to deliver a job callback")
+	flag.StringVar(&tenantsFile, "tenants", "", "JSON file describing tenants and their API keys; when empty no API key is required")
+	flag.Parse()
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "submit" {
+		os.Exit(submit(os.Args[2:]))
+	}
+
+	readFlags()
+	var err error
+	if err = inheritListeners(); err != nil {
+		log.Fatal(err)
+	}
+	insecureClient, err = newFetchClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = setupWebhooks(); err != nil {
+		log.Fatal(err)
+	}
+	setupBackendDebug()
+	darkflowClient, err = newDarkflowClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = validateOutputNameTemplate(outputNameTemplate); err != nil {
+		log.Fatal(err)
+	}
+	if downloadBandwidth > 0 {
+		downloads.limiter = newBandwidthLimiter(downloadBandwidth)
+	}
+	compareBackends, err = parseCompareBackends(compareBackendsFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = validateRestart(); err != nil {
+		log.Fatal(err)
+	}
+	if err = loadRequestTemplate(); err != nil {
+		log.Fatal(err)
+	}
+	if err = loadProtocols(); err != nil {
+		log.Fatal(err)
+	}
+	if err = openAccessLog(); err != nil {
+		log.Fatal(err)
+	}
+	if err = validateDarkflowStream(); err != nil {
+		log.Fatal(err)
+	}
+	if err = validateInMemory(); err != nil {
+		log.Fatal(err)
+	}
+	if err = setupClassThresholds(); err != nil {
+		log.Fatal(err)
+	}
+	if err = setupFilters(); err != nil {
+		log.Fatal(err)
+	}
+	if err = setupEnvironment(); err != nil {
+		log.Fatal(err)
+	}
+	if err = setupReplica(); err != nil {
+		log.Fatal(err)
+	}
+	if err = setupReport(); err != nil {
+		log.Fatal(err)
+	}
+	if err = setupOutputTokens(); err != nil {
+		log.Fatal(err)
+	}
+	if err = validateOnDisconnect(); err != nil {
+		log.Fatal(err)
+	}
+	if err = validateFormats(); err != nil {
+		log.Fatal(err)
+	}
+	if err = validateRecovery(); err != nil {
+		log.Fatal(err)
+	}
+	if err = validateDispatch(); err != nil {
+		log.Fatal(err)
+	}
+	if err = startDiscovery(); err != nil {
+		log.Fatal(err)
+	}
+	startLoadPolling()
+	if err = setupNotifiers(); err != nil {
+		log.Fatal(err)
+	}
+	if err = setupExporters(); err != nil {
+		log.Fatal(err)
+	}
+	if err = setupQA(); err != nil {
+		log.Fatal(err)
+	}
+	if err = watchURLPolicy(); err != nil {
+		log.Fatal(err)
+	}
+	if tenantsFile != "" {
+		tenants, err = loadTenants(tenantsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Loaded %d api keys from %s", len(tenants), tenantsFile)
+	}
+	for _, dir := range []string{inputDir, outputDir} {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			if !inMemory {
+				log.Fatal(err)
+			}
+			// A read-only filesystem is what -in-memory is for.
+			log.Printf("Only -in-memory requests will work: %v", err)
+		}
+	}
+	if err = validateJobLocks(); err != nil {
+		log.Fatal(err)
+	}
+	if err = setupBlobs(); err != nil {
+		log.Fatal(err)
+	}
+	loadFetchFailures()
+	if _, err = parseRetention(defaultRetention); err != nil {
+		log.Fatal(err)
+	}
+	startJanitor()
+	startStorageChecks()
+
+	if waitForDarkflow > 0 {
+		if err = awaitDarkflow(waitForDarkflow); err != nil {
+			log.Fatal(err)
+		}
+	}
+	negotiateVersions()
+	if !upgraded() {
+		recoverJobs()
+		recoverManifests()
+	}
+	go seedLatencies()
+	go seedUsage()
+
+	log.Printf("Starting file server at %s", outputDir)
+	http.Handle("/output/", outputHandler())
+	handleVersioned("/recognize", recognize)
+	handleVersioned("/upload", upload)
+	handleVersioned("/compare", compare)
+	handleVersioned("/jobs", jobs)
+	handleVersioned("/jobs/", jobs)
+	handleVersioned("/streams", streamsHandler)
+	handleVersioned("/streams/", streamsHandler)
+	handleVersioned("/sets", setsHandler)
+	handleVersioned("/sets/", setsHandler)
+	handleVersioned("/manifests", manifestsHandler)
+	handleVersioned("/manifests/", manifestsHandler)
+	handleVersioned("/models", modelsHandler)
+	handleVersioned("/models/", modelsHandler)
+	handleVersioned("/queue", queueHandler)
+	handleVersioned("/stats", statsHandler)
+	http.HandleFunc("/admin/downloads", adminDownloads)
+	http.HandleFunc("/admin/policy", adminPolicy)
+	http.HandleFunc("/admin/metrics", adminMetrics)
+	http.HandleFunc("/admin/timeouts", adminTimeouts)
+	http.HandleFunc("/admin/fetch-failures", adminFetchFailures)
+	http.HandleFunc("/admin/probe-cache", adminProbeCache)
+	http.HandleFunc("/admin/maintenance", adminMaintenance)
+	http.HandleFunc("/admin/backend-debug", adminBackendDebug)
+	http.HandleFunc("/admin/backend-debug/", adminBackendDebug)
+	http.HandleFunc("/admin/debug/", adminDebug)
+	http.HandleFunc("/admin/debug/dump", adminDebugDump)
+	http.HandleFunc("/openapi.json", openAPIHandler)
+	http.HandleFunc("/readyz", readyz)
+
+	if len(listenAddrs) == 0 {
+		listenAddrs = stringList{":8080"}
+	}
+	public, admin := splitHandlers(accessLogHandler(compressHandler(hideDebug(injectFaults(localizeHandler(http.DefaultServeMux))))))
+	errs := make(chan error)
+	if err = serve(listenAddrs, public, errs); err != nil {
+		log.Fatal(err)
+	}
+	if err = serve(adminListenAddrs, admin, errs); err != nil {
+		log.Fatal(err)
+	}
+	takeOver()
+	watchSignals()
+	log.Fatal(<-errs)
+}
+
+type recognizeRequest struct {
+	ImageURLs []string          `json:"image_urls"`
+	Model     string            `json:"model"`
+	Threshold float64           `json:"threshold"`
+	DryRun    bool              `json:"dry_run"`
+	Crops     bool              `json:"crops"`
+	Metadata  map[string]string `json:"metadata"`
+	Tags      []string          `json:"tags"`
+	// Retain is how long to keep the job's data, e.g. "1h", "7d" or
+	// "forever"; empty means -retention.
+	Retain string `json:"retain"`
+	// Force processes the request even if an identical one completed
+	// within -replay-window.
+	Force bool `json:"force"`
+	// Checksums maps image URLs to the SHA-256 checksum their content
+	// must have.
+	Checksums map[string]string `json:"checksums"`
+	// Render has the frontend draw the annotated images to the client's
+	// preferences, or skip them.
+	Render *renderOptions `json:"render"`
+	// ClassThresholds map classes to the minimum confidence of their
+	// detections, overriding Threshold and -class-thresholds.
+	ClassThresholds map[string]float64 `json:"class_thresholds"`
+	// Filters drop detections from darkflow's output, overriding
+	// -min-box-area, -max-detections and -nms-iou.
+	Filters *outputFilters `json:"filters"`
+	// Report adds a report of the job to its outputs, pdf or html;
+	// empty means -report.
+	Report string `json:"report"`
+	// IncludeImages "inline" embeds the annotated images up to
+	// -inline-max-size in /v2 responses.
+	IncludeImages string `json:"include_images"`
+	// Heatmap is the class, or * for all, whose detections across the
+	// inputs are aggregated into a heatmap among the outputs.
+	Heatmap string `json:"heatmap"`
+	// CallbackURL is POSTed the job record, signed, when the job finishes.
+	CallbackURL string `json:"callback_url"`
+}
+
+func setupResponse(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-API-Key, X-Output-Token, X-Inject-Faults, Accept-Language")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Job-Id, X-Expires-At, X-Output-Token, X-Output-Token-Expires-At, X-Replayed, X-Discrepancies, Location, Retry-After")
+}
+
+func recognize(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		setupResponse(w)
+		return
+	}
+	received := time.Now()
+	t, ok := admit(w, r)
+	if !ok {
+		return
+	}
+	var req recognizeRequest
+	status, err := decodeJSONBody(w, r, &req)
+	if err != nil {
+		jsonError(w, status, err)
+		return
+	}
+	if len(req.ImageURLs) == 0 {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: image_urls must not be empty"))
+		return
+	}
+	if err := validateLabels(req.Metadata, req.Tags); err != nil {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: %v", err))
+		return
+	}
+	if err := validateRetention(req.Retain); err != nil {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: %v", err))
+		return
+	}
+	if err := validateChecksums(req.ImageURLs, req.Checksums); err != nil {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: %v", err))
+		return
+	}
+	if err := validateRender(req.Render); err != nil {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: %v", err))
+		return
+	}
+	if err := validateClassThresholds(req.ClassThresholds); err != nil {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: %v", err))
+		return
+	}
+	if err := validateFilters(req.Filters); err != nil {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: %v", err))
+		return
+	}
+	if err := validateReport(req.Report); err != nil {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: %v", err))
+		return
+	}
+	if err := validateHeatmap(req.Heatmap); err != nil {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: %v", err))
+		return
+	}
+	if err := validateIncludeImages(r, req.IncludeImages); err != nil {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: %v", err))
+		return
+	}
+	if err := validateCallback(t, req.CallbackURL); err != nil {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: %v", err))
+		return
+	}
+	if err := checkURLs(req.ImageURLs); err != nil {
+		jsonError(w, http.StatusForbidden, err)
+		return
+	}
+	if inMemory {
+		if status, err := checkInMemory(r, req); err != nil {
+			jsonError(w, status, err)
+			return
+		}
+	}
+
+	var key string
+	if replayWindow > 0 && !inMemory {
+		key = replayKey(t, req)
+		if id, ok := replays.lookup(key); ok && !req.Force {
+			if prev, err := loadJob(t, id); err == nil && replayable(prev) {
+				log.Printf("Replaying job %s for tenant %q", prev.ID, t.Name)
+				w.Header().Set("X-Job-Id", prev.ID)
+				setOutputToken(w, t, prev)
+				w.Header().Set("X-Replayed", "true")
+				prev.IncludeImages = req.IncludeImages
+				writeRecognized(w, r, t, prev)
+				return
+			}
+		}
+	}
+
+	if err := checkMaintenance(); err != nil {
+		jsonError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err := darkflowQueue.check(); err != nil {
+		jsonError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err := t.reserveImages(len(req.ImageURLs)); err != nil {
+		jsonError(w, http.StatusTooManyRequests, err)
+		return
+	}
+
+	log.Printf("Got recognize request %+v from tenant %q", req, t.Name)
+	j := newJob()
+	j.ImageURLs = req.ImageURLs
+	j.Model = req.Model
+	j.Threshold = req.Threshold
+	j.ClassThresholds = mergeClassThresholds(req.ClassThresholds)
+	j.Filters = mergeFilters(req.Filters)
+	j.DryRun = req.DryRun
+	j.Crops = req.Crops
+	j.Metadata = req.Metadata
+	j.Tags = req.Tags
+	j.Retain = req.Retain
+	j.Checksums = req.Checksums
+	j.Render = req.Render
+	j.CallbackURL = req.CallbackURL
+	j.Report = req.Report
+	j.Heatmap = req.Heatmap
+	j.IncludeImages = req.IncludeImages
+	j.addTiming(stageValidation, time.Since(received))
+	if inMemory {
+		recognizeInMemory(w, r, j)
+		return
+	}
+	if err := createJob(t, j); err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("X-Job-Id", j.ID)
+	setOutputToken(w, t, j)
+	remember := func() {
+		if key != "" && j.Status == jobDone {
+			replays.remember(key, j.ID)
+		}
+	}
+
+	if overSyncImages(len(j.ImageURLs)) {
+		respondAsync(w, r, t, j, func(ctx context.Context) (int, error) {
+			if err := stageImages(ctx, t, j); err != nil && !partialStaging(ctx, r, j, err) {
+				finishJobStatus(t, j, stagingStatus(err), err)
+				return stagingStatus(err), err
+			}
+			defer remember()
+			return processJob(ctx, t, j)
+		})
+		return
+	}
+
+	ctx, cancel := jobContext(r, t, j.ID)
+	if err := stageImages(ctx, t, j); err != nil && !partialStaging(ctx, r, j, err) {
+		cancel()
+		finishJob(t, j, err)
+		jsonError(w, stagingStatus(err), err)
+		return
+	}
+	if overSyncBytes(stagedBytes(t, j)) {
+		// The size is only known once the images are downloaded.
+		cancel()
+		respondAsync(w, r, t, j, func(ctx context.Context) (int, error) {
+			defer remember()
+			return processJob(ctx, t, j)
+		})
+		return
+	}
+	defer cancel()
+
+	respondRecognized(ctx, w, r, t, j)
+	remember()
+}
+
+// respondRecognized runs darkflow over the staged inputs of j and responds
+// with the list of output URLs, or of staged input files for dry runs.
+func respondRecognized(ctx context.Context, w http.ResponseWriter, r *http.Request, t *tenant, j *job) {
+	status, err := processJob(ctx, t, j)
+	if err != nil {
+		jsonError(w, status, err)
+		return
+	}
+	writeRecognized(w, r, t, j)
+}
+
+// writeRecognized responds with the result of the finished job j: the list
+// of output URLs, or the outputs themselves for clients accepting
+// multipart/mixed.
+func writeRecognized(w http.ResponseWriter, r *http.Request, t *tenant, j *job) {
+	w.Header().Add("Vary", "Accept")
+	if j.ExpiresAt != nil {
+		w.Header().Set("X-Expires-At", j.ExpiresAt.Format(time.RFC3339))
+	}
+	if n := len(j.Discrepancies); n > 0 {
+		// The details are on the job record, GET /jobs/{id}.
+		w.Header().Set("X-Discrepancies", strconv.Itoa(n))
+	}
+	if j.DryRun && apiVersion(r) < apiV2 {
+		log.Printf("Sending dry-run response: %+v", j.Inputs)
+		jsonResponse(w, http.StatusOK, j.Inputs)
+		return
+	}
+
+	if apiVersion(r) >= apiV2 {
+		writeRecognizedV2(w, r, t, j)
+		return
+	}
+
+	log.Printf("Sending recognize response: %+v", j.Outputs)
+	if acceptsMultipart(r) {
+		writeMultipart(w, t, j, j.Outputs)
+		return
+	}
+	jsonResponse(w, http.StatusOK, j.Outputs)
+}
+
+// decodeJSONBody decodes exactly one JSON object from the request body into v.
+// The body is capped at maxBodySize and unknown fields are rejected. On failure
+// it returns the HTTP status to respond with and an error describing where the
+// body is malformed.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) (int, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(v)
+	if err == nil {
+		if _, err := dec.Token(); err != io.EOF {
+			return http.StatusBadRequest, fmt.Errorf("invalid json body: body must contain a single JSON object")
+		}
+		return 0, nil
+	}
+
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return http.StatusBadRequest, fmt.Errorf("invalid json body: malformed json at position %d: %v", e.Offset, e)
+	case *json.UnmarshalTypeError:
+		return http.StatusBadRequest, fmt.Errorf("invalid json body: field %q at position %d must be %s, got %s", e.Field, e.Offset, e.Type, e.Value)
+	}
+
+	msg := err.Error()
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == io.EOF:
+		return http.StatusBadRequest, fmt.Errorf("invalid json body: body is empty")
+	case err == io.ErrUnexpectedEOF:
+		return http.StatusBadRequest, fmt.Errorf("invalid json body: unexpected end of body")
+	case strings.HasPrefix(msg, "json: unknown field "):
+		return http.StatusBadRequest, fmt.Errorf("invalid json body: unknown field %s", strings.TrimPrefix(msg, "json: unknown field "))
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("invalid json body: body exceeds %d bytes", maxBodySize)
+	}
+	return http.StatusBadRequest, fmt.Errorf("invalid json body: %v", err)
+}
+
+// wget downloads from into the file to, giving up after -download-timeout.
+func wget(ctx context.Context, job, from, to string) (string, error) {
+	if err := fetchFailures.check(from); err != nil {
+		return "", err
+	}
+	step, cancel := stepContext(ctx, downloadTimeout)
+	defer cancel()
+	if err := delayDownload(step); err != nil {
+		// Injected faults do not count against the URL and host.
+		return "", timeoutError(ctx, step, codeDownloadTimeout, downloadTimeout, err)
+	}
+	sum, err := fetchImage(step, job, from, to)
+	err = timeoutError(ctx, step, codeDownloadTimeout, downloadTimeout, err)
+	fetchFailures.record(from, err)
+	return sum, err
+}
+
+// fetchImage downloads from into the file to and returns the SHA-256
+// checksum of the content.
+func fetchImage(ctx context.Context, job, from, to string) (string, error) {
+	body, size, err := openImage(ctx, from)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	d := downloads.start(job, from, size)
+	defer downloads.finish(d)
+
+	file, err := os.Create(to)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return copyChecksummed(file, downloads.reader(d, body))
+}
+
+// stageImages downloads the job's image URLs into its input directory and
+// preprocesses them. All images are attempted so that the error reports every
+// one that failed, except that a checksum mismatch stops staging right away.
+func stageImages(ctx context.Context, t *tenant, j *job) error {
+	start := time.Now()
+	defer func() { j.addTiming(stageDownload, time.Since(start)) }()
+	input := j.inputPath(t)
+	if err := os.MkdirAll(input, 0755); err != nil {
+		return fmt.Errorf("could not create input dir: %v", err)
+	}
+	var details []errorDetail
+	j.InputChecksums = make([]string, len(j.ImageURLs))
+	if inputMetadata {
+		j.InputMetadata = make([]*imageMetadata, len(j.ImageURLs))
+	}
+	for i, img := range j.ImageURLs {
+		if ctx.Err() != nil {
+			// Out of time for the whole request; the remaining images
+			// are not attempted.
+			err := timeoutError(ctx, ctx, codeRequestTimeout, requestTimeout, fmt.Errorf("%d of %d images staged", i, len(j.ImageURLs)))
+			return withCode(codeOr(err, codeInternal), err, details...)
+		}
+		file := filepath.Join(input, fmt.Sprintf("%d.jpg", i))
+		code := codeDownloadFailed
+		sum, err := wget(ctx, j.ID, img, file)
+		j.InputChecksums[i] = sum
+		if want, ok := j.Checksums[img]; ok && err == nil && sum != want {
+			err = checksumError(want, sum)
+			details = append(details, errorDetail{Index: i, Input: img, Code: codeChecksumMismatch, Message: err.Error()})
+			return stagingError(details, len(j.ImageURLs))
+		}
+		if err == nil {
+			if inputMetadata {
+				j.InputMetadata[i] = stagedMetadata(file)
+			}
+			err = preprocessInput(file)
+			code = codeInternal
+		}
+		if err != nil {
+			details = append(details, errorDetail{Index: i, Input: img, Code: codeOr(err, code), Message: err.Error()})
+			os.Remove(file)
+		}
+	}
+	return stagingError(details, len(j.ImageURLs))
+}
+
+// stagingStatus is the response status for a failure to stage images.
+func stagingStatus(err error) int {
+	switch codeOr(err, "") {
+	case codeURLBlocked:
+		return http.StatusForbidden
+	case codeChecksumMismatch:
+		return http.StatusUnprocessableEntity
+	case codeUnsupportedFormat:
+		return http.StatusUnsupportedMediaType
+	}
+	return abortStatus(err, http.StatusInternalServerError)
+}
+
+// stagingError summarizes the images of a batch of n that could not be
+// staged. It takes the code of the first failure.
+func stagingError(details []errorDetail, n int) error {
+	if len(details) == 0 {
+		return nil
+	}
+	err := fmt.Errorf("could not stage %d of %d images: %s", len(details), n, details[0].Message)
+	return withCode(details[0].Code, err, details...)
+}
+
+// preprocessInput prepares a staged input image for darkflow.
+func preprocessInput(file string) error {
+	if err := checkImage(file); err != nil {
+		return err
+	}
+	if fixOrientation {
+		if err := fixJPEGOrientation(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkImage rejects inputs that are empty or plainly not images, such as
+// the HTML error page of a misbehaving server, and those not of
+// -allowed-formats. Without an allowlist, formats the frontend cannot decode
+// itself are left for darkflow to judge.
+func checkImage(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	return checkImageHead(head[:n])
+}
+
+// checkImageHead is checkImage for the first 512 bytes of an image, or all
+// of it if shorter.
+func checkImageHead(head []byte) error {
+	if len(head) == 0 {
+		return withCode(codeInvalidImage, fmt.Errorf("image is empty"))
+	}
+	if ct := http.DetectContentType(head); strings.HasPrefix(ct, "text/") {
+		return withCode(codeInvalidImage, fmt.Errorf("not an image: got %s", ct))
+	}
+	return checkFormat(head)
+}
+
+func jsonError(w http.ResponseWriter, status int, err error) {
+	setRetryAfter(w, err)
+	body := newErrorBody(status, err)
+	w.Header().Add("Vary", "Accept-Language")
+	if lang := languageOf(w); lang != "" {
+		localize(&body, lang)
+		w.Header().Set("Content-Language", lang)
+	}
+	if e := envelopeOf(w); e != nil {
+		e.errors = append(e.errors, errorDetail{Index: -1, Code: body.Code, Message: body.Message})
+		e.errors = append(e.errors, body.Details...)
+		writeJSON(w, status, e.wrap(nil))
+		return
+	}
+	writeJSON(w, status, body)
+}
+
+// jsonResponse responds with payload, in an envelope for enveloped /v2
+// requests.
+func jsonResponse(w http.ResponseWriter, status int, payload interface{}) {
+	if e := envelopeOf(w); e != nil {
+		if lang := languageOf(w); lang != "" {
+			localizeDetails(e.warnings, lang)
+			localizeDetails(e.errors, lang)
+			w.Header().Set("Content-Language", lang)
+		}
+		payload = e.wrap(payload)
+	}
+	writeJSON(w, status, payload)
+}
+
+func writeJSON(w http.ResponseWriter, status int, payload interface{}) {
+	setupResponse(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(payload)
+	if err != nil {
+		log.Printf("Could not encode response: %v", err)
+	}
+}
+
+func generateID(len int) string {
+	buf := make([]byte, (len-1)/2+1)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)[:len]
+}
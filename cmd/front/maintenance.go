@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultMaintenanceMessage and defaultMaintenanceDuration apply to
+// maintenance windows started without a message or duration;
+// maxMaintenanceDuration caps the duration, so that a forgotten window
+// ends on its own.
+var defaultMaintenanceMessage string
+var defaultMaintenanceDuration time.Duration
+var maxMaintenanceDuration time.Duration
+
+// maintenance is the current maintenance window, if any. While it lasts
+// requests that would run darkflow are turned away with 503; jobs already
+// running complete and outputs are still served.
+var maintenance struct {
+	mu      sync.Mutex
+	message string
+	since   time.Time
+	until   time.Time
+}
+
+// maintenanceStatus describes the maintenance window. Until is when it
+// ends, the ETA of the service.
+type maintenanceStatus struct {
+	Enabled bool       `json:"enabled"`
+	Message string     `json:"message,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+	Until   *time.Time `json:"until,omitempty"`
+	// ActiveJobs is the number of jobs still running in this process,
+	// reported to admins to tell when the window can start.
+	ActiveJobs *int `json:"active_jobs,omitempty"`
+}
+
+// maintenanceRequest starts or extends a maintenance window. Duration is
+// e.g. "30m".
+type maintenanceRequest struct {
+	Message  string `json:"message"`
+	Duration string `json:"duration"`
+}
+
+// maintenanceError turns away requests during a maintenance window.
+type maintenanceError struct {
+	status maintenanceStatus
+}
+
+func (e *maintenanceError) Error() string {
+	return fmt.Sprintf("%s, expected back at %s", e.status.Message, e.status.Until.Format(time.RFC3339))
+}
+
+// retryAfter is the number of seconds until the window ends.
+func (e *maintenanceError) retryAfter() int {
+	return int(math.Max(1, math.Ceil(time.Until(*e.status.Until).Seconds())))
+}
+
+// currentMaintenance returns the maintenance window in effect, ending it
+// once its time is up.
+func currentMaintenance() maintenanceStatus {
+	maintenance.mu.Lock()
+	defer maintenance.mu.Unlock()
+	if maintenance.until.IsZero() {
+		return maintenanceStatus{}
+	}
+	if !time.Now().Before(maintenance.until) {
+		log.Printf("Maintenance window ended at %s", maintenance.until.Format(time.RFC3339))
+		maintenance.until = time.Time{}
+		return maintenanceStatus{}
+	}
+	since, until := maintenance.since, maintenance.until
+	return maintenanceStatus{Enabled: true, Message: maintenance.message, Since: &since, Until: &until}
+}
+
+// checkMaintenance fails with codeMaintenance during a maintenance window.
+func checkMaintenance() error {
+	if s := currentMaintenance(); s.Enabled {
+		return withCode(codeMaintenance, &maintenanceError{s})
+	}
+	return nil
+}
+
+// adminMaintenance serves /admin/maintenance: GET reports the window, PUT
+// starts or extends it and DELETE ends it early.
+func adminMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		setupResponse(w)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req maintenanceRequest
+		status, err := decodeJSONBody(w, r, &req)
+		if err != nil {
+			jsonError(w, status, err)
+			return
+		}
+		d := defaultMaintenanceDuration
+		if req.Duration != "" {
+			d, err = time.ParseDuration(req.Duration)
+			if err != nil || d <= 0 {
+				jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: invalid duration %q", req.Duration))
+				return
+			}
+		}
+		if maxMaintenanceDuration > 0 && d > maxMaintenanceDuration {
+			jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: duration must be at most %s", maxMaintenanceDuration))
+			return
+		}
+		if req.Message == "" {
+			req.Message = defaultMaintenanceMessage
+		}
+		now := time.Now().UTC()
+		maintenance.mu.Lock()
+		if maintenance.until.IsZero() || !now.Before(maintenance.until) {
+			maintenance.since = now
+		}
+		maintenance.message = req.Message
+		maintenance.until = now.Add(d)
+		maintenance.mu.Unlock()
+		log.Printf("Maintenance window until %s: %s", now.Add(d).Format(time.RFC3339), req.Message)
+	case http.MethodDelete:
+		maintenance.mu.Lock()
+		ended := !maintenance.until.IsZero()
+		maintenance.until = time.Time{}
+		maintenance.mu.Unlock()
+		if ended {
+			log.Printf("Maintenance window ended early")
+		}
+	default:
+		jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+		return
+	}
+	s := currentMaintenance()
+	n := activeJobs.count()
+	s.ActiveJobs = &n
+	jsonResponse(w, http.StatusOK, s)
+}
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manifestChunkSize is the number of rows of a manifest per job unless the
+// request asks otherwise; manifestMaxRows caps the rows of a manifest.
+var manifestChunkSize int
+var manifestMaxRows int
+
+// Formats of manifests, and of their results.
+const (
+	manifestCSV   = "csv"
+	manifestJSONL = "jsonl"
+)
+
+// manifestsMu serializes reads and writes of manifest records.
+var manifestsMu sync.Mutex
+
+// manifestInfo is what GET /manifests/{id} reports of a manifest.
+type manifestInfo struct {
+	ID          string `json:"id"`
+	ManifestURL string `json:"manifest_url"`
+	Format      string `json:"format"`
+	// Status is running until every row went through a job, then done. A
+	// manifest that could not be read, or whose jobs could not be
+	// created, failed.
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	ChunkSize  int        `json:"chunk_size"`
+
+	Model           string             `json:"model,omitempty"`
+	Threshold       float64            `json:"threshold,omitempty"`
+	Metadata        map[string]string  `json:"metadata,omitempty"`
+	Tags            []string           `json:"tags,omitempty"`
+	Retain          string             `json:"retain,omitempty"`
+	ClassThresholds map[string]float64 `json:"class_thresholds,omitempty"`
+	Filters         *outputFilters     `json:"filters,omitempty"`
+
+	// Jobs are the chunk jobs of the manifest, in the order of its rows.
+	Jobs []string `json:"jobs"`
+}
+
+// manifest is a batch of images listed in a CSV or JSONL file, run as
+// chunk jobs in the background. Its record is stored as
+// manifests/<id>.json in the tenant's input directory, with the rows as
+// read so that the results keep their columns.
+type manifest struct {
+	manifestInfo
+	// Columns is the header of a CSV manifest.
+	Columns []string      `json:"columns,omitempty"`
+	Rows    []manifestRow `json:"rows"`
+}
+
+// manifestRow is a row of a manifest: a CSV record or a JSONL line. JobID
+// is the chunk job of the row; Error is why it was not given to one.
+type manifestRow struct {
+	URL    string          `json:"url"`
+	Record []string        `json:"record,omitempty"`
+	Line   json.RawMessage `json:"line,omitempty"`
+	JobID  string          `json:"job_id,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+type manifestRequest struct {
+	ManifestURL string `json:"manifest_url"`
+	// Format is csv or jsonl; empty means the extension of the
+	// manifest's URL.
+	Format string `json:"format"`
+	// ChunkSize is the number of rows per job; zero means
+	// -manifest-chunk-size.
+	ChunkSize       int                `json:"chunk_size"`
+	Model           string             `json:"model"`
+	Threshold       float64            `json:"threshold"`
+	Metadata        map[string]string  `json:"metadata"`
+	Tags            []string           `json:"tags"`
+	Retain          string             `json:"retain"`
+	ClassThresholds map[string]float64 `json:"class_thresholds"`
+	Filters         *outputFilters     `json:"filters"`
+}
+
+// manifestStatus answers GET /manifests/{id}: the manifest without its
+// rows, which it counts by state.
+type manifestStatus struct {
+	manifestInfo
+	Rows   int            `json:"rows"`
+	Images map[string]int `json:"images"`
+}
+
+func manifestRecordPath(t *tenant, id string) string {
+	return filepath.Join(t.inputDir(), "manifests", id+".json")
+}
+
+func saveManifest(t *tenant, m *manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("could not encode manifest: %v", err)
+	}
+	manifestsMu.Lock()
+	defer manifestsMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(manifestRecordPath(t, m.ID)), 0755); err != nil {
+		return fmt.Errorf("could not create manifests dir: %v", err)
+	}
+	if err := ioutil.WriteFile(manifestRecordPath(t, m.ID), data, 0644); err != nil {
+		return fmt.Errorf("could not save manifest: %v", err)
+	}
+	return nil
+}
+
+func loadManifest(t *tenant, id string) (*manifest, error) {
+	if !jobIDRe.MatchString(id) {
+		return nil, os.ErrNotExist
+	}
+	manifestsMu.Lock()
+	data, err := ioutil.ReadFile(manifestRecordPath(t, id))
+	manifestsMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("could not parse manifest %s: %v", id, err)
+	}
+	return &m, nil
+}
+
+// manifestsHandler serves POST /manifests, GET /manifests/{id} and
+// GET /manifests/{id}/results.
+func manifestsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		setupResponse(w)
+		return
+	}
+	t, ok := admit(w, r)
+	if !ok {
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/manifests"), "/")
+	parts := strings.Split(rest, "/")
+	switch {
+	case rest == "" && r.Method == http.MethodPost:
+		createManifest(w, r, t)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		if m, ok := findManifest(w, t, parts[0]); ok {
+			jsonResponse(w, http.StatusOK, manifestStatusOf(t, m))
+		}
+	case len(parts) == 2 && parts[1] == "results" && r.Method == http.MethodGet:
+		if m, ok := findManifest(w, t, parts[0]); ok {
+			writeManifestResults(w, t, m)
+		}
+	default:
+		jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// findManifest loads a manifest of tenant t, responding with an error
+// itself when it cannot.
+func findManifest(w http.ResponseWriter, t *tenant, id string) (*manifest, bool) {
+	m, err := loadManifest(t, id)
+	if os.IsNotExist(err) {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("manifest %s not found", id))
+		return nil, false
+	}
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return m, true
+}
+
+// manifestFormat is the format of the manifest at url: format if given,
+// else the one its extension names.
+func manifestFormat(url, format string) (string, error) {
+	if format == "" {
+		if i := strings.IndexAny(url, "?#"); i >= 0 {
+			url = url[:i]
+		}
+		switch strings.ToLower(path.Ext(url)) {
+		case ".csv":
+			format = manifestCSV
+		case ".jsonl", ".ndjson":
+			format = manifestJSONL
+		default:
+			return "", fmt.Errorf("format must be given for manifests not named .csv or .jsonl")
+		}
+	}
+	if format != manifestCSV && format != manifestJSONL {
+		return "", fmt.Errorf("format must be %s or %s, got %q", manifestCSV, manifestJSONL, format)
+	}
+	return format, nil
+}
+
+func createManifest(w http.ResponseWriter, r *http.Request, t *tenant) {
+	var req manifestRequest
+	status, err := decodeJSONBody(w, r, &req)
+	if err != nil {
+		jsonError(w, status, err)
+		return
+	}
+	if req.ManifestURL == "" {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: manifest_url must not be empty"))
+		return
+	}
+	format, err := manifestFormat(req.ManifestURL, req.Format)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: %v", err))
+		return
+	}
+	if req.ChunkSize < 0 {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: chunk_size must not be negative"))
+		return
+	}
+	if err := validateLabels(req.Metadata, req.Tags); err != nil {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: %v", err))
+		return
+	}
+	if err := validateRetention(req.Retain); err != nil {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: %v", err))
+		return
+	}
+	if err := validateClassThresholds(req.ClassThresholds); err != nil {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: %v", err))
+		return
+	}
+	if err := validateFilters(req.Filters); err != nil {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: %v", err))
+		return
+	}
+	if err := checkURLs([]string{req.ManifestURL}); err != nil {
+		jsonError(w, http.StatusForbidden, err)
+		return
+	}
+	if inMemory {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("manifests are not available with -in-memory"))
+		return
+	}
+	if err := checkMaintenance(); err != nil {
+		jsonError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	m := &manifest{manifestInfo: manifestInfo{
+		ID:              generateID(8),
+		ManifestURL:     req.ManifestURL,
+		Format:          format,
+		Status:          jobRunning,
+		CreatedAt:       time.Now().UTC(),
+		ChunkSize:       req.ChunkSize,
+		Model:           req.Model,
+		Threshold:       req.Threshold,
+		Metadata:        req.Metadata,
+		Tags:            req.Tags,
+		Retain:          req.Retain,
+		ClassThresholds: mergeClassThresholds(req.ClassThresholds),
+		Filters:         mergeFilters(req.Filters),
+		Jobs:            []string{},
+	}}
+	if m.ChunkSize == 0 {
+		m.ChunkSize = manifestChunkSize
+	}
+	if err := saveManifest(t, m); err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.Printf("Accepted manifest %s of tenant %q from %s", m.ID, t.Name, m.ManifestURL)
+	go runManifest(t, m)
+	w.Header().Set("Location", "/manifests/"+m.ID)
+	w.Header().Set("Retry-After", fmt.Sprint(int(asyncPollInterval.Seconds())))
+	jsonResponse(w, http.StatusAccepted, manifestStatusOf(t, m))
+}
+
+// runManifest reads the rows of m, unless it has them already, and runs
+// the rows not given to a job yet in chunks, one job at a time.
+func runManifest(t *tenant, m *manifest) {
+	if m.Rows == nil {
+		if err := readManifest(m); err != nil {
+			failManifest(t, m, err)
+			return
+		}
+		if err := saveManifest(t, m); err != nil {
+			failManifest(t, m, err)
+			return
+		}
+		log.Printf("Read %d rows of manifest %s", len(m.Rows), m.ID)
+	}
+	for {
+		if draining.Load() {
+			// The next process goes on as after a restart.
+			log.Printf("Stopping manifest %s for the shutdown", m.ID)
+			return
+		}
+		var chunk []int
+		for i, row := range m.Rows {
+			if row.JobID == "" && row.Error == "" {
+				chunk = append(chunk, i)
+				if len(chunk) == m.ChunkSize {
+					break
+				}
+			}
+		}
+		if len(chunk) == 0 {
+			break
+		}
+		if err := runManifestChunk(t, m, chunk); err != nil {
+			failManifest(t, m, err)
+			return
+		}
+	}
+	now := time.Now().UTC()
+	m.Status = jobDone
+	m.FinishedAt = &now
+	if err := saveManifest(t, m); err != nil {
+		log.Printf("Could not persist manifest %s: %v", m.ID, err)
+	}
+	log.Printf("Manifest %s finished with %d jobs", m.ID, len(m.Jobs))
+}
+
+func failManifest(t *tenant, m *manifest, err error) {
+	log.Printf("Manifest %s failed: %v", m.ID, err)
+	now := time.Now().UTC()
+	m.Status = jobFailed
+	m.Error = err.Error()
+	m.FinishedAt = &now
+	if err := saveManifest(t, m); err != nil {
+		log.Printf("Could not persist manifest %s: %v", m.ID, err)
+	}
+}
+
+// runManifestChunk runs a job over the rows of m at indexes chunk. The
+// job goes on without the images that fail to stage, whose rows then
+// report their error. It only fails if the job could not be created.
+func runManifestChunk(t *tenant, m *manifest, chunk []int) error {
+	if err := checkMaintenance(); err != nil {
+		return err
+	}
+	if err := t.reserveImages(len(chunk)); err != nil {
+		return err
+	}
+	j := newJob()
+	for _, i := range chunk {
+		j.ImageURLs = append(j.ImageURLs, m.Rows[i].URL)
+	}
+	j.Model = m.Model
+	j.Threshold = m.Threshold
+	j.ClassThresholds = m.ClassThresholds
+	j.Filters = m.Filters
+	j.Metadata = m.Metadata
+	j.Tags = m.Tags
+	j.Retain = m.Retain
+	j.Manifest = m.ID
+	if err := createJob(t, j); err != nil {
+		return err
+	}
+	for _, i := range chunk {
+		m.Rows[i].JobID = j.ID
+	}
+	m.Jobs = append(m.Jobs, j.ID)
+	if err := saveManifest(t, m); err != nil {
+		finishJob(t, j, err)
+		return err
+	}
+
+	ctx, cancelTimeout := context.WithCancel(context.Background())
+	if requestTimeout > 0 {
+		ctx, cancelTimeout = context.WithTimeout(context.Background(), requestTimeout)
+	}
+	ctx, done := trackJob(ctx, cancelTimeout, t, j.ID)
+	defer done()
+	if err := stageImages(ctx, t, j); err != nil && !goOnWithout(ctx, j, err) {
+		finishJob(t, j, err)
+		log.Printf("Job %s of manifest %s failed: %v", j.ID, m.ID, err)
+		return nil
+	}
+	if _, err := processJob(ctx, t, j); err != nil {
+		log.Printf("Job %s of manifest %s failed: %v", j.ID, m.ID, err)
+	}
+	return nil
+}
+
+// readManifest streams the manifest of m into its rows. Rows whose image
+// URL is missing or not allowed are kept with their error.
+func readManifest(m *manifest) error {
+	body, _, err := openImage(context.Background(), m.ManifestURL)
+	if err != nil {
+		return fmt.Errorf("could not fetch manifest: %v", err)
+	}
+	defer body.Close()
+	m.Rows = []manifestRow{}
+	add := func(row manifestRow) error {
+		if len(m.Rows) == manifestMaxRows {
+			return fmt.Errorf("manifest has more than %d rows", manifestMaxRows)
+		}
+		if row.URL == "" {
+			row.Error = "row has no image url"
+		} else if err := checkURL(row.URL); err != nil {
+			row.Error = err.Error()
+		}
+		m.Rows = append(m.Rows, row)
+		return nil
+	}
+	if m.Format == manifestCSV {
+		return readCSVManifest(m, body, add)
+	}
+	return readJSONLManifest(body, add)
+}
+
+// manifestURLColumns are the names of the column, or JSONL field, with the
+// image URL of a row, first match wins.
+var manifestURLColumns = []string{"url", "image_url"}
+
+func readCSVManifest(m *manifest, body io.Reader, add func(manifestRow) error) error {
+	r := csv.NewReader(body)
+	header, err := r.Read()
+	if err == io.EOF {
+		return fmt.Errorf("manifest is empty")
+	}
+	if err != nil {
+		return fmt.Errorf("could not read manifest header: %v", err)
+	}
+	column := -1
+	for _, name := range manifestURLColumns {
+		for i, h := range header {
+			if column < 0 && strings.EqualFold(strings.TrimSpace(h), name) {
+				column = i
+			}
+		}
+	}
+	if column < 0 {
+		return fmt.Errorf("manifest header has no %s column", strings.Join(manifestURLColumns, " or "))
+	}
+	m.Columns = header
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read manifest: %v", err)
+		}
+		if err := add(manifestRow{URL: strings.TrimSpace(record[column]), Record: record}); err != nil {
+			return err
+		}
+	}
+}
+
+func readJSONLManifest(body io.Reader, add func(manifestRow) error) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			return fmt.Errorf("could not parse line %d of manifest: %v", n, err)
+		}
+		row := manifestRow{Line: json.RawMessage(line)}
+		for _, name := range manifestURLColumns {
+			if v, ok := fields[name]; ok && row.URL == "" {
+				if err := json.Unmarshal(v, &row.URL); err != nil {
+					return fmt.Errorf("%s on line %d of manifest is not a string", name, n)
+				}
+			}
+		}
+		if err := add(row); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("could not read manifest: %v", err)
+	}
+	return nil
+}
+
+// manifestRowResult is the outcome of a row of a manifest, which its
+// results append to the row.
+type manifestRowResult struct {
+	Status     string      `json:"status"`
+	JobID      string      `json:"job_id,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Detections []detection `json:"detections,omitempty"`
+	Outputs    []string    `json:"outputs,omitempty"`
+}
+
+// rowResults returns the outcomes of the rows of m from the records and
+// outputs of their jobs, as setResultsOf does for sets.
+func rowResults(t *tenant, m *manifest) []manifestRowResult {
+	jobs := make(map[string]*job)
+	results := make([]manifestRowResult, len(m.Rows))
+	next := make(map[string]int)
+	for i, row := range m.Rows {
+		res := manifestRowResult{Status: setImagePending, JobID: row.JobID, Error: row.Error}
+		switch {
+		case row.Error != "":
+			res.Status = setImageFailed
+		case row.JobID != "":
+			j, ok := jobs[row.JobID]
+			if !ok {
+				j, _ = loadJob(t, row.JobID)
+				jobs[row.JobID] = j
+			}
+			// Rows are given to their job in order, so a row is the
+			// next input of its job.
+			index := next[row.JobID]
+			next[row.JobID]++
+			if j != nil {
+				res.Status, res.Error = inputStatus(j, index)
+				if res.Status == setImageDone {
+					res.Detections, res.Outputs = imageOutputs(t, j, index)
+				}
+			}
+		}
+		results[i] = res
+	}
+	return results
+}
+
+func manifestStatusOf(t *tenant, m *manifest) manifestStatus {
+	s := manifestStatus{manifestInfo: m.manifestInfo, Rows: len(m.Rows), Images: make(map[string]int)}
+	for _, res := range rowResults(t, m) {
+		s.Images[res.Status]++
+	}
+	return s
+}
+
+// writeManifestResults serves GET /manifests/{id}/results: the rows of the
+// manifest in its format, each with the columns, or fields, of its result
+// added: status, job_id, error, detections and outputs. In CSV the
+// detections are JSON and the outputs space separated.
+func writeManifestResults(w http.ResponseWriter, t *tenant, m *manifest) {
+	if m.Rows == nil {
+		jsonError(w, http.StatusConflict, fmt.Errorf("manifest %s was not read yet", m.ID))
+		return
+	}
+	results := rowResults(t, m)
+	setupResponse(w)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", m.ID+"-results."+m.Format))
+	if m.Format == manifestCSV {
+		w.Header().Set("Content-Type", "text/csv")
+		cw := csv.NewWriter(w)
+		cw.Write(append(append([]string{}, m.Columns...), "status", "job_id", "error", "detections", "outputs"))
+		for i, row := range m.Rows {
+			res := results[i]
+			detections := ""
+			if res.Detections != nil {
+				data, _ := json.Marshal(res.Detections)
+				detections = string(data)
+			}
+			cw.Write(append(append([]string{}, row.Record...), res.Status, res.JobID, res.Error, detections, strings.Join(res.Outputs, " ")))
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Printf("Could not write results of manifest %s: %v", m.ID, err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for i, row := range m.Rows {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(row.Line, &fields); err != nil {
+			fields = make(map[string]interface{})
+		}
+		res := results[i]
+		fields["status"] = res.Status
+		fields["job_id"] = res.JobID
+		fields["error"] = res.Error
+		fields["detections"] = res.Detections
+		fields["outputs"] = res.Outputs
+		if err := enc.Encode(fields); err != nil {
+			log.Printf("Could not write results of manifest %s: %v", m.ID, err)
+			return
+		}
+	}
+}
+
+// recoverManifests goes on with the manifests a previous process left
+// running, after recoverJobs dealt with their jobs, or with -recover-jobs
+// fail fails them as it fails the jobs.
+func recoverManifests() {
+	if recoverMode == recoverOff {
+		return
+	}
+	for _, t := range allTenants() {
+		names, err := filepath.Glob(filepath.Join(t.inputDir(), "manifests", "*.json"))
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			m, err := loadManifest(t, strings.TrimSuffix(filepath.Base(name), ".json"))
+			if err != nil {
+				log.Printf("Skipping manifest record %s: %v", name, err)
+				continue
+			}
+			if m.Status != jobRunning {
+				continue
+			}
+			if recoverMode != recoverResume {
+				failManifest(t, m, withCode(codeInterrupted, errors.New("manifest was interrupted by a restart of the frontend")))
+				continue
+			}
+			log.Printf("Resuming manifest %s of tenant %q", m.ID, t.Name)
+			go runManifest(t, m)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// inMemory serves /recognize without the input and output directories:
+// images are downloaded into memory, streamed to a -darkflow-upload backend
+// and its outputs returned in the response, for frontends running on a
+// read-only filesystem.
+var inMemory bool
+var inMemoryMaxSize int64
+
+// memoryFile is an input image or darkflow output held in memory.
+type memoryFile struct {
+	name string
+	data []byte
+}
+
+// memoryBatch holds what darkflow works on for an -in-memory job in place
+// of its directories.
+type memoryBatch struct {
+	inputs  []memoryFile
+	outputs []memoryFile
+}
+
+func validateInMemory() error {
+	if !inMemory {
+		return nil
+	}
+	if !darkflowUpload && darkflowStreamPath == "" {
+		return fmt.Errorf("-in-memory needs -darkflow-upload or -darkflow-stream-path, darkflow has no directory to read the images from")
+	}
+	if inMemoryMaxSize <= 0 {
+		return fmt.Errorf("invalid -in-memory-max-size %d, want a positive number of bytes", inMemoryMaxSize)
+	}
+	return nil
+}
+
+// checkInMemory rejects recognize requests for what needs the job's
+// directories, before any work is done.
+func checkInMemory(r *http.Request, req recognizeRequest) (int, error) {
+	if !acceptsMultipart(r) {
+		return http.StatusNotAcceptable, withCode(codeInvalidRequest, fmt.Errorf("results of -in-memory jobs are only sent as multipart/mixed, send Accept: multipart/mixed"))
+	}
+	switch {
+	case req.DryRun:
+		return http.StatusBadRequest, fmt.Errorf("invalid json body: dry_run is not available for -in-memory jobs")
+	case req.Crops:
+		return http.StatusBadRequest, fmt.Errorf("invalid json body: crops are not available for -in-memory jobs")
+	case req.Render != nil:
+		return http.StatusBadRequest, fmt.Errorf("invalid json body: render is not available for -in-memory jobs")
+	case req.CallbackURL != "":
+		return http.StatusBadRequest, fmt.Errorf("invalid json body: callback_url is not available for -in-memory jobs")
+	case len(req.ClassThresholds) > 0:
+		return http.StatusBadRequest, fmt.Errorf("invalid json body: class_thresholds are not available for -in-memory jobs")
+	case req.Filters != nil:
+		return http.StatusBadRequest, fmt.Errorf("invalid json body: filters are not available for -in-memory jobs")
+	case req.Report != "":
+		return http.StatusBadRequest, fmt.Errorf("invalid json body: report is not available for -in-memory jobs")
+	case req.Heatmap != "":
+		return http.StatusBadRequest, fmt.Errorf("invalid json body: heatmap is not available for -in-memory jobs")
+	case req.IncludeImages != "":
+		return http.StatusBadRequest, fmt.Errorf("invalid json body: include_images is not available for -in-memory jobs, which answer with the images inline already")
+	}
+	return 0, nil
+}
+
+// recognizeInMemory runs j, whose request passed checkInMemory, without
+// touching the filesystem and responds with darkflow's outputs as
+// multipart/mixed. The job is not recorded: it cannot be listed, re-run or
+// fetched again later, and crops, post hooks and output renames do not
+// apply.
+func recognizeInMemory(w http.ResponseWriter, r *http.Request, j *job) {
+	ctx, cancel := requestContext(r)
+	defer cancel()
+
+	batch, err := fetchInMemory(ctx, j)
+	if err != nil {
+		finishInMemory(j, err)
+		jsonError(w, stagingStatus(err), err)
+		return
+	}
+	start := time.Now()
+	status, err := callDarkflow(ctx, darkflowRequest{
+		Model:     j.Model,
+		Threshold: j.Threshold,
+		images:    len(batch.inputs),
+		memory:    batch,
+	})
+	j.addTiming(stageBackend, time.Since(start))
+	finishInMemory(j, err)
+	if err != nil {
+		jsonError(w, status, err)
+		return
+	}
+
+	log.Printf("Sending %d in-memory outputs of job %s", len(batch.outputs), j.ID)
+	w.Header().Set("X-Job-Id", j.ID)
+	w.Header().Add("Vary", "Accept")
+	writeMemoryOutputs(w, j, batch.outputs)
+}
+
+// finishInMemory records the outcome of j in the metrics, as finishJob does
+// for recorded jobs.
+func finishInMemory(j *job, err error) {
+	now := time.Now().UTC()
+	j.FinishedAt = &now
+	j.Status = jobDone
+	if err != nil {
+		j.Status = jobFailed
+		j.Error = err.Error()
+		j.ErrorCode, j.ErrorDetails = errorCode(err, 0)
+		log.Printf("In-memory job %s failed: %v", j.ID, err)
+	}
+	metrics.observe(j)
+	usage.observe(j)
+}
+
+// fetchInMemory downloads and preprocesses the image URLs of j like
+// stageImages, into memory.
+func fetchInMemory(ctx context.Context, j *job) (*memoryBatch, error) {
+	start := time.Now()
+	defer func() { j.addTiming(stageDownload, time.Since(start)) }()
+	batch := &memoryBatch{}
+	var details []errorDetail
+	j.InputChecksums = make([]string, len(j.ImageURLs))
+	if inputMetadata {
+		j.InputMetadata = make([]*imageMetadata, len(j.ImageURLs))
+	}
+	for i, img := range j.ImageURLs {
+		if ctx.Err() != nil {
+			err := timeoutError(ctx, ctx, codeRequestTimeout, requestTimeout, fmt.Errorf("%d of %d images fetched", i, len(j.ImageURLs)))
+			return nil, withCode(codeOr(err, codeInternal), err, details...)
+		}
+		name := fmt.Sprintf("%d.jpg", i)
+		code := codeDownloadFailed
+		data, sum, err := wgetToMemory(ctx, j.ID, img)
+		j.InputChecksums[i] = sum
+		if want, ok := j.Checksums[img]; ok && err == nil && sum != want {
+			err = checksumError(want, sum)
+			details = append(details, errorDetail{Index: i, Input: img, Code: codeChecksumMismatch, Message: err.Error()})
+			return nil, stagingError(details, len(j.ImageURLs))
+		}
+		if err == nil {
+			if inputMetadata {
+				j.InputMetadata[i] = readMetadata(data)
+			}
+			data, err = preprocessMemoryInput(name, data)
+			code = codeInternal
+		}
+		if err != nil {
+			details = append(details, errorDetail{Index: i, Input: img, Code: codeOr(err, code), Message: err.Error()})
+			continue
+		}
+		batch.inputs = append(batch.inputs, memoryFile{name: name, data: data})
+	}
+	if err := stagingError(details, len(j.ImageURLs)); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// wgetToMemory is wget into a buffer of at most -in-memory-max-size bytes.
+func wgetToMemory(ctx context.Context, job, from string) ([]byte, string, error) {
+	if err := fetchFailures.check(from); err != nil {
+		return nil, "", err
+	}
+	step, cancel := stepContext(ctx, downloadTimeout)
+	defer cancel()
+	data, sum, err := fetchToMemory(step, job, from)
+	err = timeoutError(ctx, step, codeDownloadTimeout, downloadTimeout, err)
+	fetchFailures.record(from, err)
+	return data, sum, err
+}
+
+func fetchToMemory(ctx context.Context, job, from string) ([]byte, string, error) {
+	body, size, err := openImage(ctx, from)
+	if err != nil {
+		return nil, "", err
+	}
+	defer body.Close()
+	if size > inMemoryMaxSize {
+		return nil, "", tooLargeForMemory()
+	}
+
+	d := downloads.start(job, from, size)
+	defer downloads.finish(d)
+
+	var buf bytes.Buffer
+	sum, err := copyChecksummed(&buf, io.LimitReader(downloads.reader(d, body), inMemoryMaxSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(buf.Len()) > inMemoryMaxSize {
+		return nil, "", tooLargeForMemory()
+	}
+	return buf.Bytes(), sum, nil
+}
+
+func tooLargeForMemory() error {
+	return withCode(codeInvalidImage, fmt.Errorf("image is larger than the -in-memory-max-size of %d bytes", inMemoryMaxSize))
+}
+
+// preprocessMemoryInput is preprocessInput for an image in memory.
+func preprocessMemoryInput(name string, data []byte) ([]byte, error) {
+	head := data
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	if err := checkImageHead(head); err != nil {
+		return nil, err
+	}
+	if fixOrientation {
+		upright, err := uprightJPEG(data, name)
+		if err != nil {
+			return nil, err
+		}
+		if upright != nil {
+			return upright, nil
+		}
+	}
+	return data, nil
+}
+
+// writeMemoryOutputs responds with outputs in the multipart/mixed layout of
+// writeMultipart. Having no URLs, the list and the parts name the files as
+// darkflow did.
+func writeMemoryOutputs(w http.ResponseWriter, j *job, outputs []memoryFile) {
+	names := make([]string, len(outputs))
+	for i, f := range outputs {
+		names[i] = f.name
+	}
+	mw, err := startMultipart(w, names)
+	if err != nil {
+		log.Printf("Could not send multipart response of job %s: %v", j.ID, err)
+		return
+	}
+	for _, f := range outputs {
+		index := -1
+		if i, err := strconv.Atoi(strings.TrimSuffix(f.name, filepath.Ext(f.name))); err == nil && i >= 0 && i < j.imageCount() {
+			index = i
+		}
+		if err := writeFilePart(mw, f.name, "", index, bytes.NewReader(f.data)); err != nil {
+			log.Printf("Could not send multipart response of job %s: %v", j.ID, err)
+			return
+		}
+	}
+	mw.Close()
+}
+
+// writeMemoryForm writes the inputs of batch as the "images" parts of a
+// darkflow upload.
+func writeMemoryForm(mw *multipart.Writer, batch *memoryBatch) error {
+	for _, f := range batch.inputs {
+		part, err := mw.CreateFormFile("images", f.name)
+		if err != nil {
+			return err
+		}
+		if _, err := part.Write(f.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
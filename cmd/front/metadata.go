@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+)
+
+var inputMetadata bool
+
+// Exif tags read into imageMetadata.
+const (
+	exifMakeTag               = 0x010F
+	exifModelTag              = 0x0110
+	exifDateTimeTag           = 0x0132
+	exifIFDTag                = 0x8769
+	exifGPSIFDTag             = 0x8825
+	exifDateTimeOriginalTag   = 0x9003
+	exifOffsetTimeOriginalTag = 0x9011
+	gpsLatitudeRefTag         = 1
+	gpsLatitudeTag            = 2
+	gpsLongitudeRefTag        = 3
+	gpsLongitudeTag           = 4
+	gpsAltitudeRefTag         = 5
+	gpsAltitudeTag            = 6
+)
+
+// imageMetadata is what the frontend reads from an input image, so that
+// clients need not download it again for its Exif data. Fields the image
+// does not carry are omitted.
+type imageMetadata struct {
+	Format string `json:"format,omitempty"`
+	// Width and Height are those of the image darkflow sees, upright when
+	// -fix-orientation rotated it.
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	Orientation int    `json:"orientation,omitempty"`
+	CameraMake  string `json:"camera_make,omitempty"`
+	CameraModel string `json:"camera_model,omitempty"`
+	// TakenAt is the Exif original date and time as
+	// YYYY-MM-DDTHH:MM:SS, with the UTC offset when the image has one.
+	TakenAt string       `json:"taken_at,omitempty"`
+	GPS     *gpsPosition `json:"gps,omitempty"`
+}
+
+// hasExif reports whether any Exif data was read into m.
+func (m *imageMetadata) hasExif() bool {
+	return m.Orientation != 0 || m.CameraMake != "" || m.CameraModel != "" || m.TakenAt != "" || m.GPS != nil
+}
+
+// gpsPosition is a position in decimal degrees, south and west being
+// negative, with the altitude in meters when known.
+type gpsPosition struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}
+
+// stagedMetadata reads the metadata of the staged input file, before it is
+// preprocessed. It returns nil with -input-metadata off or when nothing can
+// be read.
+func stagedMetadata(file string) *imageMetadata {
+	if !inputMetadata {
+		return nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Printf("Could not read metadata of %s: %v", file, err)
+		return nil
+	}
+	return readMetadata(data)
+}
+
+// readMetadata reads the dimensions and Exif data of the image data.
+func readMetadata(data []byte) *imageMetadata {
+	if !inputMetadata {
+		return nil
+	}
+	m := &imageMetadata{}
+	if cfg, format, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		m.Format, m.Width, m.Height = format, cfg.Width, cfg.Height
+	} else if format := sniffFormat(data); format != "" {
+		m.Format = format
+	}
+	readExif(m, exifSegment(data))
+	if fixOrientation && m.Orientation >= 5 {
+		// Orientations 5-8 are rotated by 90 degrees.
+		m.Width, m.Height = m.Height, m.Width
+	}
+	if *m == (imageMetadata{}) {
+		return nil
+	}
+	return m
+}
+
+func readExif(m *imageMetadata, exif []byte) {
+	tr, err := newTIFFReader(exif)
+	if err != nil {
+		return
+	}
+	ifd0, err := tr.entries(tr.firstIFD())
+	if err != nil {
+		return
+	}
+	for _, e := range ifd0 {
+		switch e.tag {
+		case exifOrientationTag:
+			if o := int(tr.uint(e)); o >= 1 && o <= 8 {
+				m.Orientation = o
+			}
+		case exifMakeTag:
+			m.CameraMake = tr.ascii(e)
+		case exifModelTag:
+			m.CameraModel = tr.ascii(e)
+		case exifDateTimeTag:
+			m.TakenAt = exifTime(tr.ascii(e), "")
+		case exifIFDTag:
+			readExifIFD(m, tr, int(tr.uint(e)))
+		case exifGPSIFDTag:
+			m.GPS = readGPS(tr, int(tr.uint(e)))
+		}
+	}
+}
+
+// readExifIFD reads the original date and time from the Exif sub-IFD,
+// which take precedence over the IFD0 modification time.
+func readExifIFD(m *imageMetadata, tr *tiffReader, offset int) {
+	entries, err := tr.entries(offset)
+	if err != nil {
+		return
+	}
+	var taken, zone string
+	for _, e := range entries {
+		switch e.tag {
+		case exifDateTimeOriginalTag:
+			taken = tr.ascii(e)
+		case exifOffsetTimeOriginalTag:
+			zone = tr.ascii(e)
+		}
+	}
+	if t := exifTime(taken, zone); t != "" {
+		m.TakenAt = t
+	}
+}
+
+// exifTime converts an Exif "YYYY:MM:DD HH:MM:SS" time and its optional
+// "+HH:MM" offset, returning "" if it is not valid.
+func exifTime(s, zone string) string {
+	t, err := time.Parse("2006:01:02 15:04:05", s)
+	if err != nil {
+		return ""
+	}
+	formatted := t.Format("2006-01-02T15:04:05")
+	if _, err := time.Parse("-07:00", zone); err == nil {
+		formatted += zone
+	}
+	return formatted
+}
+
+func readGPS(tr *tiffReader, offset int) *gpsPosition {
+	entries, err := tr.entries(offset)
+	if err != nil {
+		return nil
+	}
+	var lat, lon, alt []float64
+	var latRef, lonRef string
+	belowSea := false
+	for _, e := range entries {
+		switch e.tag {
+		case gpsLatitudeRefTag:
+			latRef = tr.ascii(e)
+		case gpsLatitudeTag:
+			lat = tr.rationals(e)
+		case gpsLongitudeRefTag:
+			lonRef = tr.ascii(e)
+		case gpsLongitudeTag:
+			lon = tr.rationals(e)
+		case gpsAltitudeRefTag:
+			b := tr.bytes(e)
+			belowSea = len(b) > 0 && b[0] == 1
+		case gpsAltitudeTag:
+			alt = tr.rationals(e)
+		}
+	}
+	if len(lat) != 3 || len(lon) != 3 {
+		return nil
+	}
+	p := &gpsPosition{Latitude: degrees(lat), Longitude: degrees(lon)}
+	if strings.EqualFold(latRef, "S") {
+		p.Latitude = -p.Latitude
+	}
+	if strings.EqualFold(lonRef, "W") {
+		p.Longitude = -p.Longitude
+	}
+	if len(alt) == 1 {
+		a := alt[0]
+		if belowSea {
+			a = -a
+		}
+		p.Altitude = &a
+	}
+	return p
+}
+
+// degrees converts degrees, minutes and seconds to decimal degrees.
+func degrees(dms []float64) float64 {
+	return dms[0] + dms[1]/60 + dms[2]/3600
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestExifTime(t *testing.T) {
+	tt := []struct {
+		name string
+		s    string
+		zone string
+		want string
+	}{
+		{name: "no zone", s: "2021:03:04 05:06:07", want: "2021-03-04T05:06:07"},
+		{name: "zone", s: "2021:03:04 05:06:07", zone: "+03:00", want: "2021-03-04T05:06:07+03:00"},
+		{name: "invalid zone", s: "2021:03:04 05:06:07", zone: "MSK", want: "2021-03-04T05:06:07"},
+		{name: "empty"},
+		{name: "unset", s: "0000:00:00 00:00:00"},
+		{name: "dashes", s: "2021-03-04 05:06:07"},
+		{name: "truncated", s: "2021:03:04"},
+		{name: "out of range", s: "2021:13:40 25:61:61"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := exifTime(tc.s, tc.zone); got != tc.want {
+				t.Errorf("exifTime(%q, %q) = %q, want %q", tc.s, tc.zone, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReadExif(t *testing.T) {
+	var order testOrder = binary.LittleEndian
+	short := func(v uint16) []byte { return order.AppendUint16(nil, v) }
+	rationals := func(vs ...uint32) []byte {
+		var b []byte
+		for _, v := range vs {
+			b = order.AppendUint32(b, v)
+		}
+		return b
+	}
+	ascii := func(tag uint16, s string) testEntry {
+		return testEntry{tag: tag, typ: 2, count: uint32(len(s) + 1), data: append([]byte(s), 0)}
+	}
+	lat := testEntry{tag: gpsLatitudeTag, typ: 5, count: 3, data: rationals(55, 1, 45, 1, 36, 1)}
+	lon := testEntry{tag: gpsLongitudeTag, typ: 5, count: 3, data: rationals(37, 1, 36, 1, 0, 1)}
+	sub := func(tag uint16) testEntry { return testEntry{tag: tag, ifd: 1} }
+
+	tt := []struct {
+		name string
+		exif []byte
+		want imageMetadata
+	}{
+		{name: "empty"},
+		{name: "garbage", exif: []byte("not a tiff payload")},
+		{
+			name: "camera",
+			exif: buildTIFF(order, []testEntry{
+				{tag: exifOrientationTag, typ: 3, count: 1, data: short(6)},
+				ascii(exifMakeTag, "Canon"),
+				ascii(exifModelTag, "EOS 5D"),
+				ascii(exifDateTimeTag, "2020:01:02 03:04:05"),
+			}),
+			want: imageMetadata{Orientation: 6, CameraMake: "Canon", CameraModel: "EOS 5D", TakenAt: "2020-01-02T03:04:05"},
+		},
+		{
+			name: "original time wins",
+			exif: buildTIFF(order,
+				[]testEntry{ascii(exifDateTimeTag, "2020:01:02 03:04:05"), sub(exifIFDTag)},
+				[]testEntry{ascii(exifDateTimeOriginalTag, "2019:06:07 08:09:10"), ascii(exifOffsetTimeOriginalTag, "-05:00")},
+			),
+			want: imageMetadata{TakenAt: "2019-06-07T08:09:10-05:00"},
+		},
+		{
+			name: "invalid original time",
+			exif: buildTIFF(order,
+				[]testEntry{ascii(exifDateTimeTag, "2020:01:02 03:04:05"), sub(exifIFDTag)},
+				[]testEntry{ascii(exifDateTimeOriginalTag, "    :  :     :  :  ")},
+			),
+			want: imageMetadata{TakenAt: "2020-01-02T03:04:05"},
+		},
+		{
+			name: "invalid orientation",
+			exif: buildTIFF(order, []testEntry{{tag: exifOrientationTag, typ: 3, count: 1, data: short(42)}}),
+		},
+		{
+			name: "make of the wrong type",
+			exif: buildTIFF(order, []testEntry{{tag: exifMakeTag, typ: 3, count: 1, data: short(1)}}),
+		},
+		{
+			name: "sub-ifd past the end",
+			exif: buildTIFF(order, []testEntry{{tag: exifIFDTag, typ: 4, count: 1, data: rationals(0xFFFF)}, {tag: exifGPSIFDTag, typ: 4, count: 1, data: rationals(2)}}),
+		},
+		{
+			name: "gps",
+			exif: buildTIFF(order, []testEntry{sub(exifGPSIFDTag)}, []testEntry{
+				ascii(gpsLatitudeRefTag, "S"), lat,
+				ascii(gpsLongitudeRefTag, "W"), lon,
+				{tag: gpsAltitudeRefTag, typ: 1, count: 1, data: []byte{1}},
+				{tag: gpsAltitudeTag, typ: 5, count: 1, data: rationals(150, 2)},
+			}),
+			want: imageMetadata{GPS: &gpsPosition{Latitude: -55.76, Longitude: -37.6}},
+		},
+		{
+			name: "gps without longitude",
+			exif: buildTIFF(order, []testEntry{sub(exifGPSIFDTag)}, []testEntry{lat}),
+		},
+		{
+			name: "gps with two components",
+			exif: buildTIFF(order, []testEntry{sub(exifGPSIFDTag)}, []testEntry{
+				{tag: gpsLatitudeTag, typ: 5, count: 2, data: rationals(55, 1, 45, 1)}, lon,
+			}),
+		},
+		{
+			name: "gps with a zero denominator",
+			exif: buildTIFF(order, []testEntry{sub(exifGPSIFDTag)}, []testEntry{
+				{tag: gpsLatitudeTag, typ: 5, count: 3, data: rationals(55, 0, 45, 1, 36, 1)}, lon,
+			}),
+		},
+		{
+			name: "gps rationals past the end",
+			exif: buildTIFF(order, []testEntry{sub(exifGPSIFDTag)}, []testEntry{
+				{tag: gpsLatitudeTag, typ: 5, count: 3, data: rationals(0xFFFFFF00)}, lon,
+			}),
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var m imageMetadata
+			readExif(&m, tc.exif)
+			if m.Orientation != tc.want.Orientation || m.CameraMake != tc.want.CameraMake || m.CameraModel != tc.want.CameraModel || m.TakenAt != tc.want.TakenAt {
+				t.Errorf("readExif() = %+v, want %+v", m, tc.want)
+			}
+			switch {
+			case (m.GPS == nil) != (tc.want.GPS == nil):
+				t.Fatalf("readExif() GPS = %+v, want %+v", m.GPS, tc.want.GPS)
+			case m.GPS == nil:
+			case !near(m.GPS.Latitude, tc.want.GPS.Latitude) || !near(m.GPS.Longitude, tc.want.GPS.Longitude):
+				t.Errorf("readExif() GPS = %+v, want %+v", m.GPS, tc.want.GPS)
+			case m.GPS.Altitude == nil || *m.GPS.Altitude != -75:
+				t.Errorf("readExif() altitude = %v, want -75", m.GPS.Altitude)
+			}
+		})
+	}
+}
+
+func near(a, b float64) bool {
+	return a-b < 1e-9 && b-a < 1e-9
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// darkflowModelsPath is the darkflow endpoint listing its models; loading a
+// model is a POST to <path>/<name>/load. Empty disables /models.
+var darkflowModelsPath string
+
+// modelLoadTimeout bounds how long darkflow may take to load a model.
+var modelLoadTimeout time.Duration
+
+// modelInfo is a model darkflow can run.
+type modelInfo struct {
+	Name    string   `json:"name"`
+	Classes []string `json:"classes"`
+	// Loaded is whether darkflow holds the model in memory, when it says.
+	Loaded *bool `json:"loaded,omitempty"`
+}
+
+// modelLoad is the outcome of warming a model on every backend.
+type modelLoad struct {
+	Model  string `json:"model"`
+	Loaded int    `json:"loaded"`
+	Failed int    `json:"failed"`
+	// Errors are the reasons of the failed backends.
+	Errors []string `json:"errors,omitempty"`
+	// unknown counts the backends that do not have the model.
+	unknown int
+}
+
+var errUnknownModel = errors.New("darkflow has no such model")
+
+// modelsURL returns the URL of the models endpoint of backend, followed by
+// elems.
+func modelsURL(backend string, elems ...string) (string, error) {
+	u, err := url.Parse(backend)
+	if err != nil {
+		return "", err
+	}
+	u.Path = path.Join(append([]string{darkflowModelsPath}, elems...)...)
+	return u.String(), nil
+}
+
+// fetchModels asks a darkflow backend for its models. Both a plain list and
+// one wrapped in {"models": [...]} are understood.
+func fetchModels(ctx context.Context) ([]modelInfo, int, error) {
+	backend, done, err := backends.pick()
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, withCode(codeBackendUnavailable, err)
+	}
+	defer done()
+	u, err := modelsURL(backend)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("could not create models request: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("could not create models request: %v", err)
+	}
+	setDarkflowAuth(req)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	resp, err := darkflowClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, http.StatusBadGateway, withCode(codeBackendUnavailable, fmt.Errorf("could not list models: %v", err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, http.StatusBadGateway, withCode(codeBackendError, fmt.Errorf("darkflow returned error: %s", resp.Status))
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, http.StatusBadGateway, withCode(codeBackendError, fmt.Errorf("could not read models: %v", err))
+	}
+	var models []modelInfo
+	if err := json.Unmarshal(body, &models); err != nil {
+		var wrapped struct {
+			Models []modelInfo `json:"models"`
+		}
+		if err := json.Unmarshal(body, &wrapped); err != nil {
+			return nil, http.StatusBadGateway, withCode(codeBackendError, fmt.Errorf("could not decode models: %v", err))
+		}
+		models = wrapped.Models
+	}
+	for i := range models {
+		if models[i].Classes == nil {
+			models[i].Classes = []string{}
+		}
+	}
+	if models == nil {
+		models = []modelInfo{}
+	}
+	return models, 0, nil
+}
+
+// loadModel asks every backend to load model, so that whichever a job is
+// sent to has it warm.
+func loadModel(ctx context.Context, model string) modelLoad {
+	ctx, cancel := context.WithTimeout(ctx, modelLoadTimeout)
+	defer cancel()
+	res := modelLoad{Model: model}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, backend := range backends.list() {
+		wg.Add(1)
+		go func(backend string) {
+			defer wg.Done()
+			err := loadModelOn(ctx, backend, model)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("Could not load model %s on darkflow at %s: %v", model, backend, err)
+				res.Failed++
+				res.Errors = append(res.Errors, err.Error())
+				if errors.Is(err, errUnknownModel) {
+					res.unknown++
+				}
+				return
+			}
+			res.Loaded++
+		}(backend)
+	}
+	wg.Wait()
+	return res
+}
+
+func loadModelOn(ctx context.Context, backend, model string) error {
+	u, err := modelsURL(backend, url.PathEscape(model), "load")
+	if err != nil {
+		return fmt.Errorf("could not create load request: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, u, nil)
+	if err != nil {
+		return fmt.Errorf("could not create load request: %v", err)
+	}
+	setDarkflowAuth(req)
+	resp, err := darkflowClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("could not load model: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", errUnknownModel, model)
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("darkflow returned error: %s", resp.Status)
+	}
+	return nil
+}
+
+// modelsHandler serves GET /models, the models of darkflow and their
+// classes, and POST /models/{name}/load, which warms a model ahead of the
+// jobs that will run it.
+func modelsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		setupResponse(w)
+		return
+	}
+	if _, ok := admit(w, r); !ok {
+		return
+	}
+	if darkflowModelsPath == "" {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/models"), "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "":
+		models, status, err := fetchModels(r.Context())
+		if err != nil {
+			jsonError(w, status, err)
+			return
+		}
+		jsonResponse(w, http.StatusOK, models)
+	case r.Method == http.MethodPost && len(parts) == 2 && parts[0] != "" && parts[1] == "load":
+		if err := checkMaintenance(); err != nil {
+			jsonError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		n := len(backends.list())
+		if n == 0 {
+			jsonError(w, http.StatusServiceUnavailable, withCode(codeBackendUnavailable, fmt.Errorf("no darkflow backends available")))
+			return
+		}
+		log.Printf("Loading model %s on %d backends", parts[0], n)
+		res := loadModel(r.Context(), parts[0])
+		if res.unknown == n {
+			jsonError(w, http.StatusNotFound, fmt.Errorf("model %s not found", parts[0]))
+			return
+		}
+		if res.Loaded == 0 {
+			jsonError(w, http.StatusBadGateway, withCode(codeBackendError, fmt.Errorf("could not load model %s: %s", parts[0], strings.Join(res.Errors, "; "))))
+			return
+		}
+		jsonResponse(w, http.StatusOK, res)
+	default:
+		jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var outputNameTemplate string
+
+const defaultOutputNameTemplate = "{jobid}/{name}{ext}"
+
+// outputFile maps a file produced by darkflow to the name it is served under.
+type outputFile struct {
+	// Source is the name darkflow gave the file.
+	Source string `json:"source"`
+	// Index is the position of the input image the file was produced from,
+	// or -1 if darkflow's name does not refer to an input.
+	Index int `json:"index"`
+	// Input is the image URL or uploaded file name at Index.
+	Input string `json:"input,omitempty"`
+	URL   string `json:"url"`
+	// SHA256 is the hex checksum of the file's content.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// outputFilePath is where the output f of j lives on disk.
+func (j *job) outputFilePath(t *tenant, f outputFile) string {
+	rel := strings.TrimPrefix(f.URL, t.outputURL(j.ID, "")+"/")
+	return filepath.Join(j.outputPath(t), filepath.FromSlash(rel))
+}
+
+// validateOutputNameTemplate makes sure names rendered from tpl stay inside
+// the job's output directory and cannot collide, either across jobs or
+// between files of one job.
+func validateOutputNameTemplate(tpl string) error {
+	if !strings.HasPrefix(tpl, "{jobid}/") {
+		return fmt.Errorf("output name template %q must start with {jobid}/", tpl)
+	}
+	if !strings.Contains(tpl, "{ext}") {
+		return fmt.Errorf("output name template %q must contain {ext}", tpl)
+	}
+	if !strings.Contains(tpl, "{index}") && !strings.Contains(tpl, "{name}") {
+		return fmt.Errorf("output name template %q must contain {index} or {name}", tpl)
+	}
+	for _, part := range strings.Split(tpl, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("output name template %q contains an invalid path element", tpl)
+		}
+	}
+	return nil
+}
+
+// renameOutputs renames the files darkflow wrote for j according to
+// -output-name-template and returns the resulting mapping. Supported
+// variables are {jobid}, {tenant}, {date}, {index}, {name}, {ext} and
+// {label_count}, the number of detections in the file's annotation.
+func renameOutputs(t *tenant, j *job) ([]outputFile, error) {
+	dir := j.outputPath(t)
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read output dir: %v", err)
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not read output dir: %v", err)
+	}
+	sort.Strings(names)
+
+	files := make([]outputFile, 0, len(names))
+	targets := make(map[string]string)
+	for _, name := range names {
+		ext := filepath.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+
+		index, err := strconv.Atoi(base)
+		if err != nil || index < 0 || index >= j.imageCount() {
+			index = -1
+		}
+		labels := 0
+		if ds, err := readDetections(filepath.Join(dir, base+".json")); err == nil {
+			labels = len(ds)
+		}
+
+		rel := strings.NewReplacer(
+			"{jobid}", j.ID,
+			"{tenant}", t.Name,
+			"{date}", j.CreatedAt.Format("2006-01-02"),
+			"{index}", strconv.Itoa(index),
+			"{name}", base,
+			"{ext}", ext,
+			"{label_count}", strconv.Itoa(labels),
+		).Replace(outputNameTemplate)
+		rel = strings.TrimPrefix(rel, j.ID+"/")
+		if other, ok := targets[rel]; ok {
+			return nil, fmt.Errorf("output name template maps both %s and %s to %s", other, name, rel)
+		}
+		targets[rel] = name
+
+		f := outputFile{Source: name, Index: index, URL: t.outputURL(j.ID, filepath.ToSlash(rel))}
+		if index >= 0 {
+			f.Input = j.inputName(index)
+		}
+		files = append(files, f)
+	}
+
+	if outputNameTemplate == defaultOutputNameTemplate {
+		return files, nil
+	}
+
+	// Move everything aside first so that a rename never clobbers a file
+	// that has not been renamed yet.
+	const staging = ".naming"
+	if err := os.Mkdir(filepath.Join(dir, staging), 0755); err != nil {
+		return nil, fmt.Errorf("could not rename outputs: %v", err)
+	}
+	for _, name := range names {
+		if err := os.Rename(filepath.Join(dir, name), filepath.Join(dir, staging, name)); err != nil {
+			return nil, fmt.Errorf("could not rename outputs: %v", err)
+		}
+	}
+	for rel, name := range targets {
+		to := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			return nil, fmt.Errorf("could not rename outputs: %v", err)
+		}
+		if err := os.Rename(filepath.Join(dir, staging, name), to); err != nil {
+			return nil, fmt.Errorf("could not rename outputs: %v", err)
+		}
+	}
+	if err := os.Remove(filepath.Join(dir, staging)); err != nil {
+		return nil, fmt.Errorf("could not rename outputs: %v", err)
+	}
+	return files, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var notifySlack string
+var notifyEmail string
+var notifySNS string
+var snsEndpoint string
+var notifyEvents string
+var outageAfter int
+
+// Events operators can be notified of.
+const (
+	eventJobFailed        = "job_failed"
+	eventBackendDown      = "backend_down"
+	eventBackendRecovered = "backend_recovered"
+	eventBackendRestarted = "backend_restarted"
+	eventExportFailed     = "export_failed"
+)
+
+// notification is an alert sent to every configured sink.
+type notification struct {
+	Event   string    `json:"event"`
+	Subject string    `json:"subject"`
+	Text    string    `json:"text"`
+	Time    time.Time `json:"time"`
+}
+
+// notifier delivers notifications to one sink, such as a Slack channel.
+type notifier interface {
+	name() string
+	notify(ctx context.Context, n notification) error
+}
+
+// notifiers are the sinks set up by setupNotifiers.
+var notifiers []notifier
+
+// notifyEnabled is the set of -notify-events.
+var notifyEnabled map[string]bool
+
+// setupNotifiers builds the sinks configured by the -notify-* flags.
+func setupNotifiers() error {
+	if notifySlack != "" {
+		notifiers = append(notifiers, slackNotifier{webhook: notifySlack})
+	}
+	if notifyEmail != "" {
+		n, err := newEmailNotifier(notifyEmail)
+		if err != nil {
+			return err
+		}
+		notifiers = append(notifiers, n)
+	}
+	if notifySNS != "" {
+		n, err := newSNSNotifier(notifySNS)
+		if err != nil {
+			return err
+		}
+		notifiers = append(notifiers, n)
+	}
+
+	notifyEnabled = make(map[string]bool)
+	for _, e := range strings.Split(notifyEvents, ",") {
+		e = strings.TrimSpace(e)
+		switch e {
+		case "":
+		case eventJobFailed, eventBackendDown, eventBackendRecovered, eventBackendRestarted, eventExportFailed:
+			notifyEnabled[e] = true
+		default:
+			return fmt.Errorf("unknown notification event %q", e)
+		}
+	}
+	return nil
+}
+
+// notify sends a notification of event to every sink in the background.
+// Failures to deliver are logged.
+func notify(event, subject, format string, args ...interface{}) {
+	if len(notifiers) == 0 || !notifyEnabled[event] {
+		return
+	}
+	n := notification{Event: event, Subject: subject, Text: fmt.Sprintf(format, args...), Time: time.Now().UTC()}
+	for _, s := range notifiers {
+		go func(s notifier) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := s.notify(ctx, n); err != nil {
+				log.Printf("Could not send %s notification to %s: %v", n.Event, s.name(), err)
+			}
+		}(s)
+	}
+}
+
+// slackNotifier posts to a Slack incoming webhook.
+type slackNotifier struct {
+	webhook string
+}
+
+func (s slackNotifier) name() string { return "slack" }
+
+func (s slackNotifier) notify(ctx context.Context, n notification) error {
+	body, err := json.Marshal(map[string]string{"text": "*" + n.Subject + "*\n" + n.Text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doNotify(ctx, req)
+}
+
+// emailNotifier sends mail through an SMTP server. It is configured as
+// smtp://[user:password@]host:port?from=<address>&to=<address>[,<address>...].
+type emailNotifier struct {
+	addr string
+	auth smtp.Auth
+	from string
+	to   []string
+}
+
+func newEmailNotifier(raw string) (*emailNotifier, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "smtp" || u.Host == "" {
+		return nil, fmt.Errorf("invalid -notify-email %q, want smtp://[user:password@]host:port?from=...&to=...", raw)
+	}
+	n := &emailNotifier{addr: u.Host, from: u.Query().Get("from")}
+	for _, to := range strings.Split(u.Query().Get("to"), ",") {
+		if to = strings.TrimSpace(to); to != "" {
+			n.to = append(n.to, to)
+		}
+	}
+	if n.from == "" || len(n.to) == 0 {
+		return nil, fmt.Errorf("-notify-email needs from and to addresses")
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		n.auth = smtp.PlainAuth("", u.User.Username(), password, u.Hostname())
+	}
+	return n, nil
+}
+
+func (e *emailNotifier) name() string { return "email" }
+
+func (e *emailNotifier) notify(ctx context.Context, n notification) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", n.Subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(n.Text, "\n", "\r\n", -1))
+	msg.WriteString("\r\n")
+	// net/smtp does not take a context; the send is bounded by the
+	// server's own timeouts.
+	return smtp.SendMail(e.addr, e.auth, e.from, e.to, msg.Bytes())
+}
+
+// snsNotifier publishes to an AWS SNS topic, signed with the credentials
+// in the AWS_* environment variables.
+type snsNotifier struct {
+	topic  string
+	region string
+}
+
+func newSNSNotifier(topic string) (*snsNotifier, error) {
+	// arn:aws:sns:<region>:<account>:<name>
+	parts := strings.Split(topic, ":")
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sns" {
+		return nil, fmt.Errorf("invalid -notify-sns %q, want a topic ARN", topic)
+	}
+	if _, err := awsCredentialsFromEnv(); err != nil {
+		return nil, fmt.Errorf("-notify-sns: %v", err)
+	}
+	return &snsNotifier{topic: topic, region: parts[3]}, nil
+}
+
+func (s *snsNotifier) name() string { return "sns" }
+
+func (s *snsNotifier) notify(ctx context.Context, n notification) error {
+	creds, err := awsCredentialsFromEnv()
+	if err != nil {
+		return err
+	}
+	form := url.Values{
+		"Action":   {"Publish"},
+		"Version":  {"2010-03-31"},
+		"TopicArn": {s.topic},
+		"Subject":  {n.Subject},
+		"Message":  {n.Text},
+	}
+	payload := []byte(form.Encode())
+	endpoint := fmt.Sprintf("https://sns.%s.amazonaws.com/", s.region)
+	if snsEndpoint != "" {
+		endpoint = strings.TrimSuffix(snsEndpoint, "/") + "/"
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	signAWSv4(req, payload, "sns", s.region, creds)
+	return doNotify(ctx, req)
+}
+
+func doNotify(ctx context.Context, req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("got %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// apiRoute documents one endpoint for /openapi.json. Request and Response are
+// zero values of the types the handler decodes and encodes; their schemas
+// are derived from the types by reflection so they cannot drift from the
+// code. Routes themselves are listed by hand: add one with every new
+// endpoint.
+type apiRoute struct {
+	Method   string
+	Path     string
+	Summary  string
+	Request  interface{}
+	Response interface{}
+	// Status is the success status, 200 when zero.
+	Status int
+	// Query lists the query parameters.
+	Query []string
+	// ContentType of the response, application/json when empty.
+	ContentType string
+	Admin       bool
+}
+
+var apiRoutes = []apiRoute{
+	{Method: "post", Path: "/recognize", Summary: "Download images and run darkflow over them",
+		Request: recognizeRequest{}, Response: []string{}},
+	{Method: "post", Path: "/upload", Summary: "Upload images as multipart/form-data and run darkflow over them",
+		Response: []string{}},
+	{Method: "post", Path: "/v2/recognize", Summary: "Download images and run darkflow over them, answering with the detections of every input and going on without inputs that fail to stage",
+		Request: recognizeRequest{}, Response: recognizeResponseV2{}, Query: []string{"envelope"}},
+	{Method: "post", Path: "/v2/upload", Summary: "Upload images as multipart/form-data and run darkflow over them, answering as /v2/recognize",
+		Response: recognizeResponseV2{}, Query: []string{"envelope"}},
+	{Method: "post", Path: "/compare", Summary: "Run two models or backends over the same images and diff the detections",
+		Request: compareRequest{}, Response: compareResponse{}},
+	{Method: "get", Path: "/jobs", Summary: "List jobs, newest first",
+		Response: []job{}, Query: []string{"tag"}},
+	{Method: "get", Path: "/jobs/{id}", Summary: "Get a job record", Response: job{}},
+	{Method: "delete", Path: "/jobs/{id}", Summary: "Delete the inputs and outputs of a job", Response: job{}},
+	{Method: "post", Path: "/jobs/{id}/cancel", Summary: "Cancel a running job", Response: job{}},
+	{Method: "post", Path: "/jobs/{id}/rerun", Summary: "Run darkflow again over the inputs of a job",
+		Request: rerunRequest{}, Response: job{}},
+	{Method: "post", Path: "/jobs/{id}/retry", Summary: "Run a failed job again in place from the stage of from, download or backend, reusing the inputs it staged",
+		Response: job{}, Query: []string{"from"}},
+	{Method: "get", Path: "/jobs/{id}/results", Summary: "Page through the output files of a job",
+		Response: resultsPage{}, Query: []string{"offset", "limit"}},
+	{Method: "get", Path: "/jobs/{id}/response", Summary: "Get the response to the request of a job answered 202 Accepted, which it keeps answering until the job finished",
+		Response: []string{}},
+	{Method: "get", Path: "/jobs/{id}/stats", Summary: "Get detection counts and confidence histograms of a job by class and image",
+		Response: jobStats{}},
+	{Method: "get", Path: "/output/{tenant}/{id}/{file}", Summary: "Fetch an output file; .json files hold the detections of an input. The token parameter or X-Output-Token header takes the output token of the job's response instead of an api key",
+		Response: []detection{}, Query: []string{"token"}},
+	{Method: "get", Path: "/models", Summary: "List the models of darkflow and their classes", Response: []modelInfo{}},
+	{Method: "post", Path: "/models/{name}/load", Summary: "Load a model on every darkflow backend ahead of the jobs that run it", Response: modelLoad{}},
+	{Method: "post", Path: "/streams", Summary: "Register a camera stream", Request: streamRequest{}, Response: stream{}, Status: http.StatusCreated},
+	{Method: "get", Path: "/streams", Summary: "List camera streams", Response: []stream{}},
+	{Method: "get", Path: "/streams/{id}", Summary: "Get a camera stream", Response: stream{}},
+	{Method: "delete", Path: "/streams/{id}", Summary: "Stop and remove a camera stream", Response: stream{}},
+	{Method: "get", Path: "/streams/{id}/latest", Summary: "Get the detections of the latest frame of a stream", Response: streamResult{}},
+	{Method: "post", Path: "/sets", Summary: "Create a named image set", Request: setRequest{}, Response: imageSet{}, Status: http.StatusCreated},
+	{Method: "get", Path: "/sets", Summary: "List image sets", Response: []imageSet{}},
+	{Method: "get", Path: "/sets/{name}", Summary: "Get an image set", Response: imageSet{}},
+	{Method: "delete", Path: "/sets/{name}", Summary: "Delete an image set, leaving its jobs", Response: imageSet{}},
+	{Method: "post", Path: "/sets/{name}/images", Summary: "Add image URLs to a set; URLs already in it are ignored",
+		Request: setImagesRequest{}, Response: imageSet{}},
+	{Method: "post", Path: "/sets/{name}/recognize", Summary: "Recognize the images of a set not processed yet, or that failed, and get the results of the set",
+		Response: setResults{}},
+	{Method: "get", Path: "/sets/{name}/results", Summary: "Get the latest detections of the images of a set, with counts by state and class",
+		Response: setResults{}},
+	{Method: "post", Path: "/manifests", Summary: "Run the images listed in a CSV or JSONL manifest as chunk jobs in the background",
+		Request: manifestRequest{}, Response: manifestStatus{}, Status: http.StatusAccepted},
+	{Method: "get", Path: "/manifests/{id}", Summary: "Get the state of a manifest, with its rows counted by state", Response: manifestStatus{}},
+	{Method: "get", Path: "/manifests/{id}/results", Summary: "Get the rows of a manifest with their results appended, in the format of the manifest",
+		Response: "", ContentType: "text/csv"},
+	{Method: "get", Path: "/queue", Summary: "Get the state of the darkflow queue", Response: queueStatus{}},
+	{Method: "get", Path: "/readyz", Summary: "Get the health of the output storage and its replica; 503 when jobs cannot run", Response: readiness{}},
+	{Method: "get", Path: "/stats", Summary: "Get job counts, latency and failures of the last 24 hours across all tenants", Response: usageStats{}},
+	{Method: "get", Path: "/admin/downloads", Summary: "List downloads in flight", Response: downloadsResponse{}, Admin: true},
+	{Method: "get", Path: "/admin/policy", Summary: "Get the URL policy in effect", Response: policyStatus{}, Admin: true},
+	{Method: "get", Path: "/admin/metrics", Summary: "Get job stage timings and outcomes in the Prometheus text format",
+		Response: "", ContentType: "text/plain", Admin: true},
+	{Method: "get", Path: "/admin/timeouts", Summary: "Get darkflow latency percentiles per batch size and the timeouts they suggest",
+		Response: timeoutsResponse{}, Admin: true},
+	{Method: "get", Path: "/admin/fetch-failures", Summary: "List the image URLs and hosts in fetch failure cooldown", Response: fetchFailuresResponse{}, Admin: true},
+	{Method: "delete", Path: "/admin/fetch-failures", Summary: "End all fetch failure cooldowns", Response: fetchFailuresResponse{}, Admin: true},
+	{Method: "get", Path: "/admin/probe-cache", Summary: "List the cached HEAD results of image URLs", Response: probeCacheResponse{}, Admin: true},
+	{Method: "delete", Path: "/admin/probe-cache", Summary: "Drop the cached HEAD results of image URLs", Response: probeCacheResponse{}, Admin: true},
+	{Method: "get", Path: "/admin/maintenance", Summary: "Get the maintenance window and the number of jobs still running", Response: maintenanceStatus{}, Admin: true},
+	{Method: "put", Path: "/admin/maintenance", Summary: "Start or extend a maintenance window, turning away new work with 503 until it ends",
+		Request: maintenanceRequest{}, Response: maintenanceStatus{}, Admin: true},
+	{Method: "delete", Path: "/admin/maintenance", Summary: "End the maintenance window early", Response: maintenanceStatus{}, Admin: true},
+	{Method: "get", Path: "/admin/backend-debug", Summary: "Get the settings of darkflow call logging", Response: backendDebugConfig{}, Admin: true},
+	{Method: "put", Path: "/admin/backend-debug", Summary: "Turn darkflow call logging on or off and change its redaction", Request: backendDebugRequest{}, Response: backendDebugConfig{}, Admin: true},
+	{Method: "get", Path: "/admin/backend-debug/jobs/{id}", Summary: "Get the persisted darkflow calls of a job", Response: []backendExchange{}, Query: []string{"tenant"}, Admin: true},
+	{Method: "get", Path: "/admin/debug/pprof/{profile}", Summary: "Get a pprof profile, e.g. heap, goroutine, or a CPU profile with profile?seconds=N",
+		Response: "", ContentType: "application/octet-stream", Admin: true},
+	{Method: "get", Path: "/admin/debug/vars", Summary: "Get the expvar variables, including memory statistics and the goroutine count", Response: map[string]interface{}{}, Admin: true},
+	{Method: "post", Path: "/admin/debug/dump", Summary: "Write a goroutine dump and a heap profile to -debug-dump-dir", Response: debugDumpResponse{}, Admin: true},
+}
+
+var openAPIOnce sync.Once
+var openAPIDoc []byte
+
+// openAPIHandler serves the OpenAPI 3 description of the API.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		setupResponse(w)
+		return
+	}
+	openAPIOnce.Do(func() {
+		openAPIDoc, _ = json.MarshalIndent(buildOpenAPI(), "", "  ")
+	})
+	setupResponse(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDoc)
+}
+
+type schema = map[string]interface{}
+
+func buildOpenAPI() schema {
+	g := &schemaGen{components: make(map[string]schema)}
+	errorRef := g.schemaOf(reflect.TypeOf(errorBody{}))
+	paths := make(map[string]schema)
+	for _, route := range apiRoutes {
+		op := schema{"summary": route.Summary}
+		var params []schema
+		for _, name := range pathParams(route.Path) {
+			params = append(params, schema{"name": name, "in": "path", "required": true, "schema": schema{"type": "string"}})
+		}
+		for _, name := range route.Query {
+			params = append(params, schema{"name": name, "in": "query", "schema": schema{"type": "string"}})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+		if route.Request != nil {
+			op["requestBody"] = schema{"required": true, "content": schema{
+				"application/json": schema{"schema": g.schemaOf(reflect.TypeOf(route.Request))},
+			}}
+		} else if route.Path == "/upload" {
+			op["requestBody"] = uploadRequestBody()
+		}
+		status := route.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		contentType := route.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		op["responses"] = schema{
+			strconv.Itoa(status): schema{"description": http.StatusText(status), "content": schema{
+				contentType: schema{"schema": g.schemaOf(reflect.TypeOf(route.Response))},
+			}},
+			"default": schema{"description": "Error", "content": schema{
+				"application/json": schema{"schema": errorRef},
+			}},
+		}
+		if route.Admin {
+			op["security"] = []schema{{"adminKey": []string{}}}
+		}
+		if paths[route.Path] == nil {
+			paths[route.Path] = schema{}
+		}
+		paths[route.Path][route.Method] = op
+	}
+
+	return schema{
+		"openapi": "3.0.3",
+		"info": schema{
+			"title":   "darkflow-front",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": schema{
+			"schemas": g.components,
+			"securitySchemes": schema{
+				"apiKey":   schema{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"adminKey": schema{"type": "apiKey", "in": "header", "name": "X-Admin-Key"},
+			},
+		},
+		"security": []schema{{"apiKey": []string{}}},
+	}
+}
+
+func uploadRequestBody() schema {
+	return schema{"required": true, "content": schema{
+		"multipart/form-data": schema{"schema": schema{
+			"type": "object",
+			"properties": schema{
+				"images":           schema{"type": "array", "items": schema{"type": "string", "format": "binary"}},
+				"model":            schema{"type": "string"},
+				"threshold":        schema{"type": "number"},
+				"dry_run":          schema{"type": "boolean"},
+				"retain":           schema{"type": "string"},
+				"tag":              schema{"type": "array", "items": schema{"type": "string"}},
+				"render":           schema{"type": "string", "description": "JSON rendering options, as in /recognize"},
+				"callback_url":     schema{"type": "string", "description": "URL the signed job record is POSTed to when the job finishes"},
+				"class_thresholds": schema{"type": "string", "description": "comma separated <class>=<confidence> minimum confidences"},
+				"filters":          schema{"type": "string", "description": "JSON output filters, as in /recognize"},
+				"report":           schema{"type": "string", "enum": []string{reportPDF, reportHTML}},
+				"include_images":   schema{"type": "string", "enum": []string{includeInline}, "description": "embeds the annotated images in /v2 responses"},
+				"heatmap":          schema{"type": "string", "description": "class, or * for all, whose detections are aggregated into heatmap.png"},
+			},
+			"required": []string{"images"},
+		}},
+	}}
+}
+
+func pathParams(path string) []string {
+	var names []string
+	for _, part := range strings.Split(path, "/") {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			names = append(names, strings.Trim(part, "{}"))
+		}
+	}
+	return names
+}
+
+// schemaGen derives JSON schemas from Go types following encoding/json's
+// rules. Named structs become components referenced by $ref.
+type schemaGen struct {
+	components map[string]schema
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+func (g *schemaGen) schemaOf(t reflect.Type) schema {
+	switch t {
+	case timeType:
+		return schema{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		return schema{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := g.schemaOf(t.Elem())
+		if _, ok := s["$ref"]; ok {
+			return schema{"allOf": []schema{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	case reflect.String:
+		return schema{"type": "string"}
+	case reflect.Bool:
+		return schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return schema{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			// encoding/json sends byte slices as base64.
+			return schema{"type": "string", "format": "byte"}
+		}
+		return schema{"type": "array", "items": g.schemaOf(t.Elem())}
+	case reflect.Map:
+		return schema{"type": "object", "additionalProperties": g.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		name := componentName(t.Name())
+		if _, ok := g.components[name]; !ok {
+			// Reserve the name first so recursive types terminate.
+			g.components[name] = schema{}
+			g.components[name] = g.structSchema(t)
+		}
+		return schema{"$ref": "#/components/schemas/" + name}
+	}
+	return schema{}
+}
+
+func (g *schemaGen) structSchema(t reflect.Type) schema {
+	props := schema{}
+	g.addFields(t, props)
+	return schema{"type": "object", "properties": props}
+}
+
+func (g *schemaGen) addFields(t reflect.Type, props schema) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			g.addFields(f.Type, props)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schemaOf(f.Type)
+	}
+}
+
+func componentName(goName string) string {
+	r := []rune(goName)
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
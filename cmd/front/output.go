@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var outputRateLimit int64
+
+// serveOutput answers GET and HEAD for a file under -output, with Range and
+// conditional requests handled by http.ServeContent. Files that cannot be
+// read from -output, or all of them while it is unhealthy, are served from
+// -replica when it has them. Without a rate limit
+// the file is copied straight to the connection, with sendfile where the
+// system supports it, so large videos are never buffered. Directories are
+// left to dirs.
+func serveOutput(w http.ResponseWriter, r *http.Request, dirs http.Handler) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+		return
+	}
+	rel := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(r.URL.Path, "/output/")), "/")
+	if !localStorage.healthy() && serveReplica(w, r, rel) {
+		return
+	}
+	f, err := os.Open(filepath.Join(outputDir, filepath.FromSlash(rel)))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			localStorage.observe(err)
+		}
+		if !serveReplica(w, r, rel) {
+			http.NotFound(w, r)
+		}
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if info.IsDir() {
+		dirs.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	if outputRateLimit > 0 {
+		limiter, release := outputLimiters.acquire(r.RemoteAddr)
+		defer release()
+		w = &throttledResponseWriter{ResponseWriter: w, limiter: limiter}
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// outputLimiters hold the -output-rate-limit bucket of every client
+// connection with a transfer in flight, so that parallel requests over one
+// HTTP/2 connection share it.
+var outputLimiters = &connLimiters{conns: make(map[string]*connLimiter)}
+
+type connLimiters struct {
+	mu    sync.Mutex
+	conns map[string]*connLimiter
+}
+
+type connLimiter struct {
+	limiter *bandwidthLimiter
+	users   int
+}
+
+func (c *connLimiters) acquire(conn string) (*bandwidthLimiter, func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l := c.conns[conn]
+	if l == nil {
+		l = &connLimiter{limiter: newBandwidthLimiter(outputRateLimit)}
+		c.conns[conn] = l
+	}
+	l.users++
+	return l.limiter, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if l.users--; l.users == 0 {
+			delete(c.conns, conn)
+		}
+	}
+}
+
+// throttledResponseWriter paces the body of a response through a
+// bandwidthLimiter.
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	limiter *bandwidthLimiter
+}
+
+func (w *throttledResponseWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > w.limiter.chunk {
+			chunk = chunk[:w.limiter.chunk]
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		w.limiter.wait(n)
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// ReadFrom keeps io.Copy from bypassing the limit through the underlying
+// writer's ReadFrom.
+func (w *throttledResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{w}, r)
+}
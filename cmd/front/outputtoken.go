@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// outputTokenTTL is how long the output token issued with a job response
+// grants access to the job's outputs; 0 disables the tokens.
+// outputTokenSecret signs them, and requireOutputToken makes them the only
+// way to read /output.
+var outputTokenTTL time.Duration
+var outputTokenSecret string
+var requireOutputToken bool
+
+var outputTokenKey []byte
+
+// outputTokenScope is what an output token grants: reading the outputs of
+// one job of one tenant until Expires.
+type outputTokenScope struct {
+	Tenant  string
+	JobID   string
+	Expires time.Time
+}
+
+// dir returns the subtree of /output the token grants access to.
+func (s outputTokenScope) dir() string {
+	return path.Join(s.Tenant, s.JobID)
+}
+
+func setupOutputTokens() error {
+	if requireOutputToken && outputTokenTTL <= 0 {
+		return fmt.Errorf("-require-output-token needs a positive -output-token-ttl")
+	}
+	if outputTokenTTL <= 0 {
+		return nil
+	}
+	if outputTokenSecret != "" {
+		outputTokenKey = []byte(outputTokenSecret)
+		return nil
+	}
+	// Tokens signed with a random key do not survive a restart and are
+	// not accepted by other replicas.
+	outputTokenKey = make([]byte, 32)
+	if _, err := rand.Read(outputTokenKey); err != nil {
+		return fmt.Errorf("could not generate output token key: %v", err)
+	}
+	log.Printf("No -output-token-secret, output tokens are only valid until restart")
+	return nil
+}
+
+// issueOutputToken returns a token granting read access to the outputs of
+// j, and when it expires: after -output-token-ttl, or when the outputs do if
+// that is sooner.
+func issueOutputToken(t *tenant, j *job) (string, time.Time) {
+	expires := time.Now().Add(outputTokenTTL).Truncate(time.Second)
+	if j.ExpiresAt != nil && j.ExpiresAt.Before(expires) {
+		expires = *j.ExpiresAt
+	}
+	payload := t.Name + "/" + j.ID + "/" + strconv.FormatInt(expires.Unix(), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + signOutputToken(payload), expires
+}
+
+func signOutputToken(payload string) string {
+	mac := hmac.New(sha256.New, outputTokenKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyOutputToken checks the signature and expiry of token and returns
+// what it grants.
+func verifyOutputToken(token string) (outputTokenScope, error) {
+	if outputTokenKey == nil {
+		return outputTokenScope{}, fmt.Errorf("output tokens are disabled")
+	}
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return outputTokenScope{}, fmt.Errorf("invalid output token")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || !hmac.Equal([]byte(sig), []byte(signOutputToken(string(raw)))) {
+		return outputTokenScope{}, fmt.Errorf("invalid output token")
+	}
+	fields := strings.Split(string(raw), "/")
+	if len(fields) != 3 {
+		return outputTokenScope{}, fmt.Errorf("invalid output token")
+	}
+	unix, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return outputTokenScope{}, fmt.Errorf("invalid output token")
+	}
+	scope := outputTokenScope{Tenant: fields[0], JobID: fields[1], Expires: time.Unix(unix, 0)}
+	if !time.Now().Before(scope.Expires) {
+		return outputTokenScope{}, fmt.Errorf("output token expired at %s", scope.Expires.UTC().Format(time.RFC3339))
+	}
+	return scope, nil
+}
+
+// outputToken extracts an output token from the X-Output-Token header or,
+// for shared links, the token query parameter.
+func outputToken(r *http.Request) string {
+	if token := r.Header.Get("X-Output-Token"); token != "" {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+// setOutputToken adds a token for the outputs of j to the response, unless
+// tokens are disabled or j keeps its outputs in memory.
+func setOutputToken(w http.ResponseWriter, t *tenant, j *job) {
+	if outputTokenTTL <= 0 || inMemory {
+		return
+	}
+	token, expires := issueOutputToken(t, j)
+	w.Header().Set("X-Output-Token", token)
+	w.Header().Set("X-Output-Token-Expires-At", expires.UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var urlPolicyFile string
+var urlPolicyInterval time.Duration
+
+// urlPolicy restricts the URLs the frontend fetches images and stream frames
+// from. The zero policy allows everything.
+//
+// Host patterns are either a host name or *.<domain> matching every
+// subdomain of domain. Networks are CIDRs. Network rules are checked against
+// every address actually dialed, so host names resolving to denied addresses
+// are caught too.
+type urlPolicy struct {
+	// Schemes lists the accepted URL schemes; empty accepts all.
+	Schemes []string `json:"schemes,omitempty"`
+	// AllowHosts, when not empty, is the only hosts images may come from.
+	AllowHosts []string `json:"allow_hosts,omitempty"`
+	DenyHosts  []string `json:"deny_hosts,omitempty"`
+	// DenyPrivate rejects loopback, private and link-local addresses, such
+	// as cloud metadata endpoints.
+	DenyPrivate  bool     `json:"deny_private"`
+	DenyNetworks []string `json:"deny_networks,omitempty"`
+	// AllowNetworks are exempt from DenyPrivate and DenyNetworks.
+	AllowNetworks []string `json:"allow_networks,omitempty"`
+
+	denyNets  []*net.IPNet
+	allowNets []*net.IPNet
+}
+
+// policy holds the URL policy in effect, reloaded by watchURLPolicy.
+var policy = &policyHolder{current: &urlPolicy{}}
+
+type policyHolder struct {
+	mu        sync.Mutex
+	current   *urlPolicy
+	modTime   time.Time
+	loadedAt  time.Time
+	reloadErr string
+	failedAt  time.Time
+}
+
+func (h *policyHolder) get() *urlPolicy {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.current
+}
+
+// loadURLPolicy reads and compiles the policy in file.
+func loadURLPolicy(file string) (*urlPolicy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read url policy: %v", err)
+	}
+	var p urlPolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("could not parse url policy: %v", err)
+	}
+	for i, s := range p.Schemes {
+		p.Schemes[i] = strings.ToLower(s)
+	}
+	if p.denyNets, err = parseNetworks(p.DenyNetworks); err != nil {
+		return nil, err
+	}
+	if p.allowNets, err = parseNetworks(p.AllowNetworks); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q in url policy: %v", cidr, err)
+		}
+		nets[i] = n
+	}
+	return nets, nil
+}
+
+// watchURLPolicy loads -url-policy and, when it is set, checks the file for
+// changes every -url-policy-interval. A policy that fails to load keeps the
+// previous one in effect.
+func watchURLPolicy() error {
+	if urlPolicyFile == "" {
+		return nil
+	}
+	if err := reloadURLPolicy(); err != nil {
+		return err
+	}
+	if urlPolicyInterval <= 0 {
+		return nil
+	}
+	go func() {
+		for {
+			time.Sleep(urlPolicyInterval)
+			var mod time.Time
+			if info, err := os.Stat(urlPolicyFile); err == nil {
+				mod = info.ModTime()
+			}
+			policy.mu.Lock()
+			unchanged := mod.Equal(policy.modTime)
+			policy.mu.Unlock()
+			if unchanged {
+				continue
+			}
+			if err := reloadURLPolicy(); err != nil {
+				log.Printf("Keeping previous url policy: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func reloadURLPolicy() error {
+	info, err := os.Stat(urlPolicyFile)
+	if err == nil {
+		var p *urlPolicy
+		if p, err = loadURLPolicy(urlPolicyFile); err == nil {
+			policy.mu.Lock()
+			policy.current = p
+			policy.modTime = info.ModTime()
+			policy.loadedAt = time.Now().UTC()
+			policy.reloadErr = ""
+			policy.mu.Unlock()
+			log.Printf("Loaded url policy from %s", urlPolicyFile)
+			return nil
+		}
+	}
+	policy.mu.Lock()
+	policy.modTime = time.Time{}
+	if info != nil {
+		policy.modTime = info.ModTime()
+	}
+	policy.reloadErr = err.Error()
+	policy.failedAt = time.Now().UTC()
+	policy.mu.Unlock()
+	return err
+}
+
+func matchHost(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+func matchAnyHost(patterns []string, host string) bool {
+	for _, p := range patterns {
+		if matchHost(p, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkURL reports whether raw may be fetched under the current policy.
+func checkURL(raw string) error {
+	p := policy.get()
+	u, err := url.Parse(raw)
+	if err != nil {
+		return withCode(codeURLBlocked, fmt.Errorf("invalid url %q: %v", raw, err))
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if len(p.Schemes) > 0 && !containsString(p.Schemes, scheme) {
+		return withCode(codeURLBlocked, fmt.Errorf("scheme %q is not allowed by the url policy", u.Scheme))
+	}
+	switch scheme {
+	case "s3", "gs":
+		// Object storage is reached through its own endpoints; the host is
+		// a bucket name.
+		return nil
+	case "data", "file", "":
+		// Nothing is fetched over the network; local paths are confined to
+		// -local-image-dir instead.
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	if matchAnyHost(p.DenyHosts, host) || len(p.AllowHosts) > 0 && !matchAnyHost(p.AllowHosts, host) {
+		return withCode(codeURLBlocked, fmt.Errorf("host %q is not allowed by the url policy", host))
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return p.checkIP(ip)
+	}
+	return nil
+}
+
+// checkURLs checks all of urls, reporting each one that is blocked.
+func checkURLs(urls []string) error {
+	var details []errorDetail
+	for i, u := range urls {
+		if err := checkURL(u); err != nil {
+			details = append(details, errorDetail{Index: i, Input: u, Code: codeURLBlocked, Message: err.Error()})
+		}
+	}
+	if len(details) == 0 {
+		return nil
+	}
+	err := fmt.Errorf("%d of %d urls are not allowed: %s", len(details), len(urls), details[0].Message)
+	return withCode(codeURLBlocked, err, details...)
+}
+
+func (p *urlPolicy) checkIP(ip net.IP) error {
+	for _, n := range p.allowNets {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	if p.DenyPrivate && (ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified()) {
+		return withCode(codeURLBlocked, fmt.Errorf("address %s is private and denied by the url policy", ip))
+	}
+	for _, n := range p.denyNets {
+		if n.Contains(ip) {
+			return withCode(codeURLBlocked, fmt.Errorf("address %s is denied by the url policy", ip))
+		}
+	}
+	return nil
+}
+
+// policyDialControl rejects connections to addresses the URL policy denies.
+// It runs after name resolution, so it also covers redirects and DNS
+// rebinding.
+func policyDialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return policy.get().checkIP(ip)
+	}
+	return nil
+}
+
+// policyCheckRedirect applies the URL policy to every redirect.
+func policyCheckRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after 10 redirects")
+	}
+	return checkURL(req.URL.String())
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type policyStatus struct {
+	File     string     `json:"file,omitempty"`
+	LoadedAt *time.Time `json:"loaded_at,omitempty"`
+	// Error is why the last reload failed; the previous policy stays in
+	// effect until the file is fixed.
+	Error      string     `json:"error,omitempty"`
+	FailedAt   *time.Time `json:"failed_at,omitempty"`
+	Policy     *urlPolicy `json:"policy"`
+	Restricted bool       `json:"restricted"`
+}
+
+// adminPolicy reports the URL policy in effect.
+func adminPolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		setupResponse(w)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+		return
+	}
+
+	policy.mu.Lock()
+	p := policy.current
+	s := policyStatus{File: urlPolicyFile, Error: policy.reloadErr, Policy: p}
+	if !policy.loadedAt.IsZero() {
+		loaded := policy.loadedAt
+		s.LoadedAt = &loaded
+	}
+	if s.Error != "" {
+		failed := policy.failedAt
+		s.FailedAt = &failed
+	}
+	policy.mu.Unlock()
+	s.Restricted = len(p.Schemes) > 0 || len(p.AllowHosts) > 0 || len(p.DenyHosts) > 0 ||
+		p.DenyPrivate || len(p.DenyNetworks) > 0
+	jsonResponse(w, http.StatusOK, s)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// probeCacheTTL and probeCacheSize bound the cache of HEAD results; a zero
+// TTL disables it.
+var probeCacheTTL time.Duration
+var probeCacheSize int
+
+// probeTimeout bounds a HEAD request, which requests waiting for the same
+// URL share.
+const probeTimeout = 10 * time.Second
+
+// urlProbe is what a HEAD request tells about an image URL.
+type urlProbe struct {
+	Status      int       `json:"status"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type,omitempty"`
+	CheckedAt   time.Time `json:"checked_at"`
+}
+
+// probes caches the HEAD results of image URLs for -probe-cache-ttl, so
+// that checks of the same URLs across a burst of requests reach the origin
+// once. Concurrent probes of one URL share a single request.
+var probes = &probeCache{entries: make(map[string]*list.Element), lru: list.New()}
+
+type probeCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// lru holds the *probeEntry values, most recently used first.
+	lru          *list.List
+	hits, misses int64
+}
+
+type probeEntry struct {
+	url     string
+	done    chan struct{}
+	probe   urlProbe
+	err     error
+	expires time.Time
+}
+
+// probeURL returns the HEAD result of the http(s) URL from, from the cache
+// when a fresh one is there. Statuses other than 200 are results too and
+// cached alike; failures to get any response are not.
+func probeURL(ctx context.Context, from string) (urlProbe, error) {
+	if probeCacheTTL <= 0 {
+		return headURL(ctx, from)
+	}
+	return probes.get(ctx, from)
+}
+
+func (c *probeCache) get(ctx context.Context, from string) (urlProbe, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[from]; ok {
+		e := el.Value.(*probeEntry)
+		select {
+		case <-e.done:
+			if time.Now().Before(e.expires) {
+				c.lru.MoveToFront(el)
+				c.hits++
+				c.mu.Unlock()
+				return e.probe, nil
+			}
+			c.lru.Remove(el)
+			delete(c.entries, from)
+		default:
+			// Another request is probing the URL already.
+			c.hits++
+			c.mu.Unlock()
+			select {
+			case <-e.done:
+				return e.probe, e.err
+			case <-ctx.Done():
+				return urlProbe{}, ctx.Err()
+			}
+		}
+	}
+	e := &probeEntry{url: from, done: make(chan struct{})}
+	c.entries[from] = c.lru.PushFront(e)
+	c.misses++
+	for c.lru.Len() > probeCacheSize && probeCacheSize > 0 {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*probeEntry).url)
+	}
+	c.mu.Unlock()
+
+	// The probe is shared, so it must not end with the context of the
+	// request that happened to start it.
+	probeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), probeTimeout)
+	e.probe, e.err = headURL(probeCtx, from)
+	cancel()
+	e.expires = time.Now().Add(probeCacheTTL)
+	if e.err != nil {
+		c.mu.Lock()
+		if el, ok := c.entries[from]; ok && el.Value == e {
+			c.lru.Remove(el)
+			delete(c.entries, from)
+		}
+		c.mu.Unlock()
+	}
+	close(e.done)
+	return e.probe, e.err
+}
+
+// headURL sends a HEAD request for from with the client and per-host limits
+// of downloads.
+func headURL(ctx context.Context, from string) (urlProbe, error) {
+	req, err := http.NewRequest(http.MethodHead, from, nil)
+	if err != nil {
+		return urlProbe{}, fmt.Errorf("could not probe image: %v", err)
+	}
+	release, err := hostLimits.acquire(ctx, from)
+	if err != nil {
+		return urlProbe{}, fmt.Errorf("could not probe image: %v", err)
+	}
+	defer release()
+	resp, err := insecureClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return urlProbe{}, withCode(codeOr(err, codeDownloadFailed), fmt.Errorf("could not probe image: %w", err))
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return urlProbe{
+		Status:      resp.StatusCode,
+		Size:        resp.ContentLength,
+		ContentType: resp.Header.Get("Content-Type"),
+		CheckedAt:   time.Now().UTC(),
+	}, nil
+}
+
+// writeMetrics appends the cache counters to the Prometheus text b.
+func (c *probeCache) writeMetrics(b io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(b, "# TYPE darkflow_front_probe_cache_hits_total counter\n")
+	fmt.Fprintf(b, "darkflow_front_probe_cache_hits_total %d\n", c.hits)
+	fmt.Fprintf(b, "# TYPE darkflow_front_probe_cache_misses_total counter\n")
+	fmt.Fprintf(b, "darkflow_front_probe_cache_misses_total %d\n", c.misses)
+	fmt.Fprintf(b, "# TYPE darkflow_front_probe_cache_entries gauge\n")
+	fmt.Fprintf(b, "darkflow_front_probe_cache_entries %d\n", c.lru.Len())
+}
+
+// probeCacheResponse answers /admin/probe-cache.
+type probeCacheResponse struct {
+	TTLSeconds float64          `json:"ttl_seconds"`
+	Size       int              `json:"size"`
+	Hits       int64            `json:"hits"`
+	Misses     int64            `json:"misses"`
+	Entries    []probeCacheItem `json:"entries"`
+}
+
+type probeCacheItem struct {
+	URL string `json:"url"`
+	urlProbe
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// snapshot lists the finished entries that are still fresh, most recently
+// used first.
+func (c *probeCache) snapshot() probeCacheResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resp := probeCacheResponse{TTLSeconds: probeCacheTTL.Seconds(), Size: probeCacheSize, Hits: c.hits, Misses: c.misses, Entries: []probeCacheItem{}}
+	now := time.Now()
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*probeEntry)
+		select {
+		case <-e.done:
+		default:
+			continue
+		}
+		if now.Before(e.expires) {
+			resp.Entries = append(resp.Entries, probeCacheItem{URL: e.url, urlProbe: e.probe, ExpiresAt: e.expires.UTC()})
+		}
+	}
+	return resp
+}
+
+func (c *probeCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// adminProbeCache serves GET /admin/probe-cache, listing the cached HEAD
+// results, and DELETE, which drops them so that the next checks reach the
+// origins again.
+func adminProbeCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		setupResponse(w)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		probes.clear()
+		log.Printf("Cleared the probe cache")
+	default:
+		jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+		return
+	}
+	jsonResponse(w, http.StatusOK, probes.snapshot())
+}
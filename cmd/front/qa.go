@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// qaSamplePercent is the share of finished jobs copied to qaDestination for
+// human review, with the labels of -qa-label.
+var qaSamplePercent float64
+var qaDestination string
+var qaLabelFlags stringList
+
+// qaExporter is the destination of -qa-destination and qaStaticLabels the
+// parsed -qa-label flags.
+var qaExporter exporter
+var qaStaticLabels map[string]string
+
+// qaLabels is labels.json of a sampled job, what reviewers sort and filter
+// the samples by. Review starts as pending for the review tooling to
+// update.
+type qaLabels struct {
+	Job         string            `json:"job"`
+	Tenant      string            `json:"tenant,omitempty"`
+	Model       string            `json:"model,omitempty"`
+	SampledAt   time.Time         `json:"sampled_at"`
+	Review      string            `json:"review"`
+	Inputs      []string          `json:"inputs"`
+	Detections  int               `json:"detections"`
+	Classes     map[string]int    `json:"classes"`
+	Tags        []string          `json:"tags,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Environment *jobEnvironment   `json:"environment,omitempty"`
+}
+
+func setupQA() error {
+	if qaSamplePercent < 0 || qaSamplePercent > 100 {
+		return fmt.Errorf("invalid -qa-sample-percent %v, want a percentage from 0 to 100", qaSamplePercent)
+	}
+	qaStaticLabels = make(map[string]string, len(qaLabelFlags))
+	for _, l := range qaLabelFlags {
+		k, v, ok := strings.Cut(l, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("invalid -qa-label %q, want key=value", l)
+		}
+		qaStaticLabels[k] = v
+	}
+	if qaSamplePercent == 0 {
+		return nil
+	}
+	if qaDestination == "" {
+		return fmt.Errorf("-qa-sample-percent needs -qa-destination")
+	}
+	var err error
+	qaExporter, err = newQAExporter(qaDestination)
+	return err
+}
+
+// newQAExporter builds the destination of -qa-destination: a directory, as
+// a path or file:// URL, or any destination of -export.
+func newQAExporter(raw string) (exporter, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" || len(u.Scheme) == 1 {
+		// Windows drive letters parse as schemes.
+		return dirExporter{dir: raw}, nil
+	}
+	if u.Scheme == "file" {
+		return dirExporter{dir: filepath.FromSlash(u.Path)}, nil
+	}
+	return newExporter("-qa-destination", raw)
+}
+
+// sampledForQA reports whether j is one of the -qa-sample-percent jobs.
+// The choice hashes the job ID, so that it does not change when a job is
+// finished again after a restart.
+func sampledForQA(j *job) bool {
+	if qaExporter == nil || j.Status != jobDone || j.DryRun {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(j.ID))
+	return float64(h.Sum32()%10000) < qaSamplePercent*100
+}
+
+// copyForQA copies the inputs, outputs and record of j, which sampledForQA
+// picked, to -qa-destination in the background, under <tenant>/<job id>/
+// like -export, with labels.json describing the sample.
+func copyForQA(t *tenant, j *job) {
+	if !j.QASampled {
+		return
+	}
+	record, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		log.Printf("Could not encode job %s to sample for QA: %v", j.ID, err)
+		return
+	}
+	summary := j.resultSummary(t)
+	labels := qaLabels{
+		Job:         j.ID,
+		Tenant:      t.Name,
+		Model:       j.Model,
+		SampledAt:   time.Now().UTC(),
+		Review:      "pending",
+		Inputs:      []string{},
+		Detections:  summary.Detections,
+		Classes:     summary.Classes,
+		Tags:        j.Tags,
+		Metadata:    j.Metadata,
+		Labels:      qaStaticLabels,
+		Environment: j.Environment,
+	}
+	files := []exportFile{{Rel: "job.json", Data: record}}
+	for _, input := range j.indexedInputs() {
+		labels.Inputs = append(labels.Inputs, j.inputName(input.index))
+		files = append(files, exportFile{Rel: path.Join("inputs", filepath.Base(input.path)), Local: input.path})
+	}
+	files, err = appendDirFiles(files, j.finalOutputPath(t), "outputs")
+	if err != nil {
+		log.Printf("Could not list outputs of job %s to sample for QA: %v", j.ID, err)
+		return
+	}
+	data, err := json.MarshalIndent(labels, "", "  ")
+	if err != nil {
+		log.Printf("Could not encode QA labels of job %s: %v", j.ID, err)
+		return
+	}
+	files = append(files, exportFile{Rel: "labels.json", Data: data})
+	go func() {
+		if err := exportWithRetries(qaExporter, exportPrefix(t, j), files); err != nil {
+			log.Printf("Could not copy job %s to %s for QA: %v", j.ID, qaExporter.name(), err)
+			notify(eventExportFailed, "QA copy of job "+j.ID+" failed", "Job %s of tenant %q could not be copied to %s for QA: %v", j.ID, t.Name, qaExporter.name(), err)
+			return
+		}
+		log.Printf("Copied %d files of job %s to %s for QA", len(files), j.ID, qaExporter.name())
+	}()
+}
+
+// dirExporter copies the files into a local directory, such as a mounted
+// long-term volume.
+type dirExporter struct {
+	dir string
+}
+
+func (e dirExporter) name() string { return e.dir }
+
+func (e dirExporter) export(ctx context.Context, prefix string, files []exportFile) error {
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		dst := filepath.Join(e.dir, filepath.FromSlash(prefix), filepath.FromSlash(f.Rel))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := copyExportFile(f, dst); err != nil {
+			return fmt.Errorf("could not copy %s: %v", f.Rel, err)
+		}
+	}
+	return nil
+}
+
+func copyExportFile(f exportFile, dst string) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if f.Local == "" {
+		_, err = out.Write(f.Data)
+	} else {
+		var in *os.File
+		in, err = os.Open(f.Local)
+		if err == nil {
+			_, err = io.Copy(out, in)
+			in.Close()
+		}
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var maxConcurrentJobs int
+var maxQueuedJobs int
+
+// darkflowQueue bounds the number of darkflow calls in flight. Calls beyond
+// -max-concurrent-jobs wait in line; once -max-queue are waiting, new work is
+// turned away with the queue's state so clients can back off sensibly.
+var darkflowQueue = &jobQueue{}
+
+type jobQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	running int
+	waiting int
+	// avg is a moving average of how long a darkflow call takes.
+	avg time.Duration
+}
+
+// queueStatus is the state of the queue as reported by GET /queue and in
+// queue-full errors.
+type queueStatus struct {
+	Running  int `json:"running"`
+	Queued   int `json:"queued"`
+	Capacity int `json:"capacity"`
+	MaxQueue int `json:"max_queue"`
+	// AvgJobSeconds is the moving average duration of a darkflow call.
+	AvgJobSeconds float64 `json:"avg_job_seconds"`
+	// EstimatedWaitSeconds is how long newly queued work would wait for a
+	// free slot.
+	EstimatedWaitSeconds float64 `json:"estimated_wait_seconds"`
+}
+
+// queueFullError is returned when the queue cannot take more work.
+type queueFullError struct {
+	status queueStatus
+}
+
+func (e *queueFullError) Error() string {
+	return fmt.Sprintf("darkflow queue is full: %d running, %d queued, estimated wait %.0fs",
+		e.status.Running, e.status.Queued, e.status.EstimatedWaitSeconds)
+}
+
+// retryAfter is the number of seconds a client should wait before retrying.
+func (e *queueFullError) retryAfter() int {
+	return int(math.Max(1, math.Ceil(e.status.EstimatedWaitSeconds)))
+}
+
+func (q *jobQueue) statusLocked() queueStatus {
+	s := queueStatus{
+		Running:       q.running,
+		Queued:        q.waiting,
+		Capacity:      maxConcurrentJobs,
+		MaxQueue:      maxQueuedJobs,
+		AvgJobSeconds: q.avg.Seconds(),
+	}
+	if maxConcurrentJobs > 0 && q.running >= maxConcurrentJobs {
+		// Every slot is busy: the whole line ahead has to drain, a
+		// capacity-sized batch per average call.
+		batches := float64(q.waiting)/float64(maxConcurrentJobs) + 1
+		s.EstimatedWaitSeconds = batches * q.avg.Seconds()
+	}
+	return s
+}
+
+func (q *jobQueue) status() queueStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.statusLocked()
+}
+
+// fullLocked reports whether new work would be rejected.
+func (q *jobQueue) fullLocked() bool {
+	return maxConcurrentJobs > 0 && q.running >= maxConcurrentJobs && q.waiting >= maxQueuedJobs
+}
+
+// check returns a queue-full error if new work would be rejected right now.
+// Handlers call it before downloading anything so a saturated service fails
+// fast.
+func (q *jobQueue) check() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.fullLocked() {
+		return withCode(codeQueueFull, &queueFullError{q.statusLocked()})
+	}
+	return nil
+}
+
+// acquire waits for a free slot and returns the function releasing it. It
+// gives up when ctx is done.
+func (q *jobQueue) acquire(ctx context.Context) (func(), error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.cond == nil {
+		q.cond = sync.NewCond(&q.mu)
+	}
+	if q.fullLocked() {
+		return nil, withCode(codeQueueFull, &queueFullError{q.statusLocked()})
+	}
+	stop := context.AfterFunc(ctx, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.cond.Broadcast()
+	})
+	defer stop()
+	q.waiting++
+	for maxConcurrentJobs > 0 && q.running >= maxConcurrentJobs && ctx.Err() == nil {
+		q.cond.Wait()
+	}
+	q.waiting--
+	if err := ctx.Err(); err != nil {
+		q.cond.Signal()
+		return nil, timeoutError(ctx, ctx, codeRequestTimeout, requestTimeout, fmt.Errorf("gave up waiting for darkflow: %v", err))
+	}
+	q.running++
+
+	start := time.Now()
+	return func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.running--
+		if d := time.Since(start); q.avg == 0 {
+			q.avg = d
+		} else {
+			q.avg = (4*q.avg + d) / 5
+		}
+		q.cond.Signal()
+	}, nil
+}
+
+// queueHandler serves GET /queue.
+func queueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		setupResponse(w)
+		return
+	}
+	if _, ok := admit(w, r); !ok {
+		return
+	}
+	if r.Method != http.MethodGet {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+		return
+	}
+	jsonResponse(w, http.StatusOK, darkflowQueue.status())
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var recoverMode string
+
+// Ways to deal with jobs a previous process left running, see -recover-jobs.
+const (
+	recoverFail   = "fail"
+	recoverResume = "resume"
+	recoverOff    = "off"
+)
+
+func validateRecovery() error {
+	switch recoverMode {
+	case recoverFail, recoverResume, recoverOff:
+		return nil
+	}
+	return fmt.Errorf("invalid -recover-jobs %q, want %s, %s or %s", recoverMode, recoverFail, recoverResume, recoverOff)
+}
+
+// recoverJobs deals with the jobs still recorded as running at startup,
+// which died with a previous process. They are failed, cleaning up their
+// staging directories, or with -recover-jobs resume run again in the
+// background where their inputs allow it.
+func recoverJobs() {
+	if recoverMode == recoverOff {
+		return
+	}
+	for _, t := range allTenants() {
+		list, err := listJobs(t)
+		if err != nil {
+			log.Printf("Could not list jobs of tenant %q to recover: %v", t.Name, err)
+			continue
+		}
+		for _, j := range list {
+			if j.Status != jobRunning {
+				continue
+			}
+			if jobLocks {
+				busy, l := jobBusy(j.ID)
+				if busy {
+					log.Printf("Leaving job %s of tenant %q to the replica running it", j.ID, t.Name)
+					continue
+				}
+				j.lock = l
+			}
+			if recoverMode == recoverResume {
+				if err := resumable(t, j); err != nil {
+					log.Printf("Not resuming job %s of tenant %q: %v", j.ID, t.Name, err)
+				} else {
+					log.Printf("Resuming job %s of tenant %q", j.ID, t.Name)
+					go resumeJob(t, j)
+					continue
+				}
+			}
+			log.Printf("Failing job %s of tenant %q interrupted by a restart", j.ID, t.Name)
+			finishJob(t, j, withCode(codeInterrupted, fmt.Errorf("job was interrupted by a restart of the frontend")))
+		}
+	}
+}
+
+// resumable reports why j cannot be run again, if it cannot: compare jobs
+// are not resumed, nor jobs that were resumed before in case they are what
+// brings the process down, nor uploads whose files did not all make it to
+// disk. Jobs over image URLs download them again.
+func resumable(t *tenant, j *job) error {
+	switch {
+	case j.Compare:
+		return fmt.Errorf("compare jobs cannot be resumed")
+	case j.ResumedAt != nil:
+		return fmt.Errorf("job was resumed before at %s", j.ResumedAt.Format(time.RFC3339))
+	case j.InputID != "":
+		if _, err := os.Stat(j.inputPath(t)); err != nil {
+			return fmt.Errorf("inputs of job %s are no longer available", j.InputID)
+		}
+	case len(j.Uploads) > 0:
+		files, err := ioutil.ReadDir(j.inputPath(t))
+		if err != nil || len(files) != j.imageCount() {
+			return fmt.Errorf("uploaded images were not all staged")
+		}
+		for _, f := range files {
+			if err := checkImage(filepath.Join(j.inputPath(t), f.Name())); err != nil {
+				return fmt.Errorf("staged upload %s is damaged: %v", f.Name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// resumeJob runs the interrupted job j again from its inputs, discarding
+// whatever darkflow wrote for it before. It can be cancelled like any
+// running job; -request-timeout applies from when it resumes.
+func resumeJob(t *tenant, j *job) {
+	now := time.Now().UTC()
+	j.ResumedAt = &now
+	j.Timings = nil
+	if err := saveJob(t, j); err != nil {
+		log.Printf("Could not persist job %s: %v", j.ID, err)
+	}
+
+	ctx, cancelTimeout := context.WithCancel(context.Background())
+	if requestTimeout > 0 {
+		ctx, cancelTimeout = context.WithTimeout(context.Background(), requestTimeout)
+	}
+	ctx, done := trackJob(ctx, cancelTimeout, t, j.ID)
+	defer done()
+
+	os.RemoveAll(j.outputPath(t))
+	if len(j.ImageURLs) > 0 && j.InputID == "" {
+		os.RemoveAll(j.inputPath(t))
+		if err := stageImages(ctx, t, j); err != nil {
+			finishJob(t, j, err)
+			log.Printf("Resumed job %s failed: %v", j.ID, err)
+			return
+		}
+	}
+	if _, err := processJob(ctx, t, j); err != nil {
+		log.Printf("Resumed job %s failed: %v", j.ID, err)
+		return
+	}
+	log.Printf("Resumed job %s finished", j.ID)
+}
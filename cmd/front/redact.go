@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Redaction modes.
+const (
+	redactBlur  = "blur"
+	redactBlack = "black"
+)
+
+// redactBlurPasses box blurs approximate a gaussian blur.
+const redactBlurPasses = 3
+
+// redactOptions have the rendered images hide the detections of some
+// classes, e.g. faces or license plates, instead of boxing them.
+type redactOptions struct {
+	// Classes are the labels to redact; empty redacts every detection.
+	Classes []string `json:"classes,omitempty"`
+	// Mode is blur, the default, or black.
+	Mode string `json:"mode,omitempty"`
+}
+
+func validateRedact(o *redactOptions) error {
+	if o == nil {
+		return nil
+	}
+	switch o.Mode {
+	case "", redactBlur, redactBlack:
+		return nil
+	}
+	return fmt.Errorf("redact mode must be %s or %s, got %q", redactBlur, redactBlack, o.Mode)
+}
+
+// redacts reports whether detections of label are redacted.
+func (o *redactOptions) redacts(label string) bool {
+	if o == nil {
+		return false
+	}
+	if len(o.Classes) == 0 {
+		return true
+	}
+	for _, c := range o.Classes {
+		if c == label {
+			return true
+		}
+	}
+	return false
+}
+
+// redactedBy returns the redaction options of rendering options o, nil if
+// nothing is redacted.
+func redactedBy(o *renderOptions) *redactOptions {
+	if o == nil {
+		return nil
+	}
+	return o.Redact
+}
+
+// redactRegion hides r of img.
+func redactRegion(img *image.RGBA, r image.Rectangle, mode string) {
+	if mode == redactBlack {
+		draw.Draw(img, r, image.NewUniform(color.Black), image.Point{}, draw.Src)
+		return
+	}
+	// The radius grows with the region so that large faces are as
+	// unrecognizable as small ones.
+	radius := 2 + max(r.Dx(), r.Dy())/10
+	w, h := r.Dx(), r.Dy()
+	px := make([][4]int, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := img.RGBAAt(r.Min.X+x, r.Min.Y+y)
+			px[y*w+x] = [4]int{int(c.R), int(c.G), int(c.B), int(c.A)}
+		}
+	}
+	tmp := make([][4]int, len(px))
+	for pass := 0; pass < redactBlurPasses; pass++ {
+		boxBlur(px, tmp, w, h, radius, 1, w)
+		boxBlur(tmp, px, h, w, radius, w, 1)
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := px[y*w+x]
+			img.SetRGBA(r.Min.X+x, r.Min.Y+y, color.RGBA{uint8(p[0]), uint8(p[1]), uint8(p[2]), uint8(p[3])})
+		}
+	}
+}
+
+// boxBlur averages the lines of n pixels of src over a window of 2*radius+1
+// pixels into dst, clamping at the ends. Pixel i of line l is at
+// l*step+i*stride, so one function blurs rows and columns.
+func boxBlur(src, dst [][4]int, n, lines, radius, stride, step int) {
+	window := 2*radius + 1
+	for l := 0; l < lines; l++ {
+		base := l * step
+		at := func(i int) [4]int {
+			return src[base+min(max(i, 0), n-1)*stride]
+		}
+		var sum [4]int
+		for i := -radius; i <= radius; i++ {
+			p := at(i)
+			for c := range sum {
+				sum[c] += p[c]
+			}
+		}
+		for i := 0; i < n; i++ {
+			for c := range sum {
+				dst[base+i*stride][c] = sum[c] / window
+			}
+			in, out := at(i+radius+1), at(i-radius)
+			for c := range sum {
+				sum[c] += in[c] - out[c]
+			}
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const maxRenderThickness = 20
+
+// renderOptions are the client's preferences for the annotated images. When
+// a job has them the frontend draws the images itself from the inputs and
+// darkflow's detections, replacing darkflow's own rendering.
+type renderOptions struct {
+	// Skip drops the annotated images, leaving only the .json outputs.
+	Skip bool `json:"skip,omitempty"`
+	// Colors maps class labels to box colors as #rrggbb; other classes get
+	// a color derived from their label.
+	Colors map[string]string `json:"colors,omitempty"`
+	// Thickness is the box line width in pixels, 2 when zero.
+	Thickness int `json:"thickness,omitempty"`
+	// Labels draws the class above each box unless false.
+	Labels *bool `json:"labels,omitempty"`
+	// Confidences adds the confidence to the drawn labels.
+	Confidences bool `json:"confidences,omitempty"`
+	// Redact blurs or blacks out detections instead of boxing them.
+	Redact *redactOptions `json:"redact,omitempty"`
+}
+
+func validateRender(o *renderOptions) error {
+	if o == nil {
+		return nil
+	}
+	if o.Thickness < 0 || o.Thickness > maxRenderThickness {
+		return fmt.Errorf("render thickness must be between 0 and %d", maxRenderThickness)
+	}
+	for label, c := range o.Colors {
+		if _, err := parseColor(c); err != nil {
+			return fmt.Errorf("invalid render color for %q: %v", label, err)
+		}
+	}
+	return validateRedact(o.Redact)
+}
+
+func parseColor(s string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("want #rrggbb, got %q", s)
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("want #rrggbb, got %q", s)
+	}
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
+
+// renderPalette colors the classes the client did not choose a color for.
+var renderPalette = []color.RGBA{
+	{0xe6, 0x19, 0x4b, 0xff}, {0x3c, 0xb4, 0x4b, 0xff}, {0xff, 0xe1, 0x19, 0xff},
+	{0x43, 0x63, 0xd8, 0xff}, {0xf5, 0x82, 0x31, 0xff}, {0x91, 0x1e, 0xb4, 0xff},
+	{0x42, 0xd4, 0xf4, 0xff}, {0xf0, 0x32, 0xe6, 0xff}, {0xbf, 0xef, 0x45, 0xff},
+	{0xfa, 0xbe, 0xd4, 0xff},
+}
+
+func (o *renderOptions) colorOf(label string) color.RGBA {
+	if c, err := parseColor(o.Colors[label]); err == nil {
+		return c
+	}
+	h := fnv.New32a()
+	h.Write([]byte(label))
+	return renderPalette[h.Sum32()%uint32(len(renderPalette))]
+}
+
+// renderOutputs applies j.Render to darkflow's output dir before the outputs
+// are renamed: for every input with an annotation it removes darkflow's
+// annotated image, then draws a new one unless rendering is skipped.
+func renderOutputs(t *tenant, j *job) error {
+	if j.Render == nil {
+		return nil
+	}
+	for i := 0; i < j.imageCount(); i++ {
+		if err := renderOutput(t, j, i, j.Render); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderOutput replaces darkflow's annotated image of input i with one
+// drawn to opts, if the input has an annotation.
+func renderOutput(t *tenant, j *job, i int, opts *renderOptions) error {
+	dir := j.outputPath(t)
+	ds, err := readDetections(filepath.Join(dir, fmt.Sprintf("%d.json", i)))
+	if err != nil {
+		return nil
+	}
+	target := filepath.Join(dir, fmt.Sprintf("%d.jpg", i))
+	rendered, _ := filepath.Glob(filepath.Join(dir, fmt.Sprintf("%d.*", i)))
+	for _, f := range rendered {
+		if filepath.Ext(f) == ".json" {
+			continue
+		}
+		if ext := strings.ToLower(filepath.Ext(f)); ext == ".png" || ext == ".jpeg" {
+			// Keep the name, and so the format, darkflow chose.
+			target = f
+		}
+		if err := os.Remove(f); err != nil {
+			return fmt.Errorf("could not remove rendered image: %v", err)
+		}
+	}
+	if opts.Skip {
+		return nil
+	}
+	img, err := decodeImageFile(filepath.Join(j.inputPath(t), fmt.Sprintf("%d.jpg", i)))
+	if err != nil {
+		return err
+	}
+	return writeRendered(drawDetections(img, ds, opts), target)
+}
+
+func writeRendered(img image.Image, file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return fmt.Errorf("could not write rendered image: %v", err)
+	}
+	defer f.Close()
+	err = encodeRendered(f, img, file)
+	if err != nil {
+		return fmt.Errorf("could not encode rendered image: %v", err)
+	}
+	return nil
+}
+
+// encodeRendered writes img to w as PNG if name is a .png file, as JPEG
+// otherwise.
+func encodeRendered(w io.Writer, img image.Image, name string) error {
+	if strings.ToLower(filepath.Ext(name)) == ".png" {
+		return png.Encode(w, img)
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: 90})
+}
+
+// drawDetections returns a copy of img with the boxes of ds drawn on it and
+// the detections o redacts hidden.
+func drawDetections(img image.Image, ds []detection, o *renderOptions) image.Image {
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	draw.Draw(out, b, img, b.Min, draw.Src)
+
+	// Redacted first, so that no box or label drawn over a region is
+	// blurred with it.
+	for _, d := range ds {
+		if !o.Redact.redacts(d.Label) {
+			continue
+		}
+		if r := image.Rect(d.TopLeft.X, d.TopLeft.Y, d.BottomRight.X, d.BottomRight.Y).Intersect(b); !r.Empty() {
+			redactRegion(out, r, o.Redact.Mode)
+		}
+	}
+
+	thickness := o.Thickness
+	if thickness == 0 {
+		thickness = 2
+	}
+	// Labels grow with the lines so they stay legible on large images.
+	scale := 1 + thickness/2
+	for _, d := range ds {
+		if o.Redact.redacts(d.Label) {
+			continue
+		}
+		c := image.NewUniform(o.colorOf(d.Label))
+		r := image.Rect(d.TopLeft.X, d.TopLeft.Y, d.BottomRight.X, d.BottomRight.Y).Intersect(b)
+		if r.Empty() {
+			continue
+		}
+		for _, edge := range []image.Rectangle{
+			image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+thickness),
+			image.Rect(r.Min.X, r.Max.Y-thickness, r.Max.X, r.Max.Y),
+			image.Rect(r.Min.X, r.Min.Y, r.Min.X+thickness, r.Max.Y),
+			image.Rect(r.Max.X-thickness, r.Min.Y, r.Max.X, r.Max.Y),
+		} {
+			draw.Draw(out, edge.Intersect(r), c, image.Point{}, draw.Src)
+		}
+
+		if o.Labels != nil && !*o.Labels {
+			continue
+		}
+		text := d.Label
+		if o.Confidences {
+			text += fmt.Sprintf(" %.2f", d.Confidence)
+		}
+		w, h := textSize(text, scale)
+		// Above the box, or inside it when there is no room.
+		at := image.Pt(r.Min.X, r.Min.Y-h)
+		if at.Y < b.Min.Y {
+			at.Y = r.Min.Y
+		}
+		draw.Draw(out, image.Rect(at.X, at.Y, at.X+w, at.Y+h).Intersect(b), c, image.Point{}, draw.Src)
+		drawText(out, at, text, scale, textColor(o.colorOf(d.Label)))
+	}
+	return out
+}
+
+// textColor picks black or white, whichever reads better on background c.
+func textColor(c color.RGBA) color.Color {
+	if 299*int(c.R)+587*int(c.G)+114*int(c.B) > 128000 {
+		return color.Black
+	}
+	return color.White
+}
+
+// textSize is the size of text drawn with drawText, padding included.
+func textSize(text string, scale int) (int, int) {
+	n := len([]rune(text))
+	return (n*(glyphWidth+1) + 1) * scale, (glyphHeight + 2) * scale
+}
+
+// drawText writes text with the built-in bitmap font, its padded box's top
+// left corner at at. Letters are drawn in upper case; characters the font
+// lacks show as '?'.
+func drawText(dst draw.Image, at image.Point, text string, scale int, c color.Color) {
+	b := dst.Bounds()
+	x := at.X + scale
+	for _, r := range strings.ToUpper(text) {
+		g, ok := glyphs[r]
+		if !ok {
+			g = glyphs['?']
+		}
+		for row := 0; row < glyphHeight; row++ {
+			for col := 0; col < glyphWidth; col++ {
+				if g[row]&(1<<uint(glyphWidth-1-col)) == 0 {
+					continue
+				}
+				for dy := 0; dy < scale; dy++ {
+					for dx := 0; dx < scale; dx++ {
+						p := image.Pt(x+col*scale+dx, at.Y+(row+1)*scale+dy)
+						if p.In(b) {
+							dst.Set(p.X, p.Y, c)
+						}
+					}
+				}
+			}
+		}
+		x += (glyphWidth + 1) * scale
+	}
+}
+
+const (
+	glyphWidth  = 5
+	glyphHeight = 7
+)
+
+// glyphs is a 5x7 bitmap font, one byte per row with the leftmost pixel in
+// bit 4.
+var glyphs = map[rune][glyphHeight]uint8{
+	'0': {0x0e, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0e},
+	'1': {0x04, 0x0c, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'2': {0x0e, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1f},
+	'3': {0x1f, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0e},
+	'4': {0x02, 0x06, 0x0a, 0x12, 0x1f, 0x02, 0x02},
+	'5': {0x1f, 0x10, 0x1e, 0x01, 0x01, 0x11, 0x0e},
+	'6': {0x06, 0x08, 0x10, 0x1e, 0x11, 0x11, 0x0e},
+	'7': {0x1f, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8': {0x0e, 0x11, 0x11, 0x0e, 0x11, 0x11, 0x0e},
+	'9': {0x0e, 0x11, 0x11, 0x0f, 0x01, 0x02, 0x0c},
+	'A': {0x0e, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11},
+	'B': {0x1e, 0x11, 0x11, 0x1e, 0x11, 0x11, 0x1e},
+	'C': {0x0e, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0e},
+	'D': {0x1c, 0x12, 0x11, 0x11, 0x11, 0x12, 0x1c},
+	'E': {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x1f},
+	'F': {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x10},
+	'G': {0x0e, 0x11, 0x10, 0x17, 0x11, 0x11, 0x0f},
+	'H': {0x11, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11},
+	'I': {0x0e, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'J': {0x07, 0x02, 0x02, 0x02, 0x02, 0x12, 0x0c},
+	'K': {0x11, 0x12, 0x14, 0x18, 0x14, 0x12, 0x11},
+	'L': {0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1f},
+	'M': {0x11, 0x1b, 0x15, 0x15, 0x11, 0x11, 0x11},
+	'N': {0x11, 0x11, 0x19, 0x15, 0x13, 0x11, 0x11},
+	'O': {0x0e, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	'P': {0x1e, 0x11, 0x11, 0x1e, 0x10, 0x10, 0x10},
+	'Q': {0x0e, 0x11, 0x11, 0x11, 0x15, 0x12, 0x0d},
+	'R': {0x1e, 0x11, 0x11, 0x1e, 0x14, 0x12, 0x11},
+	'S': {0x0f, 0x10, 0x10, 0x0e, 0x01, 0x01, 0x1e},
+	'T': {0x1f, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04},
+	'U': {0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	'V': {0x11, 0x11, 0x11, 0x11, 0x11, 0x0a, 0x04},
+	'W': {0x11, 0x11, 0x11, 0x15, 0x15, 0x15, 0x0a},
+	'X': {0x11, 0x11, 0x0a, 0x04, 0x0a, 0x11, 0x11},
+	'Y': {0x11, 0x11, 0x11, 0x0a, 0x04, 0x04, 0x04},
+	'Z': {0x1f, 0x01, 0x02, 0x04, 0x08, 0x10, 0x1f},
+	' ': {},
+	'.': {0x00, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x0c},
+	'-': {0x00, 0x00, 0x00, 0x1f, 0x00, 0x00, 0x00},
+	'_': {0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1f},
+	':': {0x00, 0x0c, 0x0c, 0x00, 0x0c, 0x0c, 0x00},
+	'/': {0x01, 0x01, 0x02, 0x04, 0x08, 0x10, 0x10},
+	'%': {0x18, 0x19, 0x02, 0x04, 0x08, 0x13, 0x03},
+	'?': {0x0e, 0x11, 0x01, 0x02, 0x04, 0x00, 0x04},
+}
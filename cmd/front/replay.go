@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+var replayWindow time.Duration
+
+// replays remembers recently completed recognize requests so that an
+// identical resubmission within -replay-window is answered with the earlier
+// job instead of being processed again.
+var replays = &replayIndex{jobs: make(map[string]replayEntry)}
+
+type replayIndex struct {
+	mu   sync.Mutex
+	jobs map[string]replayEntry
+}
+
+type replayEntry struct {
+	id string
+	at time.Time
+}
+
+// replayKey identifies a recognize request by everything that affects its
+// results: the tenant, the image URLs in order and the processing options.
+func replayKey(t *tenant, req recognizeRequest) string {
+	data, _ := json.Marshal(struct {
+		Tenant    string            `json:"tenant"`
+		ImageURLs []string          `json:"image_urls"`
+		Model     string            `json:"model"`
+		Threshold float64           `json:"threshold"`
+		DryRun    bool              `json:"dry_run"`
+		Crops     bool              `json:"crops"`
+		Checksums map[string]string `json:"checksums"`
+		Render    *renderOptions    `json:"render"`
+		// ClassThresholds are merged with the server defaults, which
+		// may change between requests.
+		ClassThresholds map[string]float64 `json:"class_thresholds"`
+		Filters         *outputFilters     `json:"filters"`
+		Report          string             `json:"report"`
+		Heatmap         string             `json:"heatmap"`
+	}{t.Name, req.ImageURLs, req.Model, req.Threshold, req.DryRun, req.Crops, req.Checksums, req.Render, mergeClassThresholds(req.ClassThresholds), mergeFilters(req.Filters), req.Report, req.Heatmap})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// lookup returns the job that last completed the request with key within the
+// replay window.
+func (x *replayIndex) lookup(key string) (string, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	e, ok := x.jobs[key]
+	if !ok || time.Since(e.at) > replayWindow {
+		return "", false
+	}
+	return e.id, true
+}
+
+// remember records that job id completed the request with key, dropping
+// entries that fell out of the window.
+func (x *replayIndex) remember(key, id string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	now := time.Now()
+	for k, e := range x.jobs {
+		if now.Sub(e.at) > replayWindow {
+			delete(x.jobs, k)
+		}
+	}
+	x.jobs[key] = replayEntry{id: id, at: now}
+}
+
+// replayable reports whether the earlier job j can stand in for a new
+// submission.
+func replayable(j *job) bool {
+	return j.Status == jobDone && j.DeletedAt == nil
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replicaFlag is -replica, the s3://bucket/prefix the outputs of finished
+// jobs are replicated to next to -output.
+var replicaFlag string
+
+// storageCheckInterval is how often -output and the replica are probed.
+var storageCheckInterval time.Duration
+
+// replicaTimeout bounds every request to the replica bucket.
+const replicaTimeout = 30 * time.Second
+
+// storageProbe is the file written to probe a storage; like everything
+// under a dot name it is never served.
+const storageProbe = ".storage-probe"
+
+// storageState is the health of one storage as reported on /readyz. Since
+// is when it last turned healthy or unhealthy.
+type storageState struct {
+	Healthy   bool       `json:"healthy"`
+	Error     string     `json:"error,omitempty"`
+	Since     time.Time  `json:"since"`
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+	// Pending is the number of replica files waiting for the bucket to
+	// come back.
+	Pending int `json:"pending,omitempty"`
+}
+
+// storageHealth tracks a storage from the outcome of probes and of the
+// writes and reads done for jobs.
+type storageHealth struct {
+	name  string
+	mu    sync.Mutex
+	state storageState
+}
+
+func newStorageHealth(name string) *storageHealth {
+	return &storageHealth{name: name, state: storageState{Healthy: true, Since: time.Now().UTC()}}
+}
+
+var localStorage = newStorageHealth("local")
+var replicaStorage = newStorageHealth("replica")
+
+// observe records the outcome of an operation on the storage and reports
+// whether it turned it healthy again.
+func (s *storageHealth) observe(err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	s.state.CheckedAt = &now
+	healthy := err == nil
+	recovered := healthy && !s.state.Healthy
+	if healthy != s.state.Healthy {
+		s.state.Since = now
+		if healthy {
+			log.Printf("Storage %s is healthy again", s.name)
+		} else {
+			log.Printf("Storage %s is unhealthy: %v", s.name, err)
+		}
+	}
+	s.state.Healthy = healthy
+	s.state.Error = ""
+	if err != nil {
+		s.state.Error = err.Error()
+	}
+	return recovered
+}
+
+func (s *storageHealth) healthy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.Healthy
+}
+
+func (s *storageHealth) get() storageState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// errReplicaChecksum is returned for an object that does not match the
+// checksum it was stored with, a problem of that object only.
+var errReplicaChecksum = errors.New("content does not match its checksum")
+
+// s3Replica is the bucket of -replica. Objects are keyed by the path of
+// the file under -output and carry its checksum in x-amz-meta-sha256.
+type s3Replica struct {
+	bucket string
+	prefix string
+}
+
+var replica *s3Replica
+
+func setupReplica() error {
+	if replicaFlag == "" {
+		return nil
+	}
+	u, err := url.Parse(replicaFlag)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return fmt.Errorf("invalid -replica %q, want s3://bucket/prefix", replicaFlag)
+	}
+	if _, err := awsCredentialsFromEnv(); err != nil {
+		return fmt.Errorf("-replica %s: %v", replicaFlag, err)
+	}
+	if inMemory {
+		return fmt.Errorf("-replica is not available with -in-memory, jobs have no outputs to replicate")
+	}
+	replica = &s3Replica{bucket: u.Host, prefix: strings.Trim(u.Path, "/")}
+	return nil
+}
+
+func (s *s3Replica) do(ctx context.Context, method, rel string, body []byte, header http.Header) (*http.Response, error) {
+	creds, err := awsCredentialsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	region := awsRegion()
+	req, err := http.NewRequest(method, s3ObjectURL(s.bucket, path.Join(s.prefix, rel), region), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	signAWSv4(req, body, "s3", region, creds)
+	return http.DefaultClient.Do(req.WithContext(ctx))
+}
+
+// put stores data at rel. The signed payload hash has the bucket reject
+// content corrupted on the way.
+func (s *s3Replica) put(ctx context.Context, rel string, data []byte) error {
+	sum := sha256.Sum256(data)
+	header := http.Header{}
+	header.Set("Content-Type", contentTypeOf(rel))
+	header.Set("X-Amz-Meta-Sha256", hex.EncodeToString(sum[:]))
+	resp, err := s.do(ctx, http.MethodPut, rel, data, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("could not put %s: got %s", rel, resp.Status)
+	}
+	return nil
+}
+
+// get fetches rel and checks it against the checksum it was stored with.
+// A missing object returns an error satisfying os.IsNotExist.
+func (s *s3Replica) get(ctx context.Context, rel string) ([]byte, time.Time, error) {
+	resp, err := s.do(ctx, http.MethodGet, rel, nil, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, time.Time{}, os.ErrNotExist
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, time.Time{}, fmt.Errorf("could not get %s: got %s", rel, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("could not get %s: %v", rel, err)
+	}
+	sum := sha256.Sum256(data)
+	if want := resp.Header.Get("X-Amz-Meta-Sha256"); want != "" && want != hex.EncodeToString(sum[:]) {
+		return nil, time.Time{}, fmt.Errorf("replica of %s: %w", rel, errReplicaChecksum)
+	}
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return data, modified, nil
+}
+
+func (s *s3Replica) delete(ctx context.Context, rel string) error {
+	resp, err := s.do(ctx, http.MethodDelete, rel, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("could not delete %s: got %s", rel, resp.Status)
+	}
+	return nil
+}
+
+// replicaFile is an output file to replicate: its path under -output and
+// the checksum recorded for it.
+type replicaFile struct {
+	Rel    string
+	SHA256 string
+}
+
+// replicaPending holds the files that could not be replicated, retried once
+// the bucket passes a probe again.
+var replicaPending = struct {
+	sync.Mutex
+	files map[string]replicaFile
+}{files: make(map[string]replicaFile)}
+
+func replicaFilesOf(j *job) []replicaFile {
+	files := make([]replicaFile, 0, len(j.Files))
+	for _, f := range j.Files {
+		files = append(files, replicaFile{Rel: strings.TrimPrefix(f.URL, "/output/"), SHA256: f.SHA256})
+	}
+	return files
+}
+
+// replicateJob copies the outputs of finished job j to -replica in the
+// background. With the bucket unhealthy they wait for it to recover; the
+// job is not held up or failed either way.
+func replicateJob(j *job) {
+	if replica == nil || j.Status != jobDone || j.DryRun {
+		return
+	}
+	files := replicaFilesOf(j)
+	if !replicaStorage.healthy() {
+		deferReplicas(files)
+		return
+	}
+	go replicateFiles(files)
+}
+
+func replicateFiles(files []replicaFile) {
+	for i, f := range files {
+		err := replicateFile(f)
+		if os.IsNotExist(err) {
+			// Deleted since, nothing left to replicate.
+			continue
+		}
+		if err != nil {
+			log.Printf("Could not replicate %s: %v", f.Rel, err)
+			deferReplicas(files[i:])
+			return
+		}
+	}
+}
+
+// replicateFile puts a file to the bucket after checking it still has the
+// checksum recorded when its job finished.
+func replicateFile(f replicaFile) error {
+	data, err := ioutil.ReadFile(filepath.Join(outputDir, filepath.FromSlash(f.Rel)))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			localStorage.observe(err)
+		}
+		return err
+	}
+	if f.SHA256 != "" {
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != f.SHA256 {
+			log.Printf("Output %s does not match its checksum, it is not replicated", f.Rel)
+			return nil
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), replicaTimeout)
+	defer cancel()
+	err = replica.put(ctx, f.Rel, data)
+	if replicaStorage.observe(err) {
+		go retryReplicas()
+	}
+	return err
+}
+
+func deferReplicas(files []replicaFile) {
+	replicaPending.Lock()
+	defer replicaPending.Unlock()
+	for _, f := range files {
+		replicaPending.files[f.Rel] = f
+	}
+	replicaStorage.mu.Lock()
+	replicaStorage.state.Pending = len(replicaPending.files)
+	replicaStorage.mu.Unlock()
+}
+
+// retryReplicas replicates the files deferred while the bucket was down.
+func retryReplicas() {
+	replicaPending.Lock()
+	files := make([]replicaFile, 0, len(replicaPending.files))
+	for _, f := range replicaPending.files {
+		files = append(files, f)
+	}
+	replicaPending.files = make(map[string]replicaFile)
+	replicaPending.Unlock()
+	replicaStorage.mu.Lock()
+	replicaStorage.state.Pending = 0
+	replicaStorage.mu.Unlock()
+	if len(files) > 0 {
+		log.Printf("Replicating %d deferred files", len(files))
+		replicateFiles(files)
+	}
+}
+
+// deleteReplica removes the replicated outputs of j along with the local
+// ones, so that they are not served from the bucket after all.
+func deleteReplica(j *job) {
+	if replica == nil {
+		return
+	}
+	files := replicaFilesOf(j)
+	replicaPending.Lock()
+	for _, f := range files {
+		delete(replicaPending.files, f.Rel)
+	}
+	replicaPending.Unlock()
+	go func() {
+		for _, f := range files {
+			ctx, cancel := context.WithTimeout(context.Background(), replicaTimeout)
+			err := replica.delete(ctx, f.Rel)
+			cancel()
+			if err != nil {
+				log.Printf("Could not delete replica of %s: %v", f.Rel, err)
+			}
+		}
+	}()
+}
+
+// startStorageChecks probes -output, and the bucket with -replica, every
+// -storage-check-interval.
+func startStorageChecks() {
+	if storageCheckInterval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			checkStorage()
+			time.Sleep(storageCheckInterval)
+		}
+	}()
+}
+
+func checkStorage() {
+	localStorage.observe(probeLocal())
+	if replica == nil {
+		return
+	}
+	if replicaStorage.observe(probeReplica()) {
+		go retryReplicas()
+	}
+}
+
+// probeLocal writes a file to -output and reads it back.
+func probeLocal() error {
+	file := filepath.Join(outputDir, storageProbe)
+	data := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		return fmt.Errorf("could not write probe: %v", err)
+	}
+	defer os.Remove(file)
+	got, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("could not read probe: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("probe read back differs")
+	}
+	return nil
+}
+
+// probeReplica puts an object to the bucket and gets it back.
+func probeReplica() error {
+	ctx, cancel := context.WithTimeout(context.Background(), replicaTimeout)
+	defer cancel()
+	data := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	if err := replica.put(ctx, storageProbe, data); err != nil {
+		return err
+	}
+	got, _, err := replica.get(ctx, storageProbe)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("probe read back differs")
+	}
+	return nil
+}
+
+// serveReplica serves the file at rel under -output from the bucket and
+// reports whether it did. A missing object is left to the caller.
+func serveReplica(w http.ResponseWriter, r *http.Request, rel string) bool {
+	if replica == nil || !replicaStorage.healthy() {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), replicaTimeout)
+	defer cancel()
+	data, modified, err := replica.get(ctx, rel)
+	if os.IsNotExist(err) {
+		return false
+	}
+	if err != nil {
+		log.Printf("Could not serve %s from the replica: %v", rel, err)
+		if r.Context().Err() == nil && !errors.Is(err, errReplicaChecksum) {
+			replicaStorage.observe(err)
+		}
+		return false
+	}
+	w.Header().Set("X-Served-From", "replica")
+	http.ServeContent(w, r, path.Base(rel), modified, bytes.NewReader(data))
+	return true
+}
+
+// readiness answers /readyz.
+type readiness struct {
+	// Status is ok, degraded when the replica is unhealthy, or unavailable
+	// when -output is, since jobs cannot run without it.
+	Status  string                  `json:"status"`
+	Storage map[string]storageState `json:"storage"`
+	// Maintenance is the maintenance window in effect, which turns away
+	// new work but leaves the instance serving outputs.
+	Maintenance *maintenanceStatus `json:"maintenance,omitempty"`
+}
+
+// readyz serves /readyz for load balancers and orchestrators: 200 while jobs
+// can run, perhaps without the replica, and 503 Service Unavailable
+// otherwise.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		setupResponse(w)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+		return
+	}
+	resp := readiness{Status: "ok", Storage: map[string]storageState{"local": localStorage.get()}}
+	if replica != nil {
+		resp.Storage["replica"] = replicaStorage.get()
+		if !resp.Storage["replica"].Healthy {
+			resp.Status = "degraded"
+		}
+	}
+	if m := currentMaintenance(); m.Enabled {
+		resp.Maintenance = &m
+	}
+	status := http.StatusOK
+	if !resp.Storage["local"].Healthy {
+		resp.Status = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+	jsonResponse(w, status, resp)
+}
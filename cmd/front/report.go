@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Report formats.
+const (
+	reportPDF  = "pdf"
+	reportHTML = "html"
+)
+
+// defaultReport is -report, the format of the report of jobs that ask for
+// none.
+var defaultReport string
+
+func setupReport() error {
+	if err := validateReport(defaultReport); err != nil {
+		return fmt.Errorf("invalid -report: %v", err)
+	}
+	if defaultReport != "" && inMemory {
+		return fmt.Errorf("-report is not available with -in-memory, jobs have no output directory to write it to")
+	}
+	return nil
+}
+
+func validateReport(format string) error {
+	switch format {
+	case "", reportPDF, reportHTML:
+		return nil
+	}
+	return fmt.Errorf("invalid report %q, want %s or %s", format, reportPDF, reportHTML)
+}
+
+// reportImage is one input of a report: its annotated image, if darkflow or
+// the frontend drew one, and its detections.
+type reportImage struct {
+	Index      int
+	Input      string
+	Error      string
+	Image      []byte
+	Type       string
+	Detections []detection
+}
+
+// reportData is what a report shows of a job.
+type reportData struct {
+	Job       *job
+	Generated time.Time
+	Fields    [][2]string
+	Images    []reportImage
+}
+
+// writeReport renders the report of j, a single file with job metadata and
+// every annotated image with its detections, as report.pdf or report.html
+// in its outputs.
+func writeReport(t *tenant, j *job) error {
+	format := j.Report
+	if format == "" {
+		format = defaultReport
+	}
+	if format == "" {
+		return nil
+	}
+	data, err := reportDataOf(t, j)
+	if err != nil {
+		return err
+	}
+	var out []byte
+	if format == reportHTML {
+		out, err = renderHTMLReport(data)
+	} else {
+		out, err = renderPDFReport(data)
+	}
+	if err != nil {
+		return fmt.Errorf("could not render report: %v", err)
+	}
+	name := "report." + format
+	if err := ioutil.WriteFile(filepath.Join(j.outputPath(t), name), out, 0644); err != nil {
+		return fmt.Errorf("could not write report: %v", err)
+	}
+	url := t.outputURL(j.ID, name)
+	j.Files = append(j.Files, outputFile{Source: "report", Index: -1, URL: url})
+	j.Outputs = append(j.Outputs, url)
+	return nil
+}
+
+func reportDataOf(t *tenant, j *job) (*reportData, error) {
+	data := &reportData{Job: j, Generated: time.Now().UTC()}
+	add := func(name, value string) {
+		if value != "" {
+			data.Fields = append(data.Fields, [2]string{name, value})
+		}
+	}
+	add("Job", j.ID)
+	add("Tenant", t.Name)
+	add("Created", j.CreatedAt.UTC().Format(time.RFC3339))
+	add("Model", j.Model)
+	if j.Threshold != 0 {
+		add("Threshold", fmt.Sprint(j.Threshold))
+	}
+	add("Class thresholds", joinSorted(j.ClassThresholds, func(v float64) string { return fmt.Sprint(v) }))
+	if f := j.Filters; f != nil {
+		add("Filters", fmt.Sprintf("min box area %v, max detections %d, NMS IoU %v", f.MinBoxArea, f.MaxDetections, f.NMSIoU))
+	}
+	if e := j.Environment; e != nil {
+		add("Environment", fmt.Sprintf("frontend %s, config %s, node %s", e.Frontend, e.ConfigHash, e.Node))
+		add("Backend", strings.TrimSpace(e.Backend+" "+e.BackendVersion))
+		add("Model run", strings.TrimSpace(e.Model+" "+e.ModelVersion))
+	}
+	add("Heatmap", j.Heatmap)
+	add("Tags", strings.Join(j.Tags, ", "))
+	add("Metadata", joinSorted(j.Metadata, func(v string) string { return v }))
+	add("Images", fmt.Sprintf("%d, %d failed", j.imageCount(), len(j.Skipped)))
+
+	failed := make(map[int]string)
+	for _, e := range j.Skipped {
+		failed[e.Index] = e.Message
+	}
+	for i := 0; i < j.imageCount(); i++ {
+		img := reportImage{Index: i, Input: j.inputName(i), Error: failed[i], Detections: []detection{}}
+		for _, f := range j.Files {
+			if f.Index != i || f.Source == "crop" {
+				continue
+			}
+			file := j.outputFilePath(t, f)
+			if filepath.Ext(f.Source) == ".json" {
+				ds, err := readDetections(file)
+				if err != nil {
+					return nil, err
+				}
+				img.Detections = ds
+				continue
+			}
+			if img.Image == nil {
+				content, err := ioutil.ReadFile(file)
+				if err != nil {
+					return nil, fmt.Errorf("could not read annotated image: %v", err)
+				}
+				img.Image, img.Type = content, contentTypeOf(file)
+			}
+		}
+		data.Images = append(data.Images, img)
+	}
+	return data, nil
+}
+
+func joinSorted[V any](m map[string]V, format func(V) string) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		keys[i] = k + "=" + format(m[k])
+	}
+	return strings.Join(keys, ", ")
+}
+
+var htmlReport = template.Must(template.New("report").Funcs(template.FuncMap{
+	"dataURL": func(img reportImage) template.URL {
+		return template.URL("data:" + img.Type + ";base64," + base64.StdEncoding.EncodeToString(img.Image))
+	},
+	"percent": func(v float64) string { return fmt.Sprintf("%.1f%%", v*100) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Job {{.Job.ID}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin: 0.5em 0 2em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+img { max-width: 100%; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Job {{.Job.ID}}</h1>
+<table>
+{{range .Fields}}<tr><th>{{index . 0}}</th><td>{{index . 1}}</td></tr>
+{{end}}<tr><th>Generated</th><td>{{.Generated.Format "2006-01-02T15:04:05Z07:00"}}</td></tr>
+</table>
+{{range .Images}}<h2>Image {{.Index}}: {{.Input}}</h2>
+{{if .Error}}<p class="error">{{.Error}}</p>
+{{else}}{{if .Image}}<img src="{{dataURL .}}" alt="annotated image {{.Index}}">
+{{end}}<table>
+<tr><th>Class</th><th>Confidence</th><th>Top left</th><th>Bottom right</th></tr>
+{{range .Detections}}<tr><td>{{.Label}}</td><td>{{percent .Confidence}}</td><td>{{.TopLeft.X}}, {{.TopLeft.Y}}</td><td>{{.BottomRight.X}}, {{.BottomRight.Y}}</td></tr>
+{{else}}<tr><td colspan="4">No detections</td></tr>
+{{end}}</table>
+{{end}}{{end}}</body>
+</html>
+`))
+
+func renderHTMLReport(data *reportData) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := htmlReport.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// A4 page size and margin of PDF reports, in points.
+const (
+	pdfWidth  = 595
+	pdfHeight = 842
+	pdfMargin = 40
+)
+
+func renderPDFReport(data *reportData) ([]byte, error) {
+	doc := &pdfDoc{}
+	page := doc.newPage()
+	page.text(16, "Job "+data.Job.ID)
+	page.space(6)
+	for _, f := range data.Fields {
+		page.text(10, f[0]+": "+f[1])
+	}
+	page.text(10, "Generated: "+data.Generated.Format(time.RFC3339))
+
+	for _, img := range data.Images {
+		page = doc.newPage()
+		page.text(13, fmt.Sprintf("Image %d: %s", img.Index, img.Input))
+		page.space(6)
+		if img.Error != "" {
+			page.text(10, "Failed: "+img.Error)
+			continue
+		}
+		if img.Image != nil {
+			jpg, w, h, err := pdfJPEG(img.Image)
+			if err != nil {
+				return nil, err
+			}
+			// Fit the width, leaving at least half the page to the table.
+			scale := float64(pdfWidth-2*pdfMargin) / float64(w)
+			if maxHeight := float64(pdfHeight-2*pdfMargin) / 2; float64(h)*scale > maxHeight {
+				scale = maxHeight / float64(h)
+			}
+			page.image(doc.addImage(jpg, w, h), float64(w)*scale, float64(h)*scale)
+			page.space(10)
+		}
+		if len(img.Detections) == 0 {
+			page.text(10, "No detections")
+			continue
+		}
+		header := fmt.Sprintf("%-20s %10s   %-12s %-12s", "Class", "Confidence", "Top left", "Bottom right")
+		page.mono(9, header)
+		for _, d := range img.Detections {
+			if page.full(9) {
+				page = doc.newPage()
+				page.text(13, fmt.Sprintf("Image %d (continued)", img.Index))
+				page.mono(9, header)
+			}
+			page.mono(9, fmt.Sprintf("%-20.20s %9.1f%%   %-12s %-12s", d.Label, d.Confidence*100,
+				fmt.Sprintf("%d, %d", d.TopLeft.X, d.TopLeft.Y), fmt.Sprintf("%d, %d", d.BottomRight.X, d.BottomRight.Y)))
+		}
+	}
+	return doc.bytes(), nil
+}
+
+// pdfJPEG returns img as a baseline RGB JPEG for embedding with DCTDecode,
+// which does not take every JPEG the image package reads, let alone PNGs.
+func pdfJPEG(data []byte) ([]byte, int, int, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("could not decode annotated image: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		return nil, 0, 0, err
+	}
+	b := img.Bounds()
+	return buf.Bytes(), b.Dx(), b.Dy(), nil
+}
+
+// pdfDoc is a minimal PDF writer: pages of Helvetica and Courier text and
+// JPEG images, enough for job reports.
+type pdfDoc struct {
+	objects [][]byte
+	pages   []*pdfPage
+}
+
+type pdfPage struct {
+	content bytes.Buffer
+	images  []int
+	y       float64
+}
+
+// add stores an object and returns its number. Numbers 1-4 are the catalog,
+// the page tree and the two fonts, written last.
+func (d *pdfDoc) add(obj []byte) int {
+	d.objects = append(d.objects, obj)
+	return len(d.objects) + 4
+}
+
+func (d *pdfDoc) addStream(dict string, data []byte) int {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<< %s /Length %d >>\nstream\n", dict, len(data))
+	buf.Write(data)
+	buf.WriteString("\nendstream")
+	return d.add(buf.Bytes())
+}
+
+func (d *pdfDoc) addImage(jpg []byte, w, h int) int {
+	return d.addStream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode", w, h), jpg)
+}
+
+func (d *pdfDoc) newPage() *pdfPage {
+	p := &pdfPage{y: pdfHeight - pdfMargin}
+	d.pages = append(d.pages, p)
+	return p
+}
+
+func (p *pdfPage) full(size float64) bool {
+	return p.y-size*1.4 < pdfMargin
+}
+
+func (p *pdfPage) space(points float64) {
+	p.y -= points
+}
+
+func (p *pdfPage) text(size float64, s string) {
+	p.line("F1", size, s)
+}
+
+func (p *pdfPage) mono(size float64, s string) {
+	p.line("F2", size, s)
+}
+
+func (p *pdfPage) line(font string, size float64, s string) {
+	p.y -= size * 1.4
+	fmt.Fprintf(&p.content, "BT /%s %g Tf %d %g Td (%s) Tj ET\n", font, size, pdfMargin, p.y, pdfEscape(s))
+}
+
+func (p *pdfPage) image(obj int, w, h float64) {
+	p.y -= h
+	p.images = append(p.images, obj)
+	fmt.Fprintf(&p.content, "q %g 0 0 %g %d %g cm /Im%d Do Q\n", w, h, pdfMargin, p.y, obj)
+}
+
+// pdfEscape escapes s for a PDF string of the standard fonts, which have no
+// glyphs beyond ASCII.
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func (d *pdfDoc) bytes() []byte {
+	var kids []string
+	for _, p := range d.pages {
+		content := d.addStream("", p.content.Bytes())
+		var xobjects strings.Builder
+		for _, img := range p.images {
+			fmt.Fprintf(&xobjects, " /Im%d %d 0 R", img, img)
+		}
+		page := d.add([]byte(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Contents %d 0 R /Resources << /Font << /F1 3 0 R /F2 4 0 R >> /XObject <<%s >> >> >>",
+			pdfWidth, pdfHeight, content, xobjects.String())))
+		kids = append(kids, fmt.Sprintf("%d 0 R", page))
+	}
+	objects := append([][]byte{
+		[]byte("<< /Type /Catalog /Pages 2 0 R >>"),
+		[]byte(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids))),
+		[]byte("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>"),
+		[]byte("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>"),
+	}, d.objects...)
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n", i+1)
+		buf.Write(obj)
+		buf.WriteString("\nendobj\n")
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"text/template"
+)
+
+var darkflowRequestTemplate string
+
+// requestTemplate renders the JSON body of darkflow requests when
+// -darkflow-request-template is set; nil means darkflowRequest is encoded
+// as is.
+var requestTemplate *template.Template
+
+// requestTemplateData is what the request template is executed with.
+// Options holds the recognition options under their API names so a template
+// can pass them all through with {{json .Options}}.
+type requestTemplateData struct {
+	InputDir  string
+	OutputDir string
+	Model     string
+	Threshold float64
+	Options   map[string]interface{}
+}
+
+// loadRequestTemplate parses -darkflow-request-template and checks that it
+// renders valid JSON for a sample request, so mistakes show at startup
+// rather than on the first job.
+func loadRequestTemplate() error {
+	if darkflowRequestTemplate == "" {
+		return nil
+	}
+	t, err := parseRequestTemplate(darkflowRequestTemplate)
+	if err != nil {
+		return fmt.Errorf("-darkflow-request-template: %v", err)
+	}
+	requestTemplate = t
+	return nil
+}
+
+// parseRequestTemplate parses the request template in file and checks it
+// against a sample request.
+func parseRequestTemplate(file string) (*template.Template, error) {
+	text, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read request template: %v", err)
+	}
+	t, err := template.New("request").Option("missingkey=error").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse request template: %v", err)
+	}
+	if _, err := encodeDarkflowRequest(darkflowRequest{InputDir: "/in", OutputDir: "/out", Model: "yolo", Threshold: 0.5}, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// encodeDarkflowRequest returns the JSON body posted to darkflow for req,
+// rendered from tmpl unless it is nil.
+func encodeDarkflowRequest(req darkflowRequest, tmpl *template.Template) ([]byte, error) {
+	if tmpl == nil {
+		return json.Marshal(req)
+	}
+	data := requestTemplateData{
+		InputDir:  req.InputDir,
+		OutputDir: req.OutputDir,
+		Model:     req.Model,
+		Threshold: req.Threshold,
+		Options:   map[string]interface{}{},
+	}
+	if req.Model != "" {
+		data.Options["model"] = req.Model
+	}
+	if req.Threshold != 0 {
+		data.Options["threshold"] = req.Threshold
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("could not render request template: %v", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("request template rendered invalid JSON: %s", buf.String())
+	}
+	return buf.Bytes(), nil
+}
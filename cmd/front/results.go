@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	defaultResultsLimit = 100
+	maxResultsLimit     = 1000
+)
+
+// resultsPage is one page of the output files of a job.
+type resultsPage struct {
+	JobID  string       `json:"job_id"`
+	Offset int          `json:"offset"`
+	Limit  int          `json:"limit"`
+	Total  int          `json:"total"`
+	Items  []outputFile `json:"items"`
+	// NextOffset is the offset of the next page, or omitted on the last
+	// page.
+	NextOffset *int          `json:"next_offset,omitempty"`
+	Summary    resultSummary `json:"summary"`
+}
+
+// resultSummary totals the results of a whole job.
+type resultSummary struct {
+	Inputs     int            `json:"inputs"`
+	Files      int            `json:"files"`
+	Detections int            `json:"detections"`
+	Classes    map[string]int `json:"classes"`
+}
+
+// getResults handles GET /jobs/{id}/results?offset=&limit=, paging through
+// the job's output files so that jobs with thousands of outputs need not be
+// fetched in one response. Every page carries the summary of the whole job,
+// computed once when it finished.
+func getResults(w http.ResponseWriter, r *http.Request, t *tenant, id string) {
+	j, ok := loadResults(w, t, id)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid offset %q", query.Get("offset")))
+		return
+	}
+	limit, err := queryInt(query.Get("limit"), defaultResultsLimit)
+	if err != nil || limit <= 0 || limit > maxResultsLimit {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q, want 1 to %d", query.Get("limit"), maxResultsLimit))
+		return
+	}
+
+	page := resultsPage{
+		JobID:   j.ID,
+		Offset:  offset,
+		Limit:   limit,
+		Total:   len(j.Files),
+		Items:   []outputFile{},
+		Summary: j.resultSummary(t),
+	}
+	if offset < len(j.Files) {
+		end := offset + limit
+		if end > len(j.Files) {
+			end = len(j.Files)
+		}
+		page.Items = j.Files[offset:end]
+		if end < len(j.Files) {
+			page.NextOffset = &end
+		}
+	}
+	jsonResponse(w, http.StatusOK, page)
+}
+
+// loadResults loads job id for reading its results, responding with an error
+// itself if there are none to read yet or any more.
+func loadResults(w http.ResponseWriter, t *tenant, id string) (*job, bool) {
+	j, err := loadJob(t, id)
+	if os.IsNotExist(err) {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("job %s not found", id))
+		return nil, false
+	}
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	if j.Status == jobRunning {
+		jsonError(w, http.StatusConflict, fmt.Errorf("job %s is still running", id))
+		return nil, false
+	}
+	if j.DeletedAt != nil {
+		jsonError(w, http.StatusGone, fmt.Errorf("results of job %s have been deleted", id))
+		return nil, false
+	}
+	return j, true
+}
+
+func queryInt(s string, fallback int) (int, error) {
+	if s == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(s)
+}
+
+// resultSummary returns the summary of j stored when it finished, reading
+// the annotation files only for records from before summaries were stored.
+func (j *job) resultSummary(t *tenant) resultSummary {
+	if j.Summary != nil {
+		return *j.Summary
+	}
+	return summarizeResults(t, j)
+}
+
+// summarizeResults counts the detections in the annotation files darkflow
+// produced for j, by class.
+func summarizeResults(t *tenant, j *job) resultSummary {
+	s := resultSummary{Inputs: j.imageCount(), Files: len(j.Files), Classes: make(map[string]int)}
+	for _, f := range j.Files {
+		if f.Index < 0 || filepath.Ext(f.Source) != ".json" {
+			continue
+		}
+		ds, err := readDetections(j.outputFilePath(t, f))
+		if err != nil {
+			continue
+		}
+		s.Detections += len(ds)
+		for _, d := range ds {
+			s.Classes[d.Label]++
+		}
+	}
+	return s
+}
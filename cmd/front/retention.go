@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var defaultRetention string
+var maxRetention time.Duration
+var janitorInterval time.Duration
+
+const retainForever = "forever"
+
+// parseRetention parses a retention hint, either "forever" or a duration such
+// as "90m", "1h" or "7d". Forever is returned as 0.
+func parseRetention(s string) (time.Duration, error) {
+	if s == retainForever {
+		return 0, nil
+	}
+	var d time.Duration
+	var err error
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		var n int
+		n, err = strconv.Atoi(days)
+		if n > int(math.MaxInt64/(24*time.Hour)) {
+			// More days than a time.Duration holds would wrap around.
+			n = -1
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid retention %q, want a positive duration such as 1h or 7d, or %q", s, retainForever)
+	}
+	return d, nil
+}
+
+// validateRetention checks a client supplied retention hint; empty means the
+// -retention default.
+func validateRetention(s string) error {
+	if s == "" {
+		return nil
+	}
+	_, err := parseRetention(s)
+	return err
+}
+
+// retentionOf returns how long the data of j is kept after it finishes, or 0
+// to keep it forever. -max-retention caps whatever the client asked for.
+func retentionOf(j *job) time.Duration {
+	s := j.Retain
+	if s == "" {
+		s = defaultRetention
+	}
+	d, err := parseRetention(s)
+	if err != nil {
+		d = 0
+	}
+	if maxRetention > 0 && (d == 0 || d > maxRetention) {
+		d = maxRetention
+	}
+	return d
+}
+
+// deleteJob soft-deletes j: its inputs and outputs are removed but the record
+// is kept, marked with the deletion time, so clients can still tell what
+// happened to it. The inputs of a re-run belong to the original job and are
+// left alone.
+func deleteJob(t *tenant, j *job) error {
+	deleteReplica(j)
+	if err := os.RemoveAll(j.outputPath(t)); err != nil {
+		return fmt.Errorf("could not remove outputs of job %s: %v", j.ID, err)
+	}
+	releaseBlobs(j)
+	os.Remove(backendLogPath(t, j.ID))
+	if err := os.RemoveAll(filepath.Join(t.inputDir(), j.ID)); err != nil {
+		return fmt.Errorf("could not remove inputs of job %s: %v", j.ID, err)
+	}
+	now := time.Now().UTC()
+	j.DeletedAt = &now
+	return saveJob(t, j)
+}
+
+// startJanitor periodically soft-deletes jobs past their expiry.
+func startJanitor() {
+	if janitorInterval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			sweepExpiredJobs()
+			time.Sleep(janitorInterval)
+		}
+	}()
+}
+
+// staleStagingAge is how long a staging directory may go untouched before
+// the janitor assumes its job died with a previous process.
+const staleStagingAge = 24 * time.Hour
+
+func sweepExpiredJobs() {
+	now := time.Now()
+	for _, t := range allTenants() {
+		for _, dir := range []string{t.inputDir(), t.outputDir()} {
+			removeStaleStaging(filepath.Join(dir, stagingDir), now)
+		}
+		if jobLocks {
+			removeStaleLocks()
+		}
+		list, err := listJobs(t)
+		if err != nil {
+			log.Printf("Janitor could not list jobs of tenant %q: %v", t.Name, err)
+			continue
+		}
+		for _, j := range list {
+			if j.DeletedAt != nil || j.ExpiresAt == nil || now.Before(*j.ExpiresAt) {
+				continue
+			}
+			if err := deleteJob(t, j); err != nil {
+				log.Printf("Janitor could not delete job %s: %v", j.ID, err)
+				continue
+			}
+			log.Printf("Janitor deleted expired job %s of tenant %q", j.ID, t.Name)
+		}
+	}
+	sweepBlobs()
+}
+
+func removeStaleStaging(dir string, now time.Time) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if jobLocks {
+			// Staging directories are named after their job: one whose
+			// job nobody holds the lock of is stale however recent.
+			busy, l := jobBusy(e.Name())
+			if busy {
+				continue
+			}
+			log.Printf("Janitor removing stale staging directory %s", e.Name())
+			os.RemoveAll(filepath.Join(dir, e.Name()))
+			l.release()
+			continue
+		}
+		if now.Sub(e.ModTime()) > staleStagingAge {
+			log.Printf("Janitor removing stale staging directory %s", e.Name())
+			os.RemoveAll(filepath.Join(dir, e.Name()))
+		}
+	}
+}
+
+// removeJob handles DELETE /jobs/{id}.
+func removeJob(w http.ResponseWriter, t *tenant, id string) {
+	j, err := loadJob(t, id)
+	if os.IsNotExist(err) {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("job %s not found", id))
+		return
+	}
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if j.Status == jobRunning {
+		jsonError(w, http.StatusConflict, fmt.Errorf("job %s is still running", id))
+		return
+	}
+	if j.DeletedAt == nil {
+		if err := deleteJob(t, j); err != nil {
+			jsonError(w, http.StatusInternalServerError, err)
+			return
+		}
+		log.Printf("Deleted job %s of tenant %q", j.ID, t.Name)
+	}
+	jsonResponse(w, http.StatusOK, j)
+}
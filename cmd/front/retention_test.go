@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	tt := []struct {
+		s       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{s: "forever"},
+		{s: "90m", want: 90 * time.Minute},
+		{s: "1h30m", want: 90 * time.Minute},
+		{s: "7d", want: 7 * 24 * time.Hour},
+		{s: "+2d", want: 48 * time.Hour},
+		{s: "106751d", want: 106751 * 24 * time.Hour},
+		{s: "", wantErr: true},
+		{s: "Forever", wantErr: true},
+		{s: "d", wantErr: true},
+		{s: "0d", wantErr: true},
+		{s: "-1d", wantErr: true},
+		{s: "0s", wantErr: true},
+		{s: "-5m", wantErr: true},
+		{s: "1.5d", wantErr: true},
+		{s: "1h1d", wantErr: true},
+		{s: "7dd", wantErr: true},
+		{s: "7 d", wantErr: true},
+		{s: "7", wantErr: true},
+		{s: "1w", wantErr: true},
+		{s: "106752d", wantErr: true},
+		{s: "300000d", wantErr: true},
+		{s: "9223372036854775807d", wantErr: true},
+		{s: "99999999999999999999d", wantErr: true},
+		{s: "9999999999h", wantErr: true},
+	}
+	for _, tc := range tt {
+		got, err := parseRetention(tc.s)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("parseRetention(%q) = %v, %v, want %v, error %v", tc.s, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestRetentionOf(t *testing.T) {
+	defer func(d string, max time.Duration) { defaultRetention, maxRetention = d, max }(defaultRetention, maxRetention)
+	tt := []struct {
+		name       string
+		retain     string
+		defaultRet string
+		max        time.Duration
+		want       time.Duration
+	}{
+		{name: "forever by default"},
+		{name: "default", defaultRet: "1h", want: time.Hour},
+		{name: "request", retain: "2h", defaultRet: "1h", want: 2 * time.Hour},
+		{name: "request forever", retain: "forever", defaultRet: "1h"},
+		{name: "capped", retain: "7d", max: 24 * time.Hour, want: 24 * time.Hour},
+		{name: "forever capped", retain: "forever", max: 24 * time.Hour, want: 24 * time.Hour},
+		{name: "under the cap", retain: "1h", max: 24 * time.Hour, want: time.Hour},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			defaultRetention, maxRetention = tc.defaultRet, tc.max
+			if got := retentionOf(&job{Retain: tc.retain}); got != tc.want {
+				t.Errorf("retentionOf() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// retrying holds the IDs of the jobs this process is retrying, so that two
+// retries of one job do not run at once without -job-locks.
+var retrying = struct {
+	mu  sync.Mutex
+	ids map[string]bool
+}{ids: make(map[string]bool)}
+
+// retryFrom picks the stage a retry of the failed job j resumes from when
+// the request does not say: darkflow when the inputs were kept, the
+// downloads otherwise.
+func retryFrom(t *tenant, j *job) string {
+	if inputsKept(t, j) {
+		return stageBackend
+	}
+	return stageDownload
+}
+
+// inputsKept reports whether the staged inputs of the failed job j are
+// still on disk. They are kept unless the job failed before all of them
+// were staged.
+func inputsKept(t *tenant, j *job) bool {
+	if j.Inputs == nil && j.InputID == "" {
+		return false
+	}
+	_, err := os.Stat(j.finalInputPath(t))
+	return err == nil
+}
+
+// retryable reports why the failed job j cannot be retried from stage, if it
+// cannot.
+func retryable(t *tenant, j *job, stage string) error {
+	switch {
+	case j.Compare:
+		return fmt.Errorf("compare jobs cannot be retried")
+	case j.DeletedAt != nil:
+		return fmt.Errorf("data of job %s was deleted", j.ID)
+	case stage == stageDownload && (j.InputID != "" || len(j.ImageURLs) == 0):
+		return fmt.Errorf("job %s has no image URLs of its own to download again", j.ID)
+	case stage == stageBackend && !inputsKept(t, j):
+		if j.InputID == "" && len(j.ImageURLs) > 0 {
+			return fmt.Errorf("inputs of job %s are no longer available, retry from %s", j.ID, stageDownload)
+		}
+		return fmt.Errorf("inputs of job %s are no longer available", j.ID)
+	}
+	return nil
+}
+
+// retryJob handles POST /jobs/{id}/retry. The failed job id runs again in
+// place from the stage of the from parameter, by default the first one
+// whose artifacts were not kept: from backend, the inputs it staged are
+// handed to darkflow again; from download, its image URLs are fetched
+// again first. Post-processing cannot be resumed on its own since darkflow's
+// outputs of failed jobs are discarded.
+func retryJob(w http.ResponseWriter, r *http.Request, t *tenant, id string) {
+	received := time.Now()
+	j, err := loadJob(t, id)
+	if os.IsNotExist(err) {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("job %s not found", id))
+		return
+	}
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if j.Status != jobFailed {
+		jsonError(w, http.StatusConflict, fmt.Errorf("job %s is %s, only failed jobs can be retried", id, j.Status))
+		return
+	}
+	from := r.URL.Query().Get("from")
+	switch from {
+	case "":
+		from = retryFrom(t, j)
+	case stageDownload, stageBackend:
+	default:
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid from %q, want %s or %s", from, stageDownload, stageBackend))
+		return
+	}
+	if err := retryable(t, j, from); err != nil {
+		jsonError(w, http.StatusConflict, err)
+		return
+	}
+	if err := checkMaintenance(); err != nil {
+		jsonError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err := darkflowQueue.check(); err != nil {
+		jsonError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	retrying.mu.Lock()
+	busy := retrying.ids[id]
+	retrying.ids[id] = true
+	retrying.mu.Unlock()
+	if busy {
+		jsonError(w, http.StatusConflict, fmt.Errorf("job %s is being retried", id))
+		return
+	}
+	defer func() {
+		retrying.mu.Lock()
+		delete(retrying.ids, id)
+		retrying.mu.Unlock()
+	}()
+	if jobLocks {
+		busy, l := jobBusy(id)
+		if busy {
+			jsonError(w, http.StatusConflict, fmt.Errorf("job %s is being retried by another replica", id))
+			return
+		}
+		j.lock = l
+	}
+	// The record may have changed before the lock was taken.
+	current, err := loadJob(t, id)
+	if err != nil || current.Status != jobFailed {
+		j.unlock()
+		jsonError(w, http.StatusConflict, fmt.Errorf("job %s is no longer failed", id))
+		return
+	}
+	current.lock, j = j.lock, current
+	if err := t.reserveImages(j.imageCount()); err != nil {
+		j.unlock()
+		jsonError(w, http.StatusTooManyRequests, err)
+		return
+	}
+
+	// A /v2 or manifest job that went on without some inputs does so
+	// again.
+	partial := len(j.Skipped) > 0
+	if err := restartJob(t, j, from); err != nil {
+		finishJob(t, j, err)
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	j.addTiming(stageValidation, time.Since(received))
+	log.Printf("Retrying job %s of tenant %q from %s", id, t.Name, from)
+	setOutputToken(w, t, j)
+	ctx, cancel := jobContext(r, t, j.ID)
+	defer cancel()
+	if from == stageDownload {
+		if err := stageImages(ctx, t, j); err != nil && !(partial && goOnWithout(ctx, j, err)) {
+			finishJob(t, j, err)
+			jsonError(w, stagingStatus(err), err)
+			return
+		}
+	}
+	status, err := processJob(ctx, t, j)
+	if err != nil {
+		jsonError(w, status, err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, j)
+}
+
+// restartJob puts the failed job j back to running for a retry from stage,
+// clearing the outcome of its last run and moving its kept inputs back to
+// staging, or removing them when they are downloaded again.
+func restartJob(t *tenant, j *job, stage string) error {
+	final := j.finalInputPath(t)
+	now := time.Now().UTC()
+	j.Status = jobRunning
+	j.Retries++
+	j.RetriedAt = &now
+	j.FinishedAt = nil
+	j.ExpiresAt = nil
+	j.Error = ""
+	j.ErrorCode = ""
+	j.ErrorDetails = nil
+	j.ErrorStatus = 0
+	j.FailedStage = ""
+	j.Discrepancies = nil
+	j.Warnings = nil
+	j.Outputs = nil
+	j.Files = nil
+	j.Hooks = nil
+	j.Summary = nil
+	j.QASampled = false
+	j.Timings = nil
+	if j.InputID == "" {
+		if stage == stageDownload {
+			j.Inputs = nil
+			j.Skipped = nil
+			os.RemoveAll(final)
+			os.RemoveAll(j.inputPath(t))
+		} else {
+			if err := os.MkdirAll(filepath.Dir(j.inputPath(t)), 0755); err != nil {
+				return fmt.Errorf("could not create input dir: %v", err)
+			}
+			if err := os.Rename(final, j.inputPath(t)); err != nil {
+				return fmt.Errorf("could not stage inputs of job %s: %v", j.ID, err)
+			}
+		}
+	}
+	os.RemoveAll(j.outputPath(t))
+	return saveJob(t, j)
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var setNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// setsMu serializes the updates of set records, so that two runs of a set
+// never pick the same images.
+var setsMu sync.Mutex
+
+// imageSet is a named collection of image URLs that grows over time. Each
+// run recognizes only the images not processed yet, and the results of the
+// set are the latest detections of all of them. Its record is stored as
+// sets/<name>.json in the tenant's input directory.
+type imageSet struct {
+	Name      string            `json:"name"`
+	Model     string            `json:"model,omitempty"`
+	Threshold float64           `json:"threshold,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Tags      []string          `json:"tags,omitempty"`
+	Retain    string            `json:"retain,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+	Images    []setImage        `json:"images"`
+	// Jobs are the runs of the set, oldest first.
+	Jobs []string `json:"jobs,omitempty"`
+}
+
+// setImage is an image of a set. JobID is the last run it was part of.
+type setImage struct {
+	URL     string    `json:"url"`
+	AddedAt time.Time `json:"added_at"`
+	JobID   string    `json:"job_id,omitempty"`
+}
+
+type setRequest struct {
+	Name      string            `json:"name"`
+	ImageURLs []string          `json:"image_urls"`
+	Model     string            `json:"model"`
+	Threshold float64           `json:"threshold"`
+	Metadata  map[string]string `json:"metadata"`
+	Tags      []string          `json:"tags"`
+	// Retain applies to the jobs of the set, whose results it shows
+	// until they are deleted.
+	Retain string `json:"retain"`
+}
+
+type setImagesRequest struct {
+	ImageURLs []string `json:"image_urls"`
+}
+
+// States of the images of a set in its results. Failed images are tried
+// again by the next run; expired ones are not, their job was deleted.
+const (
+	setImagePending = "pending"
+	setImageRunning = "running"
+	setImageDone    = "done"
+	setImageFailed  = "failed"
+	setImageExpired = "expired"
+)
+
+// setResults aggregates the latest detections of the images of a set.
+type setResults struct {
+	Name string `json:"name"`
+	// JobID and Processed are set in the response to a run: its job and
+	// the images it recognized.
+	JobID     string   `json:"job_id,omitempty"`
+	Processed []string `json:"processed,omitempty"`
+	// Images counts the images of the set by state.
+	Images map[string]int `json:"images"`
+	// Classes counts the detections of the done images by class.
+	Classes    map[string]int   `json:"classes"`
+	Detections int              `json:"detections"`
+	Items      []setImageResult `json:"items"`
+}
+
+type setImageResult struct {
+	URL        string      `json:"url"`
+	Status     string      `json:"status"`
+	JobID      string      `json:"job_id,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Detections []detection `json:"detections,omitempty"`
+	Outputs    []string    `json:"outputs,omitempty"`
+}
+
+func setRecordPath(t *tenant, name string) string {
+	return filepath.Join(t.inputDir(), "sets", name+".json")
+}
+
+func saveSet(t *tenant, s *imageSet) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("could not encode set: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(setRecordPath(t, s.Name)), 0755); err != nil {
+		return fmt.Errorf("could not create sets dir: %v", err)
+	}
+	if err := ioutil.WriteFile(setRecordPath(t, s.Name), data, 0644); err != nil {
+		return fmt.Errorf("could not save set: %v", err)
+	}
+	return nil
+}
+
+func loadSet(t *tenant, name string) (*imageSet, error) {
+	if !setNameRe.MatchString(name) {
+		return nil, os.ErrNotExist
+	}
+	data, err := ioutil.ReadFile(setRecordPath(t, name))
+	if err != nil {
+		return nil, err
+	}
+	var s imageSet
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("could not parse set %s: %v", name, err)
+	}
+	return &s, nil
+}
+
+// setsHandler serves /sets and /sets/{name}[/images|/recognize|/results].
+func setsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		setupResponse(w)
+		return
+	}
+	t, ok := admit(w, r)
+	if !ok {
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/sets"), "/")
+	parts := strings.Split(rest, "/")
+	switch {
+	case rest == "" && r.Method == http.MethodGet:
+		listSets(w, t)
+	case rest == "" && r.Method == http.MethodPost:
+		createSet(w, r, t)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		if s, ok := findSet(w, t, parts[0]); ok {
+			jsonResponse(w, http.StatusOK, s)
+		}
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		removeSet(w, t, parts[0])
+	case len(parts) == 2 && parts[1] == "images" && r.Method == http.MethodPost:
+		addSetImages(w, r, t, parts[0])
+	case len(parts) == 2 && parts[1] == "recognize" && r.Method == http.MethodPost:
+		recognizeSet(w, r, t, parts[0])
+	case len(parts) == 2 && parts[1] == "results" && r.Method == http.MethodGet:
+		if s, ok := findSet(w, t, parts[0]); ok {
+			jsonResponse(w, http.StatusOK, setResultsOf(t, s))
+		}
+	default:
+		jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// findSet loads a set of tenant t, responding with an error itself when it
+// cannot.
+func findSet(w http.ResponseWriter, t *tenant, name string) (*imageSet, bool) {
+	s, err := loadSet(t, name)
+	if os.IsNotExist(err) {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("set %s not found", name))
+		return nil, false
+	}
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return s, true
+}
+
+func createSet(w http.ResponseWriter, r *http.Request, t *tenant) {
+	var req setRequest
+	status, err := decodeJSONBody(w, r, &req)
+	if err != nil {
+		jsonError(w, status, err)
+		return
+	}
+	if !setNameRe.MatchString(req.Name) {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: name must be 1 to 64 letters, digits, dots, dashes or underscores"))
+		return
+	}
+	if err := validateLabels(req.Metadata, req.Tags); err != nil {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: %v", err))
+		return
+	}
+	if err := validateRetention(req.Retain); err != nil {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: %v", err))
+		return
+	}
+	if err := checkURLs(req.ImageURLs); err != nil {
+		jsonError(w, http.StatusForbidden, err)
+		return
+	}
+
+	setsMu.Lock()
+	defer setsMu.Unlock()
+	if _, err := os.Stat(setRecordPath(t, req.Name)); err == nil {
+		jsonError(w, http.StatusConflict, fmt.Errorf("set %s already exists", req.Name))
+		return
+	}
+	now := time.Now().UTC()
+	s := &imageSet{
+		Name:      req.Name,
+		Model:     req.Model,
+		Threshold: req.Threshold,
+		Metadata:  req.Metadata,
+		Tags:      req.Tags,
+		Retain:    req.Retain,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Images:    []setImage{},
+	}
+	s.add(req.ImageURLs, now)
+	if err := saveSet(t, s); err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.Printf("Created set %s of tenant %q with %d images", s.Name, t.Name, len(s.Images))
+	jsonResponse(w, http.StatusCreated, s)
+}
+
+// add appends the URLs not in the set yet and returns how many there were.
+func (s *imageSet) add(urls []string, now time.Time) int {
+	known := make(map[string]bool, len(s.Images))
+	for _, img := range s.Images {
+		known[img.URL] = true
+	}
+	added := 0
+	for _, u := range urls {
+		if known[u] {
+			continue
+		}
+		known[u] = true
+		s.Images = append(s.Images, setImage{URL: u, AddedAt: now})
+		added++
+	}
+	return added
+}
+
+func addSetImages(w http.ResponseWriter, r *http.Request, t *tenant, name string) {
+	var req setImagesRequest
+	status, err := decodeJSONBody(w, r, &req)
+	if err != nil {
+		jsonError(w, status, err)
+		return
+	}
+	if len(req.ImageURLs) == 0 {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: image_urls must not be empty"))
+		return
+	}
+	if err := checkURLs(req.ImageURLs); err != nil {
+		jsonError(w, http.StatusForbidden, err)
+		return
+	}
+
+	setsMu.Lock()
+	defer setsMu.Unlock()
+	s, ok := findSet(w, t, name)
+	if !ok {
+		return
+	}
+	now := time.Now().UTC()
+	if added := s.add(req.ImageURLs, now); added > 0 {
+		s.UpdatedAt = now
+		if err := saveSet(t, s); err != nil {
+			jsonError(w, http.StatusInternalServerError, err)
+			return
+		}
+		log.Printf("Added %d images to set %s of tenant %q", added, s.Name, t.Name)
+	}
+	jsonResponse(w, http.StatusOK, s)
+}
+
+func listSets(w http.ResponseWriter, t *tenant) {
+	names, err := filepath.Glob(filepath.Join(t.inputDir(), "sets", "*.json"))
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	list := make([]*imageSet, 0, len(names))
+	for _, name := range names {
+		s, err := loadSet(t, strings.TrimSuffix(filepath.Base(name), ".json"))
+		if err != nil {
+			log.Printf("Skipping set record %s: %v", name, err)
+			continue
+		}
+		list = append(list, s)
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Name < list[b].Name })
+	jsonResponse(w, http.StatusOK, list)
+}
+
+// removeSet deletes the record of a set. Its jobs are left to their
+// retention.
+func removeSet(w http.ResponseWriter, t *tenant, name string) {
+	setsMu.Lock()
+	defer setsMu.Unlock()
+	s, ok := findSet(w, t, name)
+	if !ok {
+		return
+	}
+	if err := os.Remove(setRecordPath(t, name)); err != nil {
+		jsonError(w, http.StatusInternalServerError, fmt.Errorf("could not remove set %s: %v", name, err))
+		return
+	}
+	log.Printf("Removed set %s of tenant %q", name, t.Name)
+	jsonResponse(w, http.StatusOK, s)
+}
+
+// imageStatus is the state of image url of a set given the record of the
+// last job it was part of, and the index of the image in that job.
+func imageStatus(j *job, url string) (string, int, string) {
+	index := -1
+	for i, u := range j.ImageURLs {
+		if u == url {
+			index = i
+		}
+	}
+	if index < 0 {
+		return setImagePending, index, ""
+	}
+	status, message := inputStatus(j, index)
+	return status, index, message
+}
+
+// inputStatus is the state of input index of job j and, for failed
+// inputs, why.
+func inputStatus(j *job, index int) (string, string) {
+	for _, d := range j.Skipped {
+		if d.Index == index {
+			return setImageFailed, d.Message
+		}
+	}
+	switch {
+	case j.DeletedAt != nil:
+		return setImageExpired, ""
+	case j.Status == jobRunning:
+		return setImageRunning, ""
+	case j.Status == jobDone:
+		return setImageDone, ""
+	}
+	return setImageFailed, j.Error
+}
+
+// pendingImages returns the images of s that are not processed yet, or
+// whose last run failed on them.
+func pendingImages(t *tenant, s *imageSet) []string {
+	jobs := make(map[string]*job)
+	var pending []string
+	for _, img := range s.Images {
+		status := setImagePending
+		if img.JobID != "" {
+			j, ok := jobs[img.JobID]
+			if !ok {
+				j, _ = loadJob(t, img.JobID)
+				jobs[img.JobID] = j
+			}
+			if j != nil {
+				status, _, _ = imageStatus(j, img.URL)
+			}
+		}
+		if status == setImagePending || status == setImageFailed {
+			pending = append(pending, img.URL)
+		}
+	}
+	return pending
+}
+
+// setResultsOf aggregates the results of the images of s from the records
+// and outputs of their jobs.
+func setResultsOf(t *tenant, s *imageSet) *setResults {
+	res := &setResults{
+		Name:    s.Name,
+		Images:  make(map[string]int),
+		Classes: make(map[string]int),
+		Items:   make([]setImageResult, 0, len(s.Images)),
+	}
+	jobs := make(map[string]*job)
+	for _, img := range s.Images {
+		item := setImageResult{URL: img.URL, Status: setImagePending, JobID: img.JobID}
+		if img.JobID != "" {
+			j, ok := jobs[img.JobID]
+			if !ok {
+				j, _ = loadJob(t, img.JobID)
+				jobs[img.JobID] = j
+			}
+			if j != nil {
+				var index int
+				item.Status, index, item.Error = imageStatus(j, img.URL)
+				if item.Status == setImageDone {
+					item.Detections, item.Outputs = imageOutputs(t, j, index)
+				}
+			}
+		}
+		res.Images[item.Status]++
+		for _, d := range item.Detections {
+			res.Classes[d.Label]++
+			res.Detections++
+		}
+		res.Items = append(res.Items, item)
+	}
+	return res
+}
+
+// imageOutputs returns the detections and output URLs of input index of
+// finished job j.
+func imageOutputs(t *tenant, j *job, index int) ([]detection, []string) {
+	var ds []detection
+	var outputs []string
+	for _, f := range j.Files {
+		if f.Index != index {
+			continue
+		}
+		outputs = append(outputs, f.URL)
+		if f.Source != "crop" && filepath.Ext(f.Source) == ".json" {
+			got, err := readDetections(j.outputFilePath(t, f))
+			if err != nil {
+				log.Printf("Could not read detections of job %s: %v", j.ID, err)
+				continue
+			}
+			ds = append(ds, got...)
+		}
+	}
+	return ds, outputs
+}
+
+// recognizeSet serves POST /sets/{name}/recognize: it runs a job over the
+// images of the set not processed yet and responds with the results of the
+// whole set. Runs over the synchronous caps are answered 202 Accepted as
+// recognize requests are.
+func recognizeSet(w http.ResponseWriter, r *http.Request, t *tenant, name string) {
+	received := time.Now()
+	setsMu.Lock()
+	s, ok := findSet(w, t, name)
+	if !ok {
+		setsMu.Unlock()
+		return
+	}
+	pending := pendingImages(t, s)
+	if len(pending) == 0 {
+		setsMu.Unlock()
+		jsonResponse(w, http.StatusOK, setResultsOf(t, s))
+		return
+	}
+	if err := checkURLs(pending); err != nil {
+		setsMu.Unlock()
+		jsonError(w, http.StatusForbidden, err)
+		return
+	}
+	if err := checkMaintenance(); err != nil {
+		setsMu.Unlock()
+		jsonError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err := darkflowQueue.check(); err != nil {
+		setsMu.Unlock()
+		jsonError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err := t.reserveImages(len(pending)); err != nil {
+		setsMu.Unlock()
+		jsonError(w, http.StatusTooManyRequests, err)
+		return
+	}
+
+	log.Printf("Recognizing %d of %d images of set %s of tenant %q", len(pending), len(s.Images), s.Name, t.Name)
+	j := newJob()
+	j.ImageURLs = pending
+	j.Set = s.Name
+	j.Model = s.Model
+	j.Threshold = s.Threshold
+	j.ClassThresholds = mergeClassThresholds(nil)
+	j.Filters = mergeFilters(nil)
+	j.Metadata = s.Metadata
+	j.Tags = s.Tags
+	j.Retain = s.Retain
+	j.addTiming(stageValidation, time.Since(received))
+	if err := createJob(t, j); err != nil {
+		setsMu.Unlock()
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	picked := make(map[string]bool, len(pending))
+	for _, u := range pending {
+		picked[u] = true
+	}
+	for i := range s.Images {
+		if picked[s.Images[i].URL] {
+			s.Images[i].JobID = j.ID
+		}
+	}
+	s.Jobs = append(s.Jobs, j.ID)
+	s.UpdatedAt = time.Now().UTC()
+	err := saveSet(t, s)
+	setsMu.Unlock()
+	if err != nil {
+		finishJob(t, j, err)
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("X-Job-Id", j.ID)
+	setOutputToken(w, t, j)
+
+	run := func(ctx context.Context) (int, error) {
+		if err := stageImages(ctx, t, j); err != nil && !partialStaging(ctx, r, j, err) {
+			finishJobStatus(t, j, stagingStatus(err), err)
+			return stagingStatus(err), err
+		}
+		return processJob(ctx, t, j)
+	}
+	if overSyncImages(len(j.ImageURLs)) {
+		respondAsync(w, r, t, j, run)
+		return
+	}
+	ctx, cancel := jobContext(r, t, j.ID)
+	defer cancel()
+	if status, err := run(ctx); err != nil {
+		jsonError(w, status, err)
+		return
+	}
+	writeSetRun(w, t, j)
+}
+
+// writeSetRun responds with the results of the set of finished job j, as of
+// the run j was.
+func writeSetRun(w http.ResponseWriter, t *tenant, j *job) {
+	s, err := loadSet(t, j.Set)
+	if os.IsNotExist(err) {
+		jsonError(w, http.StatusGone, fmt.Errorf("set %s was deleted", j.Set))
+		return
+	}
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res := setResultsOf(t, s)
+	res.JobID = j.ID
+	res.Processed = j.ImageURLs
+	jsonResponse(w, http.StatusOK, res)
+}
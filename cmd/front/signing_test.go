@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roundTripFunc is an http.RoundTripper calling itself.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// signedDarkflow checks the request signature with "s3cret" and answers with
+// body, signed with secret.
+func signedDarkflow(t *testing.T, secret string, body []byte) http.RoundTripper {
+	return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		var reqBody []byte
+		if req.Body != nil {
+			reqBody, _ = ioutil.ReadAll(req.Body)
+		}
+		nonce := req.Header.Get(nonceHeader)
+		want := hmacSignature([]byte("s3cret"), reqBody, req.Method, req.URL.RequestURI(), req.Header.Get(timestampHeader), nonce)
+		if got := req.Header.Get(signatureHeader); got != want {
+			t.Errorf("request signature = %q, want %q", got, want)
+		}
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewReader(body))}
+		resp.Header.Set(timestampHeader, ts)
+		resp.Header.Set(signatureHeader, hmacSignature([]byte(secret), body, "200", nonce, ts))
+		return resp, nil
+	})
+}
+
+func TestSigningTransport(t *testing.T) {
+	defer func(n int64) { maxUploadSize = n }(maxUploadSize)
+	maxUploadSize = 16
+	tt := []struct {
+		name       string
+		reqBody    string
+		respBody   string
+		respSecret string
+		wantErr    string
+	}{
+		{name: "signed", reqBody: "images", respBody: "results"},
+		{name: "no body", respBody: "results"},
+		{name: "at the limit", reqBody: strings.Repeat("x", 16), respBody: strings.Repeat("y", 16)},
+		{name: "request too large", reqBody: strings.Repeat("x", 17), respBody: "results", wantErr: "cannot be signed"},
+		{name: "response too large", reqBody: "images", respBody: strings.Repeat("y", 17), wantErr: "cannot be verified"},
+		{name: "other secret", reqBody: "images", respBody: "results", respSecret: "other", wantErr: "does not match"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			secret := tc.respSecret
+			if secret == "" {
+				secret = "s3cret"
+			}
+			tr := &signingTransport{base: signedDarkflow(t, secret, []byte(tc.respBody)), secret: []byte("s3cret")}
+			req, err := http.NewRequest(http.MethodPost, "http://darkflow/recognize", nil)
+			if tc.reqBody != "" {
+				req, err = http.NewRequest(http.MethodPost, "http://darkflow/recognize", strings.NewReader(tc.reqBody))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := tr.RoundTrip(req)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("RoundTrip() error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			got, _ := ioutil.ReadAll(resp.Body)
+			if string(got) != tc.respBody {
+				t.Errorf("RoundTrip() body = %q, want %q", got, tc.respBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"sort"
+)
+
+// confidenceBins is the number of equal-width bins confidence histograms
+// split [0, 1] into; bin i counts confidences from i/10 up to (i+1)/10, the
+// last one including 1.
+const confidenceBins = 10
+
+// jobStats aggregates the detections of a finished job.
+type jobStats struct {
+	JobID      string                `json:"job_id"`
+	Inputs     int                   `json:"inputs"`
+	Detections int                   `json:"detections"`
+	Confidence []int                 `json:"confidence_histogram"`
+	Classes    map[string]classStats `json:"classes"`
+	Images     []imageStats          `json:"images"`
+}
+
+// classStats are the detections of one class across a job.
+type classStats struct {
+	Count int `json:"count"`
+	// Images is the number of inputs with at least one detection of the
+	// class.
+	Images         int     `json:"images"`
+	MinConfidence  float64 `json:"min_confidence"`
+	MaxConfidence  float64 `json:"max_confidence"`
+	MeanConfidence float64 `json:"mean_confidence"`
+	Confidence     []int   `json:"confidence_histogram"`
+}
+
+// imageStats summarizes the detections of one input.
+type imageStats struct {
+	Index      int            `json:"index"`
+	Input      string         `json:"input"`
+	Detections int            `json:"detections"`
+	Classes    map[string]int `json:"classes"`
+	// MaxConfidence is the highest confidence of any detection, 0 when
+	// there are none.
+	MaxConfidence float64 `json:"max_confidence"`
+}
+
+// getStats handles GET /jobs/{id}/stats, computing the statistics from the
+// annotation files darkflow produced so that analysts need not download
+// them all.
+func getStats(w http.ResponseWriter, t *tenant, id string) {
+	j, ok := loadResults(w, t, id)
+	if !ok {
+		return
+	}
+	jsonResponse(w, http.StatusOK, computeStats(t, j))
+}
+
+func computeStats(t *tenant, j *job) jobStats {
+	s := jobStats{
+		JobID:      j.ID,
+		Inputs:     j.imageCount(),
+		Confidence: make([]int, confidenceBins),
+		Classes:    make(map[string]classStats),
+		Images:     []imageStats{},
+	}
+	for _, f := range j.Files {
+		if f.Index < 0 || filepath.Ext(f.Source) != ".json" {
+			continue
+		}
+		ds, err := readDetections(j.outputFilePath(t, f))
+		if err != nil {
+			continue
+		}
+		img := imageStats{Index: f.Index, Input: f.Input, Detections: len(ds), Classes: make(map[string]int)}
+		for _, d := range ds {
+			bin := confidenceBin(d.Confidence)
+			s.Confidence[bin]++
+			c, ok := s.Classes[d.Label]
+			if !ok {
+				c = classStats{MinConfidence: d.Confidence, MaxConfidence: d.Confidence, Confidence: make([]int, confidenceBins)}
+			}
+			if img.Classes[d.Label] == 0 {
+				c.Images++
+			}
+			c.Count++
+			c.Confidence[bin]++
+			if d.Confidence < c.MinConfidence {
+				c.MinConfidence = d.Confidence
+			}
+			if d.Confidence > c.MaxConfidence {
+				c.MaxConfidence = d.Confidence
+			}
+			// Summed here, divided once all images are in.
+			c.MeanConfidence += d.Confidence
+			s.Classes[d.Label] = c
+
+			img.Classes[d.Label]++
+			if d.Confidence > img.MaxConfidence {
+				img.MaxConfidence = d.Confidence
+			}
+		}
+		s.Detections += len(ds)
+		s.Images = append(s.Images, img)
+	}
+	for label, c := range s.Classes {
+		c.MeanConfidence /= float64(c.Count)
+		s.Classes[label] = c
+	}
+	sort.Slice(s.Images, func(a, b int) bool { return s.Images[a].Index < s.Images[b].Index })
+	return s
+}
+
+func confidenceBin(confidence float64) int {
+	bin := int(confidence * confidenceBins)
+	if bin < 0 {
+		return 0
+	}
+	if bin >= confidenceBins {
+		return confidenceBins - 1
+	}
+	return bin
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var defaultStreamInterval time.Duration
+var minStreamInterval time.Duration
+var maxStreams int
+
+// streamGrabCommand grabs a single JPEG frame from rtsp:// and rtsps://
+// streams, which the frontend cannot read itself. {url} is replaced by the stream URL
+// and the frame is read from the command's stdout, e.g.
+// "ffmpeg -loglevel error -rtsp_transport tcp -i {url} -frames:v 1 -f mjpeg -".
+var streamGrabCommand string
+
+// streams holds the registered camera streams by ID. They live in memory
+// only and have to be registered again after a restart.
+var streams = &streamSet{byID: make(map[string]*stream)}
+
+type streamSet struct {
+	mu   sync.Mutex
+	byID map[string]*stream
+}
+
+type streamRequest struct {
+	URL string `json:"url"`
+	// Interval between sampled frames, e.g. "5s"; -stream-interval when
+	// empty.
+	Interval  string  `json:"interval"`
+	Model     string  `json:"model"`
+	Threshold float64 `json:"threshold"`
+}
+
+// stream is a camera that is sampled continuously. Every frame is run through
+// darkflow in the stream's own input and output directories, replacing the
+// previous frame.
+type stream struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Interval  string    `json:"interval"`
+	Model     string    `json:"model,omitempty"`
+	Threshold float64   `json:"threshold,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Frames    int       `json:"frames"`
+	Error     string    `json:"error,omitempty"`
+
+	tenant   *tenant
+	interval time.Duration
+	stop     chan struct{}
+	mu       sync.Mutex
+	latest   *streamResult
+}
+
+// streamResult holds the detections of the most recently processed frame.
+type streamResult struct {
+	Frame      int         `json:"frame"`
+	CapturedAt time.Time   `json:"captured_at"`
+	Detections []detection `json:"detections"`
+	// Outputs are the files darkflow produced for the frame. They are
+	// overwritten by the next frame.
+	Outputs []string `json:"outputs"`
+}
+
+func (s *stream) dir() string {
+	return "stream-" + s.ID
+}
+
+func (s *stream) inputPath() string {
+	return filepath.Join(s.tenant.inputDir(), s.dir())
+}
+
+func (s *stream) outputPath() string {
+	return filepath.Join(s.tenant.outputDir(), s.dir())
+}
+
+// snapshot returns a copy of the stream's public state.
+func (s *stream) snapshot() stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return stream{
+		ID:        s.ID,
+		URL:       s.URL,
+		Interval:  s.Interval,
+		Model:     s.Model,
+		Threshold: s.Threshold,
+		CreatedAt: s.CreatedAt,
+		Frames:    s.Frames,
+		Error:     s.Error,
+	}
+}
+
+// run samples the stream until it is removed, then deletes its files.
+func (s *stream) run() {
+	for {
+		res, err := s.sample()
+		s.mu.Lock()
+		if err != nil {
+			s.Error = err.Error()
+		} else {
+			s.Error = ""
+			s.Frames++
+			res.Frame = s.Frames
+			s.latest = res
+		}
+		s.mu.Unlock()
+		if err != nil {
+			log.Printf("Could not sample stream %s: %v", s.ID, err)
+		}
+
+		select {
+		case <-s.stop:
+			os.RemoveAll(s.inputPath())
+			os.RemoveAll(s.outputPath())
+			return
+		case <-time.After(s.interval):
+		}
+	}
+}
+
+// sample grabs one frame and runs darkflow over it. Frames are skipped
+// during maintenance windows.
+func (s *stream) sample() (*streamResult, error) {
+	if err := checkMaintenance(); err != nil {
+		return nil, err
+	}
+	if err := s.tenant.reserveImages(1); err != nil {
+		return nil, err
+	}
+	captured := time.Now().UTC()
+	frame, err := grabFrame(s.URL)
+	if err != nil {
+		return nil, withCode(codeDownloadFailed, err)
+	}
+
+	input := s.inputPath()
+	if err := os.MkdirAll(input, 0755); err != nil {
+		return nil, fmt.Errorf("could not create input dir: %v", err)
+	}
+	tmp := filepath.Join(input, ".0.jpg")
+	if err := ioutil.WriteFile(tmp, frame, 0644); err != nil {
+		return nil, fmt.Errorf("could not save frame: %v", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(input, "0.jpg")); err != nil {
+		return nil, fmt.Errorf("could not save frame: %v", err)
+	}
+
+	output := s.outputPath()
+	if _, err := callDarkflow(context.Background(), darkflowRequest{
+		InputDir:  input,
+		OutputDir: output,
+		Model:     s.Model,
+		Threshold: s.Threshold,
+		images:    1,
+	}); err != nil {
+		return nil, err
+	}
+
+	res := &streamResult{CapturedAt: captured, Detections: []detection{}}
+	files, err := ioutil.ReadDir(output)
+	if err != nil {
+		return nil, fmt.Errorf("could not read output dir: %v", err)
+	}
+	for _, f := range files {
+		res.Outputs = append(res.Outputs, s.tenant.outputURL(s.dir(), f.Name()))
+	}
+	if ds, err := readDetections(filepath.Join(output, "0.json")); err == nil {
+		res.Detections = ds
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return res, nil
+}
+
+// checkStreamURL checks that raw is a network stream URL: http(s), or rtsp(s)
+// with -stream-grab-command. Anything else would have the command read local
+// files.
+func checkStreamURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid stream url %q", raw)
+	}
+	switch scheme := strings.ToLower(u.Scheme); {
+	case scheme == "http" || scheme == "https":
+		return nil
+	case scheme != "rtsp" && scheme != "rtsps":
+		return fmt.Errorf("stream url scheme %q is not supported, want http(s) or rtsp(s)", u.Scheme)
+	case streamGrabCommand == "":
+		return fmt.Errorf("only http(s) snapshot or mjpeg streams are supported, set -stream-grab-command for others")
+	}
+	return nil
+}
+
+// grabFrame fetches a single JPEG frame from a camera. HTTP URLs may serve
+// either a snapshot image or an MJPEG multipart/x-mixed-replace stream, of
+// which the first frame is taken. RTSP goes through -stream-grab-command.
+func grabFrame(url string) ([]byte, error) {
+	// The policy may have been tightened since the stream was added.
+	if err := checkURL(url); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return grabFrameCommand(url)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := insecureClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch frame: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch frame: %s", resp.Status)
+	}
+
+	body := io.Reader(resp.Body)
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err == nil && strings.HasPrefix(mediaType, "multipart/") {
+		part, err := multipart.NewReader(resp.Body, params["boundary"]).NextPart()
+		if err != nil {
+			return nil, fmt.Errorf("could not read mjpeg frame: %v", err)
+		}
+		body = part
+	}
+	frame, err := ioutil.ReadAll(io.LimitReader(body, maxUploadSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not read frame: %v", err)
+	}
+	if int64(len(frame)) > maxUploadSize {
+		return nil, fmt.Errorf("frame exceeds %d bytes", maxUploadSize)
+	}
+	return frame, nil
+}
+
+// grabFrameCommand runs -stream-grab-command for the rtsp(s) stream raw. The
+// command dials on its own, so the addresses of the stream host are checked
+// against the URL policy first.
+func grabFrameCommand(raw string) ([]byte, error) {
+	if err := checkStreamURL(raw); err != nil {
+		return nil, fmt.Errorf("cannot read %s: %v", raw, err)
+	}
+	args := strings.Fields(streamGrabCommand)
+	for i := range args {
+		args[i] = strings.Replace(args[i], "{url}", raw, -1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	u, _ := url.Parse(raw)
+	if err := checkHostAddrs(ctx, u.Hostname()); err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("could not grab frame: %v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("could not grab frame: %v", err)
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("could not grab frame: command wrote no data")
+	}
+	return stdout.Bytes(), nil
+}
+
+// streamsHandler serves /streams and /streams/{id}[/latest].
+func streamsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		setupResponse(w)
+		return
+	}
+	t, ok := admit(w, r)
+	if !ok {
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/streams"), "/")
+	parts := strings.Split(rest, "/")
+	switch {
+	case rest == "" && r.Method == http.MethodGet:
+		listStreams(w, t)
+	case rest == "" && r.Method == http.MethodPost:
+		addStream(w, r, t)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		if s, ok := findStream(w, t, parts[0]); ok {
+			jsonResponse(w, http.StatusOK, s.snapshot())
+		}
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		removeStream(w, t, parts[0])
+	case len(parts) == 2 && parts[1] == "latest" && r.Method == http.MethodGet:
+		latestDetections(w, t, parts[0])
+	default:
+		jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+	}
+}
+
+func addStream(w http.ResponseWriter, r *http.Request, t *tenant) {
+	var req streamRequest
+	status, err := decodeJSONBody(w, r, &req)
+	if err != nil {
+		jsonError(w, status, err)
+		return
+	}
+	if req.URL == "" {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: url must not be empty"))
+		return
+	}
+	if err := checkStreamURL(req.URL); err != nil {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: %v", err))
+		return
+	}
+	if err := checkURL(req.URL); err != nil {
+		jsonError(w, http.StatusForbidden, err)
+		return
+	}
+	interval := defaultStreamInterval
+	if req.Interval != "" {
+		interval, err = time.ParseDuration(req.Interval)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: invalid interval %q: %v", req.Interval, err))
+			return
+		}
+	}
+	if interval < minStreamInterval {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: interval must be at least %s", minStreamInterval))
+		return
+	}
+
+	s := &stream{
+		ID:        generateID(8),
+		URL:       req.URL,
+		Interval:  interval.String(),
+		Model:     req.Model,
+		Threshold: req.Threshold,
+		CreatedAt: time.Now().UTC(),
+		tenant:    t,
+		interval:  interval,
+		stop:      make(chan struct{}),
+	}
+
+	streams.mu.Lock()
+	if len(streams.byID) >= maxStreams {
+		streams.mu.Unlock()
+		jsonError(w, http.StatusTooManyRequests, fmt.Errorf("at most %d streams may be registered", maxStreams))
+		return
+	}
+	streams.byID[s.ID] = s
+	streams.mu.Unlock()
+
+	log.Printf("Registered stream %s of tenant %q: %s every %s", s.ID, t.Name, s.URL, s.interval)
+	go s.run()
+	jsonResponse(w, http.StatusCreated, s.snapshot())
+}
+
+func listStreams(w http.ResponseWriter, t *tenant) {
+	streams.mu.Lock()
+	list := make([]stream, 0, len(streams.byID))
+	for _, s := range streams.byID {
+		if s.tenant == t {
+			list = append(list, s.snapshot())
+		}
+	}
+	streams.mu.Unlock()
+	jsonResponse(w, http.StatusOK, list)
+}
+
+// findStream looks up a stream of tenant t, responding with 404 itself when
+// there is none.
+func findStream(w http.ResponseWriter, t *tenant, id string) (*stream, bool) {
+	streams.mu.Lock()
+	s, ok := streams.byID[id]
+	streams.mu.Unlock()
+	if !ok || s.tenant != t {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("stream %s not found", id))
+		return nil, false
+	}
+	return s, true
+}
+
+// removeStream stops stream id. The lookup and removal happen under one
+// lock so that of concurrent removals only the one that took the stream out
+// stops it.
+func removeStream(w http.ResponseWriter, t *tenant, id string) {
+	streams.mu.Lock()
+	s, ok := streams.byID[id]
+	if ok && s.tenant == t {
+		delete(streams.byID, id)
+	}
+	streams.mu.Unlock()
+	if !ok || s.tenant != t {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("stream %s not found", id))
+		return
+	}
+	close(s.stop)
+	log.Printf("Removed stream %s of tenant %q", s.ID, t.Name)
+	jsonResponse(w, http.StatusOK, s.snapshot())
+}
+
+// latestDetections responds with the result of the stream's most recently
+// processed frame.
+func latestDetections(w http.ResponseWriter, t *tenant, id string) {
+	s, ok := findStream(w, t, id)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	latest, lastErr := s.latest, s.Error
+	s.mu.Unlock()
+	if latest == nil {
+		err := fmt.Errorf("no frame of stream %s processed yet", id)
+		if lastErr != "" {
+			err = fmt.Errorf("%v: %s", err, lastErr)
+		}
+		jsonError(w, http.StatusNotFound, err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, latest)
+}
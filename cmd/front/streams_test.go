@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestCheckStreamURL(t *testing.T) {
+	defer func(c string) { streamGrabCommand = c }(streamGrabCommand)
+	tt := []struct {
+		raw     string
+		command string
+		wantErr bool
+	}{
+		{raw: "http://cam.example.com/snapshot.jpg"},
+		{raw: "HTTPS://cam.example.com/mjpeg"},
+		{raw: "rtsp://cam.example.com/live", command: "ffmpeg -i {url}"},
+		{raw: "rtsps://cam.example.com/live", command: "ffmpeg -i {url}"},
+		{raw: "rtsp://cam.example.com/live", wantErr: true},
+		{raw: "file:///etc/passwd", command: "ffmpeg -i {url}", wantErr: true},
+		{raw: "/etc/passwd", command: "ffmpeg -i {url}", wantErr: true},
+		{raw: "data:image/jpeg;base64,aGk=", command: "ffmpeg -i {url}", wantErr: true},
+		{raw: "ftp://cam.example.com/a.jpg", command: "ffmpeg -i {url}", wantErr: true},
+		{raw: "concat:a|b", command: "ffmpeg -i {url}", wantErr: true},
+		{raw: "rtsp:///live", command: "ffmpeg -i {url}", wantErr: true},
+		{raw: "http://", wantErr: true},
+	}
+	for _, tc := range tt {
+		streamGrabCommand = tc.command
+		if err := checkStreamURL(tc.raw); (err != nil) != tc.wantErr {
+			t.Errorf("checkStreamURL(%q) with command %q error = %v, wantErr %v", tc.raw, tc.command, err, tc.wantErr)
+		}
+	}
+}
+
+func TestGrabFrameCommandPolicy(t *testing.T) {
+	defer func(c string, p *urlPolicy) { streamGrabCommand, policy.current = c, p }(streamGrabCommand, policy.current)
+	streamGrabCommand = "echo {url}"
+	policy.current = &urlPolicy{DenyPrivate: true}
+	for _, raw := range []string{"rtsp://127.0.0.1/live", "rtsp://localhost:554/live", "rtsp://[::1]/live", "file:///etc/passwd"} {
+		if _, err := grabFrameCommand(raw); err == nil {
+			t.Errorf("grabFrameCommand(%q) ran the command", raw)
+		}
+	}
+	policy.current = &urlPolicy{}
+	frame, err := grabFrameCommand("rtsp://127.0.0.1/live")
+	if err != nil || string(frame) != "rtsp://127.0.0.1/live\n" {
+		t.Errorf("grabFrameCommand() = %q, %v, want the echoed url", frame, err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sashayakovtseva/darkflow-front/pkg/client"
+)
+
+// submit implements the "submit" subcommand: it reads image URLs from a file,
+// sends them to a running instance in batches and, with -wait, downloads the
+// results. It returns the process exit code.
+func submit(args []string) int {
+	fs := flag.NewFlagSet("submit", flag.ExitOnError)
+	server := fs.String("server", envOr("DARKFLOW_FRONT_URL", "http://localhost:8080"), "URL of the running instance (defaults to $DARKFLOW_FRONT_URL)")
+	key := fs.String("api-key", os.Getenv("DARKFLOW_FRONT_API_KEY"), "API key (defaults to $DARKFLOW_FRONT_API_KEY)")
+	urlsFile := fs.String("urls-file", "-", "file with one image URL per line, - for stdin")
+	batchSize := fs.Int("batch-size", 50, "number of URLs submitted per job")
+	wait := fs.Bool("wait", false, "wait for every job to finish and download its outputs to -out")
+	out := fs.String("out", "results", "directory to download outputs to, one subdirectory per job")
+	model := fs.String("model", "", "darkflow model to use")
+	threshold := fs.Float64("threshold", 0, "darkflow detection threshold")
+	dryRun := fs.Bool("dry-run", false, "only stage the inputs on the server without calling darkflow")
+	poll := fs.Duration("poll", 2*time.Second, "interval between job status checks while waiting")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s submit [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	urls, err := readURLs(*urlsFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(urls) == 0 {
+		fmt.Fprintln(os.Stderr, "no image urls to submit")
+		return 1
+	}
+	if *batchSize <= 0 {
+		*batchSize = len(urls)
+	}
+
+	c := client.New(*server, *key)
+	ctx := context.Background()
+	opts := client.Options{Model: *model, Threshold: *threshold, DryRun: *dryRun}
+
+	failed := 0
+	for start := 0; start < len(urls); start += *batchSize {
+		end := start + *batchSize
+		if end > len(urls) {
+			end = len(urls)
+		}
+		res, err := c.Recognize(ctx, urls[start:end], opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "batch %d-%d: %v\n", start, end-1, err)
+			failed++
+			continue
+		}
+		fmt.Printf("batch %d-%d: job %s, %d outputs\n", start, end-1, res.JobID, len(res.Outputs))
+		if !*wait {
+			continue
+		}
+		if err := collect(ctx, c, res.JobID, *out, *poll); err != nil {
+			fmt.Fprintf(os.Stderr, "job %s: %v\n", res.JobID, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// collect waits for job id to leave the running state and downloads its
+// outputs into dir/<id>.
+func collect(ctx context.Context, c *client.Client, id, dir string, poll time.Duration) error {
+	var j *client.Job
+	for {
+		var err error
+		j, err = c.GetJob(ctx, id)
+		if err != nil {
+			return err
+		}
+		if j.Status != client.StatusRunning {
+			break
+		}
+		time.Sleep(poll)
+	}
+	if j.Error != "" {
+		return fmt.Errorf("job %s: %s", j.Status, j.Error)
+	}
+
+	jobDir := filepath.Join(dir, id)
+	if err := os.MkdirAll(jobDir, 0755); err != nil {
+		return err
+	}
+	for _, out := range j.Outputs {
+		to := filepath.Join(jobDir, filepath.FromSlash(outputRel(id, out)))
+		if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			return err
+		}
+		if err := downloadTo(ctx, c, out, to); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("job %s: downloaded %d files to %s\n", id, len(j.Outputs), jobDir)
+	return nil
+}
+
+// outputRel is where output URL out of job id goes under the job's directory:
+// its path below /output/[<tenant>/]<id>/, such as crops/car/0_0.jpg, so that
+// outputs of the same name in different directories do not overwrite each
+// other.
+func outputRel(id, out string) string {
+	p := out
+	if u, err := url.Parse(out); err == nil {
+		p = u.Path
+	}
+	if i := strings.Index(p, "/"+id+"/"); i >= 0 {
+		// Cleaning below the root keeps .. from climbing out of the job
+		// directory.
+		if rel := strings.TrimPrefix(path.Clean("/"+p[i+len(id)+2:]), "/"); rel != "" {
+			return rel
+		}
+	}
+	return path.Base(p)
+}
+
+func downloadTo(ctx context.Context, c *client.Client, from, to string) error {
+	file, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if err := c.Download(ctx, from, file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// readURLs reads non-empty, non-comment lines from file.
+func readURLs(file string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not open urls file: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var urls []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("could not read urls file: %v", err)
+	}
+	return urls, nil
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
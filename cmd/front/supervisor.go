@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var restartAfter int
+var restartCommand string
+var restartContainer string
+var dockerHost string
+var restartWait time.Duration
+
+// restartContainers maps backend URLs to the containers -restart-container
+// restarts for them; the key "" is the one container of a lone backend.
+var restartContainers map[string]string
+
+// validateRestart checks the restart settings and parses -restart-container:
+// a container name when darkflow is the one -darkflow-url, or
+// <backend URL>=<container> pairs, comma separated, when several backends
+// are discovered or named by -compare-backends, so that a failing backend
+// never restarts another's container.
+func validateRestart() error {
+	if restartAfter <= 0 {
+		return nil
+	}
+	if restartCommand == "" && restartContainer == "" {
+		return fmt.Errorf("-restart-after needs -restart-command or -restart-container")
+	}
+	if restartCommand != "" {
+		return nil
+	}
+	restartContainers = make(map[string]string)
+	if !strings.Contains(restartContainer, "=") {
+		if darkflowDiscovery != "" || compareBackendsFlag != "" {
+			return fmt.Errorf("-restart-container %q names one container but there are several darkflow backends, map each with <backend URL>=<container> or use -restart-command", restartContainer)
+		}
+		restartContainers[""] = restartContainer
+		return nil
+	}
+	for _, entry := range strings.Split(restartContainer, ",") {
+		entry = strings.TrimSpace(entry)
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 || i == len(entry)-1 {
+			return fmt.Errorf("invalid -restart-container entry %q, want <backend URL>=<container>", entry)
+		}
+		restartContainers[strings.TrimRight(entry[:i], "/")] = entry[i+1:]
+	}
+	return nil
+}
+
+// containerOf returns the container -restart-container restarts for backend.
+func containerOf(backend string) (string, bool) {
+	if c, ok := restartContainers[""]; ok {
+		return c, true
+	}
+	c, ok := restartContainers[strings.TrimRight(backend, "/")]
+	return c, ok
+}
+
+// supervision tracks consecutive failures of the darkflow backends, notifies
+// of outages and, when -restart-after is set, restarts backends that keep
+// failing.
+var supervision = &supervisor{
+	failures:   make(map[string]int),
+	restarting: make(map[string]chan struct{}),
+}
+
+type supervisor struct {
+	mu         sync.Mutex
+	failures   map[string]int
+	restarting map[string]chan struct{}
+}
+
+func supervising() bool {
+	return restartAfter > 0
+}
+
+// wait holds a call to backend back while the backend is being restarted.
+func (s *supervisor) wait(ctx context.Context, backend string) error {
+	s.mu.Lock()
+	done, ok := s.restarting[backend]
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return timeoutError(ctx, ctx, codeRequestTimeout, requestTimeout, fmt.Errorf("gave up waiting for darkflow to restart: %v", ctx.Err()))
+	}
+}
+
+// record counts the outcome of a call to backend and restarts the backend
+// after -restart-after consecutive failures. Only failures of darkflow itself
+// count; timeouts of the whole request, cancellations and rejected inputs do
+// not.
+func (s *supervisor) record(backend string, status int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !backendFailed(status, err) {
+		if outageAfter > 0 && s.failures[backend] >= outageAfter {
+			notify(eventBackendRecovered, "Darkflow recovered", "Darkflow at %s is answering again.", backend)
+		}
+		s.failures[backend] = 0
+		return
+	}
+	s.failures[backend]++
+	if s.failures[backend] == outageAfter {
+		notify(eventBackendDown, "Darkflow is down", "Darkflow at %s failed %d times in a row, last: %v", backend, outageAfter, err)
+	}
+	if !supervising() || s.failures[backend] < restartAfter {
+		return
+	}
+	if _, ok := s.restarting[backend]; ok {
+		return
+	}
+	log.Printf("Darkflow at %s failed %d times in a row, restarting it", backend, s.failures[backend])
+	done := make(chan struct{})
+	s.restarting[backend] = done
+	go func() {
+		if err := restartBackend(backend); err != nil {
+			log.Printf("Could not restart darkflow at %s: %v", backend, err)
+		} else {
+			notify(eventBackendRestarted, "Darkflow restarted", "Darkflow at %s was restarted after %d consecutive failures and is back up.", backend, restartAfter)
+		}
+		s.mu.Lock()
+		delete(s.restarting, backend)
+		s.failures[backend] = 0
+		s.mu.Unlock()
+		close(done)
+	}()
+}
+
+func backendFailed(status int, err error) bool {
+	switch codeOr(err, "") {
+	case codeBackendUnavailable, codeBackendTimeout:
+		return true
+	case codeBackendError:
+		return status >= 500
+	}
+	return false
+}
+
+// restartBackend runs the restart hook for backend and waits up to
+// -restart-wait for it to respond again.
+func restartBackend(backend string) error {
+	var err error
+	if restartCommand != "" {
+		err = runRestartCommand(backend)
+	} else if container, ok := containerOf(backend); ok {
+		err = restartDockerContainer(container)
+	} else {
+		err = fmt.Errorf("-restart-container names no container for it")
+	}
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(restartWait)
+	for {
+		if err = probeBackend(backend); err == nil {
+			log.Printf("Darkflow at %s is back up", backend)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("darkflow did not come back within %s: %v", restartWait, err)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// runRestartCommand runs -restart-command with {backend} replaced by the URL
+// of the failing backend.
+func runRestartCommand(backend string) error {
+	args := strings.Fields(restartCommand)
+	for i := range args {
+		args[i] = strings.Replace(args[i], "{backend}", backend, -1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), restartWait)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("restart command failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// restartDockerContainer restarts container through the Docker Engine API at
+// -docker-host.
+func restartDockerContainer(container string) error {
+	client, base, err := dockerClient()
+	if err != nil {
+		return err
+	}
+	u := base + "/containers/" + url.PathEscape(container) + "/restart?t=10"
+	req, err := http.NewRequest(http.MethodPost, u, nil)
+	if err != nil {
+		return fmt.Errorf("could not create docker request: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), restartWait)
+	defer cancel()
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("could not call docker: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("docker could not restart container %s: %s", container, resp.Status)
+	}
+	return nil
+}
+
+// dockerClient returns a client for -docker-host, which is either
+// unix://<socket path> or tcp://<host>:<port>, and the base URL to use.
+func dockerClient() (*http.Client, string, error) {
+	u, err := url.Parse(dockerHost)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid docker host %q: %v", dockerHost, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		tr := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		return &http.Client{Transport: tr}, "http://docker", nil
+	case "tcp", "http":
+		return http.DefaultClient, "http://" + u.Host, nil
+	}
+	return nil, "", fmt.Errorf("unsupported docker host %q, want unix:// or tcp://", dockerHost)
+}
+
+func defaultDockerHost() string {
+	if h := os.Getenv("DOCKER_HOST"); h != "" {
+		return h
+	}
+	return "unix:///var/run/docker.sock"
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var tenantsFile string
+
+// tenants maps API keys to their tenant. It is nil when -tenants is not set,
+// in which case every request belongs to defaultTenant and no key is required.
+var tenants map[string]*tenant
+
+var defaultTenant = &tenant{}
+
+var tenantNameRe = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// tenant is an isolated consumer of the service. Its inputs and outputs live
+// in their own subtrees of -input and -output named after the tenant.
+type tenant struct {
+	Name              string   `json:"name"`
+	APIKeys           []string `json:"api_keys"`
+	DailyImageQuota   int      `json:"daily_image_quota"`
+	RequestsPerMinute int      `json:"requests_per_minute"`
+	// WebhookSecret signs the callbacks of the tenant's jobs instead of
+	// -webhook-secret.
+	WebhookSecret string `json:"webhook_secret"`
+
+	mu         sync.Mutex
+	tokens     float64
+	lastRefill time.Time
+	quotaDay   string
+	imagesUsed int
+}
+
+// loadTenants reads the tenant list from -tenants and indexes it by API key.
+func loadTenants(file string) (map[string]*tenant, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read tenants file: %v", err)
+	}
+	var list []*tenant
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("could not parse tenants file: %v", err)
+	}
+
+	byKey := make(map[string]*tenant)
+	names := make(map[string]bool)
+	for _, t := range list {
+		if !tenantNameRe.MatchString(t.Name) {
+			return nil, fmt.Errorf("invalid tenant name %q", t.Name)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("duplicate tenant %q", t.Name)
+		}
+		names[t.Name] = true
+		if len(t.APIKeys) == 0 {
+			return nil, fmt.Errorf("tenant %q has no api keys", t.Name)
+		}
+		for _, key := range t.APIKeys {
+			if _, ok := byKey[key]; ok {
+				return nil, fmt.Errorf("api key of tenant %q is already in use", t.Name)
+			}
+			byKey[key] = t
+		}
+	}
+	return byKey, nil
+}
+
+// apiKey extracts the caller's API key from the X-API-Key header, a bearer
+// Authorization header or, for links opened in a browser, the api_key query
+// parameter.
+func apiKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// authenticate returns the tenant the request belongs to.
+func authenticate(r *http.Request) (*tenant, error) {
+	if tenants == nil {
+		return defaultTenant, nil
+	}
+	key := apiKey(r)
+	if key == "" {
+		return nil, fmt.Errorf("missing api key")
+	}
+	t, ok := tenants[key]
+	if !ok {
+		return nil, fmt.Errorf("invalid api key")
+	}
+	return t, nil
+}
+
+// allowRequest consumes one token from the tenant's rate limit bucket. When
+// the bucket is empty it returns how long the caller should wait.
+func (t *tenant) allowRequest() (bool, time.Duration) {
+	if t.RequestsPerMinute <= 0 {
+		return true, 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	rate := float64(t.RequestsPerMinute) / float64(time.Minute)
+	burst := float64(t.RequestsPerMinute)
+	if t.lastRefill.IsZero() {
+		t.tokens = burst
+	} else {
+		t.tokens += float64(now.Sub(t.lastRefill)) * rate
+		if t.tokens > burst {
+			t.tokens = burst
+		}
+	}
+	t.lastRefill = now
+
+	if t.tokens < 1 {
+		return false, time.Duration((1 - t.tokens) / rate)
+	}
+	t.tokens--
+	return true, 0
+}
+
+// reserveImages charges n images against the tenant's daily quota.
+func (t *tenant) reserveImages(n int) error {
+	if t.DailyImageQuota <= 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	day := time.Now().UTC().Format("2006-01-02")
+	if t.quotaDay != day {
+		t.quotaDay = day
+		t.imagesUsed = 0
+	}
+	if t.imagesUsed+n > t.DailyImageQuota {
+		return withCode(codeQuotaExceeded, fmt.Errorf("daily image quota exceeded: %d of %d images used", t.imagesUsed, t.DailyImageQuota))
+	}
+	t.imagesUsed += n
+	return nil
+}
+
+// allTenants returns every configured tenant once, or just defaultTenant
+// when -tenants is not set.
+func allTenants() []*tenant {
+	if tenants == nil {
+		return []*tenant{defaultTenant}
+	}
+	seen := make(map[*tenant]bool)
+	var list []*tenant
+	for _, t := range tenants {
+		if !seen[t] {
+			seen[t] = true
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+// inputDir returns the directory holding the tenant's downloaded inputs.
+func (t *tenant) inputDir() string {
+	return filepath.Join(inputDir, t.Name)
+}
+
+// outputDir returns the directory holding the tenant's darkflow outputs.
+func (t *tenant) outputDir() string {
+	return filepath.Join(outputDir, t.Name)
+}
+
+// outputURL returns the URL under which a tenant's output file is served.
+func (t *tenant) outputURL(id, name string) string {
+	return path.Join("/output", t.Name, id, name)
+}
+
+// admit authenticates the request and applies the tenant's rate limit,
+// responding with an error itself when the request may not proceed.
+func admit(w http.ResponseWriter, r *http.Request) (*tenant, bool) {
+	t, err := authenticate(r)
+	if err != nil {
+		jsonError(w, http.StatusUnauthorized, err)
+		return nil, false
+	}
+	if ok, wait := t.allowRequest(); !ok {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(wait/time.Second)+1))
+		jsonError(w, http.StatusTooManyRequests, fmt.Errorf("rate limit of %d requests per minute exceeded", t.RequestsPerMinute))
+		return nil, false
+	}
+	return t, true
+}
+
+// outputHandler serves files from -output. With tenants configured a caller
+// only ever sees its own subtree: anything else, including the top level
+// listing, is reported as not found. An output token narrows that to the
+// outputs of the job it was issued for, and needs no api key.
+func outputHandler() http.Handler {
+	files := http.StripPrefix("/output/", http.FileServer(http.Dir(outputDir)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Dot directories hold outputs that are still being written.
+		for _, elem := range strings.Split(r.URL.Path, "/") {
+			if strings.HasPrefix(elem, ".") {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		rel := strings.TrimPrefix(path.Clean(r.URL.Path), "/output/")
+		if token := outputToken(r); token != "" {
+			scope, err := verifyOutputToken(token)
+			if err != nil {
+				jsonError(w, http.StatusUnauthorized, err)
+				return
+			}
+			if rel != scope.dir() && !strings.HasPrefix(rel, scope.dir()+"/") {
+				http.NotFound(w, r)
+				return
+			}
+			serveOutput(w, r, files)
+			return
+		}
+		if requireOutputToken {
+			jsonError(w, http.StatusUnauthorized, fmt.Errorf("missing output token"))
+			return
+		}
+		if tenants == nil {
+			serveOutput(w, r, files)
+			return
+		}
+		t, err := authenticate(r)
+		if err != nil {
+			jsonError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if rel != t.Name && !strings.HasPrefix(rel, t.Name+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		serveOutput(w, r, files)
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// classThresholdsFlag is -class-thresholds, the server default minimum
+// confidences of classes; defaultClassThresholds is it parsed.
+var classThresholdsFlag string
+var defaultClassThresholds map[string]float64
+
+func setupClassThresholds() error {
+	var err error
+	defaultClassThresholds, err = parseClassThresholds(classThresholdsFlag)
+	if err != nil {
+		return fmt.Errorf("invalid -class-thresholds: %v", err)
+	}
+	if len(defaultClassThresholds) > 0 && inMemory {
+		return fmt.Errorf("-class-thresholds is not available with -in-memory, the annotated images could not be redrawn")
+	}
+	return nil
+}
+
+// parseClassThresholds parses comma separated <class>=<confidence> pairs, as
+// given to -class-thresholds and the class_thresholds field of uploads.
+func parseClassThresholds(s string) (map[string]float64, error) {
+	var thresholds map[string]float64
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid entry %q, want <class>=<confidence>", entry)
+		}
+		v, err := strconv.ParseFloat(entry[i+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid confidence for %q: %v", entry[:i], err)
+		}
+		if thresholds == nil {
+			thresholds = make(map[string]float64)
+		}
+		thresholds[strings.TrimSpace(entry[:i])] = v
+	}
+	return thresholds, validateClassThresholds(thresholds)
+}
+
+func validateClassThresholds(thresholds map[string]float64) error {
+	for class, v := range thresholds {
+		if class == "" {
+			return fmt.Errorf("class thresholds need a class name")
+		}
+		if v < 0 || v > 1 {
+			return fmt.Errorf("class threshold of %q must be between 0 and 1, got %v", class, v)
+		}
+	}
+	return nil
+}
+
+// mergeClassThresholds returns the server defaults overridden by the
+// thresholds of a request.
+func mergeClassThresholds(request map[string]float64) map[string]float64 {
+	if len(request) == 0 && len(defaultClassThresholds) == 0 {
+		return nil
+	}
+	merged := make(map[string]float64, len(defaultClassThresholds)+len(request))
+	for class, v := range defaultClassThresholds {
+		merged[class] = v
+	}
+	for class, v := range request {
+		merged[class] = v
+	}
+	return merged
+}
+
+// darkflowThreshold is the threshold darkflow is asked for: the job's,
+// lowered to its lowest class threshold so that darkflow keeps the
+// detections of classes allowed below it. When the job has no threshold
+// darkflow's own applies and cannot be lowered.
+func (j *job) darkflowThreshold() float64 {
+	threshold := j.Threshold
+	if threshold == 0 {
+		return 0
+	}
+	for _, v := range j.ClassThresholds {
+		if v < threshold {
+			threshold = v
+		}
+	}
+	return threshold
+}
+
+// minConfidence is the confidence a detection of class needs to be kept.
+func (j *job) minConfidence(class string) float64 {
+	if v, ok := j.ClassThresholds[class]; ok {
+		return v
+	}
+	return j.Threshold
+}
+
+// applyClassThresholds drops the detections below their class threshold from
+// darkflow's annotations of j.
+func applyClassThresholds(t *tenant, j *job) error {
+	if len(j.ClassThresholds) == 0 {
+		return nil
+	}
+	dropped, err := filterAnnotations(t, j, "below their class thresholds", func(ds []detection) []detection {
+		kept := ds[:0:0]
+		for _, d := range ds {
+			if d.Confidence >= j.minConfidence(d.Label) {
+				kept = append(kept, d)
+			}
+		}
+		return kept
+	})
+	if dropped > 0 {
+		log.Printf("Dropped %d detections of job %s below their class thresholds", dropped, j.ID)
+	}
+	return err
+}
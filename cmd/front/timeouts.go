@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var downloadTimeout time.Duration
+var darkflowTimeout time.Duration
+var requestTimeout time.Duration
+
+// requestContext bounds the work done for r by -request-timeout. It is also
+// cancelled when the client goes away.
+func requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if requestTimeout > 0 {
+		return context.WithTimeout(r.Context(), requestTimeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// stepContext bounds a single step of the request, such as one download, by
+// d when it is positive.
+func stepContext(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d > 0 {
+		return context.WithTimeout(ctx, d)
+	}
+	return context.WithCancel(ctx)
+}
+
+// timeoutError tells apart the step timing out, reported as code, from the
+// whole request running out of time or its job being cancelled. Other errors
+// are returned unchanged.
+func timeoutError(ctx, step context.Context, code string, limit time.Duration, err error) error {
+	if err == nil {
+		return nil
+	}
+	if context.Cause(ctx) == errJobCancelled {
+		return withCode(codeCancelled, errJobCancelled)
+	}
+	if context.Cause(ctx) == errClientDisconnected {
+		return withCode(codeClientDisconnected, errClientDisconnected)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return withCode(codeRequestTimeout, fmt.Errorf("request timed out after %s: %v", requestTimeout, err))
+	}
+	if step.Err() == context.DeadlineExceeded {
+		return withCode(code, fmt.Errorf("timed out after %s: %v", limit, err))
+	}
+	return err
+}
+
+// abortStatus is the response status for err if the work was cut short by a
+// timeout or cancellation, or fallback otherwise.
+func abortStatus(err error, fallback int) int {
+	switch codeOr(err, "") {
+	case codeRequestTimeout, codeBackendTimeout, codeDownloadTimeout:
+		return http.StatusGatewayTimeout
+	case codeCancelled:
+		return http.StatusConflict
+	case codeClientDisconnected:
+		return statusClientClosedRequest
+	}
+	return fallback
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pipeline stages timed per job.
+const (
+	stageValidation     = "validation"
+	stageDownload       = "download"
+	stageBackend        = "backend"
+	stagePostProcessing = "post_processing"
+)
+
+var stages = []string{stageValidation, stageDownload, stageBackend, stagePostProcessing}
+
+// jobTimings is how long a job spent in each stage of the pipeline, in
+// seconds. Stages a job did not go through are omitted. Download covers
+// receiving uploads too, and backend includes the wait for a free darkflow
+// slot.
+type jobTimings struct {
+	Validation     float64 `json:"validation_seconds,omitempty"`
+	Download       float64 `json:"download_seconds,omitempty"`
+	Backend        float64 `json:"backend_seconds,omitempty"`
+	PostProcessing float64 `json:"post_processing_seconds,omitempty"`
+}
+
+// addTiming adds d to the time j spent in stage.
+func (j *job) addTiming(stage string, d time.Duration) {
+	if j.Timings == nil {
+		j.Timings = &jobTimings{}
+	}
+	switch stage {
+	case stageValidation:
+		j.Timings.Validation += d.Seconds()
+	case stageDownload:
+		j.Timings.Download += d.Seconds()
+	case stageBackend:
+		j.Timings.Backend += d.Seconds()
+	case stagePostProcessing:
+		j.Timings.PostProcessing += d.Seconds()
+	}
+}
+
+func (t *jobTimings) of(stage string) float64 {
+	switch stage {
+	case stageValidation:
+		return t.Validation
+	case stageDownload:
+		return t.Download
+	case stageBackend:
+		return t.Backend
+	case stagePostProcessing:
+		return t.PostProcessing
+	}
+	return 0
+}
+
+// stageBuckets are the upper bounds of the stage duration histograms, in
+// seconds.
+var stageBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// jobMetrics aggregates the timings and outcomes of finished jobs.
+type jobMetrics struct {
+	mu     sync.Mutex
+	stages map[string]*histogram
+	jobs   map[string]uint64
+}
+
+var metrics = &jobMetrics{stages: make(map[string]*histogram), jobs: make(map[string]uint64)}
+
+// observe records a finished job.
+func (m *jobMetrics) observe(j *job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs[j.Status]++
+	if j.Timings == nil {
+		return
+	}
+	for _, stage := range stages {
+		v := j.Timings.of(stage)
+		if v == 0 {
+			continue
+		}
+		h := m.stages[stage]
+		if h == nil {
+			h = &histogram{counts: make([]uint64, len(stageBuckets))}
+			m.stages[stage] = h
+		}
+		for i, le := range stageBuckets {
+			if v <= le {
+				h.counts[i]++
+			}
+		}
+		h.count++
+		h.sum += v
+	}
+}
+
+// write renders the metrics in the Prometheus text format.
+func (m *jobMetrics) write(b *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b.WriteString("# HELP darkflow_front_jobs_total Finished jobs by status.\n")
+	b.WriteString("# TYPE darkflow_front_jobs_total counter\n")
+	statuses := make([]string, 0, len(m.jobs))
+	for s := range m.jobs {
+		statuses = append(statuses, s)
+	}
+	sort.Strings(statuses)
+	for _, s := range statuses {
+		fmt.Fprintf(b, "darkflow_front_jobs_total{status=%q} %d\n", s, m.jobs[s])
+	}
+
+	b.WriteString("# HELP darkflow_front_job_stage_duration_seconds Time jobs spent in each pipeline stage.\n")
+	b.WriteString("# TYPE darkflow_front_job_stage_duration_seconds histogram\n")
+	for _, stage := range stages {
+		h := m.stages[stage]
+		if h == nil {
+			continue
+		}
+		for i, le := range stageBuckets {
+			fmt.Fprintf(b, "darkflow_front_job_stage_duration_seconds_bucket{stage=%q,le=\"%g\"} %d\n", stage, le, h.counts[i])
+		}
+		fmt.Fprintf(b, "darkflow_front_job_stage_duration_seconds_bucket{stage=%q,le=\"+Inf\"} %d\n", stage, h.count)
+		fmt.Fprintf(b, "darkflow_front_job_stage_duration_seconds_sum{stage=%q} %g\n", stage, h.sum)
+		fmt.Fprintf(b, "darkflow_front_job_stage_duration_seconds_count{stage=%q} %d\n", stage, h.count)
+	}
+}
+
+// adminMetrics serves GET /admin/metrics for Prometheus, which can pass the
+// admin key as a bearer token.
+func adminMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		setupResponse(w)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+		return
+	}
+	var b strings.Builder
+	metrics.write(&b)
+	probes.writeMetrics(&b)
+	writeBlobMetrics(&b)
+	setupResponse(w)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// drainTimeout bounds how long a stopping process waits for its requests and
+// jobs; upgradeTimeout how long it waits for its successor to start serving.
+var drainTimeout time.Duration
+var upgradeTimeout time.Duration
+
+// listenFDsEnv hands the listeners of a process over to its successor: it
+// lists their addresses, whose sockets are the files from fd 3 on. The two
+// files after them are the pipe the successor reports it serves on and the
+// pipe that closes once its predecessor exits.
+const listenFDsEnv = "DARKFLOW_FRONT_LISTEN_FDS"
+
+// draining is set once the process stops taking work, for an upgrade or a
+// shutdown.
+var draining atomic.Bool
+
+// servers are the running servers and the listeners they serve, by
+// address as given to -listen and -admin-listen.
+var servers struct {
+	mu        sync.Mutex
+	list      []*http.Server
+	addrs     []string
+	listeners []net.Listener
+}
+
+// inherited are the listeners, by address, and pipes the predecessor of
+// this process handed over, if it was started by an upgrade.
+var inherited struct {
+	listeners map[string]net.Listener
+	ready     *os.File
+	parent    *os.File
+}
+
+// inheritListeners takes over the sockets passed in $DARKFLOW_FRONT_LISTEN_FDS.
+func inheritListeners() error {
+	names := os.Getenv(listenFDsEnv)
+	if names == "" {
+		return nil
+	}
+	os.Unsetenv(listenFDsEnv)
+	addrs := strings.Split(names, ",")
+	inherited.listeners = make(map[string]net.Listener, len(addrs))
+	for i, addr := range addrs {
+		f := os.NewFile(uintptr(3+i), addr)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("could not inherit listener on %s: %v", addr, err)
+		}
+		inherited.listeners[addr] = l
+	}
+	inherited.ready = os.NewFile(uintptr(3+len(addrs)), "ready")
+	inherited.parent = os.NewFile(uintptr(4+len(addrs)), "parent")
+	log.Printf("Took over %d listeners from the previous process", len(addrs))
+	return nil
+}
+
+// upgraded reports whether this process was started by an upgrade.
+func upgraded() bool {
+	return inherited.listeners != nil
+}
+
+// inheritedListener returns the listener on addr handed over by the
+// predecessor of this process, if any.
+func inheritedListener(addr string) (net.Listener, bool) {
+	l, ok := inherited.listeners[addr]
+	delete(inherited.listeners, addr)
+	return l, ok
+}
+
+// takeOver is called once every listener of an upgraded process serves: it
+// closes the inherited listeners no longer configured, tells the
+// predecessor to drain and, once it exited, deals with the jobs it left
+// running as recoverJobs does at startup.
+func takeOver() {
+	if !upgraded() {
+		return
+	}
+	for addr, l := range inherited.listeners {
+		log.Printf("Closing inherited listener on %s, which is no longer configured", addr)
+		l.Close()
+	}
+	inherited.ready.Write([]byte{1})
+	inherited.ready.Close()
+	go func() {
+		io.Copy(io.Discard, inherited.parent)
+		inherited.parent.Close()
+		log.Printf("The previous process exited")
+		recoverJobs()
+		recoverManifests()
+	}()
+}
+
+// watchSignals drains the process and exits on SIGINT and SIGTERM and, where
+// supported, hands its listeners over to a new process started from its
+// executable on upgradeSignal.
+func watchSignals() {
+	signals := []os.Signal{os.Interrupt, syscall.SIGTERM}
+	if upgradeSignal != nil {
+		signals = append(signals, upgradeSignal)
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, signals...)
+	go func() {
+		for sig := range c {
+			if sig == upgradeSignal {
+				if draining.Load() {
+					continue
+				}
+				if err := upgrade(); err != nil {
+					log.Printf("Upgrade failed, serving on: %v", err)
+					continue
+				}
+			} else {
+				log.Printf("Got %v, shutting down", sig)
+				// A second signal stops the process right away.
+				signal.Reset(os.Interrupt, syscall.SIGTERM)
+			}
+			drain()
+			os.Exit(0)
+		}
+	}()
+}
+
+// upgrade starts the executable of this process again with the same
+// arguments, handing it the listeners, and returns once it serves on them.
+func upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("could not find executable: %v", err)
+	}
+	servers.mu.Lock()
+	addrs := servers.addrs
+	var files []*os.File
+	for _, l := range servers.listeners {
+		f, err := listenerFile(l)
+		if err != nil {
+			servers.mu.Unlock()
+			return fmt.Errorf("could not hand over listener on %s: %v", l.Addr(), err)
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+	servers.mu.Unlock()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+	// The successor reads parentR until this process exits and closes
+	// parentW, which is never closed before.
+	parentR, parentW, err := os.Pipe()
+	if err != nil {
+		readyW.Close()
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), listenFDsEnv+"="+strings.Join(addrs, ","))
+	cmd.ExtraFiles = append(files, readyW, parentR)
+	log.Printf("Upgrading: starting %s", exe)
+	err = cmd.Start()
+	readyW.Close()
+	parentR.Close()
+	if err != nil {
+		parentW.Close()
+		return fmt.Errorf("could not start %s: %v", exe, err)
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+	timer := time.NewTimer(upgradeTimeout)
+	defer timer.Stop()
+	select {
+	case err = <-ready:
+	case <-timer.C:
+		err = fmt.Errorf("not serving after %v", upgradeTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		parentW.Close()
+		return fmt.Errorf("new process %d did not take over: %v", cmd.Process.Pid, err)
+	}
+	log.Printf("New process %d took over the listeners", cmd.Process.Pid)
+	successorPipe = parentW
+	go cmd.Wait()
+	return nil
+}
+
+// successorPipe is the write end of the pipe the successor of this process
+// waits on. It is kept referenced so that it is only closed by the exit.
+var successorPipe *os.File
+
+// drain stops accepting connections and waits up to -drain-timeout for the
+// requests and jobs in flight. Jobs still running then are left to the
+// recovery of the next process; manifests stop between chunks.
+func drain() {
+	draining.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	log.Printf("Draining %d jobs, for up to %v", activeJobs.count(), drainTimeout)
+	servers.mu.Lock()
+	list := servers.list
+	// Shutdown drops the requests it reads from connections accepted just
+	// before it started, so the listeners are closed first and those
+	// connections get a moment to send theirs.
+	for _, l := range servers.listeners {
+		l.Close()
+	}
+	servers.mu.Unlock()
+	time.Sleep(time.Second)
+	var wg sync.WaitGroup
+	for _, srv := range list {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("Could not drain connections: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	for activeJobs.count() > 0 && ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	n := activeJobs.count()
+	ids := callbacks.wait(ctx)
+	if len(ids) > 0 {
+		log.Printf("Abandoning the callbacks of jobs %s", strings.Join(ids, ", "))
+	}
+	if n > 0 {
+		log.Printf("Exiting with %d jobs still running", n)
+		return
+	}
+	if len(ids) == 0 {
+		log.Printf("Drained")
+	}
+}
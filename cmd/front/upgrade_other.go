@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// upgradeSignal is nil where listeners cannot be handed over.
+var upgradeSignal os.Signal
+
+func listenerFile(l net.Listener) (*os.File, error) {
+	return nil, fmt.Errorf("not supported on this platform")
+}
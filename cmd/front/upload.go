@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var maxUploadSize int64
+
+// upload is the multipart counterpart of recognize for images that are not
+// reachable by URL. Every "images" part is staged as an input; optional
+// "model" and "threshold" fields are passed on to darkflow and "dry_run=true"
+// stops before calling it. Repeated "tag" fields and "meta.<key>" fields
+// label the job.
+func upload(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		setupResponse(w)
+		return
+	}
+	t, ok := admit(w, r)
+	if !ok {
+		return
+	}
+
+	received := time.Now()
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid multipart body: %v", err))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	// Reading the body is the download of an upload.
+	parsed := time.Now()
+
+	images := r.MultipartForm.File["images"]
+	if len(images) == 0 {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid multipart body: no images uploaded"))
+		return
+	}
+
+	j := newJob()
+	for _, img := range images {
+		j.Uploads = append(j.Uploads, img.Filename)
+	}
+	j.Model = r.FormValue("model")
+	j.DryRun = r.FormValue("dry_run") == "true"
+	j.Crops = r.FormValue("crops") == "true"
+	j.Tags = r.MultipartForm.Value["tag"]
+	for k, vs := range r.MultipartForm.Value {
+		if strings.HasPrefix(k, "meta.") && len(vs) > 0 {
+			if j.Metadata == nil {
+				j.Metadata = make(map[string]string)
+			}
+			j.Metadata[strings.TrimPrefix(k, "meta.")] = vs[0]
+		}
+	}
+	if err := validateLabels(j.Metadata, j.Tags); err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	if v := r.FormValue("render"); v != "" {
+		if err := json.Unmarshal([]byte(v), &j.Render); err != nil {
+			jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid render %q: %v", v, err))
+			return
+		}
+		if err := validateRender(j.Render); err != nil {
+			jsonError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	j.Retain = r.FormValue("retain")
+	if err := validateRetention(j.Retain); err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	j.CallbackURL = r.FormValue("callback_url")
+	if err := validateCallback(t, j.CallbackURL); err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	if v := r.FormValue("threshold"); v != "" {
+		threshold, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid threshold %q: %v", v, err))
+			return
+		}
+		j.Threshold = threshold
+	}
+	var classThresholds map[string]float64
+	if v := r.FormValue("class_thresholds"); v != "" {
+		var err error
+		classThresholds, err = parseClassThresholds(v)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid class_thresholds %q: %v", v, err))
+			return
+		}
+	}
+	j.ClassThresholds = mergeClassThresholds(classThresholds)
+	var filters *outputFilters
+	if v := r.FormValue("filters"); v != "" {
+		if err := json.Unmarshal([]byte(v), &filters); err != nil {
+			jsonError(w, http.StatusBadRequest, fmt.Errorf("invalid filters %q: %v", v, err))
+			return
+		}
+		if err := validateFilters(filters); err != nil {
+			jsonError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	j.Filters = mergeFilters(filters)
+	if v := r.FormValue("report"); v != "" {
+		if err := validateReport(v); err != nil {
+			jsonError(w, http.StatusBadRequest, err)
+			return
+		}
+		j.Report = v
+	}
+	j.Heatmap = r.FormValue("heatmap")
+	if err := validateHeatmap(j.Heatmap); err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	j.IncludeImages = r.FormValue("include_images")
+	if err := validateIncludeImages(r, j.IncludeImages); err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := checkMaintenance(); err != nil {
+		jsonError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err := darkflowQueue.check(); err != nil {
+		jsonError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err := t.reserveImages(len(images)); err != nil {
+		jsonError(w, http.StatusTooManyRequests, err)
+		return
+	}
+
+	log.Printf("Got upload of %d images from tenant %q", len(images), t.Name)
+	j.addTiming(stageValidation, time.Since(parsed))
+	j.addTiming(stageDownload, parsed.Sub(received))
+	if err := createJob(t, j); err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("X-Job-Id", j.ID)
+	setOutputToken(w, t, j)
+
+	input := j.inputPath(t)
+	err := os.MkdirAll(input, 0755)
+	if err != nil {
+		err = fmt.Errorf("could not create input dir: %v", err)
+		finishJob(t, j, err)
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var details []errorDetail
+	saving := time.Now()
+	j.InputChecksums = make([]string, len(images))
+	if inputMetadata {
+		j.InputMetadata = make([]*imageMetadata, len(images))
+	}
+	for i, img := range images {
+		file := filepath.Join(input, fmt.Sprintf("%d.jpg", i))
+		var err error
+		j.InputChecksums[i], err = saveUpload(img, file)
+		if err == nil {
+			if inputMetadata {
+				j.InputMetadata[i] = stagedMetadata(file)
+			}
+			err = preprocessInput(file)
+		}
+		if err != nil {
+			code, _ := errorCode(err, 0)
+			details = append(details, errorDetail{Index: i, Input: img.Filename, Code: code, Message: err.Error()})
+			os.Remove(file)
+		}
+	}
+	j.addTiming(stageDownload, time.Since(saving))
+	if err := stagingError(details, len(images)); err != nil && !partialStaging(r.Context(), r, j, err) {
+		finishJob(t, j, err)
+		jsonError(w, stagingStatus(err), err)
+		return
+	}
+
+	if overSyncImages(len(images)) || overSyncBytes(uploadedBytes(images)) {
+		respondAsync(w, r, t, j, func(ctx context.Context) (int, error) {
+			return processJob(ctx, t, j)
+		})
+		return
+	}
+
+	ctx, cancel := jobContext(r, t, j.ID)
+	defer cancel()
+	respondRecognized(ctx, w, r, t, j)
+}
+
+// uploadedBytes is the size of the uploaded images.
+func uploadedBytes(images []*multipart.FileHeader) int64 {
+	var size int64
+	for _, img := range images {
+		size += img.Size
+	}
+	return size
+}
+
+// saveUpload writes the uploaded image to the file to and returns the
+// SHA-256 checksum of its content.
+func saveUpload(fh *multipart.FileHeader, to string) (string, error) {
+	src, err := fh.Open()
+	if err != nil {
+		return "", fmt.Errorf("could not open uploaded image %s: %v", fh.Filename, err)
+	}
+	defer src.Close()
+
+	file, err := os.Create(to)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return copyChecksummed(file, src)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// usageWindow is how far back GET /stats counts, in usageBuckets of an
+// hour each.
+const (
+	usageWindow  = 24 * time.Hour
+	usageBuckets = 24
+	topErrors    = 5
+)
+
+// usageBucket counts the jobs that finished within one hour.
+type usageBucket struct {
+	hour    int64
+	jobs    int
+	failed  int
+	images  int
+	latency float64
+	codes   map[string]int
+}
+
+// usageCounters keep rolling counts of finished jobs across all tenants, for
+// GET /stats.
+type usageCounters struct {
+	mu      sync.Mutex
+	buckets [usageBuckets]usageBucket
+}
+
+var usage = &usageCounters{}
+
+// usageStats is the body of GET /stats. It holds no tenant, job or input
+// names.
+type usageStats struct {
+	Window string `json:"window"`
+	Jobs   int    `json:"jobs"`
+	// Images counts the inputs of jobs that did not fail, without those
+	// skipped by /v2 jobs.
+	Images      int     `json:"images"`
+	Failed      int     `json:"failed"`
+	FailureRate float64 `json:"failure_rate"`
+	// AverageLatencySeconds is the mean time from submission to the end of
+	// a job.
+	AverageLatencySeconds float64      `json:"average_latency_seconds"`
+	TopErrorCodes         []errorCount `json:"top_error_codes"`
+}
+
+type errorCount struct {
+	Code  string `json:"code"`
+	Count int    `json:"count"`
+}
+
+// observe counts finished job j.
+func (u *usageCounters) observe(j *job) {
+	if j.FinishedAt == nil {
+		return
+	}
+	hour := j.FinishedAt.Unix() / 3600
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	b := &u.buckets[hour%usageBuckets]
+	if b.hour != hour {
+		if b.hour > hour {
+			// Older than the window.
+			return
+		}
+		*b = usageBucket{hour: hour, codes: make(map[string]int)}
+	}
+	b.jobs++
+	b.latency += j.FinishedAt.Sub(j.CreatedAt).Seconds()
+	if j.Status == jobFailed {
+		b.failed++
+		code := j.ErrorCode
+		if code == "" {
+			code = codeInternal
+		}
+		b.codes[code]++
+		return
+	}
+	b.images += j.imageCount() - len(j.Skipped)
+}
+
+// stats sums the buckets of the last usageWindow as of now.
+func (u *usageCounters) stats(now time.Time) usageStats {
+	s := usageStats{Window: "24h", TopErrorCodes: []errorCount{}}
+	latency := 0.0
+	codes := make(map[string]int)
+	hour := now.Unix() / 3600
+	u.mu.Lock()
+	for _, b := range u.buckets {
+		if b.hour <= hour-usageBuckets || b.hour > hour {
+			continue
+		}
+		s.Jobs += b.jobs
+		s.Failed += b.failed
+		s.Images += b.images
+		latency += b.latency
+		for code, n := range b.codes {
+			codes[code] += n
+		}
+	}
+	u.mu.Unlock()
+	if s.Jobs > 0 {
+		s.FailureRate = float64(s.Failed) / float64(s.Jobs)
+		s.AverageLatencySeconds = latency / float64(s.Jobs)
+	}
+	for code, n := range codes {
+		s.TopErrorCodes = append(s.TopErrorCodes, errorCount{Code: code, Count: n})
+	}
+	sort.Slice(s.TopErrorCodes, func(a, b int) bool {
+		if s.TopErrorCodes[a].Count != s.TopErrorCodes[b].Count {
+			return s.TopErrorCodes[a].Count > s.TopErrorCodes[b].Count
+		}
+		return s.TopErrorCodes[a].Code < s.TopErrorCodes[b].Code
+	})
+	if len(s.TopErrorCodes) > topErrors {
+		s.TopErrorCodes = s.TopErrorCodes[:topErrors]
+	}
+	return s
+}
+
+// seedUsage counts the jobs recorded as finished within the window, so that
+// a restart does not zero the dashboards.
+func seedUsage() {
+	since := time.Now().Add(-usageWindow)
+	seeded := 0
+	for _, t := range allTenants() {
+		list, err := listJobs(t)
+		if err != nil {
+			log.Printf("Could not list jobs of tenant %q to seed usage statistics: %v", t.Name, err)
+			continue
+		}
+		for _, j := range list {
+			if j.FinishedAt == nil || j.FinishedAt.Before(since) {
+				continue
+			}
+			usage.observe(j)
+			seeded++
+		}
+	}
+	if seeded > 0 {
+		log.Printf("Seeded usage statistics from %d finished jobs", seeded)
+	}
+}
+
+// statsHandler serves GET /stats, usage counters across all tenants for
+// dashboards that have no metrics stack to scrape /admin/metrics.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		setupResponse(w)
+		return
+	}
+	if _, ok := admit(w, r); !ok {
+		return
+	}
+	if r.Method != http.MethodGet {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+		return
+	}
+	jsonResponse(w, http.StatusOK, usage.stats(time.Now()))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// strictOutputs fails jobs whose darkflow results do not pass verification
+// instead of only reporting the discrepancies.
+var strictOutputs bool
+
+// Codes of the discrepancies found by verifyOutputs.
+const (
+	codeMissingOutput     = "MISSING_OUTPUT"
+	codeEmptyOutput       = "EMPTY_OUTPUT"
+	codeInvalidOutput     = "INVALID_OUTPUT"
+	codeInvalidAnnotation = "INVALID_ANNOTATION"
+	codeUnexpectedOutput  = "UNEXPECTED_OUTPUT"
+)
+
+// verifyOutputs checks the files darkflow wrote to dir for the n inputs
+// named by name: every input must have produced at least one file, files
+// must not be empty, images must decode and annotations must parse. Files
+// not belonging to any input are reported with index -1.
+func verifyOutputs(dir string, n int, name func(int) string) ([]errorDetail, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read output dir: %v", err)
+	}
+
+	var found []errorDetail
+	report := func(index int, code, format string, args ...interface{}) {
+		d := errorDetail{Index: index, Code: code, Message: fmt.Sprintf(format, args...)}
+		if index >= 0 {
+			d.Input = name(index)
+		}
+		found = append(found, d)
+	}
+
+	produced := make([]bool, n)
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(f.Name()))
+		index, err := strconv.Atoi(strings.TrimSuffix(f.Name(), filepath.Ext(f.Name())))
+		if err != nil || index < 0 || index >= n {
+			report(-1, codeUnexpectedOutput, "%s does not belong to any input", f.Name())
+			continue
+		}
+		produced[index] = true
+
+		file := filepath.Join(dir, f.Name())
+		switch {
+		case f.Size() == 0:
+			report(index, codeEmptyOutput, "%s is empty", f.Name())
+		case ext == ".json":
+			if _, err := readDetections(file); err != nil {
+				report(index, codeInvalidAnnotation, "%v", err)
+			}
+		case ext == ".jpg" || ext == ".jpeg" || ext == ".png" || ext == ".gif":
+			if err := checkDecodable(file); err != nil {
+				report(index, codeInvalidOutput, "%s is not a valid image: %v", f.Name(), err)
+			}
+		}
+	}
+	for i, ok := range produced {
+		if !ok {
+			report(i, codeMissingOutput, "darkflow produced no output for input %d", i)
+		}
+	}
+	return found, nil
+}
+
+func checkDecodable(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, _, err = image.DecodeConfig(f)
+	return err
+}
+
+// discrepancyError turns the discrepancies of a result into a job failure
+// for -strict-outputs.
+func discrepancyError(found []errorDetail) error {
+	if !strictOutputs || len(found) == 0 {
+		return nil
+	}
+	err := fmt.Errorf("darkflow results failed verification: %s", found[0].Message)
+	return withCode(codeBackendError, err, found...)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+var darkflowVersionPath string
+var darkflowProtocols string
+var versionTTL time.Duration
+
+// legacyVersion is assumed for backends without a version endpoint: they
+// speak the request format darkflowRequest encodes.
+const legacyVersion = "1"
+
+// protocolTemplates map darkflow major versions to the request templates of
+// their protocol, from -darkflow-protocols.
+var protocolTemplates map[string]*template.Template
+
+// backendInfo is what a darkflow version endpoint reports.
+type backendInfo struct {
+	Version string `json:"version"`
+}
+
+// versions caches the version each backend reported.
+var versions = &versionCache{backends: make(map[string]versionEntry)}
+
+type versionCache struct {
+	mu       sync.Mutex
+	backends map[string]versionEntry
+}
+
+type versionEntry struct {
+	version string
+	at      time.Time
+}
+
+// loadProtocols parses -darkflow-protocols, a comma separated list of
+// <major version>=<template file>.
+func loadProtocols() error {
+	protocolTemplates = make(map[string]*template.Template)
+	for _, entry := range strings.Split(darkflowProtocols, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.Index(entry, "=")
+		if i <= 0 {
+			return fmt.Errorf("invalid -darkflow-protocols entry %q, want <major version>=<template file>", entry)
+		}
+		t, err := parseRequestTemplate(entry[i+1:])
+		if err != nil {
+			return fmt.Errorf("-darkflow-protocols version %s: %v", entry[:i], err)
+		}
+		protocolTemplates[majorVersion(entry[:i])] = t
+	}
+	return nil
+}
+
+// majorVersion returns the major part of v, e.g. "2" of "v2.3.1".
+func majorVersion(v string) string {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, ".-+"); i >= 0 {
+		v = v[:i]
+	}
+	return v
+}
+
+// requestTemplateFor returns the template requests to backend are rendered
+// from: the one of the protocol version it speaks, or
+// -darkflow-request-template for versions without one of their own.
+func requestTemplateFor(backend string) *template.Template {
+	if darkflowVersionPath == "" {
+		return requestTemplate
+	}
+	if t, ok := protocolTemplates[majorVersion(versions.get(backend))]; ok {
+		return t
+	}
+	return requestTemplate
+}
+
+// get returns the version of backend, asking it again once the cached
+// answer is older than -darkflow-version-ttl so that backends upgraded in
+// place during a rollout are noticed. Backends that cannot be asked keep
+// the version they reported last, or are assumed to speak the legacy
+// protocol, until they are asked again after another TTL, so that calls to
+// an unreachable backend do not each wait on its version endpoint first.
+func (c *versionCache) get(backend string) string {
+	c.mu.Lock()
+	e, ok := c.backends[backend]
+	c.mu.Unlock()
+	if ok && time.Since(e.at) < versionTTL {
+		return e.version
+	}
+	v, err := fetchVersion(backend)
+	if err != nil {
+		log.Printf("Could not get version of darkflow at %s: %v", backend, err)
+		if !ok {
+			e.version = legacyVersion
+		}
+		c.mu.Lock()
+		c.backends[backend] = versionEntry{version: e.version, at: time.Now()}
+		c.mu.Unlock()
+		return e.version
+	}
+	if !ok || v != e.version {
+		c.report(backend, v)
+	}
+	c.mu.Lock()
+	c.backends[backend] = versionEntry{version: v, at: time.Now()}
+	c.mu.Unlock()
+	return v
+}
+
+// forget drops the cached version of backend, for instance after it
+// rejected a request, so the next call negotiates again.
+func (c *versionCache) forget(backend string) {
+	c.mu.Lock()
+	delete(c.backends, backend)
+	c.mu.Unlock()
+}
+
+func (c *versionCache) report(backend, v string) {
+	major := majorVersion(v)
+	_, known := protocolTemplates[major]
+	if !known && major != legacyVersion {
+		log.Printf("Darkflow at %s speaks version %s, which has no -darkflow-protocols template; using the default request format", backend, v)
+		return
+	}
+	log.Printf("Darkflow at %s speaks version %s", backend, v)
+}
+
+// negotiateVersions asks every backend for its version, logging what each
+// speaks.
+func negotiateVersions() {
+	if darkflowVersionPath == "" {
+		return
+	}
+	for _, backend := range backends.list() {
+		versions.get(backend)
+	}
+}
+
+// fetchVersion asks backend for its version at -darkflow-version-path. A
+// backend that does not serve the endpoint, or whose answer has no version,
+// is a legacy one.
+func fetchVersion(backend string) (string, error) {
+	u, err := url.Parse(backend)
+	if err != nil {
+		return "", err
+	}
+	u.Path = darkflowVersionPath
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	setDarkflowAuth(req)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := darkflowClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed:
+		return legacyVersion, nil
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("got %s", resp.Status)
+	}
+	var info backendInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil || info.Version == "" {
+		return legacyVersion, nil
+	}
+	return info.Version, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var webhookSecret string
+var webhookTimeout time.Duration
+
+// Headers of signed webhook callbacks.
+const (
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookNonceHeader     = "X-Webhook-Nonce"
+)
+
+// webhookAttempts is how many times a callback is tried before it is given
+// up.
+const webhookAttempts = 3
+
+// callbacks tracks the deliveries in progress, so that a stopping process
+// waits for them.
+var callbacks = &callbackTracker{pending: make(map[string]int)}
+
+// callbackTracker counts the deliveries in progress by job ID.
+type callbackTracker struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	pending map[string]int
+}
+
+func (c *callbackTracker) add(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending[id]++
+	c.wg.Add(1)
+}
+
+func (c *callbackTracker) done(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending[id]--; c.pending[id] == 0 {
+		delete(c.pending, id)
+	}
+	c.wg.Done()
+}
+
+// wait waits for the deliveries in progress until ctx is done, and returns
+// the IDs of the jobs whose callbacks are still pending then.
+func (c *callbackTracker) wait(ctx context.Context) []string {
+	finished := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]string, 0, len(c.pending))
+	for id := range c.pending {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// webhookClient delivers callbacks. It dials like insecureClient, subject to
+// the URL policy, but verifies certificates and does not follow redirects,
+// which would send the signed payload elsewhere.
+var webhookClient *http.Client
+
+// setupWebhooks builds webhookClient from insecureClient.
+func setupWebhooks() error {
+	base, ok := insecureClient.Transport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("could not set up webhook client: unexpected fetch transport %T", insecureClient.Transport)
+	}
+	tr := base.Clone()
+	tr.TLSClientConfig = nil
+	webhookClient = &http.Client{
+		Transport: tr,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return nil
+}
+
+// webhookSecretOf is the key the callbacks of tenant t are signed with: its
+// webhook_secret, or -webhook-secret.
+func webhookSecretOf(t *tenant) string {
+	if t.WebhookSecret != "" {
+		return t.WebhookSecret
+	}
+	return webhookSecret
+}
+
+// validateCallback checks the callback_url raw of a request of tenant t.
+// Callbacks are always signed, so one needs a secret to be accepted.
+func validateCallback(t *tenant, raw string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid callback_url %q, want an http(s) URL", raw)
+	}
+	if webhookSecretOf(t) == "" {
+		return fmt.Errorf("callback_url needs a webhook secret, which is not configured")
+	}
+	return checkURL(raw)
+}
+
+// deliverCallback POSTs the record of finished job j to its callback_url in
+// the background, signed with the webhook secret of t. Failures are logged,
+// and drain waits for the delivery.
+func deliverCallback(t *tenant, j *job) {
+	if j.CallbackURL == "" {
+		return
+	}
+	body, err := json.Marshal(j)
+	if err != nil {
+		log.Printf("Could not encode job %s for its callback: %v", j.ID, err)
+		return
+	}
+	secret := []byte(webhookSecretOf(t))
+	callbacks.add(j.ID)
+	go func() {
+		defer callbacks.done(j.ID)
+		var err error
+		for attempt := 1; attempt <= webhookAttempts; attempt++ {
+			if err = postCallback(j.CallbackURL, secret, body); err == nil {
+				log.Printf("Delivered the callback of job %s", j.ID)
+				return
+			}
+			if attempt < webhookAttempts {
+				time.Sleep(time.Duration(attempt) * 10 * time.Second)
+			}
+		}
+		log.Printf("Could not deliver the callback of job %s: %v", j.ID, err)
+	}()
+}
+
+// postCallback sends one signed delivery of body to raw. Every attempt has
+// its own timestamp and nonce; receivers should reject timestamps more than
+// 5 minutes off and nonces they have seen within that window. The signature
+// is
+//
+//	hex HMAC-SHA256(<method>\n<request URI>\n<timestamp>\n<nonce>\n<body hash>)
+func postCallback(raw string, secret, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, raw, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return fmt.Errorf("could not generate signature nonce: %v", err)
+	}
+	nonce := hex.EncodeToString(random)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookTimestampHeader, ts)
+	req.Header.Set(webhookNonceHeader, nonce)
+	req.Header.Set(webhookSignatureHeader, hmacSignature(secret, body, req.Method, req.URL.RequestURI(), ts, nonce))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("got %s", resp.Status)
+	}
+	return nil
+}
+
+// hmacSignature returns the hex HMAC-SHA256, keyed with secret, of fields and
+// the hex SHA-256 of body, one per line.
+func hmacSignature(secret, body []byte, fields ...string) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	for _, f := range fields {
+		fmt.Fprintf(mac, "%s\n", f)
+	}
+	mac.Write([]byte(hex.EncodeToString(sum[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
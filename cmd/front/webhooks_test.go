@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sashayakovtseva/darkflow-front/pkg/client"
+)
+
+func TestValidateCallback(t *testing.T) {
+	defer func(s string) { webhookSecret = s }(webhookSecret)
+	tt := []struct {
+		name         string
+		raw          string
+		secret       string
+		tenantSecret string
+		wantErr      bool
+	}{
+		{name: "none"},
+		{name: "https", raw: "https://example.com/hook", secret: "s"},
+		{name: "http", raw: "http://example.com/hook?job=1", secret: "s"},
+		{name: "tenant secret", raw: "https://example.com/hook", tenantSecret: "s"},
+		{name: "no secret", raw: "https://example.com/hook", wantErr: true},
+		{name: "ftp", raw: "ftp://example.com/hook", secret: "s", wantErr: true},
+		{name: "file", raw: "file:///etc/passwd", secret: "s", wantErr: true},
+		{name: "no host", raw: "https:///hook", secret: "s", wantErr: true},
+		{name: "relative", raw: "/hook", secret: "s", wantErr: true},
+		{name: "unparsable", raw: "https://exa mple.com/%zz", secret: "s", wantErr: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			webhookSecret = tc.secret
+			if err := validateCallback(&tenant{WebhookSecret: tc.tenantSecret}, tc.raw); (err != nil) != tc.wantErr {
+				t.Errorf("validateCallback(%q) error = %v, wantErr %v", tc.raw, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestPostCallback(t *testing.T) {
+	defer func(c, wc *http.Client, d time.Duration) {
+		insecureClient, webhookClient, webhookTimeout = c, wc, d
+	}(insecureClient, webhookClient, webhookTimeout)
+	insecureClient = &http.Client{Transport: &http.Transport{}}
+	webhookTimeout = 5 * time.Second
+	if err := setupWebhooks(); err != nil {
+		t.Fatal(err)
+	}
+	tt := []struct {
+		name      string
+		secret    string
+		status    int
+		wantErr   bool
+		wantValid bool
+	}{
+		{name: "delivered", secret: "s3cret", status: http.StatusNoContent, wantValid: true},
+		{name: "other secret", secret: "other", status: http.StatusNoContent},
+		{name: "rejected", secret: "s3cret", status: http.StatusInternalServerError, wantErr: true, wantValid: true},
+		{name: "redirected", secret: "s3cret", status: http.StatusFound, wantErr: true, wantValid: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var got *client.Job
+			var verr error
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, verr = client.VerifyCallback(r, "s3cret")
+				if tc.status == http.StatusFound {
+					w.Header().Set("Location", "/elsewhere")
+				}
+				w.WriteHeader(tc.status)
+			}))
+			defer srv.Close()
+			err := postCallback(srv.URL+"/hook?job=j1", []byte(tc.secret), []byte(`{"id":"j1","status":"done"}`))
+			if (err != nil) != tc.wantErr {
+				t.Errorf("postCallback() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if (verr == nil) != tc.wantValid {
+				t.Fatalf("VerifyCallback() error = %v, want valid %v", verr, tc.wantValid)
+			}
+			if verr == nil && (got.ID != "j1" || got.Status != "done") {
+				t.Errorf("VerifyCallback() = %+v, want job j1 done", got)
+			}
+		})
+	}
+}
+
+func TestVerifyCallbackStale(t *testing.T) {
+	body := []byte(`{"id":"j1"}`)
+	for _, age := range []time.Duration{client.CallbackMaxSkew + time.Minute, -client.CallbackMaxSkew - time.Minute} {
+		ts := strconv.FormatInt(time.Now().Add(-age).Unix(), 10)
+		req := httptest.NewRequest(http.MethodPost, "/hook", bytes.NewReader(body))
+		req.Header.Set(webhookTimestampHeader, ts)
+		req.Header.Set(webhookNonceHeader, "n")
+		req.Header.Set(webhookSignatureHeader, hmacSignature([]byte("s3cret"), body, req.Method, req.URL.RequestURI(), ts, "n"))
+		if _, err := client.VerifyCallback(req, "s3cret"); err == nil {
+			t.Errorf("VerifyCallback() of a callback %v old succeeded", age)
+		}
+	}
+}
+
+func TestCallbackTrackerWait(t *testing.T) {
+	c := &callbackTracker{pending: make(map[string]int)}
+	if ids := c.wait(context.Background()); ids != nil {
+		t.Errorf("wait() with nothing pending = %v", ids)
+	}
+	c.add("b")
+	c.add("a")
+	c.add("a")
+	c.done("a")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if ids := c.wait(ctx); !reflect.DeepEqual(ids, []string{"a", "b"}) {
+		t.Errorf("wait() = %v, want [a b] abandoned", ids)
+	}
+	c.done("a")
+	c.done("b")
+	if ids := c.wait(context.Background()); ids != nil {
+		t.Errorf("wait() after all were done = %v", ids)
+	}
+}
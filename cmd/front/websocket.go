@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes, RFC 6455 section 5.2.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// wsAcceptGUID is appended to the key of a handshake to compute the accept
+// header the server must answer with.
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsMaxMessage bounds the messages read from darkflow.
+const wsMaxMessage = 64 << 20
+
+// errWSClosed is returned once the server closed the connection.
+var errWSClosed = errors.New("websocket closed by darkflow")
+
+// wsConn is the client end of a WebSocket connection. Messages may be
+// written and read concurrently; writes are serialized.
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	wmu  sync.Mutex
+}
+
+// dialWebSocket opens a WebSocket to the http(s) URL target, sending the
+// darkflow credentials with the handshake.
+func dialWebSocket(ctx context.Context, target string, tlsConfig *tls.Config) (*wsConn, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "https" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "https" {
+		cfg := tlsConfig.Clone()
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		tc := tls.Client(conn, cfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	ws, err := wsHandshake(ctx, conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+func wsHandshake(ctx context.Context, conn net.Conn, u *url.URL) (*wsConn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	setDarkflowAuth(req)
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("darkflow refused the websocket: %s", resp.Status)
+	}
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, fmt.Errorf("darkflow answered the websocket handshake with a wrong accept key")
+	}
+	return &wsConn{conn: conn, r: r}, nil
+}
+
+// writeMessage sends payload as one masked frame of opcode.
+func (c *wsConn) writeMessage(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.writeFrameLocked(opcode, payload)
+}
+
+// writeFrameLocked is writeMessage for callers holding c.wmu, such as those
+// sending several messages in a row.
+func (c *wsConn) writeFrameLocked(opcode byte, payload []byte) error {
+	header := make([]byte, 0, 14)
+	header = append(header, 0x80|opcode)
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, 0x80|byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 0x80|126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 0x80|127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	var mask [4]byte
+	rand.Read(mask[:])
+	header = append(header, mask[:]...)
+	masked := make([]byte, len(payload))
+	for i, b := range payload {
+		masked[i] = b ^ mask[i%4]
+	}
+	if _, err := c.conn.Write(append(header, masked...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readMessage returns the next data message, answering pings on the way.
+func (c *wsConn) readMessage() (byte, []byte, error) {
+	var opcode byte
+	var message []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case wsPing:
+			if err := c.writeMessage(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.writeMessage(wsClose, payload)
+			return 0, nil, errWSClosed
+		case wsContinuation:
+			if opcode == 0 {
+				return 0, nil, fmt.Errorf("websocket continuation frame without a message")
+			}
+		default:
+			if opcode != 0 {
+				return 0, nil, fmt.Errorf("websocket message interrupted by another")
+			}
+			opcode = op
+		}
+		if len(message)+len(payload) > wsMaxMessage {
+			return 0, nil, fmt.Errorf("websocket message larger than %d bytes", wsMaxMessage)
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (bool, byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, op := head[0]&0x80 != 0, head[0]&0x0F
+	masked := head[1]&0x80 != 0
+	n := uint64(head[1] & 0x7F)
+	if head[0]&0x70 != 0 {
+		// No extension was negotiated that could use them.
+		return false, 0, nil, fmt.Errorf("websocket frame with reserved bits set")
+	}
+	switch op {
+	case wsContinuation, wsText, wsBinary:
+	case wsClose, wsPing, wsPong:
+		if !fin || n > 125 {
+			return false, 0, nil, fmt.Errorf("websocket control frame fragmented or longer than 125 bytes")
+		}
+	default:
+		return false, 0, nil, fmt.Errorf("websocket frame with unknown opcode %#x", op)
+	}
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > wsMaxMessage {
+		return false, 0, nil, fmt.Errorf("websocket frame larger than %d bytes", wsMaxMessage)
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, op, payload, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// recordConn is a connection reading from in and recording what is written
+// to it.
+type recordConn struct {
+	net.Conn
+	in  io.Reader
+	out bytes.Buffer
+}
+
+func (c *recordConn) Read(p []byte) (int, error)  { return c.in.Read(p) }
+func (c *recordConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+
+func newTestWSConn(in []byte) (*wsConn, *recordConn) {
+	rc := &recordConn{in: bytes.NewReader(in)}
+	return &wsConn{conn: rc, r: bufio.NewReader(rc)}, rc
+}
+
+// wsFrame encodes an unmasked server frame, or a masked one with mask.
+func wsFrame(fin bool, opcode byte, payload []byte, mask []byte) []byte {
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	b := []byte{b0}
+	var m byte
+	if mask != nil {
+		m = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, m|byte(n))
+	case n <= 0xFFFF:
+		b = binary.BigEndian.AppendUint16(append(b, m|126), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint64(append(b, m|127), uint64(n))
+	}
+	if mask == nil {
+		return append(b, payload...)
+	}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+func concat(frames ...[]byte) []byte {
+	return bytes.Join(frames, nil)
+}
+
+func TestWSReadMessage(t *testing.T) {
+	long := bytes.Repeat([]byte("x"), 300)
+	tt := []struct {
+		name    string
+		in      []byte
+		opcode  byte
+		want    []byte
+		wantErr bool
+		closed  bool
+	}{
+		{name: "text", in: wsFrame(true, wsText, []byte("hi"), nil), opcode: wsText, want: []byte("hi")},
+		{name: "empty binary", in: wsFrame(true, wsBinary, nil, nil), opcode: wsBinary, want: []byte{}},
+		{name: "16 bit length", in: wsFrame(true, wsBinary, long, nil), opcode: wsBinary, want: long},
+		{name: "masked", in: wsFrame(true, wsText, []byte("hello"), []byte{1, 2, 3, 4}), opcode: wsText, want: []byte("hello")},
+		{
+			name:   "fragmented",
+			in:     concat(wsFrame(false, wsText, []byte("he"), nil), wsFrame(false, wsContinuation, []byte("ll"), nil), wsFrame(true, wsContinuation, []byte("o"), nil)),
+			opcode: wsText, want: []byte("hello"),
+		},
+		{
+			name:   "ping between fragments",
+			in:     concat(wsFrame(false, wsText, []byte("he"), nil), wsFrame(true, wsPing, []byte("p"), nil), wsFrame(true, wsContinuation, []byte("llo"), nil)),
+			opcode: wsText, want: []byte("hello"),
+		},
+		{name: "pong skipped", in: concat(wsFrame(true, wsPong, nil, nil), wsFrame(true, wsText, []byte("a"), nil)), opcode: wsText, want: []byte("a")},
+		{name: "close", in: wsFrame(true, wsClose, []byte{0x03, 0xE8}, nil), wantErr: true, closed: true},
+		{name: "empty", wantErr: true},
+		{name: "truncated header", in: []byte{0x81}, wantErr: true},
+		{name: "truncated 16 bit length", in: []byte{0x82, 126, 0x01}, wantErr: true},
+		{name: "truncated 64 bit length", in: []byte{0x82, 127, 0, 0, 0}, wantErr: true},
+		{name: "truncated mask", in: []byte{0x81, 0x82, 1, 2}, wantErr: true},
+		{name: "truncated payload", in: wsFrame(true, wsText, []byte("hello"), nil)[:4], wantErr: true},
+		{name: "frame too large", in: binary.BigEndian.AppendUint64([]byte{0x82, 127}, wsMaxMessage+1), wantErr: true},
+		{name: "huge 64 bit length", in: binary.BigEndian.AppendUint64([]byte{0x82, 127}, 1<<63), wantErr: true},
+		{name: "continuation first", in: wsFrame(true, wsContinuation, []byte("x"), nil), wantErr: true},
+		{
+			name:    "message interrupted",
+			in:      concat(wsFrame(false, wsText, []byte("a"), nil), wsFrame(true, wsBinary, []byte("b"), nil)),
+			wantErr: true,
+		},
+		{name: "reserved bits", in: []byte{0xC1, 0x01, 'a'}, wantErr: true},
+		{name: "unknown opcode", in: wsFrame(true, 0x3, []byte("a"), nil), wantErr: true},
+		{name: "unknown control opcode", in: wsFrame(true, 0xB, nil, nil), wantErr: true},
+		{name: "fragmented ping", in: wsFrame(false, wsPing, []byte("p"), nil), wantErr: true},
+		{name: "long ping", in: wsFrame(true, wsPing, long[:126], nil), wantErr: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			c, _ := newTestWSConn(tc.in)
+			opcode, got, err := c.readMessage()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("readMessage() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if tc.closed != errors.Is(err, errWSClosed) {
+				t.Errorf("readMessage() error = %v, closed %v", err, tc.closed)
+			}
+			if err != nil {
+				return
+			}
+			if opcode != tc.opcode || !bytes.Equal(got, tc.want) {
+				t.Errorf("readMessage() = %#x %q, want %#x %q", opcode, got, tc.opcode, tc.want)
+			}
+		})
+	}
+}
+
+func TestWSMessageTooLarge(t *testing.T) {
+	half := bytes.Repeat([]byte("x"), wsMaxMessage/2+1)
+	c, _ := newTestWSConn(concat(wsFrame(false, wsBinary, half, nil), wsFrame(true, wsContinuation, half, nil)))
+	if _, _, err := c.readMessage(); err == nil {
+		t.Fatal("readMessage() of a message over wsMaxMessage succeeded")
+	}
+}
+
+func TestWSPingAnswered(t *testing.T) {
+	c, rc := newTestWSConn(concat(wsFrame(true, wsPing, []byte("abc"), nil), wsFrame(true, wsText, []byte("a"), nil)))
+	if _, _, err := c.readMessage(); err != nil {
+		t.Fatal(err)
+	}
+	pong, _ := newTestWSConn(rc.out.Bytes())
+	fin, op, payload, err := pong.readFrame()
+	if err != nil || !fin || op != wsPong || string(payload) != "abc" {
+		t.Errorf("answered ping with %v %#x %q %v, want a pong of %q", fin, op, payload, err, "abc")
+	}
+}
+
+func TestWSWriteMessage(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		payload := bytes.Repeat([]byte{0xA5}, n)
+		c, rc := newTestWSConn(nil)
+		if err := c.writeMessage(wsBinary, payload); err != nil {
+			t.Fatal(err)
+		}
+		out := rc.out.Bytes()
+		if out[1]&0x80 == 0 {
+			t.Errorf("frame of %d bytes is not masked", n)
+		}
+		back, _ := newTestWSConn(out)
+		fin, op, got, err := back.readFrame()
+		if err != nil || !fin || op != wsBinary || !bytes.Equal(got, payload) {
+			t.Errorf("frame of %d bytes reads back as %v %#x %d bytes %v", n, fin, op, len(got), err)
+		}
+	}
+}
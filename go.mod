@@ -0,0 +1,3 @@
+module github.com/sashayakovtseva/darkflow-front
+
+go 1.24
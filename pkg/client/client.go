@@ -0,0 +1,1314 @@
+// Package client is a Go client for the darkflow-front HTTP API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to a single darkflow-front instance.
+type Client struct {
+	// BaseURL is the address of the instance, e.g. http://front:8080.
+	BaseURL string
+	// APIKey is sent as X-API-Key when non-empty.
+	APIKey string
+	// HTTPClient is used for all requests; http.DefaultClient when nil.
+	HTTPClient *http.Client
+	// Language is sent as Accept-Language when non-empty, e.g. "ru", for
+	// error messages in that language.
+	Language string
+}
+
+// New returns a client for the instance at baseURL authenticating with apiKey.
+func New(baseURL, apiKey string) *Client {
+	return &Client{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		APIKey:  apiKey,
+	}
+}
+
+// Options tune how darkflow processes a job. Zero values leave the choice
+// to the server.
+type Options struct {
+	Model     string  `json:"model,omitempty"`
+	Threshold float64 `json:"threshold,omitempty"`
+	// DryRun stages the inputs without calling darkflow; Result.Outputs then
+	// lists the staged input files.
+	DryRun bool `json:"dry_run,omitempty"`
+	// Crops additionally stores every detected box as crops/<label>/<index>_<n>.jpg.
+	Crops bool `json:"crops,omitempty"`
+	// Metadata and Tags are stored with the job and echoed in its record.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+	// Retain is how long the server keeps the job's data, e.g. "1h", "7d"
+	// or "forever"; empty uses the server default.
+	Retain string `json:"retain,omitempty"`
+	// Force makes Recognize process the images even if the server could
+	// replay an identical earlier request.
+	Force bool `json:"force,omitempty"`
+	// Checksums maps image URLs to the SHA-256 checksum, in hex, their
+	// content must have. Recognize fails with CodeChecksumMismatch
+	// otherwise.
+	Checksums map[string]string `json:"checksums,omitempty"`
+	// Render has the server draw the annotated images to these
+	// preferences instead of darkflow, or skip them.
+	Render *RenderOptions `json:"render,omitempty"`
+	// CallbackURL is POSTed the Job, signed, when the job finishes; see
+	// VerifyCallback.
+	CallbackURL string `json:"callback_url,omitempty"`
+	// ClassThresholds map classes to the minimum confidence of their
+	// detections, e.g. {"person": 0.8, "car": 0.4}, overriding Threshold
+	// and the server defaults.
+	ClassThresholds map[string]float64 `json:"class_thresholds,omitempty"`
+	// Filters drop noisy detections from darkflow's output, overriding the
+	// server defaults filter by filter.
+	Filters *Filters `json:"filters,omitempty"`
+	// Report adds a single file report of the job to its outputs, with
+	// the annotated images, their detections and the job's metadata:
+	// ReportPDF or ReportHTML.
+	Report string `json:"report,omitempty"`
+	// Heatmap adds heatmap.png to the outputs, showing where the
+	// detections of this class, or of all for HeatmapAll, concentrate
+	// across the images.
+	Heatmap string `json:"heatmap,omitempty"`
+	// IncludeImages IncludeInline embeds the small annotated images in
+	// ImageResult.Inline, saving a Download per image. It applies to
+	// RecognizeV2 and UploadAndRecognizeV2.
+	IncludeImages string `json:"include_images,omitempty"`
+	// Inline has the server return the output files in its response,
+	// filling Result.Files, saving a Download per output. It applies to
+	// Recognize and UploadAndRecognize.
+	Inline bool `json:"-"`
+}
+
+// Filters clean up darkflow's detections before they are returned. Zero
+// values leave the server default.
+type Filters struct {
+	// MinBoxArea drops the detections whose box is smaller, in pixels.
+	MinBoxArea float64 `json:"min_box_area,omitempty"`
+	// MaxDetections keeps only the most confident detections of each
+	// image.
+	MaxDetections int `json:"max_detections,omitempty"`
+	// NMSIoU drops the detections overlapping a more confident one of
+	// their class by more than this intersection over union.
+	NMSIoU float64 `json:"nms_iou,omitempty"`
+}
+
+// RenderOptions are preferences for the annotated images.
+type RenderOptions struct {
+	// Skip leaves only the .json outputs.
+	Skip bool `json:"skip,omitempty"`
+	// Colors maps class labels to box colors as #rrggbb.
+	Colors map[string]string `json:"colors,omitempty"`
+	// Thickness is the box line width in pixels; the server uses 2 when
+	// zero.
+	Thickness int `json:"thickness,omitempty"`
+	// Labels draws the class above each box unless false.
+	Labels *bool `json:"labels,omitempty"`
+	// Confidences adds the confidence to the labels.
+	Confidences bool `json:"confidences,omitempty"`
+	// Redact hides detections instead of boxing them.
+	Redact *RedactOptions `json:"redact,omitempty"`
+}
+
+// Redaction modes.
+const (
+	RedactBlur  = "blur"
+	RedactBlack = "black"
+)
+
+// RedactOptions choose the detections the annotated images hide, e.g. faces
+// or license plates.
+type RedactOptions struct {
+	// Classes are the labels to redact; empty redacts every detection.
+	Classes []string `json:"classes,omitempty"`
+	// Mode is RedactBlur, the server default, or RedactBlack.
+	Mode string `json:"mode,omitempty"`
+}
+
+// IncludeInline is the Options.IncludeImages embedding the images.
+const IncludeInline = "inline"
+
+// HeatmapAll is the Options.Heatmap aggregating every class.
+const HeatmapAll = "*"
+
+// Report formats.
+const (
+	ReportPDF  = "pdf"
+	ReportHTML = "html"
+)
+
+// Result is the outcome of a synchronous recognition.
+type Result struct {
+	// JobID identifies the job for later GetJob calls.
+	JobID string
+	// Replayed is set when the server answered with the results of an
+	// identical earlier request instead of processing the images again.
+	Replayed bool
+	// Discrepancies is the number of problems the server found in
+	// darkflow's results; GetJob has the details.
+	Discrepancies int
+	// OutputToken grants read access to the outputs of this job only, for
+	// a while; see SharedURL.
+	OutputToken string
+	// Outputs are the paths of the produced files, relative to BaseURL.
+	Outputs []string
+	// Files maps the entries of Outputs to their content when
+	// Options.Inline was set.
+	Files map[string][]byte
+}
+
+// Recognition is the outcome of a synchronous recognition through the v2
+// API.
+type Recognition struct {
+	JobID string `json:"job_id"`
+	// Status is StatusDone, or StatusPartial when some images failed and
+	// the job went on without them.
+	Status string        `json:"status"`
+	Images []ImageResult `json:"images"`
+	// OtherOutputs are outputs not tied to an image, such as files added
+	// by post hooks.
+	OtherOutputs  []string      `json:"other_outputs,omitempty"`
+	Discrepancies []ErrorDetail `json:"discrepancies,omitempty"`
+	// Errors lists the images that failed.
+	Errors    []ErrorDetail `json:"errors,omitempty"`
+	DryRun    bool          `json:"dry_run,omitempty"`
+	ExpiresAt *time.Time    `json:"expires_at,omitempty"`
+	// OutputToken is Result.OutputToken.
+	OutputToken string `json:"-"`
+	// Warnings are the non-fatal issues the server met, such as JPEGs
+	// without Exif data or detections dropped by thresholds and filters,
+	// and the discrepancies of darkflow's results.
+	Warnings []ErrorDetail `json:"-"`
+}
+
+// ImageResult is the outcome of one input image of a Recognition.
+type ImageResult struct {
+	Index int    `json:"index"`
+	Input string `json:"input"`
+	// Status is StatusDone or StatusFailed.
+	Status     string       `json:"status"`
+	Outputs    []string     `json:"outputs"`
+	Detections []Detection  `json:"detections"`
+	Error      *ErrorDetail `json:"error,omitempty"`
+	// Staged is where a dry run left the image.
+	Staged   string         `json:"staged,omitempty"`
+	Metadata *ImageMetadata `json:"metadata,omitempty"`
+	// Inline holds the annotated images of the input when
+	// Options.IncludeImages asked for them and they are small enough.
+	Inline []InlineOutput `json:"inline,omitempty"`
+}
+
+// InlineOutput is an output file embedded in a response.
+type InlineOutput struct {
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
+}
+
+// ImageMetadata is what the server read from an input image before
+// recognition. Fields the image does not carry are empty.
+type ImageMetadata struct {
+	Format      string `json:"format,omitempty"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	Orientation int    `json:"orientation,omitempty"`
+	CameraMake  string `json:"camera_make,omitempty"`
+	CameraModel string `json:"camera_model,omitempty"`
+	// TakenAt is the Exif original time as YYYY-MM-DDTHH:MM:SS, followed
+	// by the UTC offset when the image has one.
+	TakenAt string       `json:"taken_at,omitempty"`
+	GPS     *GPSPosition `json:"gps,omitempty"`
+}
+
+// GPSPosition is a position in decimal degrees, with the altitude in meters.
+type GPSPosition struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}
+
+// Detection is a bounding box darkflow found.
+type Detection struct {
+	Label       string  `json:"label"`
+	Confidence  float64 `json:"confidence"`
+	TopLeft     Point   `json:"topleft"`
+	BottomRight Point   `json:"bottomright"`
+}
+
+// Point is a pixel position in an image.
+type Point struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// StatusPartial is the status of a Recognition that went on without some
+// of its images.
+const StatusPartial = "partial"
+
+// Job statuses.
+const (
+	StatusRunning   = "running"
+	StatusDone      = "done"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+// Job is the server-side record of a recognition run.
+type Job struct {
+	ID         string         `json:"id"`
+	Status     string         `json:"status"`
+	ImageURLs  []string       `json:"image_urls,omitempty"`
+	Uploads    []string       `json:"uploads,omitempty"`
+	Model      string         `json:"model,omitempty"`
+	Threshold  float64        `json:"threshold,omitempty"`
+	InputID    string         `json:"input_id,omitempty"`
+	Crops      bool           `json:"crops,omitempty"`
+	Render     *RenderOptions `json:"render,omitempty"`
+	DryRun     bool           `json:"dry_run,omitempty"`
+	Inputs     []string       `json:"inputs,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+	Outputs    []string       `json:"outputs,omitempty"`
+	Files      []OutputFile   `json:"files,omitempty"`
+	// Hooks holds the data reported by each post-processing hook.
+	Hooks     map[string]json.RawMessage `json:"hooks,omitempty"`
+	Error     string                     `json:"error,omitempty"`
+	ErrorCode string                     `json:"error_code,omitempty"`
+	// ErrorDetails lists the failed items of a job that failed on some
+	// of its images.
+	ErrorDetails []ErrorDetail `json:"error_details,omitempty"`
+	// Discrepancies lists problems the server found in darkflow's results.
+	Discrepancies []ErrorDetail `json:"discrepancies,omitempty"`
+	Retain        string        `json:"retain,omitempty"`
+	// ExpiresAt is when the server deletes the job's inputs and outputs;
+	// nil means never. DeletedAt is set once it did.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Checksums are the checksums the client expected; InputChecksums
+	// are the SHA-256 checksums of the inputs as received, in order.
+	Checksums      map[string]string `json:"checksums,omitempty"`
+	InputChecksums []string          `json:"input_checksums,omitempty"`
+	// InputMetadata is the metadata of the inputs, in order, nil for
+	// those that failed.
+	InputMetadata []*ImageMetadata `json:"input_metadata,omitempty"`
+	// Timings is how long the job spent in each stage of the pipeline.
+	Timings *JobTimings `json:"timings,omitempty"`
+	// Compare marks the jobs of /compare.
+	Compare bool `json:"compare,omitempty"`
+	// ResumedAt is set when the job was resumed after a restart of the
+	// frontend interrupted it.
+	ResumedAt *time.Time `json:"resumed_at,omitempty"`
+	// CallbackURL is where the job is POSTed when it finishes, if
+	// anywhere.
+	CallbackURL string `json:"callback_url,omitempty"`
+	// Skipped lists the inputs that failed to stage and that a job started
+	// through the v2 API went on without.
+	Skipped []ErrorDetail `json:"skipped,omitempty"`
+	// ClassThresholds are the class thresholds the job applied, the
+	// server defaults merged with the request's.
+	ClassThresholds map[string]float64 `json:"class_thresholds,omitempty"`
+	// Filters are the output filters the job applied, the server defaults
+	// merged with the request's.
+	Filters *Filters `json:"filters,omitempty"`
+	// Report is the format of the report the job asked for, if any.
+	Report string `json:"report,omitempty"`
+	// Heatmap is the class of the job's heatmap, if any.
+	Heatmap string `json:"heatmap,omitempty"`
+	// Environment is what the job last ran on.
+	Environment *Environment `json:"environment,omitempty"`
+	// Summary totals the detections of a finished job by class.
+	Summary *ResultSummary `json:"summary,omitempty"`
+	// QASampled is set when the job was sampled for quality review.
+	QASampled bool `json:"qa_sampled,omitempty"`
+	// Warnings are the non-fatal issues of the job's inputs, see
+	// Recognition.Warnings.
+	Warnings []ErrorDetail `json:"warnings,omitempty"`
+	// FailedStage is the stage a failed job failed in: download, backend
+	// or post_processing. Retries counts its retries, last at RetriedAt.
+	FailedStage string     `json:"failed_stage,omitempty"`
+	Retries     int        `json:"retries,omitempty"`
+	RetriedAt   *time.Time `json:"retried_at,omitempty"`
+}
+
+// Environment identifies what a job ran on, to reproduce its results.
+type Environment struct {
+	// Frontend is the version of the frontend, ConfigHash a hash of its
+	// configuration and Node the name of the node the job ran on.
+	Frontend   string `json:"frontend"`
+	ConfigHash string `json:"config_hash"`
+	Node       string `json:"node"`
+	// Backend is the darkflow the job was sent to and BackendVersion the
+	// version it reported, if known.
+	Backend        string `json:"backend,omitempty"`
+	BackendVersion string `json:"backend_version,omitempty"`
+	// Model is the model darkflow ran and ModelVersion its version, if
+	// darkflow reports it.
+	Model        string `json:"model,omitempty"`
+	ModelVersion string `json:"model_version,omitempty"`
+}
+
+// JobTimings breaks down the duration of a job by pipeline stage, in
+// seconds. Stages the job did not go through are zero.
+type JobTimings struct {
+	Validation     float64 `json:"validation_seconds,omitempty"`
+	Download       float64 `json:"download_seconds,omitempty"`
+	Backend        float64 `json:"backend_seconds,omitempty"`
+	PostProcessing float64 `json:"post_processing_seconds,omitempty"`
+}
+
+// OutputFile maps a file produced by darkflow to the URL it is served under.
+type OutputFile struct {
+	// Source is the name darkflow gave the file.
+	Source string `json:"source"`
+	// Index is the position of the input image the file was produced from,
+	// or -1 if the file does not belong to a single input.
+	Index int    `json:"index"`
+	Input string `json:"input,omitempty"`
+	URL   string `json:"url"`
+	// SHA256 is the hex checksum of the file's content.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Image is a named image to upload.
+type Image struct {
+	Name string
+	Body io.Reader
+}
+
+// Error codes reported in Error.Code and Job.ErrorCode.
+const (
+	CodeInvalidRequest     = "INVALID_REQUEST"
+	CodeBodyTooLarge       = "BODY_TOO_LARGE"
+	CodeUnauthorized       = "UNAUTHORIZED"
+	CodeForbidden          = "FORBIDDEN"
+	CodeNotFound           = "NOT_FOUND"
+	CodeGone               = "GONE"
+	CodeConflict           = "CONFLICT"
+	CodeRateLimited        = "RATE_LIMITED"
+	CodeQueueFull          = "QUEUE_FULL"
+	CodeMaintenance        = "MAINTENANCE"
+	CodeQuotaExceeded      = "QUOTA_EXCEEDED"
+	CodeURLBlocked         = "URL_BLOCKED"
+	CodeDownloadFailed     = "DOWNLOAD_FAILED"
+	CodeSourceCooldown     = "SOURCE_COOLDOWN"
+	CodeInvalidImage       = "INVALID_IMAGE"
+	CodeUnsupportedFormat  = "UNSUPPORTED_FORMAT"
+	CodeChecksumMismatch   = "CHECKSUM_MISMATCH"
+	CodeBackendUnavailable = "BACKEND_UNAVAILABLE"
+	CodeBackendError       = "BACKEND_ERROR"
+	CodeDownloadTimeout    = "DOWNLOAD_TIMEOUT"
+	CodeBackendTimeout     = "BACKEND_TIMEOUT"
+	CodeRequestTimeout     = "REQUEST_TIMEOUT"
+	CodeCancelled          = "CANCELLED"
+	CodeClientDisconnected = "CLIENT_DISCONNECTED"
+	CodeInterrupted        = "INTERRUPTED"
+	CodeInternal           = "INTERNAL"
+)
+
+// ErrorDetail describes the failure of one item, such as one image of a
+// batch.
+type ErrorDetail struct {
+	Index   int    `json:"index"`
+	Input   string `json:"input,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error is returned when the server responds with a non-200 status.
+type Error struct {
+	StatusCode int
+	// Code is the machine-readable error code, e.g. CodeDownloadFailed.
+	Code    string
+	Reason  string
+	Details []ErrorDetail
+	// RetryAfter is how long the server asked clients to wait before
+	// retrying, or 0.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("darkflow-front: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Reason)
+	}
+	return fmt.Sprintf("darkflow-front: %d %s: %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Code, e.Reason)
+}
+
+// Recognize downloads the images at urls on the server, runs darkflow over
+// them and waits for the result. Requests the server answers 202 Accepted
+// for their size are polled until the job finished, here and in the other
+// recognize and upload calls.
+func (c *Client) Recognize(ctx context.Context, urls []string, opts Options) (*Result, error) {
+	req, err := c.newRecognizeRequest(ctx, "/recognize", urls, opts)
+	if err != nil {
+		return nil, err
+	}
+	return c.doRecognize(req, opts.Inline)
+}
+
+// RecognizeV2 is Recognize through the v2 API: the result groups the
+// outputs and detections by input, and images that fail to download or are
+// not images are reported in it rather than failing the whole job.
+func (c *Client) RecognizeV2(ctx context.Context, urls []string, opts Options) (*Recognition, error) {
+	req, err := c.newRecognizeRequest(ctx, "/v2/recognize?envelope=true", urls, opts)
+	if err != nil {
+		return nil, err
+	}
+	return c.doRecognition(req)
+}
+
+func (c *Client) newRecognizeRequest(ctx context.Context, path string, urls []string, opts Options) (*http.Request, error) {
+	body, err := json.Marshal(struct {
+		ImageURLs []string `json:"image_urls"`
+		Options
+	}{urls, opts})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPost, path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// UploadAndRecognize uploads images to the server, runs darkflow over them
+// and waits for the result. The images are streamed, not buffered.
+func (c *Client) UploadAndRecognize(ctx context.Context, images []Image, opts Options) (*Result, error) {
+	req, err := c.newUploadRequest(ctx, "/upload", images, opts)
+	if err != nil {
+		return nil, err
+	}
+	return c.doRecognize(req, opts.Inline)
+}
+
+// UploadAndRecognizeV2 is UploadAndRecognize through the v2 API, see
+// RecognizeV2.
+func (c *Client) UploadAndRecognizeV2(ctx context.Context, images []Image, opts Options) (*Recognition, error) {
+	req, err := c.newUploadRequest(ctx, "/v2/upload?envelope=true", images, opts)
+	if err != nil {
+		return nil, err
+	}
+	return c.doRecognition(req)
+}
+
+// doRecognition sends the v2 request req, which asks for an enveloped
+// response, and unwraps it. Servers predating envelopes answer bare.
+func (c *Client) doRecognition(req *http.Request) (*Recognition, error) {
+	var env struct {
+		Data     json.RawMessage `json:"data"`
+		Warnings []ErrorDetail   `json:"warnings"`
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read response: %v", err)
+	}
+	if err := json.Unmarshal(body, &env); err != nil {
+		return nil, fmt.Errorf("could not decode response: %v", err)
+	}
+	if env.Data != nil {
+		body = env.Data
+	}
+	var res Recognition
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, fmt.Errorf("could not decode response: %v", err)
+	}
+	res.Warnings = env.Warnings
+	res.OutputToken = resp.Header.Get("X-Output-Token")
+	return &res, nil
+}
+
+func (c *Client) newUploadRequest(ctx context.Context, path string, images []Image, opts Options) (*http.Request, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeUpload(mw, images, opts))
+	}()
+
+	req, err := c.newRequest(ctx, http.MethodPost, path, pr)
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req, nil
+}
+
+func writeUpload(mw *multipart.Writer, images []Image, opts Options) error {
+	if opts.Model != "" {
+		if err := mw.WriteField("model", opts.Model); err != nil {
+			return err
+		}
+	}
+	if opts.Threshold != 0 {
+		if err := mw.WriteField("threshold", strconv.FormatFloat(opts.Threshold, 'f', -1, 64)); err != nil {
+			return err
+		}
+	}
+	if len(opts.ClassThresholds) > 0 {
+		classes := make([]string, 0, len(opts.ClassThresholds))
+		for class, v := range opts.ClassThresholds {
+			classes = append(classes, class+"="+strconv.FormatFloat(v, 'f', -1, 64))
+		}
+		sort.Strings(classes)
+		if err := mw.WriteField("class_thresholds", strings.Join(classes, ",")); err != nil {
+			return err
+		}
+	}
+	if opts.Filters != nil {
+		filters, err := json.Marshal(opts.Filters)
+		if err != nil {
+			return err
+		}
+		if err := mw.WriteField("filters", string(filters)); err != nil {
+			return err
+		}
+	}
+	if opts.Report != "" {
+		if err := mw.WriteField("report", opts.Report); err != nil {
+			return err
+		}
+	}
+	if opts.Heatmap != "" {
+		if err := mw.WriteField("heatmap", opts.Heatmap); err != nil {
+			return err
+		}
+	}
+	if opts.IncludeImages != "" {
+		if err := mw.WriteField("include_images", opts.IncludeImages); err != nil {
+			return err
+		}
+	}
+	if opts.Crops {
+		if err := mw.WriteField("crops", "true"); err != nil {
+			return err
+		}
+	}
+	if opts.DryRun {
+		if err := mw.WriteField("dry_run", "true"); err != nil {
+			return err
+		}
+	}
+	if opts.Retain != "" {
+		if err := mw.WriteField("retain", opts.Retain); err != nil {
+			return err
+		}
+	}
+	if opts.Render != nil {
+		render, err := json.Marshal(opts.Render)
+		if err != nil {
+			return err
+		}
+		if err := mw.WriteField("render", string(render)); err != nil {
+			return err
+		}
+	}
+	if opts.CallbackURL != "" {
+		if err := mw.WriteField("callback_url", opts.CallbackURL); err != nil {
+			return err
+		}
+	}
+	for _, tag := range opts.Tags {
+		if err := mw.WriteField("tag", tag); err != nil {
+			return err
+		}
+	}
+	for k, v := range opts.Metadata {
+		if err := mw.WriteField("meta."+k, v); err != nil {
+			return err
+		}
+	}
+	for _, img := range images {
+		part, err := mw.CreateFormFile("images", img.Name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(part, img.Body); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// GetJob fetches the record of job id.
+func (c *Client) GetJob(ctx context.Context, id string) (*Job, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/jobs/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	var j Job
+	if _, err := c.do(req, &j); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// ResultsPage is one page of the output files of a job.
+type ResultsPage struct {
+	JobID  string       `json:"job_id"`
+	Offset int          `json:"offset"`
+	Limit  int          `json:"limit"`
+	Total  int          `json:"total"`
+	Items  []OutputFile `json:"items"`
+	// NextOffset is the offset of the next page; nil on the last page.
+	NextOffset *int          `json:"next_offset,omitempty"`
+	Summary    ResultSummary `json:"summary"`
+}
+
+// ResultSummary totals the results of a whole job.
+type ResultSummary struct {
+	Inputs     int `json:"inputs"`
+	Files      int `json:"files"`
+	Detections int `json:"detections"`
+	// Classes counts the detections by label.
+	Classes map[string]int `json:"classes"`
+}
+
+// GetResults fetches up to limit output files of job id starting at offset.
+// A limit of 0 uses the server default.
+func (c *Client) GetResults(ctx context.Context, id string, offset, limit int) (*ResultsPage, error) {
+	q := url.Values{}
+	q.Set("offset", strconv.Itoa(offset))
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	req, err := c.newRequest(ctx, http.MethodGet, "/jobs/"+id+"/results?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var p ResultsPage
+	if _, err := c.do(req, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// JobStats aggregates the detections of a finished job. Confidence
+// histograms have ten equal-width bins over [0, 1].
+type JobStats struct {
+	JobID      string                `json:"job_id"`
+	Inputs     int                   `json:"inputs"`
+	Detections int                   `json:"detections"`
+	Confidence []int                 `json:"confidence_histogram"`
+	Classes    map[string]ClassStats `json:"classes"`
+	Images     []ImageStats          `json:"images"`
+}
+
+// ClassStats are the detections of one class across a job.
+type ClassStats struct {
+	Count          int     `json:"count"`
+	Images         int     `json:"images"`
+	MinConfidence  float64 `json:"min_confidence"`
+	MaxConfidence  float64 `json:"max_confidence"`
+	MeanConfidence float64 `json:"mean_confidence"`
+	Confidence     []int   `json:"confidence_histogram"`
+}
+
+// ImageStats summarizes the detections of one input.
+type ImageStats struct {
+	Index         int            `json:"index"`
+	Input         string         `json:"input"`
+	Detections    int            `json:"detections"`
+	Classes       map[string]int `json:"classes"`
+	MaxConfidence float64        `json:"max_confidence"`
+}
+
+// GetStats fetches the detection statistics of job id.
+func (c *Client) GetStats(ctx context.Context, id string) (*JobStats, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/jobs/"+id+"/stats", nil)
+	if err != nil {
+		return nil, err
+	}
+	var s JobStats
+	if _, err := c.do(req, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// DeleteJob deletes the inputs and outputs of job id. The job record stays
+// available with DeletedAt set.
+func (c *Client) DeleteJob(ctx context.Context, id string) (*Job, error) {
+	req, err := c.newRequest(ctx, http.MethodDelete, "/jobs/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	var j Job
+	if _, err := c.do(req, &j); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// CancelJob stops the running job id and discards its partial inputs and
+// outputs. The request that started the job fails with CodeCancelled.
+func (c *Client) CancelJob(ctx context.Context, id string) (*Job, error) {
+	req, err := c.newRequest(ctx, http.MethodPost, "/jobs/"+id+"/cancel", nil)
+	if err != nil {
+		return nil, err
+	}
+	var j Job
+	if _, err := c.do(req, &j); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// Stages of the pipeline a failed job can be retried from.
+const (
+	StageDownload = "download"
+	StageBackend  = "backend"
+)
+
+// RetryJob runs the failed job id again in place from stage, StageBackend to
+// reuse the inputs it staged or StageDownload to fetch its image URLs again.
+// An empty stage lets the server resume from the first stage whose inputs
+// were not kept.
+func (c *Client) RetryJob(ctx context.Context, id, stage string) (*Job, error) {
+	path := "/jobs/" + id + "/retry"
+	if stage != "" {
+		path += "?from=" + url.QueryEscape(stage)
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	var j Job
+	if _, err := c.do(req, &j); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// ListJobs lists jobs, newest first, that carry all of tags and all of the
+// metadata values.
+func (c *Client) ListJobs(ctx context.Context, tags []string, metadata map[string]string) ([]Job, error) {
+	q := url.Values{}
+	for _, tag := range tags {
+		q.Add("tag", tag)
+	}
+	for k, v := range metadata {
+		q.Set("meta."+k, v)
+	}
+	path := "/jobs"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	req, err := c.newRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	var list []Job
+	if _, err := c.do(req, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Set is a named collection of image URLs recognized incrementally: each
+// RecognizeSet only runs the images not processed yet.
+type Set struct {
+	Name      string            `json:"name"`
+	Model     string            `json:"model,omitempty"`
+	Threshold float64           `json:"threshold,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Tags      []string          `json:"tags,omitempty"`
+	Retain    string            `json:"retain,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+	Images    []SetImage        `json:"images"`
+	Jobs      []string          `json:"jobs,omitempty"`
+}
+
+// SetImage is an image of a Set and the last job it was part of.
+type SetImage struct {
+	URL     string    `json:"url"`
+	AddedAt time.Time `json:"added_at"`
+	JobID   string    `json:"job_id,omitempty"`
+}
+
+// SetOptions are the options of the jobs of a set.
+type SetOptions struct {
+	Model     string            `json:"model,omitempty"`
+	Threshold float64           `json:"threshold,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Tags      []string          `json:"tags,omitempty"`
+	Retain    string            `json:"retain,omitempty"`
+}
+
+// States of the images of a set in SetResults.
+const (
+	SetImagePending = "pending"
+	SetImageRunning = "running"
+	SetImageDone    = "done"
+	SetImageFailed  = "failed"
+	SetImageExpired = "expired"
+)
+
+// SetResults are the latest detections of the images of a set.
+type SetResults struct {
+	Name string `json:"name"`
+	// JobID and Processed are the job and the images of the run
+	// RecognizeSet started, empty when there was nothing new.
+	JobID      string           `json:"job_id,omitempty"`
+	Processed  []string         `json:"processed,omitempty"`
+	Images     map[string]int   `json:"images"`
+	Classes    map[string]int   `json:"classes"`
+	Detections int              `json:"detections"`
+	Items      []SetImageResult `json:"items"`
+}
+
+// SetImageResult is the state and the detections of an image of a set.
+type SetImageResult struct {
+	URL        string      `json:"url"`
+	Status     string      `json:"status"`
+	JobID      string      `json:"job_id,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Detections []Detection `json:"detections,omitempty"`
+	Outputs    []string    `json:"outputs,omitempty"`
+}
+
+// CreateSet creates the set name with urls, its first images.
+func (c *Client) CreateSet(ctx context.Context, name string, urls []string, opts SetOptions) (*Set, error) {
+	var s Set
+	if err := c.postJSON(ctx, "/sets", struct {
+		Name      string   `json:"name"`
+		ImageURLs []string `json:"image_urls,omitempty"`
+		SetOptions
+	}{name, urls, opts}, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// AddToSet appends urls to set name. URLs already in the set are ignored,
+// so overlapping batches can be added as they come.
+func (c *Client) AddToSet(ctx context.Context, name string, urls []string) (*Set, error) {
+	var s Set
+	if err := c.postJSON(ctx, "/sets/"+url.PathEscape(name)+"/images", struct {
+		ImageURLs []string `json:"image_urls"`
+	}{urls}, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// RecognizeSet runs darkflow over the images of set name not processed
+// yet, or that failed before, and returns the results of the whole set.
+func (c *Client) RecognizeSet(ctx context.Context, name string) (*SetResults, error) {
+	req, err := c.newRequest(ctx, http.MethodPost, "/sets/"+url.PathEscape(name)+"/recognize", nil)
+	if err != nil {
+		return nil, err
+	}
+	var res SetResults
+	if _, err := c.do(req, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// GetSetResults fetches the latest detections of the images of set name.
+func (c *Client) GetSetResults(ctx context.Context, name string) (*SetResults, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/sets/"+url.PathEscape(name)+"/results", nil)
+	if err != nil {
+		return nil, err
+	}
+	var res SetResults
+	if _, err := c.do(req, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Manifest is a batch of images listed in a CSV or JSONL file that the
+// server runs in chunk jobs in the background.
+type Manifest struct {
+	ID          string     `json:"id"`
+	ManifestURL string     `json:"manifest_url"`
+	Format      string     `json:"format"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	ChunkSize   int        `json:"chunk_size"`
+	Jobs        []string   `json:"jobs"`
+	// Rows is the number of rows read from the manifest, and Images
+	// counts them by state, as SetResults.Images does.
+	Rows   int            `json:"rows"`
+	Images map[string]int `json:"images"`
+}
+
+// ManifestOptions are the options of the jobs of a manifest.
+type ManifestOptions struct {
+	// Format is ManifestCSV or ManifestJSONL; empty means the extension
+	// of the manifest's URL.
+	Format string `json:"format,omitempty"`
+	// ChunkSize is the number of rows per job; zero leaves it to the
+	// server.
+	ChunkSize       int                `json:"chunk_size,omitempty"`
+	Model           string             `json:"model,omitempty"`
+	Threshold       float64            `json:"threshold,omitempty"`
+	Metadata        map[string]string  `json:"metadata,omitempty"`
+	Tags            []string           `json:"tags,omitempty"`
+	Retain          string             `json:"retain,omitempty"`
+	ClassThresholds map[string]float64 `json:"class_thresholds,omitempty"`
+	Filters         *Filters           `json:"filters,omitempty"`
+}
+
+// Formats of manifests.
+const (
+	ManifestCSV   = "csv"
+	ManifestJSONL = "jsonl"
+)
+
+// SubmitManifest has the server run the images listed in the manifest at
+// manifestURL, one per row in its url or image_url column. It returns the
+// state of the manifest once the server accepted it, without waiting for
+// its jobs; GetManifest follows its progress.
+func (c *Client) SubmitManifest(ctx context.Context, manifestURL string, opts ManifestOptions) (*Manifest, error) {
+	var m Manifest
+	if err := c.postJSON(ctx, "/manifests", struct {
+		ManifestURL string `json:"manifest_url"`
+		ManifestOptions
+	}{manifestURL, opts}, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// GetManifest fetches the state of manifest id.
+func (c *Client) GetManifest(ctx context.Context, id string) (*Manifest, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/manifests/"+url.PathEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if _, err := c.do(req, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// DownloadManifestResults writes the results manifest of manifest id to
+// w: its rows in its format with the status, job_id, error, detections
+// and outputs of each appended.
+func (c *Client) DownloadManifestResults(ctx context.Context, id string, w io.Writer) error {
+	return c.Download(ctx, "/manifests/"+url.PathEscape(id)+"/results", w)
+}
+
+// Model is a model darkflow can run.
+type Model struct {
+	Name    string   `json:"name"`
+	Classes []string `json:"classes"`
+	// Loaded is whether darkflow holds the model in memory, when it says.
+	Loaded *bool `json:"loaded,omitempty"`
+}
+
+// ModelLoad is the outcome of LoadModel across the darkflow backends.
+type ModelLoad struct {
+	Model  string   `json:"model"`
+	Loaded int      `json:"loaded"`
+	Failed int      `json:"failed"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// ListModels lists the models of darkflow and their classes, e.g. for a
+// model picker.
+func (c *Client) ListModels(ctx context.Context) ([]Model, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/models", nil)
+	if err != nil {
+		return nil, err
+	}
+	var models []Model
+	if _, err := c.do(req, &models); err != nil {
+		return nil, err
+	}
+	return models, nil
+}
+
+// LoadModel has every darkflow backend load model, so that a big batch
+// that follows does not wait for it. It fails unless at least one backend
+// loaded it.
+func (c *Client) LoadModel(ctx context.Context, model string) (*ModelLoad, error) {
+	req, err := c.newRequest(ctx, http.MethodPost, "/models/"+url.PathEscape(model)+"/load", nil)
+	if err != nil {
+		return nil, err
+	}
+	var res ModelLoad
+	if _, err := c.do(req, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (c *Client) postJSON(ctx context.Context, path string, body, v interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	_, err = c.do(req, v)
+	return err
+}
+
+// SharedURL returns the absolute URL of the output file at path that
+// carries token, an OutputToken of its job, in place of an api key. The
+// link only opens outputs of that job and stops working when the token
+// expires.
+func (c *Client) SharedURL(path, token string) string {
+	return c.BaseURL + path + "?token=" + url.QueryEscape(token)
+}
+
+// Download writes the output file at path, as listed in Result.Outputs or
+// Job.Outputs, to w.
+func (c *Client) Download(ctx context.Context, path string, w io.Writer) error {
+	req, err := c.newRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &Error{StatusCode: resp.StatusCode, Reason: "could not download " + path}
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+	if c.Language != "" {
+		req.Header.Set("Accept-Language", c.Language)
+	}
+	return req.WithContext(ctx), nil
+}
+
+func (c *Client) doRecognize(req *http.Request, inline bool) (*Result, error) {
+	var res Result
+	var resp *http.Response
+	var err error
+	if inline {
+		req.Header.Set("Accept", "multipart/mixed")
+		resp, err = c.send(req)
+		if err == nil {
+			defer resp.Body.Close()
+			err = readInline(resp, &res)
+		}
+	} else {
+		resp, err = c.do(req, &res.Outputs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res.JobID = resp.Header.Get("X-Job-Id")
+	res.Replayed = resp.Header.Get("X-Replayed") == "true"
+	res.Discrepancies, _ = strconv.Atoi(resp.Header.Get("X-Discrepancies"))
+	res.OutputToken = resp.Header.Get("X-Output-Token")
+	return &res, nil
+}
+
+// readInline reads the output list and files of a multipart/mixed
+// recognize response into res. Dry runs are answered with plain JSON.
+func readInline(resp *http.Response, res *Result) error {
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		if err := json.NewDecoder(resp.Body).Decode(&res.Outputs); err != nil {
+			return fmt.Errorf("could not decode response: %v", err)
+		}
+		return nil
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		return fmt.Errorf("could not read response: %v", err)
+	}
+	if err := json.NewDecoder(part).Decode(&res.Outputs); err != nil {
+		return fmt.Errorf("could not decode response: %v", err)
+	}
+	res.Files = make(map[string][]byte)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read response: %v", err)
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			return fmt.Errorf("could not read response: %v", err)
+		}
+		// Servers running -in-memory have no URLs for the outputs and
+		// list them by name.
+		name := part.Header.Get("Content-Location")
+		if name == "" {
+			name = part.FileName()
+		}
+		res.Files[name] = data
+	}
+}
+
+// do sends req and decodes a successful JSON response into v.
+func (c *Client) do(req *http.Request, v interface{}) (*http.Response, error) {
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return nil, fmt.Errorf("could not decode response: %v", err)
+	}
+	return resp, nil
+}
+
+// poll waits as long as the 202 Accepted resp to req asks, then fetches its
+// Location with the same Accept header.
+func (c *Client) poll(hc *http.Client, req *http.Request, resp *http.Response) (*http.Response, error) {
+	resp.Body.Close()
+	wait := 2 * time.Second
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		wait = time.Duration(secs) * time.Second
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	next, err := c.newRequest(req.Context(), http.MethodGet, resp.Header.Get("Location"), nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept := req.Header.Get("Accept"); accept != "" {
+		next.Header.Set("Accept", accept)
+	}
+	return hc.Do(next)
+}
+
+// send sends req and returns the response if it succeeded, with its body
+// left for the caller to read and close. Failures are returned as *Error.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for resp.StatusCode == http.StatusAccepted && resp.Header.Get("Location") != "" {
+		resp, err = c.poll(hc, req, resp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		defer resp.Body.Close()
+		var e struct {
+			Code    string        `json:"code"`
+			Message string        `json:"message"`
+			Details []ErrorDetail `json:"details"`
+			Reason  string        `json:"reason"`
+			// Errors holds the error of enveloped responses, followed
+			// by its details.
+			Errors []ErrorDetail `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		if e.Code == "" && len(e.Errors) > 0 {
+			e.Code, e.Message, e.Details = e.Errors[0].Code, e.Errors[0].Message, e.Errors[1:]
+		}
+		if e.Message == "" {
+			e.Message = e.Reason
+		}
+		apiErr := &Error{StatusCode: resp.StatusCode, Code: e.Code, Reason: e.Message, Details: e.Details}
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			apiErr.RetryAfter = time.Duration(secs) * time.Second
+		}
+		return nil, apiErr
+	}
+	return resp, nil
+}
+
+// CallbackMaxSkew is how far the timestamp of a callback VerifyCallback
+// accepts may be from the receiver's clock.
+const CallbackMaxSkew = 5 * time.Minute
+
+// VerifyCallback checks that r is a callback of the server signed with
+// secret, less than CallbackMaxSkew old, and returns the job it carries.
+// Receivers should also reject a repeated X-Webhook-Nonce within
+// CallbackMaxSkew, which VerifyCallback cannot know about.
+func VerifyCallback(r *http.Request, secret string) (*Job, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read callback: %v", err)
+	}
+	ts := r.Header.Get("X-Webhook-Timestamp")
+	nonce := r.Header.Get("X-Webhook-Nonce")
+	sig := r.Header.Get("X-Webhook-Signature")
+	if ts == "" || nonce == "" || sig == "" {
+		return nil, fmt.Errorf("callback is not signed")
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid callback timestamp %q", ts)
+	}
+	if skew := time.Since(time.Unix(sec, 0)); skew > CallbackMaxSkew || skew < -CallbackMaxSkew {
+		return nil, fmt.Errorf("callback timestamp is %s off", skew.Round(time.Second))
+	}
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, f := range []string{r.Method, r.URL.RequestURI(), ts, nonce} {
+		fmt.Fprintf(mac, "%s\n", f)
+	}
+	mac.Write([]byte(hex.EncodeToString(sum[:])))
+	if !hmac.Equal([]byte(sig), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return nil, fmt.Errorf("callback signature does not match")
+	}
+	var j Job
+	if err := json.Unmarshal(body, &j); err != nil {
+		return nil, fmt.Errorf("could not decode callback: %v", err)
+	}
+	return &j, nil
+}